@@ -0,0 +1,125 @@
+package gospatial
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Stable codes of failed api responses
+const (
+	// datasource, feature, apikey or method does not exist
+	ERROR_NOT_FOUND string = "not_found"
+	// apikey or authkey missing or incorrect
+	ERROR_UNAUTHORIZED string = "unauthorized"
+	// apikey scope or role does not allow the request
+	ERROR_FORBIDDEN string = "forbidden"
+	// request parameters or body are invalid
+	ERROR_VALIDATION_FAILED string = "validation_failed"
+	// request conflicts with a feature version, lock or precondition
+	ERROR_CONFLICT string = "conflict"
+	// upstream tile server of a proxied tile layer failed
+	ERROR_UPSTREAM string = "upstream_error"
+	// server is shutting down and no longer writes
+	ERROR_SHUTTING_DOWN string = "shutting_down"
+	// unexpected server error
+	ERROR_INTERNAL string = "internal_error"
+)
+
+// http status codes of error codes
+var api_error_status = map[string]int{
+	ERROR_NOT_FOUND:         http.StatusNotFound,
+	ERROR_UNAUTHORIZED:      http.StatusUnauthorized,
+	ERROR_FORBIDDEN:         http.StatusForbidden,
+	ERROR_VALIDATION_FAILED: http.StatusBadRequest,
+	ERROR_CONFLICT:          http.StatusConflict,
+	ERROR_UPSTREAM:          http.StatusBadGateway,
+	ERROR_SHUTTING_DOWN:     http.StatusServiceUnavailable,
+	ERROR_INTERNAL:          http.StatusInternalServerError,
+}
+
+// ApiError is a failed api request. Code is stable for clients to match
+// on, Status is the http status code, which tcp responses do not carry.
+type ApiError struct {
+	Code    string
+	Status  int
+	Message string
+}
+
+func (self *ApiError) Error() string {
+	return self.Message
+}
+
+// NewApiError returns error with the http status of its code
+// @param code {string}
+// @param message {string}
+// @returns *ApiError
+func NewApiError(code string, message string) *ApiError {
+	return &ApiError{Code: code, Status: api_error_status[code], Message: message}
+}
+
+// Response returns JSend envelope of error. Client errors are sent as
+// fail with code and error in data, server errors as error with code and
+// message.
+// @returns HttpMessageResponse
+func (self *ApiError) Response() HttpMessageResponse {
+	if self.Status < http.StatusInternalServerError {
+		return HttpMessageResponse{Status: JSEND_FAIL, Data: map[string]string{"code": self.Code, "error": self.Message}}
+	}
+	return HttpMessageResponse{Status: JSEND_ERROR, Code: self.Code, Message: self.Message}
+}
+
+// Errors shared by both transports
+var (
+	ErrUnauthorized       = NewApiError(ERROR_UNAUTHORIZED, "unauthorized")
+	ErrPermissionDenied   = NewApiError(ERROR_FORBIDDEN, "permission denied")
+	ErrNotOwner           = NewApiError(ERROR_FORBIDDEN, "apikey does not own datasource")
+	ErrMissingParameters  = NewApiError(ERROR_VALIDATION_FAILED, "Missing required parameters")
+	ErrMethodNotFound     = NewApiError(ERROR_NOT_FOUND, "method not found")
+	ErrPreconditionFailed = &ApiError{ERROR_CONFLICT, http.StatusPreconditionFailed, "precondition failed"}
+)
+
+// validationFailed returns request validation error
+func validationFailed(err error) *ApiError {
+	return NewApiError(ERROR_VALIDATION_FAILED, err.Error())
+}
+
+// apiError returns typed error of err
+// @param err {error}
+// @returns *ApiError
+func apiError(err error) *ApiError {
+	switch err {
+	case ErrApikeyNotFound, ErrFeatureNotFound, ErrDatasourceNotFound, ErrCollaboratorNotFound, ErrWebhookNotFound, ErrGeofencesNotFound, ErrTilesetNotFound:
+		return NewApiError(ERROR_NOT_FOUND, err.Error())
+	case ErrVersionConflict:
+		return ErrPreconditionFailed
+	case ErrFeatureLocked:
+		return &ApiError{ERROR_CONFLICT, http.StatusLocked, "feature locked"}
+	case ErrServerShuttingDown:
+		return NewApiError(ERROR_SHUTTING_DOWN, err.Error())
+	}
+	if api_err, ok := err.(*ApiError); ok {
+		return api_err
+	}
+	if errors.Is(err, ErrInvalidSyncChange) {
+		return validationFailed(err)
+	}
+	return NewApiError(ERROR_INTERNAL, err.Error())
+}
+
+// sendApiError sends JSend response of error with its http status
+func sendApiError(w http.ResponseWriter, r *http.Request, err error) {
+	api_err := apiError(err)
+	message := fmt.Sprintf(" %v %v [%v]", r.Method, r.URL.Path, api_err.Status)
+	if http.StatusInternalServerError <= api_err.Status {
+		NetworkLogger.Critical(r.RemoteAddr, message)
+	} else {
+		NetworkLogger.Error(r.RemoteAddr, message)
+	}
+	js, _ := json.Marshal(api_err.Response())
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(api_err.Status)
+	w.Write(js)
+}
@@ -0,0 +1,24 @@
+package gospatial
+
+// rotateApikey issues a new apikey for the customer. The apikey of
+// the request keeps working for APIKEY_ROTATION_GRACE.
+// @param apikey
+// @return json
+func rotateApikey(ctx *OperationContext) (interface{}, error) {
+	new_apikey, expires, err := DB.RotateApikey(ctx.Request.Apikey)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"apikey": new_apikey, "expires": expires}, nil
+}
+
+// revokeApikey revokes the apikey of the request
+// @param apikey
+// @return json
+func revokeApikey(ctx *OperationContext) (interface{}, error) {
+	err := DB.RevokeApikey(ctx.Request.Apikey)
+	if err != nil {
+		return nil, err
+	}
+	return "apikey revoked", nil
+}
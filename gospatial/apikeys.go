@@ -0,0 +1,281 @@
+package gospatial
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+import (
+	"./utils"
+)
+
+import "github.com/boltdb/bolt"
+
+// Time a rotated apikey keeps working after its replacement is issued
+var APIKEY_ROTATION_GRACE time.Duration = 24 * time.Hour
+
+// ErrApikeyNotFound is returned for unknown, expired and revoked apikeys
+var ErrApikeyNotFound = errors.New("Apikey not found")
+
+// ApikeyRecord is stored in the apikeys table under the salted hash of
+// the apikey. Expires is set once the apikey has been rotated.
+type ApikeyRecord struct {
+	Customer string `json:"customer"`
+	Expires  int64  `json:"expires,omitempty"`
+}
+
+// expired checks if rotated apikey is past its grace period
+func (self ApikeyRecord) expired() bool {
+	return 0 != self.Expires && self.Expires <= time.Now().Unix()
+}
+
+// loadApikeySalt reads the apikey hash salt, creating it for new databases
+func (self *Database) loadApikeySalt(conn *bolt.DB) error {
+	return conn.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("meta"))
+		if bucket == nil {
+			return fmt.Errorf("Bucket meta not found!")
+		}
+		salt := bucket.Get([]byte("apikey_salt"))
+		if nil == salt {
+			salt = make([]byte, 32)
+			_, err := rand.Read(salt)
+			if err != nil {
+				return err
+			}
+			err = bucket.Put([]byte("apikey_salt"), salt)
+			if err != nil {
+				return err
+			}
+		}
+		self.apikey_salt = append([]byte{}, salt...)
+		return nil
+	})
+}
+
+// HashApikey returns the salted hash an apikey is stored under
+// @param apikey {string}
+// @returns string
+func (self *Database) HashApikey(apikey string) string {
+	mac := hmac.New(sha256.New, self.apikey_salt)
+	mac.Write([]byte(apikey))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// generateApikey returns a new random apikey
+func generateApikey() (string, error) {
+	b := make([]byte, 18)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// getApikeyRecord returns record of unexpired apikey
+func (self *Database) getApikeyRecord(apikey string) (ApikeyRecord, error) {
+	hash := self.HashApikey(apikey)
+	self.guard.RLock()
+	record, ok := self.key_cache[hash]
+	self.guard.RUnlock()
+	if !ok {
+		value, err := self.Select("apikeys", hash)
+		if err != nil {
+			return record, err
+		}
+		if 0 == len(value) {
+			return record, ErrApikeyNotFound
+		}
+		err = json.Unmarshal(value, &record)
+		if err != nil {
+			return record, err
+		}
+		self.guard.Lock()
+		self.key_cache[hash] = record
+		self.guard.Unlock()
+	}
+	if record.expired() {
+		return record, ErrApikeyNotFound
+	}
+	return record, nil
+}
+
+// putApikeyRecord stores record under apikey hash
+func (self *Database) putApikeyRecord(hash string, record ApikeyRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	self.guard.Lock()
+	self.key_cache[hash] = record
+	self.guard.Unlock()
+	self.commitLog("insert_apikey_hash", 0, map[string]interface{}{"hash": hash, "record": json.RawMessage(value)})
+	return self.Insert("apikeys", hash, value)
+}
+
+// RotateApikey issues a new apikey for the customer of apikey. The old
+// apikey keeps working for APIKEY_ROTATION_GRACE.
+// @param apikey {string}
+// @returns string new apikey
+// @returns int64 unix time the old apikey expires
+// @returns Error
+func (self *Database) RotateApikey(apikey string) (string, int64, error) {
+	// write lock for shutdown process
+	if self.WriteLock {
+		return "", 0, ErrServerShuttingDown
+	}
+
+	self.key_guard.Lock()
+	defer self.key_guard.Unlock()
+
+	record, err := self.getApikeyRecord(apikey)
+	if err != nil {
+		return "", 0, err
+	}
+
+	new_apikey, err := generateApikey()
+	if err != nil {
+		return "", 0, err
+	}
+	err = self.putApikeyRecord(self.HashApikey(new_apikey), ApikeyRecord{Customer: record.Customer})
+	if err != nil {
+		return "", 0, err
+	}
+
+	expires := time.Now().Add(APIKEY_ROTATION_GRACE).Unix()
+	if 0 != record.Expires && record.Expires < expires {
+		expires = record.Expires
+	}
+	record.Expires = expires
+	return new_apikey, expires, self.putApikeyRecord(self.HashApikey(apikey), record)
+}
+
+// RevokeApikey removes apikey. The customer's other apikeys keep working.
+// @param apikey {string}
+// @returns Error
+func (self *Database) RevokeApikey(apikey string) error {
+	// write lock for shutdown process
+	if self.WriteLock {
+		return ErrServerShuttingDown
+	}
+
+	self.key_guard.Lock()
+	defer self.key_guard.Unlock()
+
+	_, err := self.getApikeyRecord(apikey)
+	if err != nil {
+		return err
+	}
+
+	hash := self.HashApikey(apikey)
+	self.guard.Lock()
+	delete(self.key_cache, hash)
+	self.guard.Unlock()
+	self.commitLog("delete_apikey_hash", 0, map[string]string{"hash": hash})
+
+	conn := self.Connect()
+	defer conn.Close()
+	return conn.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("apikeys"))
+		if bucket == nil {
+			return fmt.Errorf("Bucket apikeys not found!")
+		}
+		return bucket.Delete([]byte(hash))
+	})
+}
+
+// migrateApikeys moves customers stored under plaintext apikeys to the
+// customers table and stores the apikeys as salted hashes. Datasource
+// owners and collaborators recorded by apikey are changed to customer ids.
+func (self *Database) migrateApikeys(conn *bolt.DB) error {
+	return conn.Update(func(tx *bolt.Tx) error {
+		apikeys := tx.Bucket([]byte("apikeys"))
+		customers := tx.Bucket([]byte("customers"))
+		shares := tx.Bucket([]byte("shares"))
+		if nil == apikeys || nil == customers || nil == shares {
+			return fmt.Errorf("Bucket apikeys, customers or shares not found!")
+		}
+
+		// plaintext apikey to customer id
+		migrated := make(map[string]string)
+		legacy := make(map[string]Customer)
+		err := apikeys.ForEach(func(key, value []byte) error {
+			customer := Customer{}
+			err := json.Unmarshal(self.decompressByte(value), &customer)
+			if err == nil && "" != customer.Apikey && "" == customer.Id {
+				legacy[string(key)] = customer
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for apikey, customer := range legacy {
+			customer.Id, _ = utils.NewUUID()
+			customer.Apikey = ""
+			migrated[apikey] = customer.Id
+			value, err := json.Marshal(customer)
+			if err != nil {
+				return err
+			}
+			err = customers.Put([]byte(customer.Id), self.compressByte(value))
+			if err != nil {
+				return err
+			}
+			value, err = json.Marshal(ApikeyRecord{Customer: customer.Id})
+			if err != nil {
+				return err
+			}
+			err = apikeys.Delete([]byte(apikey))
+			if err != nil {
+				return err
+			}
+			err = apikeys.Put([]byte(self.HashApikey(apikey)), self.compressByte(value))
+			if err != nil {
+				return err
+			}
+		}
+		if 0 == len(migrated) {
+			return nil
+		}
+
+		updated := make(map[string][]byte)
+		err = shares.ForEach(func(key, value []byte) error {
+			record := DatasourceShares{}
+			err := json.Unmarshal(self.decompressByte(value), &record)
+			if err != nil {
+				return err
+			}
+			if id, ok := migrated[record.Owner]; ok {
+				record.Owner = id
+			}
+			for i, collaborator := range record.Collaborators {
+				if id, ok := migrated[collaborator.Apikey]; ok {
+					record.Collaborators[i].Customer = id
+					record.Collaborators[i].Apikey = ""
+				}
+			}
+			value, err = json.Marshal(record)
+			updated[string(key)] = value
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		for key, value := range updated {
+			err = shares.Put([]byte(key), self.compressByte(value))
+			if err != nil {
+				return err
+			}
+		}
+		ServerLogger.Info("Migrated ", len(migrated), " apikeys to hashed storage")
+		return nil
+	})
+}
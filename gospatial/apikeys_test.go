@@ -0,0 +1,182 @@
+package gospatial
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+import "github.com/boltdb/bolt"
+
+func TestApikeyHeaders(t *testing.T) {
+	server := httptest.NewServer(Router())
+	defer server.Close()
+	apikey := "testHeaderKey"
+	DB.InsertCustomer(Customer{Apikey: apikey})
+
+	request := func(method string, header string, value string) int {
+		req, _ := http.NewRequest(method, server.URL+"/api/v1/customer", nil)
+		if "" != header {
+			req.Header.Set(header, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := request("GET", "Authorization", "Bearer "+apikey); http.StatusOK != code {
+		t.Errorf("Expected bearer apikey accepted: %v", code)
+	}
+	if code := request("GET", "X-Api-Key", apikey); http.StatusOK != code {
+		t.Errorf("Expected X-Api-Key accepted: %v", code)
+	}
+	if code := request("GET", "", ""); http.StatusUnauthorized != code {
+		t.Errorf("Expected missing apikey unauthorized: %v", code)
+	}
+
+	// apikeys are only stored hashed
+	customer, _ := DB.GetCustomer(apikey)
+	if value, _ := DB.Select("apikeys", apikey); 0 != len(value) {
+		t.Errorf("Expected no plaintext apikey: %s", value)
+	}
+	if value, _ := DB.Select("customers", customer.Id); 0 == len(value) || strings.Contains(string(value), apikey) {
+		t.Errorf("Expected customer stored without apikey: %s", value)
+	}
+
+	redacted := redactedRequest(httptest.NewRequest("GET", "/api/v1/customer?apikey="+apikey, nil))
+	if strings.Contains(redacted, apikey) {
+		t.Errorf("Expected apikey redacted: %v", redacted)
+	}
+	if strings.Contains(redactTcpMessage(`{"method":"authenticate", "authkey": "`+apikey+`"}`), apikey) {
+		t.Error("Expected authkey redacted")
+	}
+}
+
+func TestRotateApikey(t *testing.T) {
+	server := httptest.NewServer(Router())
+	defer server.Close()
+	apikey := "testRotateKey"
+	DB.InsertCustomer(Customer{Apikey: apikey, Datasources: []string{"testRotateDs"}})
+
+	req, _ := http.NewRequest("POST", server.URL+"/api/v1/customer/apikey", nil)
+	req.Header.Set("Authorization", "Bearer "+apikey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := struct {
+		Data struct {
+			Apikey  string `json:"apikey"`
+			Expires int64  `json:"expires"`
+		} `json:"data"`
+	}{}
+	json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	rotated := result.Data
+	if http.StatusOK != resp.StatusCode || "" == rotated.Apikey || apikey == rotated.Apikey || 0 == rotated.Expires {
+		t.Fatalf("Expected new apikey: %v %v", resp.StatusCode, rotated)
+	}
+
+	// both apikeys work during grace period
+	old, err := DB.GetCustomer(apikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	customer, err := DB.GetCustomer(rotated.Apikey)
+	if err != nil || old.Id != customer.Id || 1 != len(customer.Datasources) {
+		t.Fatalf("Expected same customer: %v %v %v", old, customer, err)
+	}
+
+	// rotating without grace period expires apikey
+	grace := APIKEY_ROTATION_GRACE
+	APIKEY_ROTATION_GRACE = -time.Second
+	defer func() { APIKEY_ROTATION_GRACE = grace }()
+	_, _, err = DB.RotateApikey(rotated.Apikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = DB.GetCustomer(rotated.Apikey); ErrApikeyNotFound != err {
+		t.Errorf("Expected rotated apikey expired: %v", err)
+	}
+	if _, err = DB.GetCustomer(apikey); err != nil {
+		t.Errorf("Expected earlier apikey in grace period: %v", err)
+	}
+}
+
+func TestRevokeApikey(t *testing.T) {
+	server := httptest.NewServer(Router())
+	defer server.Close()
+	apikey := "testRevokeKey"
+	DB.InsertCustomer(Customer{Apikey: apikey})
+
+	request := func(method string) int {
+		req, _ := http.NewRequest(method, server.URL+"/api/v1/customer/apikey", nil)
+		req.Header.Set("X-Api-Key", apikey)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := request("DELETE"); http.StatusOK != code {
+		t.Fatalf("Expected apikey revoked: %v", code)
+	}
+	if code := request("DELETE"); http.StatusNotFound != code {
+		t.Errorf("Expected revoked apikey not found: %v", code)
+	}
+	if _, err := DB.GetCustomer(apikey); ErrApikeyNotFound != err {
+		t.Errorf("Expected revoked apikey rejected: %v", err)
+	}
+}
+
+func TestMigrateApikeys(t *testing.T) {
+	db := Database{File: "./test_migrate.db"}
+	db.createDb()
+	defer os.Remove(db.File)
+	conn := db.Connect()
+	defer conn.Close()
+	for _, table := range []string{"apikeys", "customers", "shares", "meta"} {
+		db.CreateTable(conn, table)
+	}
+	db.loadApikeySalt(conn)
+
+	// customer and share stored by plaintext apikey
+	legacy, _ := json.Marshal(Customer{Apikey: "legacyKey", Datasources: []string{"legacyDs"}})
+	shared, _ := json.Marshal(DatasourceShares{Datasource: "legacyDs", Owner: "legacyKey", Collaborators: []Collaborator{}})
+	conn.Update(func(tx *bolt.Tx) error {
+		tx.Bucket([]byte("apikeys")).Put([]byte("legacyKey"), db.compressByte(legacy))
+		return tx.Bucket([]byte("shares")).Put([]byte("legacyDs"), db.compressByte(shared))
+	})
+
+	err := db.migrateApikeys(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.View(func(tx *bolt.Tx) error {
+		if nil != tx.Bucket([]byte("apikeys")).Get([]byte("legacyKey")) {
+			t.Error("Expected plaintext apikey removed")
+		}
+		record := ApikeyRecord{}
+		json.Unmarshal(db.decompressByte(tx.Bucket([]byte("apikeys")).Get([]byte(db.HashApikey("legacyKey")))), &record)
+		customer := Customer{}
+		json.Unmarshal(db.decompressByte(tx.Bucket([]byte("customers")).Get([]byte(record.Customer))), &customer)
+		if "" == record.Customer || record.Customer != customer.Id || "" != customer.Apikey || 1 != len(customer.Datasources) {
+			t.Errorf("Expected customer migrated: %v %v", record, customer)
+		}
+		shares := DatasourceShares{}
+		json.Unmarshal(db.decompressByte(tx.Bucket([]byte("shares")).Get([]byte("legacyDs"))), &shares)
+		if record.Customer != shares.Owner {
+			t.Errorf("Expected owner migrated: %v", shares)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,165 @@
+package gospatial
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+import "github.com/gorilla/mux"
+
+// Server-Sent Events stream settings
+const (
+	// Change events buffered for a stream before it is closed as a slow consumer
+	SSE_SEND_BUFFER = 1000
+	// Period of keepalive comments
+	SSE_KEEPALIVE_PERIOD = 15 * time.Second
+	// Client reconnect delay in milliseconds
+	SSE_RETRY = 3000
+)
+
+// writeServerSentEvent writes change event in text/event-stream format.
+// The event id is the sequence number, used by clients to resume.
+func writeServerSentEvent(w io.Writer, event ChangeEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %v\nevent: %v\ndata: %s\n\n", event.Sequence, event.Type, data)
+	return err
+}
+
+// getLastEventId reads the sequence number to resume from the Last-Event-ID
+// header or last_event_id param. Returns false if request is not resuming.
+func getLastEventId(r *http.Request) (uint64, bool, error) {
+	last_event_id := r.Header.Get("Last-Event-ID")
+	if "" == last_event_id {
+		last_event_id = r.FormValue("last_event_id")
+	}
+	if "" == last_event_id {
+		return 0, false, nil
+	}
+	seq, err := strconv.ParseUint(last_event_id, 10, 64)
+	return seq, true, err
+}
+
+// LayerChangesHandler streams layer change events as Server-Sent Events.
+// Clients resuming with Last-Event-ID first receive the changes they
+// missed. A reset event is sent if those are no longer stored, after
+// which the client should reload the layer.
+// @param apikey customer id
+// @oaram ds datasource uuid
+// @param last_event_id sequence number to resume after
+func LayerChangesHandler(w http.ResponseWriter, r *http.Request) {
+	NetworkLogger.Debug("[In] ", redactedRequest(r))
+
+	// Get ds from url path
+	vars := mux.Vars(r)
+	ds := vars["ds"]
+
+	/*=======================================*/
+	apikey := GetApikeyFromRequest(w, r)
+	if apikey == "" {
+		return
+	}
+
+	customer, err := GetCustomerFromDatabase(w, r, apikey)
+	if err != nil {
+		return
+	}
+
+	if !CheckCustomerPermission(w, r, customer, ds, SCOPE_READ) {
+		return
+	}
+	/*=======================================*/
+
+	last, resume, err := getLastEventId(r)
+	if err != nil {
+		sendApiError(w, r, NewApiError(ERROR_VALIDATION_FAILED, "invalid Last-Event-ID"))
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		sendApiError(w, r, NewApiError(ERROR_INTERNAL, "Streaming unsupported"))
+		return
+	}
+
+	// listen before reading stored changes so none are missed in between
+	live := make(chan ChangeEvent, SSE_SEND_BUFFER)
+	dropped := make(chan bool)
+	var drop sync.Once
+	cancel := Changes.Listen(func(event ChangeEvent) {
+		if ds != event.Datasource {
+			return
+		}
+		select {
+		case live <- event:
+		default:
+			drop.Do(func() { close(dropped) })
+		}
+	})
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	message := fmt.Sprintf(" %v %v [200]", r.Method, r.URL.Path)
+	NetworkLogger.Info(r.RemoteAddr, message)
+	fmt.Fprintf(w, "retry: %v\n\n", SSE_RETRY)
+
+	if resume {
+		events, err := DB.ChangesSince(ds, last)
+		if ErrChangesExpired == err {
+			last = DB.Sequence()
+			fmt.Fprintf(w, "id: %v\nevent: reset\ndata: {\"seq\": %v}\n\n", last, last)
+		} else if err != nil {
+			ServerLogger.Error(err)
+			return
+		}
+		for _, event := range events {
+			err = writeServerSentEvent(w, event)
+			if err != nil {
+				return
+			}
+			last = event.Sequence
+		}
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(SSE_KEEPALIVE_PERIOD)
+	defer keepalive.Stop()
+	for {
+		select {
+		case event := <-live:
+			// already sent from stored changes
+			if event.Sequence <= last {
+				continue
+			}
+			err = writeServerSentEvent(w, event)
+			if err != nil {
+				return
+			}
+			last = event.Sequence
+			flusher.Flush()
+		case <-keepalive.C:
+			_, err = fmt.Fprintf(w, ": keepalive\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-dropped:
+			// client reconnects and resumes from last
+			NetworkLogger.Warn(r.RemoteAddr, " ", r.Method, " ", r.URL.Path, " slow consumer closed")
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package gospatial
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+import "github.com/paulmach/go.geojson"
+
+// readServerSentEvent reads the next event with an id from stream
+func readServerSentEvent(reader *bufio.Reader) (map[string]string, error) {
+	event := make(map[string]string)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return event, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if "" == line {
+			if _, ok := event["id"]; ok {
+				return event, nil
+			}
+			continue
+		}
+		parts := strings.SplitN(line, ": ", 2)
+		if 2 == len(parts) {
+			event[parts[0]] = parts[1]
+		}
+	}
+}
+
+// openChanges requests layer change stream resuming after last_event_id
+func openChanges(t *testing.T, url string, last_event_id uint64) (*http.Response, *bufio.Reader) {
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("Last-Event-ID", fmt.Sprintf("%v", last_event_id))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if "text/event-stream" != resp.Header.Get("Content-Type") {
+		t.Fatalf("Expected event stream: %v %v", resp.StatusCode, resp.Header)
+	}
+	return resp, bufio.NewReader(resp.Body)
+}
+
+func TestLayerChangesResume(t *testing.T) {
+	server, ds := startSocketServer(t)
+	defer server.Close()
+	url := server.URL + "/api/v1/layer/" + ds + "/changes?apikey=" + testSocketApikey
+
+	since := DB.Sequence()
+	for _, name := range []string{"first", "second"} {
+		feat := geojson.NewPointFeature([]float64{1, 1})
+		feat.Properties["name"] = name
+		err := DB.InsertFeature(ds, feat)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// missed changes are replayed, then live changes follow
+	resp, reader := openChanges(t, url, since)
+	defer resp.Body.Close()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		feat := geojson.NewPointFeature([]float64{1, 1})
+		feat.Properties["name"] = "third"
+		DB.InsertFeature(ds, feat)
+	}()
+	last := since
+	for _, name := range []string{"first", "second", "third"} {
+		event, err := readServerSentEvent(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seq, _ := strconv.ParseUint(event["id"], 10, 64)
+		if FEATURE_ADDED != event["event"] || !strings.Contains(event["data"], name) || seq <= last {
+			t.Errorf("Expected %v change: %v", name, event)
+		}
+		last = seq
+	}
+
+	// unknown sequence resets client
+	resp, reader = openChanges(t, url, DB.Sequence()+100)
+	defer resp.Body.Close()
+	event, err := readServerSentEvent(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if "reset" != event["event"] {
+		t.Errorf("Expected reset event: %v", event)
+	}
+}
@@ -0,0 +1,347 @@
+package gospatial
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/paulmach/go.geojson"
+)
+
+// Change event types
+const (
+	FEATURE_ADDED   string = "feature_added"
+	FEATURE_UPDATED string = "feature_updated"
+	FEATURE_DELETED string = "feature_deleted"
+	LAYER_REPLACED  string = "layer_replaced"
+	LAYER_DELETED   string = "layer_deleted"
+)
+
+// Number of most recent change events kept for resuming change feeds
+var CHANGE_LOG_LIMIT uint64 = 100000
+
+// Change events queued for listeners, events published to a full queue
+// are replayed from the changes table
+var CHANGE_FEED_BUFFER int = 10000
+
+// ErrChangesExpired is returned when changes after a sequence number are
+// no longer stored. The client has to reload the layer.
+var ErrChangesExpired = errors.New("changes expired!")
+
+// ChangeEvent describes a single write to a datasource layer.
+// Feature events carry the stored feature, delete events only the geo_id.
+// Previous holds the feature as it was before an update or delete and is
+// not sent to clients.
+type ChangeEvent struct {
+	Type       string           `json:"type"`
+	Sequence   uint64           `json:"seq"`
+	Datasource string           `json:"datasource"`
+	GeoId      string           `json:"geo_id,omitempty"`
+	Feature    *geojson.Feature `json:"feature,omitempty"`
+	Timestamp  int64            `json:"timestamp"`
+	Previous   *geojson.Feature `json:"-"`
+}
+
+// storedChange is the changes table row of a change event. It keeps the
+// previous feature, so replayed events match subscriptions like published
+// ones.
+type storedChange struct {
+	ChangeEvent
+	Previous *geojson.Feature `json:"previous,omitempty"`
+}
+
+// decodeChange reads change event from its changes table row
+func decodeChange(value []byte) (ChangeEvent, error) {
+	stored := storedChange{}
+	err := json.Unmarshal(value, &stored)
+	event := stored.ChangeEvent
+	event.Previous = stored.Previous
+	return event, err
+}
+
+// changeListener is a function registered on the change feed
+type changeListener struct {
+	id     uint64
+	listen func(ChangeEvent)
+}
+
+// changeFeed delivers change events to listeners in sequence order.
+// Publishing never blocks writers: when the queue is full the event is
+// dropped, and once the listeners catch up the dropped events are read
+// back with replay.
+type changeFeed struct {
+	guard     sync.RWMutex
+	listeners []changeListener
+	next_id   uint64
+	queue     chan ChangeEvent
+	replay    func(since uint64, limit int) ([]ChangeEvent, error)
+	// set when events were dropped, read by dispatch
+	overflow int32
+	// sequence number of the last dispatched event
+	last uint64
+	// queued events up to this sequence number were replayed
+	replayed uint64
+}
+
+// Changes is the application change feed. Database writes publish to it
+// and the websocket hub listens on it.
+var Changes = newChangeFeed(CHANGE_FEED_BUFFER, func(since uint64, limit int) ([]ChangeEvent, error) {
+	return DB.changesAfter(since, limit)
+})
+
+func newChangeFeed(buffer int, replay func(uint64, int) ([]ChangeEvent, error)) *changeFeed {
+	feed := &changeFeed{queue: make(chan ChangeEvent, buffer), replay: replay}
+	go feed.dispatch()
+	return feed
+}
+
+func init() {
+	Changes.Listen(Hub.broadcastChange)
+}
+
+// Listen registers a function to be called for every change event.
+// Listeners are called from a single goroutine and should not block.
+// @param listener {func(ChangeEvent)}
+// @returns func() removes the listener
+func (self *changeFeed) Listen(listener func(ChangeEvent)) func() {
+	self.guard.Lock()
+	self.next_id++
+	id := self.next_id
+	self.listeners = append(self.listeners, changeListener{id: id, listen: listener})
+	self.guard.Unlock()
+	return func() {
+		self.guard.Lock()
+		defer self.guard.Unlock()
+		// copy so dispatch can keep using the old slice
+		listeners := []changeListener{}
+		for _, listener := range self.listeners {
+			if id != listener.id {
+				listeners = append(listeners, listener)
+			}
+		}
+		self.listeners = listeners
+	}
+}
+
+// publish queues change event for delivery. Events are dropped from a
+// full queue and replayed later, so slow listeners do not hold up writers.
+func (self *changeFeed) publish(event ChangeEvent) {
+	select {
+	case self.queue <- event:
+	default:
+		if atomic.CompareAndSwapInt32(&self.overflow, 0, 1) {
+			ServerLogger.Warn("Change feed full, replaying from change ", event.Sequence)
+		}
+	}
+}
+
+// dispatch sends queued events to listeners. After events were dropped
+// the events following the last dispatched one are replayed, queued events
+// already replayed are skipped.
+func (self *changeFeed) dispatch() {
+	for event := range self.queue {
+		if event.Sequence <= self.replayed {
+			continue
+		}
+		self.replayed = 0
+		self.send(event)
+		for atomic.CompareAndSwapInt32(&self.overflow, 1, 0) {
+			self.replayDropped()
+			self.replayed = self.last
+		}
+	}
+}
+
+// replayDropped sends stored events after the last dispatched event
+func (self *changeFeed) replayDropped() {
+	for {
+		events, err := self.replay(self.last, 1000)
+		if err != nil {
+			ServerLogger.Error(err)
+			return
+		}
+		if 0 == len(events) {
+			return
+		}
+		for _, event := range events {
+			self.send(event)
+		}
+	}
+}
+
+// send calls the listeners with event
+func (self *changeFeed) send(event ChangeEvent) {
+	self.guard.RLock()
+	listeners := self.listeners
+	self.guard.RUnlock()
+	for _, listener := range listeners {
+		listener.listen(event)
+	}
+	self.last = event.Sequence
+}
+
+// nextSequence returns the next database sequence number. Must be called
+// while holding commit_guard so sequence numbers follow write order.
+func (self *Database) nextSequence() uint64 {
+	self.sequence++
+	return self.sequence
+}
+
+// changeKey is the changes table key of sequence number. Keys are zero
+// padded so they sort in sequence order.
+func changeKey(seq uint64) string {
+	return fmt.Sprintf("%020d", seq)
+}
+
+// emitChange stores change event and publishes it. Events without a sequence
+// number get the next one. Must be called while holding commit_guard.
+func (self *Database) emitChange(event ChangeEvent) {
+	if 0 == event.Sequence {
+		event.Sequence = self.nextSequence()
+	}
+	event.Timestamp = time.Now().Unix()
+	invalidateTiles(event)
+	value, err := json.Marshal(storedChange{event, event.Previous})
+	if err != nil {
+		ServerLogger.Error(err)
+	} else {
+		err = self.Insert("changes", changeKey(event.Sequence), value)
+		if err != nil {
+			ServerLogger.Error(err)
+		}
+	}
+	Changes.publish(event)
+}
+
+// loadSequence sets sequence to the last stored change event
+func (self *Database) loadSequence(conn *bolt.DB) error {
+	return conn.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("changes"))
+		if bucket == nil {
+			return fmt.Errorf("Bucket changes not found!")
+		}
+		key, _ := bucket.Cursor().Last()
+		if nil == key {
+			return nil
+		}
+		seq, err := strconv.ParseUint(string(key), 10, 64)
+		self.sequence = seq
+		return err
+	})
+}
+
+// ChangesSince returns stored change events of datasource after sequence
+// number since, in order. Returns ErrChangesExpired if some of them are no
+// longer stored or since is ahead of the database.
+// @param datasource {string}
+// @param since {uint64}
+// @returns []ChangeEvent
+// @returns Error
+func (self *Database) ChangesSince(datasource_id string, since uint64) ([]ChangeEvent, error) {
+	events := []ChangeEvent{}
+	if since > self.Sequence() {
+		return events, ErrChangesExpired
+	}
+	conn := self.Connect()
+	defer conn.Close()
+	err := conn.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("changes"))
+		if bucket == nil {
+			return fmt.Errorf("Bucket changes not found!")
+		}
+		cursor := bucket.Cursor()
+		first, _ := cursor.First()
+		if nil != first && string(first) > changeKey(since+1) {
+			return ErrChangesExpired
+		}
+		for key, value := cursor.Seek([]byte(changeKey(since + 1))); nil != key; key, value = cursor.Next() {
+			event, err := decodeChange(self.decompressByte(value))
+			if err != nil {
+				return err
+			}
+			if datasource_id == event.Datasource {
+				events = append(events, event)
+			}
+		}
+		return nil
+	})
+	return events, err
+}
+
+// changesAfter returns at most limit stored change events of every
+// datasource after sequence number since, in order
+func (self *Database) changesAfter(since uint64, limit int) ([]ChangeEvent, error) {
+	events := []ChangeEvent{}
+	conn := self.Connect()
+	defer conn.Close()
+	err := conn.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("changes"))
+		if bucket == nil {
+			return fmt.Errorf("Bucket changes not found!")
+		}
+		cursor := bucket.Cursor()
+		for key, value := cursor.Seek([]byte(changeKey(since + 1))); nil != key && len(events) < limit; key, value = cursor.Next() {
+			event, err := decodeChange(self.decompressByte(value))
+			if err != nil {
+				return err
+			}
+			events = append(events, event)
+		}
+		return nil
+	})
+	return events, err
+}
+
+// pruneChanges removes change events older than CHANGE_LOG_LIMIT
+func (self *Database) pruneChanges() error {
+	seq := self.Sequence()
+	if seq <= CHANGE_LOG_LIMIT {
+		return nil
+	}
+	oldest := changeKey(seq - CHANGE_LOG_LIMIT + 1)
+	conn := self.Connect()
+	defer conn.Close()
+	return conn.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("changes"))
+		if bucket == nil {
+			return fmt.Errorf("Bucket changes not found!")
+		}
+		cursor := bucket.Cursor()
+		for key, _ := cursor.First(); nil != key && string(key) < oldest; key, _ = cursor.First() {
+			err := cursor.Delete()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Sequence returns the sequence number of the last change event
+// @returns uint64
+func (self *Database) Sequence() uint64 {
+	self.commit_guard.Lock()
+	defer self.commit_guard.Unlock()
+	return self.sequence
+}
+
+// emitFeatureChange publishes feature change event. The feature is decoded
+// from its committed json so listeners get a copy detached from the cache.
+func (self *Database) emitFeatureChange(seq uint64, event_type string, datasource_id string, geo_id string, value []byte, previous *geojson.Feature) {
+	event := ChangeEvent{Type: event_type, Sequence: seq, Datasource: datasource_id, GeoId: geo_id, Previous: previous}
+	if nil != value {
+		feat, err := geojson.UnmarshalFeature(value)
+		if err != nil {
+			ServerLogger.Error(err)
+		}
+		event.Feature = feat
+	}
+	self.emitChange(event)
+}
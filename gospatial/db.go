@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"compress/flate"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math"
 	"os"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -38,9 +40,27 @@ var (
 	COMMIT_LOG_FILE string = "commit.log"
 )
 
+// Errors returned by feature write methods
+var (
+	ErrFeatureNotFound = errors.New("feature not found!")
+	ErrVersionConflict = errors.New("feature version conflict!")
+	ErrFeatureLocked   = errors.New("feature locked!")
+	ErrFeatureUnlocked = errors.New("feature not locked!")
+)
+
+// ANY_VERSION as expected_version skips the feature version check
+const ANY_VERSION int = -1
+
+// ErrDatasourceNotFound is returned for layers not in the database
+var ErrDatasourceNotFound = errors.New("Datasource not found")
+
+// ErrServerShuttingDown is returned for writes after shutdown started
+var ErrServerShuttingDown = errors.New("Server shutting down!")
+
 // LayerCache keeps track of Database's loaded geojson layers
 type LayerCache struct {
 	Geojson *geojson.FeatureCollection
+	Index   *SpatialIndex
 	Time    time.Time
 }
 
@@ -49,8 +69,17 @@ type Database struct {
 	File             string
 	Cache            map[string]*LayerCache
 	Apikeys          map[string]Customer
+	key_cache        map[string]ApikeyRecord
+	key_guard        sync.Mutex
+	apikey_salt      []byte
 	guard            sync.RWMutex
+	commit_guard     sync.Mutex
 	commit_log_queue chan string
+	sequence         uint64
+	locks            map[string]FeatureLock
+	lock_guard       sync.Mutex
+	share_guard      sync.Mutex
+	sync_guard       sync.Mutex
 	Precision        int
 	WriteLock        bool
 }
@@ -96,9 +125,12 @@ func (self *Database) Init() error {
 	m := make(map[string]*LayerCache)
 	self.Cache = m
 	self.Apikeys = make(map[string]Customer)
+	self.key_cache = make(map[string]ApikeyRecord)
+	// create commit log queue before any writes can reach it
+	self.commit_log_queue = make(chan string, 10000)
 	go self.cacheManager()
 	// start commit log
-	go self.startCommitLog()
+	go self.startCommitLog(COMMIT_LOG_FILE)
 	// create database if not exists
 	self.createDb()
 	// connect to db
@@ -108,24 +140,53 @@ func (self *Database) Init() error {
 	err := self.CreateTable(conn, "layers")
 	if err != nil {
 		panic(err)
-		return err
 	}
 	// Add table for datasource owner
-	// permissions
-	err = self.CreateTable(conn, "apikeys")
+	err = self.CreateTable(conn, "shares")
 	if err != nil {
 		panic(err)
-		return err
+	}
+	// customers by id, their apikeys are stored as salted hashes
+	for _, table := range []string{"apikeys", "customers", "meta"} {
+		err = self.CreateTable(conn, table)
+		if err != nil {
+			panic(err)
+		}
+	}
+	err = self.loadApikeySalt(conn)
+	if err != nil {
+		panic(err)
+	}
+	err = self.migrateApikeys(conn)
+	if err != nil {
+		panic(err)
+	}
+	// change events for resumable change feeds
+	err = self.CreateTable(conn, "changes")
+	if err != nil {
+		panic(err)
+	}
+	err = self.loadSequence(conn)
+	if err != nil {
+		panic(err)
+	}
+	// webhooks with their delivery outbox and last queued change, geofences
+	// and their event log, layer styles and their rendered tiles, uploaded
+	// tilesets, applied sync client changes
+	for _, table := range []string{"webhooks", "webhook_deliveries", "webhook_outbox", "webhook_state", "geofences", "geofence_events", "styles", "raster_tiles", "tilesets", "sync_clients"} {
+		err = self.CreateTable(conn, table)
+		if err != nil {
+			panic(err)
+		}
 	}
 	// close and return err
 	return err
 }
 
 // Starts Database commit log
-func (self *Database) startCommitLog() {
-	self.commit_log_queue = make(chan string, 10000)
+func (self *Database) startCommitLog(commit_log_file string) {
 	// open file to write database commit log
-	COMMIT_LOG, err := os.OpenFile(COMMIT_LOG_FILE, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	COMMIT_LOG, err := os.OpenFile(commit_log_file, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
 	if err != nil {
 		log.Println(err)
 	}
@@ -143,6 +204,27 @@ func (self *Database) startCommitLog() {
 	}
 }
 
+// commitLogEntry is a line of the commit log
+type commitLogEntry struct {
+	Method string      `json:"method"`
+	Seq    uint64      `json:"seq,omitempty"`
+	Data   interface{} `json:"data"`
+}
+
+// commitLog queues commit log entry of write. Stored values are given as
+// json.RawMessage.
+// @param method {string}
+// @param seq {uint64}
+// @param data {interface{}}
+func (self *Database) commitLog(method string, seq uint64, data interface{}) {
+	line, err := json.Marshal(commitLogEntry{Method: method, Seq: seq, Data: data})
+	if err != nil {
+		ServerLogger.Error("commit log: ", method, " ", err)
+		return
+	}
+	self.commit_log_queue <- string(line)
+}
+
 // CommitQueueLength returns length of database commit_log_queue
 // @returns int
 func (self *Database) CommitQueueLength() int {
@@ -160,56 +242,114 @@ func (self *Database) CreateTable(conn *bolt.DB, table string) error {
 	return err
 }
 
-// InsertCustomer inserts customer into apikeys table
+// InsertCustomer inserts customer into customers table. A customer
+// without id is created, or found by its apikey. The apikey is stored
+// as a salted hash if it is not stored yet.
+// Datasources of the customer's scopes are added to its datasource list.
 // @param customer {Customer}
 // @returns Error
 func (self *Database) InsertCustomer(customer Customer) error {
 	// write lock for shutdown process
 	if self.WriteLock {
-		return fmt.Errorf("Server shutting down!")
+		return ErrServerShuttingDown
+	}
+
+	err := customer.normalizeScopes()
+	if err != nil {
+		return err
+	}
+
+	self.key_guard.Lock()
+	defer self.key_guard.Unlock()
+
+	if "" != customer.Apikey {
+		record, err := self.getApikeyRecord(customer.Apikey)
+		switch {
+		case nil == err && "" == customer.Id:
+			customer.Id = record.Customer
+		case nil == err && customer.Id != record.Customer:
+			return fmt.Errorf("Apikey belongs to another customer")
+		case ErrApikeyNotFound == err && "" == record.Customer && "" == customer.Id:
+			// new customer
+			customer.Id, _ = utils.NewUUID()
+			err = self.putApikeyRecord(self.HashApikey(customer.Apikey), ApikeyRecord{Customer: customer.Id})
+			if err != nil {
+				return err
+			}
+		case nil != err && "" == customer.Id:
+			// expired apikey
+			return err
+		}
+		// customers loaded with an apikey revoked since are saved without it
+	}
+	if "" == customer.Id {
+		return fmt.Errorf("Customer requires apikey or id")
 	}
 
-	self.Apikeys[customer.Apikey] = customer
+	// apikey is only stored as hash
+	customer.Apikey = ""
+	self.guard.Lock()
+	self.Apikeys[customer.Id] = customer
+	self.guard.Unlock()
 	value, err := json.Marshal(customer)
 	if err != nil {
 		return err
 	}
-	self.commit_log_queue <- `{"method": "insert_apikey", "data":` + string(value) + `}`
+	self.commitLog("insert_apikey", 0, json.RawMessage(value))
 	// Insert customer into database
-	err = self.Insert("apikeys", customer.Apikey, value)
+	err = self.Insert("customers", customer.Id, value)
 	if err != nil {
 		panic(err)
 	}
 	return err
 }
 
-// GetCustomer returns customer from database
+// GetCustomer returns customer of apikey from database.
+// Fails for unknown, revoked and expired apikeys.
 // @param apikey {string}
 // @returns Customer
 // @returns Error
 func (self *Database) GetCustomer(apikey string) (Customer, error) {
-	// Check apikey cache
-	if _, ok := self.Apikeys[apikey]; ok {
-		return self.Apikeys[apikey], nil
+	record, err := self.getApikeyRecord(apikey)
+	if err != nil {
+		return Customer{}, err
+	}
+	customer, err := self.GetCustomerById(record.Customer)
+	customer.Apikey = apikey
+	return customer, err
+}
+
+// GetCustomerById returns customer from database
+// @param id {string}
+// @returns Customer
+// @returns Error
+func (self *Database) GetCustomerById(id string) (Customer, error) {
+	// Check customer cache
+	self.guard.RLock()
+	customer, ok := self.Apikeys[id]
+	self.guard.RUnlock()
+	if ok {
+		return customer, nil
 	}
 	// If customer not found get from database
-	val, err := self.Select("apikeys", apikey)
+	val, err := self.Select("customers", id)
 	if err != nil {
 		panic(err)
 	}
-	// datasource not found
+	// customer not found
 	if "" == string(val) {
-		return Customer{}, fmt.Errorf("Apikey not found")
+		return Customer{}, ErrApikeyNotFound
 	}
 	// Read to struct
-	customer := Customer{}
+	customer = Customer{}
 	err = json.Unmarshal(val, &customer)
 	if err != nil {
 		return Customer{}, err
 	}
-	// Put apikey into cache
-	self.Apikeys[apikey] = customer
-	// Close database connection
+	// Put customer into cache
+	self.guard.Lock()
+	self.Apikeys[id] = customer
+	self.guard.Unlock()
 	return customer, nil
 }
 
@@ -226,7 +366,7 @@ func (self *Database) NewLayer() (string, error) {
 	if err != nil {
 		return "", nil
 	}
-	self.commit_log_queue <- `{"method": "create_datasource", "data": { "datasource": "` + datasource_id + `", "layer": ` + string(value) + `}}`
+	self.commitLog("create_datasource", 0, map[string]interface{}{"datasource": datasource_id, "layer": json.RawMessage(value)})
 	// Insert layer into database
 	err = self.Insert("layers", datasource_id, value)
 	if err != nil {
@@ -235,25 +375,42 @@ func (self *Database) NewLayer() (string, error) {
 	return datasource_id, err
 }
 
-// InsertLayer inserts layer into database
+// InsertLayer inserts layer into database, replacing any existing layer
 // @param datasource {string}
 // @param geojs {Geojson}
 // @returns Error
 func (self *Database) InsertLayer(datasource_id string, geojs *geojson.FeatureCollection) error {
+	self.commit_guard.Lock()
+	defer self.commit_guard.Unlock()
+	err := self.saveLayer(datasource_id, geojs)
+	if err != nil {
+		return err
+	}
+	// recorded client changes refer to features of the replaced layer
+	if err := self.deleteSyncClients(datasource_id); err != nil {
+		ServerLogger.Error(err)
+	}
+	self.emitChange(ChangeEvent{Type: LAYER_REPLACED, Datasource: datasource_id})
+	return err
+}
+
+// saveLayer writes layer to cache and database
+func (self *Database) saveLayer(datasource_id string, geojs *geojson.FeatureCollection) error {
 	// write lock for shutdown process
 	if self.WriteLock {
-		return fmt.Errorf("Server shutting down!")
+		return ErrServerShuttingDown
 	}
 	// Update caching layer
+	self.guard.Lock()
 	if v, ok := self.Cache[datasource_id]; ok {
-		self.guard.Lock()
 		v.Geojson = geojs
+		v.Index = nil
 		v.Time = time.Now()
-		self.guard.Unlock()
 	} else {
 		pgc := &LayerCache{Geojson: geojs, Time: time.Now()}
 		self.Cache[datasource_id] = pgc
 	}
+	self.guard.Unlock()
 	// convert to bytes
 	value, err := geojs.MarshalJSON()
 	if err != nil {
@@ -270,25 +427,50 @@ func (self *Database) InsertLayer(datasource_id string, geojs *geojson.FeatureCo
 	return err
 }
 
+// GetLayerIndex returns layer and its spatial index. The index is built
+// on first use and dropped whenever the layer is saved.
+// @param datasource {string}
+// @returns Geojson
+// @returns *SpatialIndex
+// @returns Error
+func (self *Database) GetLayerIndex(datasource_id string) (*geojson.FeatureCollection, *SpatialIndex, error) {
+	geojs, err := self.GetLayer(datasource_id)
+	if err != nil {
+		return geojs, nil, err
+	}
+	self.guard.Lock()
+	defer self.guard.Unlock()
+	v, ok := self.Cache[datasource_id]
+	if !ok || v.Geojson != geojs {
+		// unloaded or replaced in the meantime
+		return geojs, NewSpatialIndex(geojs), nil
+	}
+	if nil == v.Index {
+		v.Index = NewSpatialIndex(geojs)
+	}
+	return v.Geojson, v.Index, nil
+}
+
 // GetLayer returns layer from database
 // @param datasource {string}
 // @returns Geojson
 // @returns Error
 func (self *Database) GetLayer(datasource_id string) (*geojson.FeatureCollection, error) {
 	// Caching layer
+	self.guard.Lock()
 	if v, ok := self.Cache[datasource_id]; ok {
-		self.guard.RLock()
 		v.Time = time.Now()
-		self.guard.RUnlock()
+		self.guard.Unlock()
 		return v.Geojson, nil
 	}
+	self.guard.Unlock()
 	// If cache ds not found get from database
 	val, err := self.Select("layers", datasource_id)
 	if err != nil {
 		return nil, err
 	}
 	if "" == string(val) {
-		return nil, fmt.Errorf("Datasource not found")
+		return nil, ErrDatasourceNotFound
 	}
 	// Read to struct
 	geojs, err := geojson.UnmarshalFeatureCollection(val)
@@ -297,7 +479,9 @@ func (self *Database) GetLayer(datasource_id string) (*geojson.FeatureCollection
 	}
 	// Store page in memory cache
 	pgc := &LayerCache{Geojson: geojs, Time: time.Now()}
+	self.guard.Lock()
 	self.Cache[datasource_id] = pgc
+	self.guard.Unlock()
 	return geojs, nil
 }
 
@@ -305,10 +489,12 @@ func (self *Database) GetLayer(datasource_id string) (*geojson.FeatureCollection
 // @param datasource {string}
 // @returns Error
 func (self *Database) DeleteLayer(datasource_id string) error {
+	self.commit_guard.Lock()
+	defer self.commit_guard.Unlock()
 	conn := self.Connect()
-	defer conn.Close()
 	key := []byte(datasource_id)
-	self.commit_log_queue <- `{"method": "delete_layer", "data": { "datasource": "` + datasource_id + `"}}`
+	seq := self.nextSequence()
+	self.commitLog("delete_layer", seq, map[string]string{"datasource": datasource_id})
 	err := conn.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte("layers"))
 		if bucket == nil {
@@ -317,19 +503,25 @@ func (self *Database) DeleteLayer(datasource_id string) error {
 		err := bucket.Delete(key)
 		return err
 	})
+	// close before the change event is stored
+	conn.Close()
 	if err != nil {
 		panic(err)
 	}
 	self.guard.Lock()
 	delete(self.Cache, datasource_id)
 	self.guard.Unlock()
+	if err := self.deleteSyncClients(datasource_id); err != nil {
+		ServerLogger.Error(err)
+	}
+	self.emitChange(ChangeEvent{Type: LAYER_DELETED, Sequence: seq, Datasource: datasource_id})
 	return err
 }
 
 func (self *Database) Insert(table string, key string, value []byte) error {
 	// write lock for shutdown process
 	if self.WriteLock {
-		return fmt.Errorf("Server shutting down!")
+		return ErrServerShuttingDown
 	}
 	// connect to database and write to table
 	conn := self.Connect()
@@ -378,6 +570,44 @@ func (self *Database) SelectAll(table string) ([]string, error) {
 	return data, err
 }
 
+// Delete removes keys from table
+// @param table {string}
+// @param keys {...string}
+// @returns Error
+func (self *Database) Delete(table string, keys ...string) error {
+	conn := self.Connect()
+	defer conn.Close()
+	return conn.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(table))
+		if bucket == nil {
+			return fmt.Errorf("Bucket %q not found!", table)
+		}
+		for _, key := range keys {
+			err := bucket.Delete([]byte(key))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// scanKeys calls fn with every key of table and the stored size of its value
+func (self *Database) scanKeys(table string, fn func(string, int)) error {
+	conn := self.Connect()
+	defer conn.Close()
+	return conn.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(table))
+		if bucket == nil {
+			return fmt.Errorf("Bucket %q not found!", table)
+		}
+		return bucket.ForEach(func(key, value []byte) error {
+			fn(string(key), len(value))
+			return nil
+		})
+	})
+}
+
 func (self *Database) normalizeGeometry(feat *geojson.Feature) (*geojson.Feature, error) {
 	// FIT TO 7 - 8 DECIMAL PLACES OF PRECISION
 	if nil == feat.Geometry {
@@ -473,6 +703,51 @@ func (self *Database) normalizeProperties(feat *geojson.Feature, featCollection
 	return feat
 }
 
+// FeatureVersion returns the version counter stored in the feature properties.
+// Features written before versioning was added report version 0.
+// @param feat {Geojson Feature}
+// @returns int
+func FeatureVersion(feat *geojson.Feature) int {
+	if nil == feat || nil == feat.Properties {
+		return 0
+	}
+	switch v := feat.Properties["version"].(type) {
+	case int:
+		return v
+	case int64:
+		return int(v)
+	case float64:
+		return int(v)
+	case string:
+		n, _ := strconv.Atoi(v)
+		return n
+	}
+	return 0
+}
+
+// findFeature returns the index of the feature with matching geo_id
+func (self *Database) findFeature(featCollection *geojson.FeatureCollection, geo_id string) int {
+	for i := range featCollection.Features {
+		if geo_id == fmt.Sprintf("%v", featCollection.Features[i].Properties["geo_id"]) {
+			return i
+		}
+	}
+	return -1
+}
+
+// newGeoId returns geo_id of feature created at time now. The geo_id is
+// the creation time, suffixed with a counter when features were already
+// added to the layer in the same second. Without the suffix the features
+// of a sync batch or an import share a geo_id, and edits and deletes only
+// ever find the first of them.
+func (self *Database) newGeoId(featCollection *geojson.FeatureCollection, now int64) string {
+	geo_id := fmt.Sprintf("%v", now)
+	for i := 1; -1 != self.findFeature(featCollection, geo_id); i++ {
+		geo_id = fmt.Sprintf("%v-%v", now, i)
+	}
+	return geo_id
+}
+
 // InsertFeature adds feature to layer. Updates layer in Database
 // @param datasource {string}
 // @param feat {Geojson Feature}
@@ -480,13 +755,16 @@ func (self *Database) normalizeProperties(feat *geojson.Feature, featCollection
 func (self *Database) InsertFeature(datasource_id string, feat *geojson.Feature) error {
 	// write lock for shutdown process
 	if self.WriteLock {
-		return fmt.Errorf("Server shutting down!")
+		return ErrServerShuttingDown
 	}
 
 	if nil == feat {
 		return fmt.Errorf("feature value is <nil>!")
 	}
 
+	self.commit_guard.Lock()
+	defer self.commit_guard.Unlock()
+
 	// Get layer from database
 	featCollection, err := self.GetLayer(datasource_id)
 	if err != nil {
@@ -505,7 +783,8 @@ func (self *Database) InsertFeature(datasource_id string, feat *geojson.Feature)
 	feat.Properties["is_deleted"] = false
 	feat.Properties["date_created"] = now
 	feat.Properties["date_modified"] = now
-	feat.Properties["geo_id"] = fmt.Sprintf("%v", now)
+	feat.Properties["geo_id"] = self.newGeoId(featCollection, now)
+	feat.Properties["version"] = 1
 
 	feat, err = self.normalizeGeometry(feat)
 	if nil != err {
@@ -519,70 +798,224 @@ func (self *Database) InsertFeature(datasource_id string, feat *geojson.Feature)
 	if err != nil {
 		return err
 	}
-	self.commit_log_queue <- `{"method": "insert_feature", "data": { "datasource": "` + datasource_id + `", "feature": ` + string(value) + `}}`
+	seq := self.nextSequence()
+	self.commitLog("insert_feature", seq, map[string]interface{}{"datasource": datasource_id, "feature": json.RawMessage(value)})
 
 	// Add new feature to layer
 	featCollection.AddFeature(feat)
 
 	// insert layer
-	err = self.InsertLayer(datasource_id, featCollection)
+	err = self.saveLayer(datasource_id, featCollection)
 	if err != nil {
 		panic(err)
 	}
+	self.emitFeatureChange(seq, FEATURE_ADDED, datasource_id, fmt.Sprintf("%v", feat.Properties["geo_id"]), value, nil)
 	return err
 }
 
-// EditFeature Edits feature in layer. Updates layer in Database
+// GetFeature returns a copy of feature from layer. Writers change the
+// properties of cached features while holding commit_guard, so the copy is
+// made while holding it.
+// @param datasource {string}
+// @param geo_id {string}
+// @returns Geojson Feature
+// @returns Error
+func (self *Database) GetFeature(datasource_id string, geo_id string) (*geojson.Feature, error) {
+	featCollection, err := self.GetLayer(datasource_id)
+	if err != nil {
+		return nil, err
+	}
+	self.commit_guard.Lock()
+	defer self.commit_guard.Unlock()
+	i := self.findFeature(featCollection, geo_id)
+	if -1 == i {
+		return nil, ErrFeatureNotFound
+	}
+	value, err := featCollection.Features[i].MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	return geojson.UnmarshalFeature(value)
+}
+
+// EditFeature Edits feature in layer. Updates layer in Database.
+// An expected_version of ANY_VERSION skips the version check. Edits are refused
+// with ErrFeatureLocked while another editor holds the feature lock.
+// On success feat holds the stored feature, including its new version.
 // @param datasource {string}
 // @param geo_id {string}
 // @param feat {Geojson Feature}
+// @param expected_version {int}
+// @param editor {string} customer id making the edit, or lock holder id when sent with a lock token
 // @returns Error
-func (self *Database) EditFeature(datasource_id string, geo_id string, feat *geojson.Feature) error {
+func (self *Database) EditFeature(datasource_id string, geo_id string, feat *geojson.Feature, expected_version int, editor string) error {
+	if nil == feat {
+		return fmt.Errorf("feature value is <nil>!")
+	}
+	return self.updateFeature(datasource_id, geo_id, expected_version, editor, func(current *geojson.Feature) *geojson.Feature {
+		return feat
+	})
+}
+
+// PatchFeature merges properties and geometry of patch into existing feature.
+// Properties missing from patch are kept, as is the geometry when patch has none.
+// On success patch holds the stored feature.
+// @param datasource {string}
+// @param geo_id {string}
+// @param patch {Geojson Feature}
+// @param expected_version {int}
+// @param editor {string} customer id making the edit, or lock holder id when sent with a lock token
+// @returns Error
+func (self *Database) PatchFeature(datasource_id string, geo_id string, patch *geojson.Feature, expected_version int, editor string) error {
+	if nil == patch {
+		return fmt.Errorf("feature value is <nil>!")
+	}
+	return self.updateFeature(datasource_id, geo_id, expected_version, editor, func(current *geojson.Feature) *geojson.Feature {
+		if nil == patch.Properties {
+			patch.Properties = make(map[string]interface{})
+		}
+		for key, value := range current.Properties {
+			if _, ok := patch.Properties[key]; !ok {
+				patch.Properties[key] = value
+			}
+		}
+		if nil == patch.Geometry {
+			patch.Geometry = current.Geometry
+		}
+		return patch
+	})
+}
+
+// updateFeature checks feature version and lock and replaces feature with the result of update
+func (self *Database) updateFeature(datasource_id string, geo_id string, expected_version int, editor string, update func(*geojson.Feature) *geojson.Feature) error {
 	// write lock for shutdown process
 	if self.WriteLock {
-		return fmt.Errorf("Server shutting down!")
+		return ErrServerShuttingDown
 	}
 
+	self.commit_guard.Lock()
+	defer self.commit_guard.Unlock()
+
 	// Get layer from database
 	featCollection, err := self.GetLayer(datasource_id)
 	if err != nil {
 		return err
 	}
 
-	feature_exists := false
+	i := self.findFeature(featCollection, geo_id)
+	if -1 == i {
+		return ErrFeatureNotFound
+	}
 
-	for i := range featCollection.Features {
-		if geo_id == fmt.Sprintf("%v", featCollection.Features[i].Properties["geo_id"]) {
+	current := featCollection.Features[i]
+	version := FeatureVersion(current)
+	// copy of the current feature for change listeners
+	previous_value, err := current.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	previous, err := geojson.UnmarshalFeature(previous_value)
+	if err != nil {
+		return err
+	}
+	if ANY_VERSION != expected_version && expected_version != version {
+		return ErrVersionConflict
+	}
 
-			now := time.Now().Unix()
-			feat.Properties["date_modified"] = now
+	err = self.checkFeatureLock(datasource_id, geo_id, editor)
+	if err != nil {
+		return err
+	}
 
-			feat, err = self.normalizeGeometry(feat)
-			if nil != err {
-				return err
-			}
+	feat := update(current)
+	if nil == feat.Properties {
+		feat.Properties = make(map[string]interface{})
+	}
 
-			feat = self.normalizeProperties(feat, featCollection)
-			featCollection.Features[i] = feat
-			// Write to commit log
-			value, err := feat.MarshalJSON()
-			if err != nil {
-				return err
-			}
-			self.commit_log_queue <- `{"method": "edit_feature", "data": { "datasource": "` + datasource_id + `", "geo_id": "` + geo_id + `", "feature": ` + string(value) + `}}`
-			feature_exists = true
-		}
+	// reserved fields are owned by the database
+	feat.Properties["geo_id"] = current.Properties["geo_id"]
+	if date_created, ok := current.Properties["date_created"]; ok {
+		feat.Properties["date_created"] = date_created
+	}
+	feat.Properties["date_modified"] = time.Now().Unix()
+	feat.Properties["version"] = version + 1
+
+	feat, err = self.normalizeGeometry(feat)
+	if nil != err {
+		return err
+	}
+
+	feat = self.normalizeProperties(feat, featCollection)
+	featCollection.Features[i] = feat
+
+	// Write to commit log
+	value, err := feat.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	seq := self.nextSequence()
+	self.commitLog("edit_feature", seq, map[string]interface{}{"datasource": datasource_id, "geo_id": geo_id, "feature": json.RawMessage(value)})
+
+	// insert layer
+	err = self.saveLayer(datasource_id, featCollection)
+	if err != nil {
+		panic(err)
+	}
+	self.emitFeatureChange(seq, FEATURE_UPDATED, datasource_id, geo_id, value, previous)
+	return err
+}
+
+// DeleteFeature removes feature from layer. Updates layer in Database.
+// An expected_version of ANY_VERSION skips the version check. Refused with
+// ErrFeatureLocked while another editor holds the feature lock.
+// @param datasource {string}
+// @param geo_id {string}
+// @param expected_version {int}
+// @param editor {string} customer id making the edit, or lock holder id when sent with a lock token
+// @returns Error
+func (self *Database) DeleteFeature(datasource_id string, geo_id string, expected_version int, editor string) error {
+	// write lock for shutdown process
+	if self.WriteLock {
+		return ErrServerShuttingDown
+	}
+
+	self.commit_guard.Lock()
+	defer self.commit_guard.Unlock()
+
+	// Get layer from database
+	featCollection, err := self.GetLayer(datasource_id)
+	if err != nil {
+		return err
+	}
+
+	i := self.findFeature(featCollection, geo_id)
+	if -1 == i {
+		return ErrFeatureNotFound
 	}
 
-	if !feature_exists {
-		return fmt.Errorf("feature not found!")
+	if ANY_VERSION != expected_version && expected_version != FeatureVersion(featCollection.Features[i]) {
+		return ErrVersionConflict
+	}
+
+	err = self.checkFeatureLock(datasource_id, geo_id, editor)
+	if err != nil {
+		return err
 	}
 
+	previous := featCollection.Features[i]
+	featCollection.Features = append(featCollection.Features[:i], featCollection.Features[i+1:]...)
+
+	// Write to commit log
+	seq := self.nextSequence()
+	self.commitLog("delete_feature", seq, map[string]string{"datasource": datasource_id, "geo_id": geo_id})
+
 	// insert layer
-	err = self.InsertLayer(datasource_id, featCollection)
+	err = self.saveLayer(datasource_id, featCollection)
 	if err != nil {
 		panic(err)
 	}
+	self.removeFeatureLock(datasource_id, geo_id)
+	self.emitFeatureChange(seq, FEATURE_DELETED, datasource_id, geo_id, nil, previous)
 	return err
 }
 
@@ -592,6 +1025,9 @@ func (self *Database) EditFeature(datasource_id string, geo_id string, feat *geo
 //		When items in cache --> 15 sec timer
 func (self *Database) cacheManager() {
 	for {
+		// commit_guard keeps writers from growing layers while they are measured
+		self.commit_guard.Lock()
+		self.guard.Lock()
 		n := float64(len(self.Cache))
 		if n != 0 {
 			for key := range self.Cache {
@@ -602,13 +1038,17 @@ func (self *Database) cacheManager() {
 					limit = 10.0
 				}
 				if time.Since(self.Cache[key].Time).Seconds() > limit {
-					self.guard.Lock()
 					delete(self.Cache, key)
-					self.guard.Unlock()
 				}
 			}
 		}
+		self.guard.Unlock()
+		self.commit_guard.Unlock()
 		time.Sleep(10000 * time.Millisecond)
+		err := self.pruneChanges()
+		if err != nil {
+			ServerLogger.Error(err)
+		}
 	}
 }
 
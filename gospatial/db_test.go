@@ -6,7 +6,7 @@ import (
 	//"log"
 	//"math/rand"
 	"testing"
-	//"time"
+	"time"
 )
 
 // go test -bench=.
@@ -50,9 +50,11 @@ func BenchmarkDbGetCustomerWithOutCache(b *testing.B) {
 	testCustomer := Customer{Apikey: testCustomerApikey}
 	testDb.InsertCustomer(testCustomer)
 	b.ResetTimer()
-	testDb.Apikeys = make(map[string]Customer)
+	customer, _ := testDb.GetCustomer(testCustomerApikey)
+	hash := testDb.HashApikey(testCustomerApikey)
 	for i := 0; i < b.N; i++ {
-		delete(testDb.Apikeys, testCustomerApikey)
+		delete(testDb.Apikeys, customer.Id)
+		delete(testDb.key_cache, hash)
 		testDb.GetCustomer(testCustomerApikey)
 	}
 }
@@ -196,6 +198,129 @@ func TestDbLayers(t *testing.T) {
 	}
 }
 
+// Unittest: Database.EditFeature
+// Unittest: Database.DeleteFeature
+func TestDbFeatureVersions(t *testing.T) {
+	lyr_data := []byte(`{"features":[],"type":"FeatureCollection"}`)
+	layer, err := geojson.UnmarshalFeatureCollection(lyr_data)
+	if err != nil {
+		t.Error(err)
+	}
+	testDb.InsertLayer(testDatasource, layer)
+
+	feat_data := []byte(`{"geometry":{"coordinates":[47.279229,47.27922900257082],"type":"Point"},"properties":{"name":"Dot"},"type":"Feature"}`)
+	feature, err := geojson.UnmarshalFeature(feat_data)
+	if err != nil {
+		t.Error(err)
+	}
+	err = testDb.InsertFeature(testDatasource, feature)
+	if err != nil {
+		t.Error(err)
+	}
+	geo_id := feature.Properties["geo_id"].(string)
+	if 1 != FeatureVersion(feature) {
+		t.Errorf("Expected version 1: %v", FeatureVersion(feature))
+	}
+
+	edit, _ := geojson.UnmarshalFeature(feat_data)
+	err = testDb.EditFeature(testDatasource, geo_id, edit, 1, "")
+	if err != nil {
+		t.Error(err)
+	}
+	if 2 != FeatureVersion(edit) {
+		t.Errorf("Expected version 2: %v", FeatureVersion(edit))
+	}
+
+	// stale version
+	stale, _ := geojson.UnmarshalFeature(feat_data)
+	err = testDb.EditFeature(testDatasource, geo_id, stale, 1, "")
+	if ErrVersionConflict != err {
+		t.Errorf("Expected version conflict: %v", err)
+	}
+	err = testDb.DeleteFeature(testDatasource, geo_id, 1, "")
+	if ErrVersionConflict != err {
+		t.Errorf("Expected version conflict: %v", err)
+	}
+
+	// patch keeps existing properties
+	patch, _ := geojson.UnmarshalFeature([]byte(`{"geometry":null,"properties":{"color":"red"},"type":"Feature"}`))
+	err = testDb.PatchFeature(testDatasource, geo_id, patch, 2, "")
+	if err != nil {
+		t.Error(err)
+	}
+	feat, err := testDb.GetFeature(testDatasource, geo_id)
+	if err != nil {
+		t.Error(err)
+	}
+	if "Dot" != feat.Properties["name"] || "red" != feat.Properties["color"] || 3 != FeatureVersion(feat) {
+		t.Errorf("Patch not applied: %v", feat.Properties)
+	}
+
+	err = testDb.DeleteFeature(testDatasource, geo_id, 3, "")
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = testDb.GetFeature(testDatasource, geo_id)
+	if ErrFeatureNotFound != err {
+		t.Errorf("Expected feature not found: %v", err)
+	}
+
+	// features stored without version are at version 0, which is checked
+	// like any other version
+	legacy, _ := geojson.UnmarshalFeatureCollection([]byte(`{"features":[{"geometry":{"coordinates":[1,1],"type":"Point"},"properties":{"geo_id":"legacy"},"type":"Feature"}],"type":"FeatureCollection"}`))
+	testDb.InsertLayer(testDatasource, legacy)
+	err = testDb.EditFeature(testDatasource, "legacy", geojson.NewPointFeature([]float64{2, 2}), 0, "")
+	if err != nil {
+		t.Errorf("Expected edit of version 0: %v", err)
+	}
+	err = testDb.DeleteFeature(testDatasource, "legacy", 0, "")
+	if ErrVersionConflict != err {
+		t.Errorf("Expected version conflict for version 0: %v", err)
+	}
+}
+
+// Unittest: Database change events
+func TestDbChangeEvents(t *testing.T) {
+	datasource := "testChanges"
+	events := make(chan ChangeEvent, 10)
+	Changes.Listen(func(event ChangeEvent) {
+		if datasource == event.Datasource {
+			select {
+			case events <- event:
+			default:
+			}
+		}
+	})
+
+	layer, _ := geojson.UnmarshalFeatureCollection([]byte(`{"features":[],"type":"FeatureCollection"}`))
+	testDb.InsertLayer(datasource, layer)
+	feature, _ := geojson.UnmarshalFeature([]byte(`{"geometry":{"coordinates":[1,2],"type":"Point"},"properties":{},"type":"Feature"}`))
+	testDb.InsertFeature(datasource, feature)
+	geo_id := feature.Properties["geo_id"].(string)
+	edit, _ := geojson.UnmarshalFeature([]byte(`{"geometry":{"coordinates":[3,4],"type":"Point"},"properties":{},"type":"Feature"}`))
+	testDb.EditFeature(datasource, geo_id, edit, ANY_VERSION, "")
+	testDb.DeleteFeature(datasource, geo_id, ANY_VERSION, "")
+
+	var last uint64
+	for _, event_type := range []string{LAYER_REPLACED, FEATURE_ADDED, FEATURE_UPDATED, FEATURE_DELETED} {
+		select {
+		case event := <-events:
+			if event_type != event.Type {
+				t.Errorf("Expected %v event: %v", event_type, event.Type)
+			}
+			if event.Sequence <= last {
+				t.Errorf("Sequence not increasing: %v %v", last, event.Sequence)
+			}
+			last = event.Sequence
+			if FEATURE_UPDATED == event.Type && (nil == event.Feature || 3 != event.Feature.Geometry.Point[0]) {
+				t.Errorf("Missing feature payload: %v", event.Feature)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Missing %v event", event_type)
+		}
+	}
+}
+
 /*
 // Test NewLayer
 // Test InsertFeature
@@ -247,3 +372,383 @@ func create_random_feature() {
 
 
 */
+
+// Unittest: Database.LockFeature
+// Unittest: Database.UnlockFeature
+func TestDbFeatureLocks(t *testing.T) {
+	datasource := "testLocks"
+	layer, _ := geojson.UnmarshalFeatureCollection([]byte(`{"features":[],"type":"FeatureCollection"}`))
+	testDb.InsertLayer(datasource, layer)
+	feature, _ := geojson.UnmarshalFeature([]byte(`{"geometry":{"coordinates":[1,2],"type":"Point"},"properties":{},"type":"Feature"}`))
+	testDb.InsertFeature(datasource, feature)
+	geo_id := feature.Properties["geo_id"].(string)
+	edit := func() *geojson.Feature {
+		feat, _ := geojson.UnmarshalFeature([]byte(`{"geometry":{"coordinates":[3,4],"type":"Point"},"properties":{},"type":"Feature"}`))
+		return feat
+	}
+
+	_, err := testDb.LockFeature(datasource, "not_a_feature", "alice", "Alice", 1)
+	if ErrFeatureNotFound != err {
+		t.Errorf("Expected feature not found: %v", err)
+	}
+	_, err = testDb.LockFeature(datasource, geo_id, "alice", "Alice", 1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// other editors are refused
+	lock, err := testDb.LockFeature(datasource, geo_id, "bob", "Bob", 2)
+	if ErrFeatureLocked != err || "Alice" != lock.User {
+		t.Errorf("Expected feature locked by Alice: %v %v", err, lock)
+	}
+	if err = testDb.EditFeature(datasource, geo_id, edit(), ANY_VERSION, "bob"); ErrFeatureLocked != err {
+		t.Errorf("Expected feature locked: %v", err)
+	}
+	if err = testDb.DeleteFeature(datasource, geo_id, ANY_VERSION, "bob"); ErrFeatureLocked != err {
+		t.Errorf("Expected feature locked: %v", err)
+	}
+	if err = testDb.UnlockFeature(datasource, geo_id, "bob"); ErrFeatureLocked != err {
+		t.Errorf("Expected feature locked: %v", err)
+	}
+
+	// lock owner and superuser may edit
+	if err = testDb.EditFeature(datasource, geo_id, edit(), ANY_VERSION, "alice"); err != nil {
+		t.Error(err)
+	}
+	if err = testDb.EditFeature(datasource, geo_id, edit(), ANY_VERSION, ""); err != nil {
+		t.Error(err)
+	}
+	if 1 != len(testDb.FeatureLocks(datasource)) {
+		t.Errorf("Expected 1 lock: %v", testDb.FeatureLocks(datasource))
+	}
+
+	if err = testDb.UnlockFeature(datasource, geo_id, "alice"); err != nil {
+		t.Error(err)
+	}
+	if err = testDb.UnlockFeature(datasource, geo_id, "alice"); ErrFeatureUnlocked != err {
+		t.Errorf("Expected feature not locked: %v", err)
+	}
+	if err = testDb.EditFeature(datasource, geo_id, edit(), ANY_VERSION, "bob"); err != nil {
+		t.Error(err)
+	}
+
+	// expired locks are ignored
+	timeout := FEATURE_LOCK_TIMEOUT
+	FEATURE_LOCK_TIMEOUT = -time.Second
+	testDb.LockFeature(datasource, geo_id, "alice", "Alice", 1)
+	FEATURE_LOCK_TIMEOUT = timeout
+	if err = testDb.EditFeature(datasource, geo_id, edit(), ANY_VERSION, "bob"); err != nil {
+		t.Error(err)
+	}
+
+	// released with websocket client
+	testDb.LockFeature(datasource, geo_id, "alice", "Alice", 1)
+	if released := testDb.ReleaseClientLocks(1); 1 != len(released) {
+		t.Errorf("Expected 1 released lock: %v", released)
+	}
+	if 0 != len(testDb.FeatureLocks(datasource)) {
+		t.Errorf("Expected no locks: %v", testDb.FeatureLocks(datasource))
+	}
+}
+
+// Unittest: changeFeed publish with a full queue
+func TestChangeFeedOverflow(t *testing.T) {
+	stored := []ChangeEvent{}
+	for seq := uint64(1); seq <= 10; seq++ {
+		stored = append(stored, ChangeEvent{Type: FEATURE_ADDED, Sequence: seq})
+	}
+	feed := newChangeFeed(2, func(since uint64, limit int) ([]ChangeEvent, error) {
+		events := []ChangeEvent{}
+		for _, event := range stored {
+			if event.Sequence > since && len(events) < limit {
+				events = append(events, event)
+			}
+		}
+		return events, nil
+	})
+	release := make(chan bool)
+	received := make(chan uint64, 20)
+	feed.Listen(func(event ChangeEvent) {
+		<-release
+		received <- event.Sequence
+	})
+
+	// writers are not held up by the blocked listener
+	published := make(chan bool)
+	go func() {
+		for _, event := range stored {
+			feed.publish(event)
+		}
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("Expected publish not to block")
+	}
+
+	// dropped events are replayed in order
+	close(release)
+	for seq := uint64(1); seq <= 10; seq++ {
+		select {
+		case got := <-received:
+			if seq != got {
+				t.Fatalf("Expected change %v: %v", seq, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected change %v replayed", seq)
+		}
+	}
+}
+
+// Unittest: Database.ChangesSince
+func TestDbChangesSince(t *testing.T) {
+	datasource := "testChangesSince"
+	layer, _ := geojson.UnmarshalFeatureCollection([]byte(`{"features":[],"type":"FeatureCollection"}`))
+	testDb.InsertLayer(datasource, layer)
+	since := testDb.Sequence()
+	for i := 0; i < 3; i++ {
+		feature, _ := geojson.UnmarshalFeature([]byte(`{"geometry":{"coordinates":[1,2],"type":"Point"},"properties":{},"type":"Feature"}`))
+		testDb.InsertFeature(datasource, feature)
+	}
+	testDb.InsertLayer("testChangesOther", layer)
+
+	events, err := testDb.ChangesSince(datasource, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if 3 != len(events) {
+		t.Fatalf("Expected 3 changes: %v", events)
+	}
+	for _, event := range events {
+		if FEATURE_ADDED != event.Type || nil == event.Feature || event.Sequence <= since {
+			t.Errorf("Unexpected change: %v", event)
+		}
+		since = event.Sequence
+	}
+
+	// sequence survives restart
+	seq := testDb.Sequence()
+	conn := testDb.Connect()
+	testDb.commit_guard.Lock()
+	testDb.sequence = 0
+	err = testDb.loadSequence(conn)
+	testDb.commit_guard.Unlock()
+	conn.Close()
+	if err != nil || seq != testDb.Sequence() {
+		t.Errorf("Expected sequence %v: %v %v", seq, testDb.Sequence(), err)
+	}
+
+	_, err = testDb.ChangesSince(datasource, seq+1)
+	if ErrChangesExpired != err {
+		t.Errorf("Expected changes expired: %v", err)
+	}
+
+	limit := CHANGE_LOG_LIMIT
+	CHANGE_LOG_LIMIT = 1
+	err = testDb.pruneChanges()
+	CHANGE_LOG_LIMIT = limit
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = testDb.ChangesSince(datasource, since-1)
+	if ErrChangesExpired != err {
+		t.Errorf("Expected changes expired: %v", err)
+	}
+}
+
+// Unittest: Database.Sync
+func TestDbSync(t *testing.T) {
+	datasource := "testSync"
+	layer, _ := geojson.UnmarshalFeatureCollection([]byte(`{"features":[],"type":"FeatureCollection"}`))
+	testDb.InsertLayer(datasource, layer)
+	point := func(name string) *geojson.Feature {
+		feat := geojson.NewPointFeature([]float64{1, 2})
+		feat.Properties["name"] = name
+		return feat
+	}
+
+	// initial sync returns layer
+	result, err := testDb.Sync(datasource, SyncRequest{Changes: []SyncChange{{Op: SYNC_INSERT, ClientId: "a", Feature: point("a")}, {Op: SYNC_INSERT, ClientId: "b", Feature: point("b")}}}, "tablet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Reset || 2 != len(result.Layer.Features) || 2 != len(result.Applied) {
+		t.Fatalf("Expected reset with layer: %v", result)
+	}
+	if result.Applied[0].GeoId == result.Applied[1].GeoId {
+		t.Errorf("Expected unique geo_ids: %v", result.Applied)
+	}
+	token := result.Token
+	geo_a := result.Applied[0].GeoId
+	geo_b := result.Applied[1].GeoId
+	zero, one := 0, 1
+
+	// another client edits a while offline tablet edits a and b
+	err = testDb.EditFeature(datasource, geo_a, point("server"), 1, "office")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = testDb.Sync(datasource, SyncRequest{Token: token, Changes: []SyncChange{
+		{Op: SYNC_UPDATE, GeoId: geo_a, BaseVersion: &one, Feature: point("tablet")},
+		{Op: SYNC_PATCH, GeoId: geo_b, BaseVersion: &one, Feature: point("tablet")},
+		{Op: SYNC_DELETE, GeoId: "not_a_feature", BaseVersion: &one},
+	}}, "tablet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Reset || 2 != len(result.Applied) || 1 != len(result.Conflicts) {
+		t.Fatalf("Unexpected sync result: %v", result)
+	}
+	conflict := result.Conflicts[0]
+	if "version" != conflict.Reason || "tablet" != conflict.Local.Properties["name"] || "server" != conflict.Server.Properties["name"] {
+		t.Errorf("Unexpected conflict: %v", conflict)
+	}
+	if 2 != result.Applied[0].Version {
+		t.Errorf("Expected version 2: %v", result.Applied[0])
+	}
+	// only the other client's edit is returned
+	if 1 != len(result.Changes) || geo_a != result.Changes[0].GeoId {
+		t.Errorf("Expected other client's change: %v", result.Changes)
+	}
+
+	// nothing new since token
+	result, err = testDb.Sync(datasource, SyncRequest{Token: result.Token}, "tablet")
+	if err != nil || 0 != len(result.Changes) {
+		t.Errorf("Expected no changes: %v %v", result.Changes, err)
+	}
+
+	_, err = testDb.Sync(datasource, SyncRequest{Token: token, Changes: []SyncChange{{Op: SYNC_UPDATE, GeoId: geo_a, Feature: point("tablet")}}}, "tablet")
+	if !errors.Is(err, ErrInvalidSyncChange) {
+		t.Errorf("Expected error for update without base_version: %v", err)
+	}
+
+	// retried changes return their first result and are not applied again
+	result, err = testDb.Sync(datasource, SyncRequest{Token: token, Changes: []SyncChange{{Op: SYNC_INSERT, ClientId: "a", Feature: point("a")}}}, "tablet")
+	if err != nil || 1 != len(result.Applied) || geo_a != result.Applied[0].GeoId {
+		t.Errorf("Expected first result of retried change: %v %v", result.Applied, err)
+	}
+	if layer, _ := testDb.GetLayer(datasource); 2 != len(layer.Features) {
+		t.Errorf("Expected retried insert not applied: %v", len(layer.Features))
+	}
+
+	// features stored without version are synced with base_version 0
+	legacy, _ := geojson.UnmarshalFeatureCollection([]byte(`{"features":[{"geometry":{"coordinates":[1,1],"type":"Point"},"properties":{"geo_id":"legacy"},"type":"Feature"}],"type":"FeatureCollection"}`))
+	testDb.InsertLayer(datasource, legacy)
+	result, err = testDb.Sync(datasource, SyncRequest{Changes: []SyncChange{{Op: SYNC_UPDATE, ClientId: "legacy-edit", GeoId: "legacy", BaseVersion: &zero, Feature: point("tablet")}}}, "tablet")
+	if err != nil || 1 != len(result.Applied) || 1 != result.Applied[0].Version {
+		t.Errorf("Expected legacy feature updated: %v %v", result, err)
+	}
+	// replaced layer forgets recorded client changes
+	result, err = testDb.Sync(datasource, SyncRequest{Changes: []SyncChange{{Op: SYNC_INSERT, ClientId: "a", Feature: point("a")}}}, "tablet")
+	if err != nil || 1 != len(result.Applied) || nil == result.Layer || 2 != len(result.Layer.Features) {
+		t.Errorf("Expected change applied to replaced layer: %v %v", result, err)
+	}
+}
+
+// Unittest: Database.ReportPositions
+func TestDbTrackReports(t *testing.T) {
+	datasource := "testTracks"
+	layer, _ := geojson.UnmarshalFeatureCollection([]byte(`{"features":[
+		{"geometry":{"coordinates":[[1,2],[3,4]],"type":"LineString"},"properties":{"geo_id":"track-truck-2000-01-01","track_type":"track","day":"2000-01-01"},"type":"Feature"},
+		{"geometry":{"coordinates":[0,0],"type":"Point"},"properties":{"geo_id":"depot","name":"depot"},"type":"Feature"}
+	],"type":"FeatureCollection"}`))
+	testDb.InsertLayer(datasource, layer)
+	max_vertices := TRACK_MAX_VERTICES
+	TRACK_MAX_VERTICES = 3
+	defer func() {
+		TRACK_MAX_VERTICES = max_vertices
+		TRACK_OUT_OF_ORDER = TRACK_OUT_OF_ORDER_INSERT
+	}()
+
+	now := time.Now().UTC()
+	base := time.Date(now.Year(), now.Month(), now.Day(), 0, 1, 0, 0, time.UTC).Unix()
+	report := func(offset int64, lon float64) PositionReport {
+		return PositionReport{DeviceId: "truck", Lon: lon, Lat: 1, Timestamp: base + offset, Speed: float64(offset)}
+	}
+	track := func() (*geojson.Feature, []float64) {
+		feat, err := testDb.GetFeature(datasource, TrackGeoId("truck", base))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return feat, trackNumbers(feat.Properties["times"])
+	}
+
+	// late report is added in timestamp order, old track is removed by retention
+	result, err := testDb.ReportPositions(datasource, []PositionReport{report(10, 10), report(30, 30), report(20, 20), {DeviceId: "truck", Lon: 1, Lat: 1, Timestamp: 1000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if 3 != result.Applied || 1 != result.Dropped {
+		t.Errorf("Unexpected result: %v", result)
+	}
+	feat, times := track()
+	if 3 != len(times) || float64(base+20) != times[1] || 20 != feat.Geometry.LineString[1][0] {
+		t.Errorf("Expected vertices in timestamp order: %v %v", times, feat.Geometry.LineString)
+	}
+	position, _ := testDb.GetFeature(datasource, PositionGeoId("truck"))
+	if nil == position || 30 != position.Geometry.Point[0] || 1 != FeatureVersion(position) {
+		t.Errorf("Expected last known position of latest report: %v", position)
+	}
+	_, err = testDb.GetFeature(datasource, "track-truck-2000-01-01")
+	if ErrFeatureNotFound != err {
+		t.Errorf("Expected expired track removed: %v", err)
+	}
+
+	// track read back from database drops oldest vertex past the limit
+	testDb.guard.Lock()
+	delete(testDb.Cache, datasource)
+	testDb.guard.Unlock()
+	testDb.ReportPositions(datasource, []PositionReport{report(40, 40)})
+	feat, times = track()
+	if 3 != len(times) || float64(base+20) != times[0] || 40 != feat.Geometry.LineString[2][0] || 2 != FeatureVersion(feat) {
+		t.Errorf("Expected oldest vertex removed: %v %v", times, feat.Geometry.LineString)
+	}
+
+	// late reports dropped
+	TRACK_OUT_OF_ORDER = TRACK_OUT_OF_ORDER_DROP
+	result, _ = testDb.ReportPositions(datasource, []PositionReport{report(35, 35)})
+	if 0 != result.Applied || 1 != result.Dropped {
+		t.Errorf("Expected late report dropped: %v", result)
+	}
+
+	_, err = testDb.ReportPositions(datasource, []PositionReport{{DeviceId: "truck", Lon: 200}})
+	if err == nil {
+		t.Error("Expected invalid report error")
+	}
+
+	// first vertex of a track is a Point, other features keep their properties
+	testDb.ReportPositions(datasource, []PositionReport{{DeviceId: "van", Lon: 5, Lat: 5, Timestamp: base}})
+	van, _ := testDb.GetFeature(datasource, TrackGeoId("van", base))
+	if nil == van || !van.Geometry.IsPoint() || 5 != van.Geometry.Point[0] {
+		t.Errorf("Expected single vertex track as Point: %v", van)
+	}
+	testDb.ReportPositions(datasource, []PositionReport{{DeviceId: "van", Lon: 6, Lat: 6, Timestamp: base + 10}})
+	van, _ = testDb.GetFeature(datasource, TrackGeoId("van", base))
+	if nil == van || !van.Geometry.IsLineString() || 2 != len(van.Geometry.LineString) {
+		t.Errorf("Expected track LineString: %v", van)
+	}
+	depot, _ := testDb.GetFeature(datasource, "depot")
+	if _, ok := depot.Properties["times"]; ok {
+		t.Errorf("Expected track properties kept off other features: %v", depot.Properties)
+	}
+
+	// track edited by clients gets times and speeds matching its vertices
+	for _, edited := range [][]float64{{1, 2, 3, 4, 5}, {}} {
+		van.Properties["times"] = edited
+		van.Properties["speeds"] = edited
+		err = testDb.EditFeature(datasource, TrackGeoId("van", base), van, ANY_VERSION, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = testDb.ReportPositions(datasource, []PositionReport{{DeviceId: "van", Lon: 7, Lat: 7, Timestamp: base + 20}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		van, _ = testDb.GetFeature(datasource, TrackGeoId("van", base))
+		times := trackNumbers(van.Properties["times"])
+		if nil == van.Geometry || len(van.Geometry.LineString) != len(times) || len(times) != len(trackNumbers(van.Properties["speeds"])) {
+			t.Errorf("Expected one time and speed per vertex: %v %v", van.Geometry, van.Properties)
+		}
+	}
+}
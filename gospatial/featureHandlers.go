@@ -1,217 +1,114 @@
 package gospatial
 
 import (
-	"fmt"
-	"io/ioutil"
-	"net/http"
-)
-
-import (
-	"github.com/gorilla/mux"
 	"github.com/paulmach/go.geojson"
 )
 
-// NewFeatureHandler creates a new feature and adds it to a layer.
+// decodeFeature reads http request body as the request feature
+func decodeFeature(body []byte, req *TcpMessage) error {
+	feat, err := geojson.UnmarshalFeature(body)
+	req.Data.Feature = feat
+	return err
+}
+
+// insertFeature creates a new feature and adds it to a layer.
 // Layer is then saved to database. All active clients viewing layer
-// are notified of update via websocket hub.
+// are notified of the change event via websocket hub.
 // @param apikey customer id
 // @oaram ds datasource uuid
 // @return json
-func NewFeatureHandler(w http.ResponseWriter, r *http.Request) {
-	NetworkLogger.Debug("[In] ", r)
-
-	// Get request body
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		message := fmt.Sprintf(" %v %v [500]", r.Method, r.URL.Path)
-		NetworkLogger.Critical(r.RemoteAddr, message)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	r.Body.Close()
-
-	// Get ds from url path
-	vars := mux.Vars(r)
-	ds := vars["ds"]
-
-	/*=======================================*/
-	apikey := GetApikeyFromRequest(w, r)
-	if apikey == "" {
-		return
-	}
-
-	customer, err := GetCustomerFromDatabase(w, r, apikey)
-	if err != nil {
-		return
+func insertFeature(ctx *OperationContext) (interface{}, error) {
+	if nil == ctx.Request.Data.Feature {
+		return nil, ErrMissingParameters
 	}
-
-	if !CheckCustomerForDatasource(w, r, customer, ds) {
-		return
-	}
-
-	// Unmarshal feature
-	feat, err := geojson.UnmarshalFeature(body)
-	if err != nil {
-		message := fmt.Sprintf(" %v %v [400]", r.Method, r.URL.Path)
-		NetworkLogger.Critical(r.RemoteAddr, message)
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
 	// Save feature to database
-	err = DB.InsertFeature(ds, feat)
+	err := DB.InsertFeature(ctx.Datasource(), ctx.Request.Data.Feature)
 	if err != nil {
-		message := fmt.Sprintf(" %v %v [500]", r.Method, r.URL.Path)
-		NetworkLogger.Critical(r.RemoteAddr, message)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
-
-	// Generate message
-	data := HttpMessageResponse{Status: "success", Datasource: ds, Data: "feature added"}
-	js, err := MarshalJsonFromStruct(w, r, data)
-	if err != nil {
-		return
-	}
-
-	// Update websockets
-	conn := connection{ds: ds, ip: r.RemoteAddr}
-	Hub.broadcast(true, &conn)
-
-	// Return results
-	SendJsonResponse(w, r, js)
+	return "feature added", nil
 }
 
-// ViewFeatureHandler finds feature in layer via array index. Returns feature geojson.
+// viewFeature finds feature in layer via geo_id. Returns feature geojson.
+// Response carries an ETag built from the feature version.
 // @param apikey customer id
 // @oaram ds datasource uuid
 // @return feature geojson
-func ViewFeatureHandler(w http.ResponseWriter, r *http.Request) {
-	NetworkLogger.Debug("[In] ", r)
-
-	// Get ds from url path
-	vars := mux.Vars(r)
-	ds := vars["ds"]
-
-	/*=======================================*/
-	apikey := GetApikeyFromRequest(w, r)
-	if apikey == "" {
-		return
-	}
-
-	customer, err := GetCustomerFromDatabase(w, r, apikey)
-	if err != nil {
-		return
+func viewFeature(ctx *OperationContext) (interface{}, error) {
+	if "" == ctx.Request.Data.GeoId {
+		return nil, ErrMissingParameters
 	}
-
-	if !CheckCustomerForDatasource(w, r, customer, ds) {
-		return
-	}
-	/*=======================================*/
-
-	// Get layer from database
-	data, err := DB.GetLayer(ds)
+	// Get feature from database
+	feat, err := DB.GetFeature(ctx.Datasource(), ctx.Request.Data.GeoId)
 	if err != nil {
-		message := fmt.Sprintf(" %v %v [404]", r.Method, r.URL.Path)
-		NetworkLogger.Critical(r.RemoteAddr, message)
-		http.Error(w, err.Error(), http.StatusNotFound)
-		return
-	}
-
-	// Check for feature
-	var js []byte
-	for _, v := range data.Features {
-		geo_id := fmt.Sprintf("%v", v.Properties["geo_id"])
-		if geo_id == vars["k"] {
-			js, err = v.MarshalJSON()
-			if err != nil {
-				message := fmt.Sprintf(" %v %v [500]", r.Method, r.URL.Path)
-				NetworkLogger.Critical(r.RemoteAddr, message)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			// Return results
-			SendJsonResponse(w, r, js)
-			return
-		}
+		return nil, ErrFeatureNotFound
 	}
+	ctx.ETag = FeatureETag(feat)
+	return feat, nil
+}
 
-	// Feature not found
-	message := fmt.Sprintf(" %v %v [404]", r.Method, r.URL.Path)
-	NetworkLogger.Critical(r.RemoteAddr, message)
-	err = fmt.Errorf("Not found")
-	http.Error(w, err.Error(), http.StatusNotFound)
+// editFeature finds feature in layer via geo_id. Replaces feature.
+// The expected version is checked against the feature version. Returns
+// 423 while another apikey holds the feature lock.
+// @param apikey customer id
+// @oaram ds datasource uuid
+func editFeature(ctx *OperationContext) (interface{}, error) {
+	return updateFeature(ctx, DB.EditFeature, "feature edited")
 }
 
-// EditFeatureHandler finds feature in layer via array index. Edits feature.
+// patchFeature finds feature in layer via geo_id. Merges request
+// properties and geometry into the feature.
+// The expected version is checked against the feature version. Returns
+// 423 while another apikey holds the feature lock.
 // @param apikey customer id
 // @oaram ds datasource uuid
-func EditFeatureHandler(w http.ResponseWriter, r *http.Request) {
-	NetworkLogger.Debug("[In] ", r)
+func patchFeature(ctx *OperationContext) (interface{}, error) {
+	return updateFeature(ctx, DB.PatchFeature, "feature patched")
+}
 
-	// Get request body
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		message := fmt.Sprintf(" %v %v [500]", r.Method, r.URL.Path)
-		NetworkLogger.Critical(r.RemoteAddr, message)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+// updateFeature handles edit and patch feature requests
+func updateFeature(ctx *OperationContext, update func(string, string, *geojson.Feature, int, string) error, result string) (interface{}, error) {
+	geo_id := ctx.Request.Data.GeoId
+	feat := ctx.Request.Data.Feature
+	if "" == geo_id || nil == feat {
+		return nil, ErrMissingParameters
 	}
-	r.Body.Close()
-
-	//TESTING
-	fmt.Printf(string(body))
 
-	// Get ds from url path
-	vars := mux.Vars(r)
-	ds := vars["ds"]
-	geo_id := vars["k"]
-
-	/*=======================================*/
-	apikey := GetApikeyFromRequest(w, r)
-	if apikey == "" {
-		return
+	expected_version, err := ctx.expectedVersion(geo_id)
+	if err != nil {
+		return nil, err
 	}
 
-	customer, err := GetCustomerFromDatabase(w, r, apikey)
+	err = update(ctx.Datasource(), geo_id, feat, expected_version, ctx.editor())
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	if !CheckCustomerForDatasource(w, r, customer, ds) {
-		return
-	}
-	/*=======================================*/
+	// new feature version
+	ctx.ETag = FeatureETag(feat)
+	return result, nil
+}
 
-	// Unmarshal feature
-	feat, err := geojson.UnmarshalFeature(body)
-	if err != nil {
-		message := fmt.Sprintf(" %v %v [400]", r.Method, r.URL.Path)
-		NetworkLogger.Critical(r.RemoteAddr, message)
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+// deleteFeature removes feature from layer via geo_id.
+// The expected version is checked against the feature version. Returns
+// 423 while another apikey holds the feature lock.
+// @param apikey customer id
+// @oaram ds datasource uuid
+// @return json
+func deleteFeature(ctx *OperationContext) (interface{}, error) {
+	geo_id := ctx.Request.Data.GeoId
+	if "" == geo_id {
+		return nil, ErrMissingParameters
 	}
 
-	err = DB.EditFeature(ds, geo_id, feat)
+	expected_version, err := ctx.expectedVersion(geo_id)
 	if err != nil {
-		// Feature not found
-		message := fmt.Sprintf(" %v %v [404]", r.Method, r.URL.Path)
-		NetworkLogger.Critical(r.RemoteAddr, message)
-		err = fmt.Errorf("Not found")
-		http.Error(w, err.Error(), http.StatusNotFound)
+		return nil, err
 	}
 
-	// Generate message
-	data := HttpMessageResponse{Status: "success", Datasource: ds, Data: "feature edited"}
-	js, err := MarshalJsonFromStruct(w, r, data)
+	err = DB.DeleteFeature(ctx.Datasource(), geo_id, expected_version, ctx.editor())
 	if err != nil {
-		return
+		return nil, err
 	}
-
-	// Update websockets
-	conn := connection{ds: ds, ip: r.RemoteAddr}
-	Hub.broadcast(true, &conn)
-
-	// Feature not found
-	SendJsonResponse(w, r, js)
+	return "feature deleted", nil
 }
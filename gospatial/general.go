@@ -15,4 +15,6 @@ const (
 var (
 	startTime           = time.Now()
 	SuperuserKey string = utils.NewAPIKey(12)
+	// read-only tcp operator key, operators are disabled when empty
+	OperatorKey string
 )
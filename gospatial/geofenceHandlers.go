@@ -0,0 +1,71 @@
+package gospatial
+
+import (
+	"encoding/json"
+)
+
+// decodeGeofences reads http request body as the request geofence set
+func decodeGeofences(body []byte, req *TcpMessage) error {
+	req.Data.Geofences = &GeofenceSet{}
+	return json.Unmarshal(body, req.Data.Geofences)
+}
+
+// setGeofences attaches a polygon layer as geofences to the layer.
+// Apikey needs admin scope on the layer and read scope on the fences layer.
+// @param apikey customer id
+// @oaram ds datasource uuid
+// @return json
+func setGeofences(ctx *OperationContext) (interface{}, error) {
+	if nil == ctx.Request.Data.Geofences {
+		return nil, ErrMissingParameters
+	}
+	set := *ctx.Request.Data.Geofences
+	set.Datasource = ctx.Datasource()
+
+	err := ctx.CheckDatasource(set.Fences, SCOPE_READ)
+	if err != nil {
+		return nil, err
+	}
+
+	err = DB.InsertGeofenceSet(set)
+	if err != nil {
+		return nil, validationFailed(err)
+	}
+	return set, nil
+}
+
+// viewGeofences returns the geofence set of the layer
+// @param apikey customer id
+// @oaram ds datasource uuid
+// @return json
+func viewGeofences(ctx *OperationContext) (interface{}, error) {
+	set, err := DB.GetGeofenceSet(ctx.Datasource())
+	if err != nil {
+		return nil, ErrGeofencesNotFound
+	}
+	return set, nil
+}
+
+// deleteGeofences detaches geofences from the layer
+// @param apikey customer id
+// @oaram ds datasource uuid
+// @return json
+func deleteGeofences(ctx *OperationContext) (interface{}, error) {
+	err := DB.DeleteGeofenceSet(ctx.Datasource())
+	if err != nil {
+		return nil, err
+	}
+	return "geofences deleted", nil
+}
+
+// viewGeofenceEvents returns logged geofence events of the layer
+// @param apikey customer id
+// @oaram ds datasource uuid
+// @param geo_id only events of this point
+// @param since unix time of oldest event
+// @param limit number of most recent events
+// @return json
+func viewGeofenceEvents(ctx *OperationContext) (interface{}, error) {
+	data := ctx.Request.Data
+	return DB.GetGeofenceEvents(ctx.Datasource(), data.GeoId, data.Since, data.Limit)
+}
@@ -0,0 +1,385 @@
+package gospatial
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/paulmach/go.geojson"
+)
+
+// Geofence event types
+const (
+	GEOFENCE_ENTER string = "enter"
+	GEOFENCE_EXIT  string = "exit"
+	GEOFENCE_DWELL string = "dwell"
+)
+
+// Period points inside fences are checked for dwell events
+var GEOFENCE_POLL_PERIOD time.Duration = 5 * time.Second
+
+// Number of most recent geofence events kept in the event log
+var GEOFENCE_EVENT_LIMIT int = 100000
+
+// ErrGeofencesNotFound is returned for layers without a geofence set
+var ErrGeofencesNotFound = errors.New("geofences not found!")
+
+// GeofenceSet attaches a polygon layer as fences to a layer of tracked points.
+// Dwell is the number of seconds a point stays in a fence before a dwell
+// event is sent, 0 sends none.
+type GeofenceSet struct {
+	Datasource string `json:"datasource"`
+	Fences     string `json:"fences"`
+	Dwell      int64  `json:"dwell"`
+}
+
+// GeofenceEvent is sent when a tracked point enters, exits or dwells in a fence
+type GeofenceEvent struct {
+	Type       string    `json:"type"`
+	Event      string    `json:"event"`
+	Id         string    `json:"id"`
+	Datasource string    `json:"datasource"`
+	GeoId      string    `json:"geo_id"`
+	Fences     string    `json:"fences"`
+	Fence      string    `json:"fence"`
+	Position   []float64 `json:"position,omitempty"`
+	Sequence   uint64    `json:"seq,omitempty"`
+	Timestamp  int64     `json:"timestamp"`
+}
+
+// InsertGeofenceSet attaches fence layer to tracked layer, replacing any existing set
+// @param set {GeofenceSet}
+// @returns Error
+func (self *Database) InsertGeofenceSet(set GeofenceSet) error {
+	if "" == set.Datasource || "" == set.Fences || 0 > set.Dwell {
+		return fmt.Errorf("geofences require fences layer and dwell >= 0")
+	}
+	value, err := json.Marshal(set)
+	if err != nil {
+		return err
+	}
+	return self.Insert("geofences", set.Datasource, value)
+}
+
+// GetGeofenceSet returns geofence set of tracked layer
+// @param datasource {string}
+// @returns GeofenceSet
+// @returns Error
+func (self *Database) GetGeofenceSet(datasource_id string) (GeofenceSet, error) {
+	set := GeofenceSet{}
+	value, err := self.Select("geofences", datasource_id)
+	if err != nil {
+		return set, err
+	}
+	if 0 == len(value) {
+		return set, ErrGeofencesNotFound
+	}
+	err = json.Unmarshal(value, &set)
+	return set, err
+}
+
+// DeleteGeofenceSet detaches fences from tracked layer
+// @param datasource {string}
+// @returns Error
+func (self *Database) DeleteGeofenceSet(datasource_id string) error {
+	conn := self.Connect()
+	defer conn.Close()
+	return conn.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("geofences"))
+		if bucket == nil {
+			return fmt.Errorf("Bucket geofences not found!")
+		}
+		return bucket.Delete([]byte(datasource_id))
+	})
+}
+
+// deleteDatasourceGeofences removes geofence sets tracking datasource or
+// using it as fences
+func (self *Database) deleteDatasourceGeofences(datasource_id string) error {
+	conn := self.Connect()
+	defer conn.Close()
+	return conn.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("geofences"))
+		if bucket == nil {
+			return fmt.Errorf("Bucket geofences not found!")
+		}
+		keys := [][]byte{}
+		err := bucket.ForEach(func(key, value []byte) error {
+			set := GeofenceSet{}
+			err := json.Unmarshal(self.decompressByte(value), &set)
+			if nil == err && (datasource_id == set.Datasource || datasource_id == set.Fences) {
+				keys = append(keys, append([]byte{}, key...))
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			err = bucket.Delete(key)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// insertGeofenceEvent appends event to the geofence event log
+func (self *Database) insertGeofenceEvent(event GeofenceEvent) error {
+	value, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return self.Insert("geofence_events", event.Id, value)
+}
+
+// GetGeofenceEvents returns logged geofence events of tracked layer, oldest
+// first. Events are filtered by point geo_id when it is not empty.
+// @param datasource {string}
+// @param geo_id {string}
+// @param since {int64} unix time
+// @param limit {int} most recent events returned, 0 for all
+// @returns []GeofenceEvent
+// @returns Error
+func (self *Database) GetGeofenceEvents(datasource_id string, geo_id string, since int64, limit int) ([]GeofenceEvent, error) {
+	events := []GeofenceEvent{}
+	err := self.scanTable("geofence_events", func(value []byte) error {
+		event := GeofenceEvent{}
+		err := json.Unmarshal(value, &event)
+		if err != nil {
+			return err
+		}
+		if datasource_id == event.Datasource && ("" == geo_id || geo_id == event.GeoId) && since <= event.Timestamp {
+			events = append(events, event)
+		}
+		return nil
+	})
+	if 0 < limit && limit < len(events) {
+		events = events[len(events)-limit:]
+	}
+	return events, err
+}
+
+// pruneGeofenceEvents removes events older than GEOFENCE_EVENT_LIMIT
+func (self *Database) pruneGeofenceEvents() error {
+	conn := self.Connect()
+	defer conn.Close()
+	return conn.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("geofence_events"))
+		if bucket == nil {
+			return fmt.Errorf("Bucket geofence_events not found!")
+		}
+		cursor := bucket.Cursor()
+		for n := bucket.Stats().KeyN - GEOFENCE_EVENT_LIMIT; 0 < n; n-- {
+			key, _ := cursor.First()
+			if nil == key {
+				break
+			}
+			err := cursor.Delete()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// fenceStay tracks how long a point has been inside a fence
+type fenceStay struct {
+	event   GeofenceEvent
+	entered time.Time
+	dwelled bool
+}
+
+// GeofenceMonitor evaluates tracked point changes against their layer's
+// fences and sends geofence events to the websocket hub and event log.
+// Fence stays are only used by the monitor goroutine.
+type GeofenceMonitor struct {
+	db      *Database
+	queue   chan ChangeEvent
+	stop    chan bool
+	done    chan bool
+	cancel  func()
+	stays   map[string]*fenceStay
+	counter uint64
+}
+
+// StartGeofences starts evaluating database changes against geofences
+// @param db {*Database}
+// @returns *GeofenceMonitor
+func StartGeofences(db *Database) *GeofenceMonitor {
+	monitor := &GeofenceMonitor{
+		db:    db,
+		queue: make(chan ChangeEvent, 10000),
+		stop:  make(chan bool),
+		done:  make(chan bool),
+		stays: make(map[string]*fenceStay),
+	}
+	monitor.cancel = Changes.Listen(func(event ChangeEvent) {
+		if FEATURE_ADDED != event.Type && FEATURE_UPDATED != event.Type && FEATURE_DELETED != event.Type {
+			return
+		}
+		select {
+		case monitor.queue <- event:
+		default:
+			ServerLogger.Error("Geofence queue full, change ", event.Sequence, " not evaluated")
+		}
+	})
+	go monitor.run()
+	return monitor
+}
+
+// Stop stops evaluating changes
+func (self *GeofenceMonitor) Stop() {
+	self.cancel()
+	close(self.stop)
+	<-self.done
+}
+
+func (self *GeofenceMonitor) run() {
+	defer close(self.done)
+	ticker := time.NewTicker(GEOFENCE_POLL_PERIOD)
+	defer ticker.Stop()
+	for {
+		select {
+		case event := <-self.queue:
+			self.evaluate(event)
+		case <-ticker.C:
+			self.checkDwell()
+			err := self.db.pruneGeofenceEvents()
+			if err != nil {
+				ServerLogger.Error(err)
+			}
+		case <-self.stop:
+			return
+		}
+	}
+}
+
+// pointPosition returns coordinates of point feature
+func pointPosition(feat *geojson.Feature) ([]float64, bool) {
+	if nil == feat || nil == feat.Geometry || geojson.GeometryPoint != feat.Geometry.Type || 2 > len(feat.Geometry.Point) {
+		return nil, false
+	}
+	return feat.Geometry.Point, true
+}
+
+// fencesContaining returns geo_ids of fences containing point, found with
+// the fence layer's spatial index
+func (self *GeofenceMonitor) fencesContaining(fences string, point []float64) map[string]bool {
+	found := make(map[string]bool)
+	if nil == point {
+		return found
+	}
+	_, index, err := self.db.GetLayerIndex(fences)
+	if err != nil {
+		ServerLogger.Error(err)
+		return found
+	}
+	for _, fence := range index.Search([]float64{point[0], point[1], point[0], point[1]}) {
+		if PointInGeometry(point, fence.Geometry) {
+			found[fmt.Sprintf("%v", fence.Properties["geo_id"])] = true
+		}
+	}
+	return found
+}
+
+// evaluate compares the fences containing point before and after change
+func (self *GeofenceMonitor) evaluate(change ChangeEvent) {
+	set, err := self.db.GetGeofenceSet(change.Datasource)
+	if err != nil {
+		if ErrGeofencesNotFound != err {
+			ServerLogger.Error(err)
+		}
+		return
+	}
+
+	before, _ := pointPosition(change.Previous)
+	after, is_point := pointPosition(change.Feature)
+	if nil == before && !is_point {
+		return
+	}
+	was_inside := self.fencesContaining(set.Fences, before)
+	inside := self.fencesContaining(set.Fences, after)
+
+	for fence := range was_inside {
+		if !inside[fence] {
+			self.emit(set, change, fence, GEOFENCE_EXIT, before)
+		}
+	}
+	for fence := range inside {
+		if !was_inside[fence] {
+			self.emit(set, change, fence, GEOFENCE_ENTER, after)
+		}
+	}
+
+	// track stays for dwell events
+	for fence := range was_inside {
+		if !inside[fence] {
+			delete(self.stays, change.Datasource+"/"+change.GeoId+"/"+fence)
+		}
+	}
+	for fence := range inside {
+		key := change.Datasource + "/" + change.GeoId + "/" + fence
+		stay, ok := self.stays[key]
+		if !ok {
+			// entered now, or before a restart
+			stay = &fenceStay{entered: time.Now()}
+			self.stays[key] = stay
+		}
+		stay.event = GeofenceEvent{Datasource: change.Datasource, GeoId: change.GeoId, Fences: set.Fences, Fence: fence, Position: after}
+	}
+}
+
+// checkDwell sends dwell events for points that stayed in a fence long enough
+func (self *GeofenceMonitor) checkDwell() {
+	due := []GeofenceEvent{}
+	for _, stay := range self.stays {
+		if stay.dwelled {
+			continue
+		}
+		set, err := self.db.GetGeofenceSet(stay.event.Datasource)
+		if err != nil || 0 == set.Dwell || time.Since(stay.entered) < time.Duration(set.Dwell)*time.Second {
+			continue
+		}
+		stay.dwelled = true
+		due = append(due, stay.event)
+	}
+	for _, event := range due {
+		self.send(event, GEOFENCE_DWELL)
+	}
+}
+
+// emit sends geofence event for change
+func (self *GeofenceMonitor) emit(set GeofenceSet, change ChangeEvent, fence string, event_type string, position []float64) {
+	event := GeofenceEvent{
+		Datasource: change.Datasource,
+		GeoId:      change.GeoId,
+		Fences:     set.Fences,
+		Fence:      fence,
+		Position:   position,
+		Sequence:   change.Sequence,
+	}
+	self.send(event, event_type)
+}
+
+// send logs geofence event and broadcasts it to viewers of the tracked layer
+func (self *GeofenceMonitor) send(event GeofenceEvent, event_type string) {
+	now := time.Now()
+	self.counter++
+	event.Type = "geofence"
+	event.Event = event_type
+	event.Timestamp = now.Unix()
+	// ids sort in event order
+	event.Id = fmt.Sprintf("%020d-%v", now.UnixNano(), self.counter)
+	err := self.db.insertGeofenceEvent(event)
+	if err != nil {
+		ServerLogger.Error(err)
+	}
+	Hub.broadcast(event.Datasource, event, nil)
+}
@@ -0,0 +1,127 @@
+package gospatial
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/paulmach/go.geojson"
+)
+
+// square returns polygon feature covering [x, y, x+size, y+size]
+func square(x float64, y float64, size float64) *geojson.Feature {
+	return geojson.NewPolygonFeature([][][]float64{{{x, y}, {x + size, y}, {x + size, y + size}, {x, y + size}, {x, y}}})
+}
+
+func TestSpatialIndexSearch(t *testing.T) {
+	geojs := geojson.NewFeatureCollection()
+	for i := 0; i < 100; i++ {
+		feat := square(float64(i%10)*10, float64(i/10)*10, 5)
+		feat.Properties["n"] = i
+		geojs.AddFeature(feat)
+	}
+	// polygon with hole
+	donut := geojson.NewPolygonFeature([][][]float64{
+		{{200, 200}, {210, 200}, {210, 210}, {200, 210}, {200, 200}},
+		{{204, 204}, {206, 204}, {206, 206}, {204, 206}, {204, 204}},
+	})
+	geojs.AddFeature(donut)
+	index := NewSpatialIndex(geojs)
+
+	found := index.Search([]float64{12, 12, 12, 12})
+	if 1 != len(found) || 11 != found[0].Properties["n"] {
+		t.Errorf("Expected feature 11: %v", found)
+	}
+	if 0 != len(index.Search([]float64{7, 7, 8, 8})) {
+		t.Error("Expected no features between squares")
+	}
+	if 4 != len(index.Search([]float64{0, 0, 12, 12})) {
+		t.Errorf("Expected 4 features: %v", index.Search([]float64{0, 0, 12, 12}))
+	}
+	if 0 != len(index.Search([]float64{-50, -50, -40, -40})) {
+		t.Error("Expected no features outside layer")
+	}
+
+	if !PointInGeometry([]float64{201, 201}, donut.Geometry) {
+		t.Error("Expected point in polygon")
+	}
+	if PointInGeometry([]float64{205, 205}, donut.Geometry) {
+		t.Error("Expected point in hole to be outside polygon")
+	}
+}
+
+func TestGeofenceEvents(t *testing.T) {
+	poll := GEOFENCE_POLL_PERIOD
+	GEOFENCE_POLL_PERIOD = 10 * time.Millisecond
+	monitor := StartGeofences(&DB)
+	defer func() {
+		monitor.Stop()
+		GEOFENCE_POLL_PERIOD = poll
+	}()
+
+	server, ds := startSocketServer(t)
+	defer server.Close()
+	fences, _ := DB.NewLayer()
+	DB.InsertCustomer(Customer{Apikey: testSocketApikey, Datasources: []string{ds, fences}})
+	fence := square(0, 0, 10)
+	DB.InsertFeature(fences, fence)
+	fence_id := fence.Properties["geo_id"].(string)
+
+	body := strings.NewReader(`{"fences": "` + fences + `", "dwell": 1}`)
+	req, _ := http.NewRequest("PUT", server.URL+"/api/v1/layer/"+ds+"/geofences?apikey="+testSocketApikey, body)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if http.StatusOK != resp.StatusCode {
+		t.Fatalf("Expected geofences set: %v", resp.StatusCode)
+	}
+
+	ws := dialSocket(t, server, ds)
+	defer ws.Close()
+	readGeofenceEvent := func() GeofenceEvent {
+		event := GeofenceEvent{}
+		err := readTyped(ws, "geofence", &event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+
+	// vehicle drives into the fence, stays, then leaves
+	vehicle := geojson.NewPointFeature([]float64{20, 20})
+	DB.InsertFeature(ds, vehicle)
+	geo_id := vehicle.Properties["geo_id"].(string)
+	DB.EditFeature(ds, geo_id, geojson.NewPointFeature([]float64{5, 5}), ANY_VERSION, "")
+	DB.EditFeature(ds, geo_id, geojson.NewPointFeature([]float64{6, 6}), ANY_VERSION, "")
+	for _, expected := range []string{GEOFENCE_ENTER, GEOFENCE_DWELL} {
+		event := readGeofenceEvent()
+		if expected != event.Event || geo_id != event.GeoId || fence_id != event.Fence {
+			t.Errorf("Expected %v event: %v", expected, event)
+		}
+	}
+	DB.EditFeature(ds, geo_id, geojson.NewPointFeature([]float64{30, 30}), ANY_VERSION, "")
+	event := readGeofenceEvent()
+	if GEOFENCE_EXIT != event.Event || 6 != event.Position[0] {
+		t.Errorf("Expected exit event: %v", event)
+	}
+
+	// event log
+	resp, err = http.Get(server.URL + "/api/v1/layer/" + ds + "/geofences/events?geo_id=" + geo_id + "&apikey=" + testSocketApikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logged := struct {
+		Data []GeofenceEvent `json:"data"`
+	}{}
+	json.NewDecoder(resp.Body).Decode(&logged)
+	resp.Body.Close()
+	if 3 != len(logged.Data) || GEOFENCE_EXIT != logged.Data[2].Event {
+		t.Errorf("Unexpected event log: %v", logged.Data)
+	}
+}
@@ -1,21 +1,25 @@
 package gospatial
 
 import (
+	"crypto/sha1"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 )
 
 import (
 	"./utils"
 )
 
+import (
+	"github.com/paulmach/go.geojson"
+)
+
 func MarshalJsonFromString(w http.ResponseWriter, r *http.Request, data string) ([]byte, error) {
 	js, err := json.Marshal(data)
 	if err != nil {
-		message := fmt.Sprintf(" %v %v [500]", r.Method, r.URL.Path)
-		NetworkLogger.Critical(r.RemoteAddr, message)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		sendApiError(w, r, err)
 		return js, err
 	}
 	return js, nil
@@ -24,9 +28,7 @@ func MarshalJsonFromString(w http.ResponseWriter, r *http.Request, data string)
 func MarshalJsonFromStruct(w http.ResponseWriter, r *http.Request, data interface{}) ([]byte, error) {
 	js, err := json.Marshal(data)
 	if err != nil {
-		message := fmt.Sprintf(" %v %v [500]", r.Method, r.URL.Path)
-		NetworkLogger.Critical(r.RemoteAddr, message)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		sendApiError(w, r, err)
 		return js, err
 	}
 	return js, nil
@@ -46,26 +48,62 @@ func SendJsonResponse(w http.ResponseWriter, r *http.Request, js []byte) {
 	w.Write(js)
 }
 
-// check request for valid authkey
-func CheckAuthKey(w http.ResponseWriter, r *http.Request) bool {
-	if SuperuserKey != r.FormValue("authkey") {
-		message := fmt.Sprintf(" %v %v [401]", r.Method, r.URL.Path)
-		NetworkLogger.Error(r.RemoteAddr, message)
-		http.Error(w, `{"status": "fail", "data": {"error": "unauthorized"}}`, http.StatusUnauthorized)
-		return false
+// getRequestAuthKey reads superuser or operator authkey from the X-Auth-Key
+// header. Authkeys are not read from params, which end up in proxy and
+// browser logs.
+func getRequestAuthKey(r *http.Request) string {
+	return r.Header.Get("X-Auth-Key")
+}
+
+// getRequestApikey reads apikey from the Authorization: Bearer or
+// X-Api-Key headers, or the apikey param
+func getRequestApikey(r *http.Request) string {
+	authorization := r.Header.Get("Authorization")
+	if strings.HasPrefix(authorization, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
 	}
-	return true
+	if apikey := r.Header.Get("X-Api-Key"); "" != apikey {
+		return apikey
+	}
+	return r.FormValue("apikey")
 }
 
-// Check for apikey in request
+// requestBaseUrl returns scheme and host of request, honouring the
+// X-Forwarded-Proto header of proxies
+func requestBaseUrl(r *http.Request) string {
+	scheme := "http"
+	if nil != r.TLS {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); "" != proto {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+// redactedRequest describes request for logging without its apikey,
+// authkey or Authorization header
+func redactedRequest(r *http.Request) string {
+	query := r.URL.Query()
+	for _, param := range []string{"apikey", "authkey"} {
+		if "" != query.Get(param) {
+			query.Set(param, "REDACTED")
+		}
+	}
+	url := r.URL.Path
+	if 0 != len(query) {
+		url += "?" + query.Encode()
+	}
+	return fmt.Sprintf("%v %v %v %v", r.RemoteAddr, r.Method, url, r.UserAgent())
+}
+
+// Check for apikey in request headers or params
 func GetApikeyFromRequest(w http.ResponseWriter, r *http.Request) string {
 	// Get params
-	apikey := r.FormValue("apikey")
+	apikey := getRequestApikey(r)
 	// Check for apikey in request
 	if apikey == "" {
-		message := fmt.Sprintf(" %v %v [401]", r.Method, r.URL.Path)
-		NetworkLogger.Error(r.RemoteAddr, message)
-		http.Error(w, `{"status": "fail", "data": {"error": "unauthorized"}}`, http.StatusUnauthorized)
+		sendApiError(w, r, ErrUnauthorized)
 	}
 	// return apikey
 	return apikey
@@ -75,21 +113,58 @@ func GetApikeyFromRequest(w http.ResponseWriter, r *http.Request) string {
 func GetCustomerFromDatabase(w http.ResponseWriter, r *http.Request, apikey string) (Customer, error) {
 	customer, err := DB.GetCustomer(apikey)
 	if err != nil {
-		message := fmt.Sprintf(" %v %v [404]", r.Method, r.URL.Path)
-		NetworkLogger.Error(r.RemoteAddr, message)
-		http.Error(w, err.Error(), http.StatusNotFound)
+		sendApiError(w, r, NewApiError(ERROR_NOT_FOUND, err.Error()))
 		return customer, err
 	}
 	return customer, err
 }
 
-// Check customer datasource list
-func CheckCustomerForDatasource(w http.ResponseWriter, r *http.Request, customer Customer, ds string) bool {
+// CheckCustomerPermission checks customer is allowed scope on datasource.
+// Sends 401 if the customer has no access to the datasource and 403 if
+// the customer's scopes do not include the requested action.
+// Returns false if an error response was sent.
+func CheckCustomerPermission(w http.ResponseWriter, r *http.Request, customer Customer, ds string, scope string) bool {
 	if !utils.StringInSlice(ds, customer.Datasources) {
-		message := fmt.Sprintf(" %v %v [401]", r.Method, r.URL.Path)
-		NetworkLogger.Error(r.RemoteAddr, message)
-		http.Error(w, `{"status": "error", "result": "unauthorized"}`, http.StatusUnauthorized)
+		sendApiError(w, r, ErrUnauthorized)
+		return false
+	}
+	if !customer.HasScope(ds, scope) {
+		sendApiError(w, r, NewApiError(ERROR_FORBIDDEN, "apikey requires "+scope+" scope"))
 		return false
 	}
 	return true
 }
+
+// FeatureETag returns entity tag built from feature geo_id and version
+// @param feat {Geojson Feature}
+// @returns string
+func FeatureETag(feat *geojson.Feature) string {
+	return fmt.Sprintf(`"%v-%v"`, feat.Properties["geo_id"], FeatureVersion(feat))
+}
+
+// LayerETag returns entity tag built from marshaled layer contents
+// @param js {[]byte}
+// @returns string
+func LayerETag(js []byte) string {
+	return fmt.Sprintf(`"%x"`, sha1.Sum(js))
+}
+
+// Check If-None-Match header against entity tag.
+// Sends 304 Not Modified and returns true when the client copy is current.
+func CheckIfNoneMatch(w http.ResponseWriter, r *http.Request, etag string) bool {
+	header := r.Header.Get("If-None-Match")
+	if "" == header {
+		return false
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if "*" == tag || etag == tag {
+			message := fmt.Sprintf(" %v %v [304]", r.Method, r.URL.Path)
+			NetworkLogger.Info(r.RemoteAddr, message)
+			w.Header().Set("ETag", etag)
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
@@ -1,172 +1,158 @@
 package gospatial
 
 import (
-	"fmt"
-	"github.com/gorilla/mux"
-	"net/http"
+	"encoding/json"
 )
 
 import (
 	"./utils"
 )
 
-// ViewLayersHandler returns json containing customer layers
+// viewCustomer returns customer of apikey with its layers
 // @param apikey customer id
 // @return json
-func ViewLayersHandler(w http.ResponseWriter, r *http.Request) {
-	NetworkLogger.Debug("[In] ", r)
-
-	apikey := GetApikeyFromRequest(w, r)
-	if apikey == "" {
-		return
-	}
-
-	customer, err := GetCustomerFromDatabase(w, r, apikey)
-	if err != nil {
-		return
-	}
-
-	js, err := MarshalJsonFromStruct(w, r, customer)
-	if err != nil {
-		return
-	}
-
-	SendJsonResponse(w, r, js)
+func viewCustomer(ctx *OperationContext) (interface{}, error) {
+	return ctx.Customer, nil
 }
 
-// NewLayerHandler creates a new geojson layer. Saves layer to database and adds layer to customer
+// newLayer creates a new geojson layer. Saves layer to database and adds layer to customer,
+// who is recorded as the layer owner
 // @param apikey
 // @return json
-func NewLayerHandler(w http.ResponseWriter, r *http.Request) {
-	NetworkLogger.Debug("[In] ", r)
-
-	apikey := GetApikeyFromRequest(w, r)
-	if apikey == "" {
-		return
-	}
-
-	customer, err := GetCustomerFromDatabase(w, r, apikey)
-	if err != nil {
-		return
-	}
-
+func newLayer(ctx *OperationContext) (interface{}, error) {
 	// Create datasource
 	ds, err := DB.NewLayer()
 	if err != nil {
-		message := fmt.Sprintf(" %v %v [500]", r.Method, r.URL.Path)
-		NetworkLogger.Critical(r.RemoteAddr, message)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
 	// Add datasource uuid to customer
+	customer := ctx.Customer
 	customer.Datasources = append(customer.Datasources, ds)
 	DB.InsertCustomer(customer)
-
-	// Generate message
-	data := HttpMessageResponse{Status: "success", Datasource: ds}
-	js, err := MarshalJsonFromStruct(w, r, data)
+	err = DB.SetDatasourceOwner(ds, customer.Id)
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	// Return results
-	SendJsonResponse(w, r, js)
+	ctx.Request.Datasource = ds
+	return map[string]string{"datasource": ds}, nil
+}
+
+// createDatasource inserts layer with datasource uuid, or creates an
+// empty layer when none is given. The layer has no owner.
+// @param data.datasource
+// @param data.layer
+// @return json
+func createDatasource(ctx *OperationContext) (interface{}, error) {
+	ds := ctx.Request.Data.Datasource
+	if "" == ds {
+		var err error
+		ds, err = DB.NewLayer()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if nil == ctx.Request.Data.Layer {
+			return nil, ErrMissingParameters
+		}
+		err := DB.InsertLayer(ds, ctx.Request.Data.Layer)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return map[string]string{"datasource": ds}, nil
+}
+
+// exportDatasources lists datasource uuids of all layers
+// @return json
+func exportDatasources(ctx *OperationContext) (interface{}, error) {
+	return DB.SelectAll("layers")
 }
 
-// ViewLayerHandler returns geojson of requested layer. Apikey/customer is checked for permissions to requested layer.
+// viewLayer returns geojson of requested layer.
+// Response carries an ETag built from the layer contents.
 // @param ds
 // @param apikey
 // @return geojson
-func ViewLayerHandler(w http.ResponseWriter, r *http.Request) {
-	NetworkLogger.Debug("[In] ", r)
-
-	// Get ds from url path
-	vars := mux.Vars(r)
-	ds := vars["ds"]
-
-	apikey := GetApikeyFromRequest(w, r)
-	if apikey == "" {
-		return
-	}
-
-	customer, err := GetCustomerFromDatabase(w, r, apikey)
-	if err != nil {
-		return
-	}
-
-	if !CheckCustomerForDatasource(w, r, customer, ds) {
-		return
-	}
-
-	// Get layer from database
-	lyr, err := DB.GetLayer(ds)
+func viewLayer(ctx *OperationContext) (interface{}, error) {
+	js, err := marshalLayer(ctx.Datasource())
 	if err != nil {
-		message := fmt.Sprintf(" %v %v [404]", r.Method, r.URL.Path)
-		NetworkLogger.Critical(r.RemoteAddr, message)
-		http.Error(w, err.Error(), http.StatusNotFound)
-		return
+		return nil, err
 	}
+	ctx.ETag = LayerETag(js)
+	return json.RawMessage(js), nil
+}
 
-	// Marshal datasource layer to json
-	js, err := lyr.MarshalJSON()
+// marshalLayer returns json of layer from database
+func marshalLayer(datasource_id string) ([]byte, error) {
+	lyr, err := DB.GetLayer(datasource_id)
 	if err != nil {
-		message := fmt.Sprintf(" %v %v [500]", r.Method, r.URL.Path)
-		NetworkLogger.Critical(r.RemoteAddr, message)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
-
-	// Return layer json
-	SendJsonResponse(w, r, js)
+	return lyr.MarshalJSON()
 }
 
-// DeleteLayerHandler deletes layer from database and removes it from customer list.
+// deleteLayer deletes layer from database and removes it from the owner's list.
+// Only the layer owner can delete it, collaborators lose access.
+// If-Match header is checked against the layer ETag.
 // @param ds
 // @param apikey
 // @return json
-func DeleteLayerHandler(w http.ResponseWriter, r *http.Request) {
-	NetworkLogger.Debug("[In] ", r)
-
-	// Get ds from url path
-	vars := mux.Vars(r)
-	ds := vars["ds"]
-
-	apikey := GetApikeyFromRequest(w, r)
-	if apikey == "" {
-		return
+func deleteLayer(ctx *OperationContext) (interface{}, error) {
+	ds := ctx.Datasource()
+	err := ctx.checkOwner(ds)
+	if err != nil {
+		return nil, err
 	}
 
-	customer, err := GetCustomerFromDatabase(w, r, apikey)
+	// Check layer precondition
+	js, err := marshalLayer(ds)
 	if err != nil {
-		return
+		return nil, err
 	}
-
-	if !CheckCustomerForDatasource(w, r, customer, ds) {
-		return
+	if "" != ctx.IfMatch && !etagMatches(ctx.IfMatch, LayerETag(js)) {
+		return nil, ErrPreconditionFailed
 	}
 
-	// Delete layer from customer
-	i := utils.SliceIndex(ds, customer.Datasources)
-	customer.Datasources = append(customer.Datasources[:i], customer.Datasources[i+1:]...)
-	DB.InsertCustomer(customer)
+	// Delete layer from owner, superusers delete layers of any owner
+	owner := ctx.Customer
+	shares, err := DB.GetDatasourceShares(ds)
+	if err == nil && "" != shares.Owner && owner.Id != shares.Owner {
+		owner, err = DB.GetCustomerById(shares.Owner)
+	}
+	if err != nil {
+		ServerLogger.Error(err)
+	} else if utils.StringInSlice(ds, owner.Datasources) {
+		DB.InsertCustomer(owner.removeDatasource(ds))
+	}
 
 	// Delete layer from database
 	err = DB.DeleteLayer(ds)
 	if err != nil {
-		message := fmt.Sprintf(" %v %v [500]", r.Method, r.URL.Path)
-		NetworkLogger.Critical(r.RemoteAddr, message)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
+	}
+
+	// Revoke access of collaborators
+	err = DB.deleteDatasourceShares(ds)
+	if err != nil {
+		ServerLogger.Error(err)
 	}
 
-	// Generate message
-	data := HttpMessageResponse{Status: "success", Datasource: ds, Data: "datasource deleted"}
-	js, err := MarshalJsonFromStruct(w, r, data)
+	// Drop style and rendered tiles
+	err = DB.DeleteLayerStyle(ds)
 	if err != nil {
-		return
+		ServerLogger.Error(err)
 	}
 
-	// Returns results
-	SendJsonResponse(w, r, js)
+	// Drop webhooks with their pending deliveries, and geofences
+	err = DB.deleteDatasourceWebhooks(ds)
+	if err != nil {
+		ServerLogger.Error(err)
+	}
+	err = DB.deleteDatasourceGeofences(ds)
+	if err != nil {
+		ServerLogger.Error(err)
+	}
+	return "datasource deleted", nil
 }
@@ -0,0 +1,179 @@
+package gospatial
+
+import (
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/paulmach/go.geojson"
+)
+
+// Style limits in pixels, rendered tiles draw features this far beyond
+// their borders
+const (
+	STYLE_MAX_STROKE_WIDTH float64 = 16
+	STYLE_MAX_POINT_RADIUS float64 = 32
+)
+
+// ColorStop is the color of a property value in a color ramp
+type ColorStop struct {
+	Value float64 `json:"value"`
+	Color string  `json:"color"`
+}
+
+// ColorRamp colors features by a numeric property, interpolating between
+// the colors of the stops
+type ColorRamp struct {
+	Property string      `json:"property"`
+	Stops    []ColorStop `json:"stops"`
+}
+
+// LayerStyle is how rendered tiles draw the features of a layer. Colors
+// are given as #rgb, #rrggbb or #rrggbbaa. The ramp colors polygon and
+// point fills and line strokes of features with its property.
+type LayerStyle struct {
+	Fill        string     `json:"fill"`
+	Stroke      string     `json:"stroke"`
+	StrokeWidth float64    `json:"stroke_width"`
+	PointRadius float64    `json:"point_radius"`
+	Ramp        *ColorRamp `json:"ramp,omitempty"`
+}
+
+// DefaultLayerStyle is used for layers without a style
+var DefaultLayerStyle = LayerStyle{Fill: "#3388ff66", Stroke: "#3388ff", StrokeWidth: 2, PointRadius: 4}
+
+// parseColor parses #rgb, #rrggbb or #rrggbbaa color
+// @param value {string}
+// @returns color.NRGBA
+// @returns Error
+func parseColor(value string) (color.NRGBA, error) {
+	hex := strings.TrimPrefix(value, "#")
+	if 3 == len(hex) {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if 6 == len(hex) {
+		hex += "ff"
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil || 8 != len(hex) || !strings.HasPrefix(value, "#") {
+		return color.NRGBA{}, fmt.Errorf("invalid color: %v", value)
+	}
+	return color.NRGBA{uint8(v >> 24), uint8(v >> 16), uint8(v >> 8), uint8(v)}, nil
+}
+
+// Validate checks colors and sizes of style, and sorts ramp stops by value
+// @returns Error
+func (self *LayerStyle) Validate() error {
+	for _, value := range []string{self.Fill, self.Stroke} {
+		if _, err := parseColor(value); err != nil {
+			return err
+		}
+	}
+	if self.StrokeWidth < 0 || self.StrokeWidth > STYLE_MAX_STROKE_WIDTH {
+		return fmt.Errorf("stroke_width must be between 0 and %v", STYLE_MAX_STROKE_WIDTH)
+	}
+	if self.PointRadius < 0 || self.PointRadius > STYLE_MAX_POINT_RADIUS {
+		return fmt.Errorf("point_radius must be between 0 and %v", STYLE_MAX_POINT_RADIUS)
+	}
+	if nil != self.Ramp {
+		if "" == self.Ramp.Property || len(self.Ramp.Stops) < 2 {
+			return fmt.Errorf("ramp requires property and at least 2 stops")
+		}
+		for _, stop := range self.Ramp.Stops {
+			if _, err := parseColor(stop.Color); err != nil {
+				return err
+			}
+		}
+		sort.SliceStable(self.Ramp.Stops, func(i, j int) bool {
+			return self.Ramp.Stops[i].Value < self.Ramp.Stops[j].Value
+		})
+	}
+	return nil
+}
+
+// featureColor returns ramp color of feature, or base color when the
+// style has no ramp or the feature no numeric ramp property
+func (self LayerStyle) featureColor(feat *geojson.Feature, base color.NRGBA) color.NRGBA {
+	if nil == self.Ramp {
+		return base
+	}
+	value, ok := feat.Properties[self.Ramp.Property].(float64)
+	if !ok {
+		return base
+	}
+	stops := self.Ramp.Stops
+	i := sort.Search(len(stops), func(i int) bool { return stops[i].Value >= value })
+	if 0 == i {
+		c, _ := parseColor(stops[0].Color)
+		return c
+	}
+	if len(stops) == i {
+		c, _ := parseColor(stops[len(stops)-1].Color)
+		return c
+	}
+	from, _ := parseColor(stops[i-1].Color)
+	to, _ := parseColor(stops[i].Color)
+	t := (value - stops[i-1].Value) / (stops[i].Value - stops[i-1].Value)
+	lerp := func(a, b uint8) uint8 {
+		return uint8(float64(a) + (float64(b)-float64(a))*t + 0.5)
+	}
+	return color.NRGBA{lerp(from.R, to.R), lerp(from.G, to.G), lerp(from.B, to.B), lerp(from.A, to.A)}
+}
+
+// InsertLayerStyle sets style of layer
+// @param datasource {string}
+// @param style {LayerStyle}
+// @returns Error
+func (self *Database) InsertLayerStyle(datasource_id string, style LayerStyle) error {
+	err := style.Validate()
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(style)
+	if err != nil {
+		return err
+	}
+	err = self.Insert("styles", datasource_id, value)
+	if err != nil {
+		return err
+	}
+	RasterTiles.Invalidate(datasource_id, nil)
+	return nil
+}
+
+// GetLayerStyle returns style of layer, the default style if none was set
+// @param datasource {string}
+// @returns LayerStyle
+// @returns Error
+func (self *Database) GetLayerStyle(datasource_id string) (LayerStyle, error) {
+	style := DefaultLayerStyle
+	value, err := self.Select("styles", datasource_id)
+	if err != nil || 0 == len(value) {
+		return style, err
+	}
+	err = json.Unmarshal(value, &style)
+	return style, err
+}
+
+// DeleteLayerStyle resets layer to the default style
+// @param datasource {string}
+// @returns Error
+func (self *Database) DeleteLayerStyle(datasource_id string) error {
+	conn := self.Connect()
+	defer conn.Close()
+	err := conn.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("styles"))
+		if bucket == nil {
+			return fmt.Errorf("Bucket styles not found!")
+		}
+		return bucket.Delete([]byte(datasource_id))
+	})
+	RasterTiles.Invalidate(datasource_id, nil)
+	return err
+}
@@ -0,0 +1,161 @@
+package gospatial
+
+import (
+	"time"
+)
+
+// Time an advisory feature lock is held unless renewed
+var FEATURE_LOCK_TIMEOUT time.Duration = 5 * time.Minute
+
+// FeatureLock is an advisory edit lock on a feature, held by one websocket
+// client. While it is held, feature edits without the client's lock token
+// are refused, including edits with the same apikey.
+type FeatureLock struct {
+	Datasource string `json:"datasource"`
+	GeoId      string `json:"geo_id"`
+	Owner      string `json:"-"`
+	User       string `json:"user"`
+	Client     uint64 `json:"client"`
+	Expires    int64  `json:"expires"`
+}
+
+// lockHolder returns the editor id of the websocket client holding lock_token
+// @param customer_id {string}
+// @param lock_token {string}
+// @returns string
+func lockHolder(customer_id string, lock_token string) string {
+	return customer_id + "/" + lock_token
+}
+
+func featureLockKey(datasource_id string, geo_id string) string {
+	return datasource_id + "/" + geo_id
+}
+
+// activeLock returns unexpired lock on feature. Expired locks are removed.
+// Must be called while holding lock_guard.
+func (self *Database) activeLock(datasource_id string, geo_id string) (FeatureLock, bool) {
+	key := featureLockKey(datasource_id, geo_id)
+	lock, ok := self.locks[key]
+	if ok && lock.Expires <= time.Now().Unix() {
+		delete(self.locks, key)
+		return lock, false
+	}
+	return lock, ok
+}
+
+// LockFeature claims or renews advisory edit lock on feature.
+// Fails with ErrFeatureLocked and the current lock if another client holds it.
+// @param datasource {string}
+// @param geo_id {string}
+// @param owner {string} lock holder id of the client claiming the lock
+// @param user {string} lock holder shown to other viewers
+// @param client {uint64} websocket connection id
+// @returns FeatureLock
+// @returns Error
+func (self *Database) LockFeature(datasource_id string, geo_id string, owner string, user string, client uint64) (FeatureLock, error) {
+	_, err := self.GetFeature(datasource_id, geo_id)
+	if err != nil {
+		return FeatureLock{}, err
+	}
+
+	self.lock_guard.Lock()
+	defer self.lock_guard.Unlock()
+
+	if lock, ok := self.activeLock(datasource_id, geo_id); ok && owner != lock.Owner {
+		return lock, ErrFeatureLocked
+	}
+
+	if nil == self.locks {
+		self.locks = make(map[string]FeatureLock)
+	}
+	lock := FeatureLock{
+		Datasource: datasource_id,
+		GeoId:      geo_id,
+		Owner:      owner,
+		User:       user,
+		Client:     client,
+		Expires:    time.Now().Add(FEATURE_LOCK_TIMEOUT).Unix(),
+	}
+	self.locks[featureLockKey(datasource_id, geo_id)] = lock
+	return lock, nil
+}
+
+// UnlockFeature releases advisory edit lock on feature.
+// Fails with ErrFeatureLocked if another client holds it and with
+// ErrFeatureUnlocked if it is not locked.
+// @param datasource {string}
+// @param geo_id {string}
+// @param owner {string} lock holder id of the client releasing the lock
+// @returns Error
+func (self *Database) UnlockFeature(datasource_id string, geo_id string, owner string) error {
+	self.lock_guard.Lock()
+	defer self.lock_guard.Unlock()
+
+	lock, ok := self.activeLock(datasource_id, geo_id)
+	if !ok {
+		return ErrFeatureUnlocked
+	}
+	if owner != lock.Owner {
+		return ErrFeatureLocked
+	}
+	delete(self.locks, featureLockKey(datasource_id, geo_id))
+	return nil
+}
+
+// ReleaseClientLocks releases all locks claimed by websocket connection
+// @param client {uint64}
+// @returns []FeatureLock released locks
+func (self *Database) ReleaseClientLocks(client uint64) []FeatureLock {
+	self.lock_guard.Lock()
+	defer self.lock_guard.Unlock()
+
+	released := []FeatureLock{}
+	for key, lock := range self.locks {
+		if client == lock.Client {
+			delete(self.locks, key)
+			released = append(released, lock)
+		}
+	}
+	return released
+}
+
+// FeatureLocks returns the active locks on datasource features
+// @param datasource {string}
+// @returns []FeatureLock
+func (self *Database) FeatureLocks(datasource_id string) []FeatureLock {
+	self.lock_guard.Lock()
+	defer self.lock_guard.Unlock()
+
+	locks := []FeatureLock{}
+	for _, lock := range self.locks {
+		if datasource_id != lock.Datasource {
+			continue
+		}
+		if lock, ok := self.activeLock(lock.Datasource, lock.GeoId); ok {
+			locks = append(locks, lock)
+		}
+	}
+	return locks
+}
+
+// checkFeatureLock returns ErrFeatureLocked if feature is locked by
+// a client other than editor. An empty editor is the superuser and
+// is not subject to locks.
+func (self *Database) checkFeatureLock(datasource_id string, geo_id string, editor string) error {
+	if "" == editor {
+		return nil
+	}
+	self.lock_guard.Lock()
+	defer self.lock_guard.Unlock()
+	if lock, ok := self.activeLock(datasource_id, geo_id); ok && editor != lock.Owner {
+		return ErrFeatureLocked
+	}
+	return nil
+}
+
+// removeFeatureLock drops lock on deleted feature
+func (self *Database) removeFeatureLock(datasource_id string, geo_id string) {
+	self.lock_guard.Lock()
+	delete(self.locks, featureLockKey(datasource_id, geo_id))
+	self.lock_guard.Unlock()
+}
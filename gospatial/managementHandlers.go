@@ -1,8 +1,10 @@
 package gospatial
 
 import (
+	"bytes"
 	"encoding/json"
-	"net/http"
+	"io/ioutil"
+	"os"
 	"runtime"
 	"time"
 )
@@ -11,91 +13,149 @@ import (
 	"./utils"
 )
 
-// PingHandler provides an api route for server health check
-func PingHandler(w http.ResponseWriter, r *http.Request) {
-	NetworkLogger.Debug("[In] ", r)
-
-	var data map[string]interface{}
-	data = make(map[string]interface{})
-	data["status"] = "success"
+// ping provides an operation for server health check
+func ping(ctx *OperationContext) (interface{}, error) {
 	result := make(map[string]interface{})
 	result["result"] = "pong"
+	result["version"] = VERSION
 	result["registered"] = startTime.UTC()
 	result["uptime"] = time.Since(startTime).Seconds()
 	result["num_cores"] = runtime.NumCPU()
-	data["data"] = result
+	return result, nil
+}
 
-	js, err := MarshalJsonFromStruct(w, r, data)
+// createApikey superuser operation to create new api customers/apikeys.
+// Optional data sets the scopes of the new apikey on datasources,
+// e.g. {"scopes": {"<ds>": ["read"]}} for a read-only key.
+func createApikey(ctx *OperationContext) (interface{}, error) {
+	data := ctx.Request.Data
+	customer := Customer{Datasources: data.Datasources, Scopes: data.Scopes}
+	err := customer.normalizeScopes()
 	if err != nil {
-		return
+		return nil, validationFailed(err)
 	}
-
-	SendJsonResponse(w, r, js)
+	customer.Apikey = utils.NewAPIKey(12)
+	err = DB.InsertCustomer(customer)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"apikey": customer.Apikey}, nil
 }
 
-// NewCustomerHandler superuser route to create new api customers/apikeys
-func NewCustomerHandler(w http.ResponseWriter, r *http.Request) {
-	NetworkLogger.Debug("[In] ", r)
-
-	// Check auth key
-	if !CheckAuthKey(w, r) {
-		return
+// insertApikey superuser operation to add customer with a given apikey
+func insertApikey(ctx *OperationContext) (interface{}, error) {
+	data := ctx.Request.Data
+	if "" == data.Apikey {
+		return nil, ErrMissingParameters
 	}
-
-	// new customer
-	apikey := utils.NewAPIKey(12)
-	customer := Customer{Apikey: apikey}
-	err := DB.InsertCustomer(customer)
+	customer := Customer{Apikey: data.Apikey, Datasources: data.Datasources, Scopes: data.Scopes}
+	err := customer.normalizeScopes()
 	if err != nil {
-		ServerLogger.Error(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, validationFailed(err)
 	}
-
-	data := HttpMessageResponse{Status: "success", Apikey: apikey, Data: "customer created"}
-	js, err := MarshalJsonFromStruct(w, r, data)
+	err = DB.InsertCustomer(customer)
 	if err != nil {
-		return
+		return nil, err
 	}
-
-	SendJsonResponse(w, r, js)
+	return map[string]string{"apikey": data.Apikey}, nil
 }
 
-// Pull all customer datasource pairs
+// exportCustomers pulls all customer datasource pairs
 // Distributed System
-func AllCustomerDatasources(w http.ResponseWriter, r *http.Request) {
+func exportCustomers(ctx *OperationContext) (interface{}, error) {
 	results := []Customer{}
-
-	if !CheckAuthKey(w, r) {
-		return
-	}
-
-	customers, err := DB.SelectAll("apikeys")
+	customers, err := DB.SelectAll("customers")
 	if err != nil {
-		ServerLogger.Error(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
-
 	for _, v := range customers {
-		val, err := DB.Select("apikeys", v)
+		val, err := DB.Select("customers", v)
 		if err != nil {
-			ServerLogger.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return nil, err
 		}
 		customer := Customer{}
 		err = json.Unmarshal(val, &customer)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 		results = append(results, customer)
 	}
+	return results, nil
+}
+
+// assignDatasource gives customer of apikey access to datasource.
+// Scopes in data limit access, full access when not given.
+func assignDatasource(ctx *OperationContext) (interface{}, error) {
+	datasource_id := ctx.Datasource()
+	if "" == datasource_id || "" == ctx.Request.Apikey {
+		return nil, ErrMissingParameters
+	}
 
-	js, err := MarshalJsonFromStruct(w, r, results)
+	err := ctx.loadCustomer()
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	SendJsonResponse(w, r, js)
+	_, err = DB.GetLayer(datasource_id)
+	if err != nil {
+		return nil, err
+	}
+
+	scopes := ctx.Request.Data.Scopes[datasource_id]
+	if nil != scopes {
+		err = ValidateScopes(scopes)
+		if err != nil {
+			return nil, validationFailed(err)
+		}
+	}
+
+	customer := ctx.Customer
+	if !utils.StringInSlice(datasource_id, customer.Datasources) {
+		customer.Datasources = append(customer.Datasources, datasource_id)
+	}
+	err = DB.InsertCustomer(customer.setScopes(datasource_id, scopes))
+	if err != nil {
+		return nil, err
+	}
+	return "datasource assigned", nil
+}
+
+// decodeImportUpload writes http request body, a GeoJSON FeatureCollection,
+// to a temporary file imported in place of the tcp file param. Http
+// requests do not name files on the server.
+func decodeImportUpload(body []byte, req *TcpMessage) error {
+	if 0 == len(bytes.TrimSpace(body)) {
+		return nil
+	}
+	file, err := ioutil.TempFile("", "import-*.geojson")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(body)
+	file.Close()
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	req.File = file.Name()
+	req.upload = true
+	return nil
+}
+
+// importFile imports geojson or shapefile on the server as a new layer.
+// Over http the geojson is uploaded as request body.
+// @param file
+// @return json
+func importFile(ctx *OperationContext) (interface{}, error) {
+	if "" == ctx.Request.File {
+		return nil, ErrMissingParameters
+	}
+	if ctx.Request.upload {
+		defer os.Remove(ctx.Request.File)
+	}
+	ds, err := importDatasource(ctx.Request.File)
+	if err != nil {
+		return nil, validationFailed(err)
+	}
+	return map[string]string{"datasource": ds}, nil
 }
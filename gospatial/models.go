@@ -1,18 +1,34 @@
 package gospatial
 
+import (
+	"encoding/json"
+)
+
 import "github.com/paulmach/go.geojson"
 
-// Customer structure for database
+// Customer structure for database. Apikey is the key the customer was
+// loaded with and is never stored, customers are stored by Id.
 type Customer struct {
-	Apikey      string      `json:"apikey"`
-	Datasources []string    `json:"datasources"`
-	TileLayers  []TileLayer `json:"tilelayers"`
+	Id          string              `json:"id"`
+	Apikey      string              `json:"apikey,omitempty"`
+	Datasources []string            `json:"datasources"`
+	Scopes      map[string][]string `json:"scopes,omitempty"`
+	TileLayers  []TileLayer         `json:"tilelayers"`
 	// TileLayers  map[string]string  `json:"tilelayers"`
 }
 
+// TileLayer is a basemap or overlay of customer. Datasource is set for
+// the rendered tiles of a layer, Tileset for uploaded MBTiles. Proxied
+// tile layers are served through the tile proxy, which caches their
+// tiles for ProxyTtl seconds.
 type TileLayer struct {
-	Url  string `json:"url"`
-	Name string `json:"name"`
+	Id         string `json:"id,omitempty"`
+	Url        string `json:"url"`
+	Name       string `json:"name"`
+	Datasource string `json:"datasource,omitempty"`
+	Tileset    string `json:"tileset,omitempty"`
+	Proxy      bool   `json:"proxy,omitempty"`
+	ProxyTtl   int    `json:"proxy_ttl,omitempty"`
 }
 
 // MapData for html templates
@@ -22,26 +38,69 @@ type PageViewData struct {
 }
 
 type TcpData struct {
-	Apikey      string                     `json:"apikey"`
-	Datasources []string                   `json:"datasources"`
-	Datasource  string                     `json:"datasource"`
-	Layer       *geojson.FeatureCollection `json:"layer"`
-	Feature     *geojson.Feature           `json:"feature"`
-	GeoId       string                     `json:"geo_id"`
+	Apikey          string                     `json:"apikey"`
+	Datasources     []string                   `json:"datasources"`
+	Datasource      string                     `json:"datasource"`
+	Layer           *geojson.FeatureCollection `json:"layer"`
+	Feature         *geojson.Feature           `json:"feature"`
+	GeoId           string                     `json:"geo_id"`
+	ExpectedVersion *int                       `json:"expected_version"`
+	LockToken       string                     `json:"lock_token"`
+	Reports         []PositionReport           `json:"reports"`
+	Scopes          map[string][]string        `json:"scopes"`
+	Requests        []TcpMessage               `json:"requests"`
+	Role            string                     `json:"role"`
+	Collaborator    string                     `json:"collaborator"`
+	WebhookId       string                     `json:"webhook_id"`
+	Webhook         *Webhook                   `json:"webhook"`
+	Geofences       *GeofenceSet               `json:"geofences"`
+	Since           int64                      `json:"since"`
+	Limit           int                        `json:"limit"`
+	Sync            *SyncRequest               `json:"sync"`
+	TileLayer       *TileLayer                 `json:"tilelayer"`
+	Style           *LayerStyle                `json:"style"`
+	TilesetId       string                     `json:"tileset_id"`
+	TileLayerId     string                     `json:"tilelayer_id"`
+	Bbox            []float64                  `json:"bbox"`
+	MinZoom         int                        `json:"min_zoom"`
+	MaxZoom         int                        `json:"max_zoom"`
 }
 
+// TcpMessage is a tcp request. Id is optional and echoed in the response.
 type TcpMessage struct {
-	Authkey    string  `json:"authkey"`
-	Apikey     string  `json:"apikey"`
-	Method     string  `json:"method"`
-	Data       TcpData `json:"data"`
-	Datasource string  `json:"datasource"`
-	File       string  `json:"file"`
+	Id         json.RawMessage `json:"id,omitempty"`
+	Authkey    string          `json:"authkey"`
+	Apikey     string          `json:"apikey"`
+	Method     string          `json:"method"`
+	Data       TcpData         `json:"data"`
+	Datasource string          `json:"datasource"`
+	File       string          `json:"file"`
+	// File is a temporary copy of an http upload
+	upload bool
 }
 
+// JSend response status words
+const (
+	// request succeeded, result in data
+	JSEND_SUCCESS string = "success"
+	// request was rejected, error code in data
+	JSEND_FAIL string = "fail"
+	// server failed to process request, error code and message
+	JSEND_ERROR string = "error"
+)
+
+// HttpMessageResponse is the JSend envelope of http and tcp responses
 type HttpMessageResponse struct {
 	Status     string      `json:"status"`
 	Datasource string      `json:"datasource,omitempty"`
 	Apikey     string      `json:"apikey,omitempty"`
 	Data       interface{} `json:"data,omitempty"`
+	Code       string      `json:"code,omitempty"`
+	Message    string      `json:"message,omitempty"`
+}
+
+// TcpResponse is a tcp response with the id of its request
+type TcpResponse struct {
+	Id json.RawMessage `json:"id,omitempty"`
+	HttpMessageResponse
 }
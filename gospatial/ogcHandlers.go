@@ -0,0 +1,486 @@
+package gospatial
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import "github.com/gorilla/mux"
+import "github.com/paulmach/go.geojson"
+
+// OGC API - Features Part 1 settings
+const (
+	// items returned when no limit is requested
+	OGC_DEFAULT_LIMIT int = 10
+	// largest limit, larger limits are clamped
+	OGC_MAX_LIMIT int = 10000
+	// coordinate reference system of all collections
+	OGC_CRS84 string = "http://www.opengis.net/def/crs/OGC/1.3/CRS84"
+)
+
+// conformance classes implemented by the ogc routes
+var ogc_conformance = []string{
+	"http://www.opengis.net/spec/ogcapi-features-1/1.0/conf/core",
+	"http://www.opengis.net/spec/ogcapi-features-1/1.0/conf/oas30",
+	"http://www.opengis.net/spec/ogcapi-features-1/1.0/conf/geojson",
+}
+
+// query params of items requests which are not property filters
+var ogc_reserved_params = []string{"apikey", "bbox", "bbox-crs", "datetime", "f", "limit", "offset"}
+
+// OgcLink is a link of an ogc resource
+type OgcLink struct {
+	Href  string `json:"href"`
+	Rel   string `json:"rel"`
+	Type  string `json:"type,omitempty"`
+	Title string `json:"title,omitempty"`
+}
+
+// OgcCollection describes a datasource as an ogc feature collection
+type OgcCollection struct {
+	Id       string                 `json:"id"`
+	Title    string                 `json:"title"`
+	Links    []OgcLink              `json:"links"`
+	Extent   map[string]interface{} `json:"extent,omitempty"`
+	ItemType string                 `json:"itemType"`
+	Crs      []string               `json:"crs"`
+}
+
+// OgcItem is a feature with its geo_id as id
+type OgcItem struct {
+	Type       string                 `json:"type"`
+	Id         string                 `json:"id"`
+	Geometry   *geojson.Geometry      `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+	Links      []OgcLink              `json:"links,omitempty"`
+}
+
+// OgcItems is a page of the features of a collection
+type OgcItems struct {
+	Type           string    `json:"type"`
+	Features       []OgcItem `json:"features"`
+	Links          []OgcLink `json:"links"`
+	TimeStamp      string    `json:"timeStamp"`
+	NumberMatched  int       `json:"numberMatched"`
+	NumberReturned int       `json:"numberReturned"`
+}
+
+// ogcQuery is the filter and page of an items request
+type ogcQuery struct {
+	Bbox   []float64
+	Start  int64
+	End    int64
+	Time   bool
+	Filter map[string]string
+	Limit  int
+	Offset int
+}
+
+// ogcUrl returns absolute url of ogc path. The apikey is kept on links
+// when it was sent as query param, so clients following links stay
+// authenticated.
+func ogcUrl(r *http.Request, path string, query url.Values) string {
+	if nil == query {
+		query = url.Values{}
+	}
+	if apikey := r.URL.Query().Get("apikey"); "" != apikey {
+		query.Set("apikey", apikey)
+	}
+	href := requestBaseUrl(r) + "/ogc" + path
+	if 0 != len(query) {
+		href += "?" + query.Encode()
+	}
+	return href
+}
+
+// sendOgcResponse sends ogc resource with content type
+func sendOgcResponse(w http.ResponseWriter, r *http.Request, content_type string, data interface{}) {
+	js, err := MarshalJsonFromStruct(w, r, data)
+	if err != nil {
+		return
+	}
+	message := fmt.Sprintf(" %v %v [200]", r.Method, r.URL.Path)
+	NetworkLogger.Info(r.RemoteAddr, message)
+	w.Header().Set("Content-Type", content_type)
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Write(js)
+}
+
+// ogcCustomer returns customer of request apikey, sends error if missing
+func ogcCustomer(w http.ResponseWriter, r *http.Request) (Customer, bool) {
+	apikey := GetApikeyFromRequest(w, r)
+	if apikey == "" {
+		return Customer{}, false
+	}
+	customer, err := GetCustomerFromDatabase(w, r, apikey)
+	return customer, nil == err
+}
+
+// OgcLandingHandler serves the ogc api landing page
+func OgcLandingHandler(w http.ResponseWriter, r *http.Request) {
+	NetworkLogger.Debug("[In] ", redactedRequest(r))
+	sendOgcResponse(w, r, "application/json", map[string]interface{}{
+		"title":       "gospatial",
+		"description": "OGC API - Features of gospatial layers",
+		"links": []OgcLink{
+			{ogcUrl(r, "", nil), "self", "application/json", "this document"},
+			{ogcUrl(r, "/api", nil), "service-desc", "application/vnd.oai.openapi+json;version=3.0", "api definition"},
+			{ogcUrl(r, "/conformance", nil), "conformance", "application/json", "conformance classes"},
+			{ogcUrl(r, "/collections", nil), "data", "application/json", "collections"},
+		},
+	})
+}
+
+// OgcConformanceHandler lists the implemented conformance classes
+func OgcConformanceHandler(w http.ResponseWriter, r *http.Request) {
+	NetworkLogger.Debug("[In] ", redactedRequest(r))
+	sendOgcResponse(w, r, "application/json", map[string]interface{}{"conformsTo": ogc_conformance})
+}
+
+// OgcApiHandler serves the OpenAPI definition of the ogc routes
+func OgcApiHandler(w http.ResponseWriter, r *http.Request) {
+	NetworkLogger.Debug("[In] ", redactedRequest(r))
+	param := func(name string, in string, kind string, required bool) map[string]interface{} {
+		return map[string]interface{}{"name": name, "in": in, "required": required, "schema": map[string]string{"type": kind}}
+	}
+	operation := func(summary string, params ...map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{"get": map[string]interface{}{
+			"summary":    summary,
+			"parameters": append(params, param("apikey", "query", "string", false)),
+			"responses":  map[string]interface{}{"200": map[string]string{"description": summary}},
+		}}
+	}
+	collection_id := param("collectionId", "path", "string", true)
+	server := strings.SplitN(ogcUrl(r, "", nil), "?", 2)[0]
+	sendOgcResponse(w, r, "application/vnd.oai.openapi+json;version=3.0", map[string]interface{}{
+		"openapi": "3.0.0",
+		"info":    map[string]string{"title": "gospatial", "version": VERSION},
+		"servers": []map[string]string{{"url": server}},
+		"components": map[string]interface{}{"securitySchemes": map[string]interface{}{
+			"apikey": map[string]string{"type": "apiKey", "in": "header", "name": "X-Api-Key"},
+		}},
+		"paths": map[string]interface{}{
+			"/":                           operation("landing page"),
+			"/conformance":                operation("conformance classes"),
+			"/collections":                operation("collections of apikey"),
+			"/collections/{collectionId}": operation("collection", collection_id),
+			"/collections/{collectionId}/items/{featureId}": operation("feature", collection_id, param("featureId", "path", "string", true)),
+			"/collections/{collectionId}/items": operation("features", collection_id,
+				param("bbox", "query", "string", false),
+				param("datetime", "query", "string", false),
+				param("limit", "query", "integer", false),
+				param("offset", "query", "integer", false)),
+		},
+	})
+}
+
+// ogcCollection describes datasource as collection
+func ogcCollection(r *http.Request, datasource_id string) (OgcCollection, error) {
+	lyr, err := DB.GetLayer(datasource_id)
+	if err != nil {
+		return OgcCollection{}, err
+	}
+	collection := OgcCollection{
+		Id:    datasource_id,
+		Title: datasource_id,
+		Links: []OgcLink{
+			{ogcUrl(r, "/collections/"+datasource_id, nil), "self", "application/json", "collection"},
+			{ogcUrl(r, "/collections/"+datasource_id+"/items", nil), "items", "application/geo+json", "features"},
+		},
+		ItemType: "feature",
+		Crs:      []string{OGC_CRS84},
+	}
+	if bounds, ok := layerBounds(lyr); ok {
+		collection.Extent = map[string]interface{}{"spatial": map[string]interface{}{"bbox": [][]float64{bounds}, "crs": OGC_CRS84}}
+	}
+	return collection, nil
+}
+
+// OgcCollectionsHandler lists the datasources the apikey may read
+// @param apikey
+func OgcCollectionsHandler(w http.ResponseWriter, r *http.Request) {
+	NetworkLogger.Debug("[In] ", redactedRequest(r))
+	customer, ok := ogcCustomer(w, r)
+	if !ok {
+		return
+	}
+	collections := []OgcCollection{}
+	for _, ds := range customer.Datasources {
+		if !customer.HasScope(ds, SCOPE_READ) {
+			continue
+		}
+		collection, err := ogcCollection(r, ds)
+		if err != nil {
+			// layer deleted since it was assigned
+			continue
+		}
+		collections = append(collections, collection)
+	}
+	sendOgcResponse(w, r, "application/json", map[string]interface{}{
+		"links":       []OgcLink{{ogcUrl(r, "/collections", nil), "self", "application/json", "collections"}},
+		"collections": collections,
+	})
+}
+
+// OgcCollectionHandler describes a datasource of the apikey
+// @param apikey
+// @param ds
+func OgcCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	NetworkLogger.Debug("[In] ", redactedRequest(r))
+	ds := mux.Vars(r)["ds"]
+	customer, ok := ogcCustomer(w, r)
+	if !ok || !CheckCustomerPermission(w, r, customer, ds, SCOPE_READ) {
+		return
+	}
+	collection, err := ogcCollection(r, ds)
+	if err != nil {
+		sendApiError(w, r, err)
+		return
+	}
+	sendOgcResponse(w, r, "application/json", collection)
+}
+
+// parseOgcDatetime parses RFC 3339 date-time or date. Dates span the
+// whole day, so the end of the returned range is the end of the day.
+func parseOgcDatetime(value string) (int64, int64, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.Unix(), t.Unix(), nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid datetime: %v", value)
+	}
+	return t.Unix(), t.AddDate(0, 0, 1).Unix() - 1, nil
+}
+
+// parseOgcQuery reads filter and page of items request
+func parseOgcQuery(r *http.Request) (ogcQuery, error) {
+	query := ogcQuery{Limit: OGC_DEFAULT_LIMIT, Filter: make(map[string]string)}
+	params := r.URL.Query()
+
+	if value := params.Get("limit"); "" != value {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			return query, fmt.Errorf("limit must be a positive integer")
+		}
+		if limit > OGC_MAX_LIMIT {
+			limit = OGC_MAX_LIMIT
+		}
+		query.Limit = limit
+	}
+	if value := params.Get("offset"); "" != value {
+		offset, err := strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			return query, fmt.Errorf("offset must be a non-negative integer")
+		}
+		query.Offset = offset
+	}
+
+	// bbox of 2D or 3D coordinates
+	if value := params.Get("bbox"); "" != value {
+		parts := strings.Split(value, ",")
+		coords := []float64{}
+		for _, part := range parts {
+			coord, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil {
+				return query, fmt.Errorf("invalid bbox: %v", value)
+			}
+			coords = append(coords, coord)
+		}
+		switch len(coords) {
+		case 4:
+			query.Bbox = coords
+		case 6:
+			query.Bbox = []float64{coords[0], coords[1], coords[3], coords[4]}
+		default:
+			return query, fmt.Errorf("bbox must have 4 or 6 numbers")
+		}
+		if query.Bbox[1] > query.Bbox[3] {
+			return query, fmt.Errorf("bbox min is greater than max")
+		}
+	}
+
+	// datetime instant or interval, open ends given as .. or empty
+	if value := params.Get("datetime"); "" != value {
+		query.Time = true
+		query.Start, query.End = math.MinInt64, math.MaxInt64
+		parts := strings.Split(value, "/")
+		if 2 < len(parts) {
+			return query, fmt.Errorf("invalid datetime: %v", value)
+		}
+		var err error
+		if 1 == len(parts) {
+			query.Start, query.End, err = parseOgcDatetime(value)
+			if err != nil {
+				return query, err
+			}
+		} else {
+			if ".." != parts[0] && "" != parts[0] {
+				query.Start, _, err = parseOgcDatetime(parts[0])
+				if err != nil {
+					return query, err
+				}
+			}
+			if ".." != parts[1] && "" != parts[1] {
+				_, query.End, err = parseOgcDatetime(parts[1])
+				if err != nil {
+					return query, err
+				}
+			}
+			if query.Start > query.End {
+				return query, fmt.Errorf("datetime interval start is after end")
+			}
+		}
+	}
+
+	for key := range params {
+		reserved := false
+		for _, param := range ogc_reserved_params {
+			reserved = reserved || param == key
+		}
+		if !reserved {
+			query.Filter[key] = params.Get(key)
+		}
+	}
+	return query, nil
+}
+
+// featureTime returns unix time of feature, the timestamp of position
+// reports or else the time the feature was last modified
+func featureTime(feat *geojson.Feature) (int64, bool) {
+	for _, key := range []string{"timestamp", "date_modified", "date_created"} {
+		switch v := feat.Properties[key].(type) {
+		case float64:
+			return int64(v), true
+		case int64:
+			return v, true
+		case int:
+			return int64(v), true
+		}
+	}
+	return 0, false
+}
+
+// matches checks feature against bbox, datetime and property filters
+func (self ogcQuery) matches(feat *geojson.Feature) bool {
+	for key, value := range self.Filter {
+		if value != fmt.Sprintf("%v", feat.Properties[key]) {
+			return false
+		}
+	}
+	if nil != self.Bbox {
+		bounds, ok := geometryBounds(feat.Geometry)
+		if !ok || bounds[0] > self.Bbox[2] || bounds[2] < self.Bbox[0] || bounds[1] > self.Bbox[3] || bounds[3] < self.Bbox[1] {
+			return false
+		}
+	}
+	if self.Time {
+		t, ok := featureTime(feat)
+		if !ok || t < self.Start || t > self.End {
+			return false
+		}
+	}
+	return true
+}
+
+// ogcFeature returns feature as item
+func ogcFeature(feat *geojson.Feature) OgcItem {
+	return OgcItem{Type: "Feature", Id: fmt.Sprintf("%v", feat.Properties["geo_id"]), Geometry: feat.Geometry, Properties: feat.Properties}
+}
+
+// OgcItemsHandler serves page of the datasource features matching the
+// bbox, datetime and property filters of the request
+// @param apikey
+// @param ds
+// @param bbox minx,miny,maxx,maxy
+// @param datetime RFC 3339 instant or interval
+// @param limit
+// @param offset
+func OgcItemsHandler(w http.ResponseWriter, r *http.Request) {
+	NetworkLogger.Debug("[In] ", redactedRequest(r))
+	ds := mux.Vars(r)["ds"]
+	customer, ok := ogcCustomer(w, r)
+	if !ok || !CheckCustomerPermission(w, r, customer, ds, SCOPE_READ) {
+		return
+	}
+	query, err := parseOgcQuery(r)
+	if err != nil {
+		sendApiError(w, r, validationFailed(err))
+		return
+	}
+	lyr, err := DB.GetLayer(ds)
+	if err != nil {
+		sendApiError(w, r, err)
+		return
+	}
+
+	items := OgcItems{Type: "FeatureCollection", Features: []OgcItem{}, TimeStamp: time.Now().UTC().Format(time.RFC3339)}
+	for _, feat := range lyr.Features {
+		if !query.matches(feat) {
+			continue
+		}
+		if items.NumberMatched >= query.Offset && len(items.Features) < query.Limit {
+			items.Features = append(items.Features, ogcFeature(feat))
+		}
+		items.NumberMatched++
+	}
+	items.NumberReturned = len(items.Features)
+
+	// page links keep the filters of the request
+	page := func(offset int) url.Values {
+		params := url.Values{}
+		for key, values := range r.URL.Query() {
+			params[key] = values
+		}
+		params.Set("limit", strconv.Itoa(query.Limit))
+		params.Set("offset", strconv.Itoa(offset))
+		return params
+	}
+	path := "/collections/" + ds + "/items"
+	items.Links = []OgcLink{
+		{ogcUrl(r, path, page(query.Offset)), "self", "application/geo+json", "this page"},
+		{ogcUrl(r, "/collections/"+ds, nil), "collection", "application/json", "collection"},
+	}
+	if query.Offset+query.Limit < items.NumberMatched {
+		items.Links = append(items.Links, OgcLink{ogcUrl(r, path, page(query.Offset+query.Limit)), "next", "application/geo+json", "next page"})
+	}
+	if 0 < query.Offset {
+		prev := query.Offset - query.Limit
+		if prev < 0 {
+			prev = 0
+		}
+		items.Links = append(items.Links, OgcLink{ogcUrl(r, path, page(prev)), "prev", "application/geo+json", "previous page"})
+	}
+	sendOgcResponse(w, r, "application/geo+json", items)
+}
+
+// OgcItemHandler serves a feature of the datasource by geo_id
+// @param apikey
+// @param ds
+// @param k geo_id
+func OgcItemHandler(w http.ResponseWriter, r *http.Request) {
+	NetworkLogger.Debug("[In] ", redactedRequest(r))
+	vars := mux.Vars(r)
+	ds := vars["ds"]
+	customer, ok := ogcCustomer(w, r)
+	if !ok || !CheckCustomerPermission(w, r, customer, ds, SCOPE_READ) {
+		return
+	}
+	feat, err := DB.GetFeature(ds, vars["k"])
+	if err != nil {
+		sendApiError(w, r, err)
+		return
+	}
+	item := ogcFeature(feat)
+	item.Links = []OgcLink{
+		{ogcUrl(r, "/collections/"+ds+"/items/"+vars["k"], nil), "self", "application/geo+json", "feature"},
+		{ogcUrl(r, "/collections/"+ds, nil), "collection", "application/json", "collection"},
+	}
+	w.Header().Set("ETag", FeatureETag(feat))
+	sendOgcResponse(w, r, "application/geo+json", item)
+}
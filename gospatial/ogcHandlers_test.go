@@ -0,0 +1,146 @@
+package gospatial
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+import "github.com/paulmach/go.geojson"
+
+const testOgcApikey = "testOgcKey"
+
+// getOgc requests ogc path and decodes json response
+func getOgc(t *testing.T, server *httptest.Server, path string, result interface{}) *http.Response {
+	resp, err := http.Get(server.URL + "/ogc" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if nil != result {
+		json.NewDecoder(resp.Body).Decode(result)
+	}
+	return resp
+}
+
+func TestOgcLandingAndConformance(t *testing.T) {
+	server := httptest.NewServer(Router())
+	defer server.Close()
+
+	landing := struct{ Links []OgcLink }{}
+	getOgc(t, server, "", &landing)
+	rels := map[string]bool{}
+	for _, link := range landing.Links {
+		rels[link.Rel] = strings.HasPrefix(link.Href, server.URL+"/ogc")
+	}
+	for _, rel := range []string{"self", "service-desc", "conformance", "data"} {
+		if !rels[rel] {
+			t.Errorf("Expected %v link: %v", rel, landing.Links)
+		}
+	}
+
+	conformance := struct{ ConformsTo []string }{}
+	getOgc(t, server, "/conformance", &conformance)
+	if 3 != len(conformance.ConformsTo) {
+		t.Errorf("Expected conformance classes: %v", conformance)
+	}
+}
+
+func TestOgcCollections(t *testing.T) {
+	server := httptest.NewServer(Router())
+	defer server.Close()
+	ds, _ := DB.NewLayer()
+	other, _ := DB.NewLayer()
+	DB.InsertFeature(ds, geojson.NewPointFeature([]float64{-76.6, 39.3}))
+	DB.InsertCustomer(Customer{Apikey: testOgcApikey, Datasources: []string{ds}})
+
+	if resp := getOgc(t, server, "/collections", nil); http.StatusUnauthorized != resp.StatusCode {
+		t.Errorf("Expected apikey required: %v", resp.StatusCode)
+	}
+
+	collections := struct{ Collections []OgcCollection }{}
+	getOgc(t, server, "/collections?apikey="+testOgcApikey, &collections)
+	if 1 != len(collections.Collections) || ds != collections.Collections[0].Id {
+		t.Fatalf("Expected datasource of apikey: %v", collections)
+	}
+	// links keep the apikey
+	if !strings.Contains(collections.Collections[0].Links[1].Href, "apikey="+testOgcApikey) {
+		t.Errorf("Expected apikey on links: %v", collections.Collections[0].Links)
+	}
+	if nil == collections.Collections[0].Extent {
+		t.Errorf("Expected extent: %v", collections.Collections[0])
+	}
+
+	if resp := getOgc(t, server, "/collections/"+other+"?apikey="+testOgcApikey, nil); http.StatusUnauthorized != resp.StatusCode {
+		t.Errorf("Expected other datasource unauthorized: %v", resp.StatusCode)
+	}
+}
+
+func TestOgcItems(t *testing.T) {
+	server := httptest.NewServer(Router())
+	defer server.Close()
+	ds, _ := DB.NewLayer()
+	DB.InsertCustomer(Customer{Apikey: testOgcApikey, Datasources: []string{ds}})
+	for i, name := range []string{"a", "b", "a"} {
+		feat := geojson.NewPointFeature([]float64{float64(i), float64(i)})
+		feat.Properties["name"] = name
+		DB.InsertFeature(ds, feat)
+	}
+	items_path := "/collections/" + ds + "/items?apikey=" + testOgcApikey
+
+	items := OgcItems{}
+	resp := getOgc(t, server, items_path+"&limit=2", &items)
+	if "application/geo+json" != resp.Header.Get("Content-Type") {
+		t.Errorf("Expected geojson: %v", resp.Header)
+	}
+	if 3 != items.NumberMatched || 2 != items.NumberReturned || "" == items.Features[0].Id {
+		t.Fatalf("Expected first page: %v", items)
+	}
+	next := ""
+	for _, link := range items.Links {
+		if "next" == link.Rel {
+			next = link.Href
+		}
+	}
+	if !strings.Contains(next, "offset=2") {
+		t.Fatalf("Expected next link: %v", items.Links)
+	}
+	if resp = getOgc(t, server, strings.TrimPrefix(next, server.URL+"/ogc"), &items); 1 != items.NumberReturned {
+		t.Errorf("Expected last page: %v", items)
+	}
+
+	getOgc(t, server, items_path+"&bbox=0.5,0.5,2.5,2.5", &items)
+	if 2 != items.NumberMatched {
+		t.Errorf("Expected features in bbox: %v", items)
+	}
+	getOgc(t, server, items_path+"&name=a", &items)
+	if 2 != items.NumberMatched {
+		t.Errorf("Expected property filter: %v", items)
+	}
+	today := time.Now().UTC().Format("2006-01-02")
+	getOgc(t, server, items_path+"&datetime="+today+"/..", &items)
+	if 3 != items.NumberMatched {
+		t.Errorf("Expected features modified today: %v", items)
+	}
+	getOgc(t, server, items_path+"&datetime=../2000-01-01T00:00:00Z", &items)
+	if 0 != items.NumberMatched {
+		t.Errorf("Expected no features before 2000: %v", items)
+	}
+	if resp = getOgc(t, server, items_path+"&bbox=1,2,3", nil); http.StatusBadRequest != resp.StatusCode {
+		t.Errorf("Expected invalid bbox: %v", resp.StatusCode)
+	}
+
+	// item by geo_id
+	getOgc(t, server, items_path+"&limit=1", &items)
+	item := OgcItem{}
+	getOgc(t, server, "/collections/"+ds+"/items/"+items.Features[0].Id+"?apikey="+testOgcApikey, &item)
+	if items.Features[0].Id != item.Id || 2 != len(item.Links) {
+		t.Errorf("Expected item: %v", item)
+	}
+	if resp = getOgc(t, server, "/collections/"+ds+"/items/missing?apikey="+testOgcApikey, nil); http.StatusNotFound != resp.StatusCode {
+		t.Errorf("Expected item not found: %v", resp.StatusCode)
+	}
+}
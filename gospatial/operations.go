@@ -0,0 +1,386 @@
+package gospatial
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+import (
+	"./utils"
+)
+
+import "github.com/gorilla/mux"
+
+// Operation access levels
+const (
+	// anyone
+	ACCESS_PUBLIC string = "public"
+	// apikey of a customer
+	ACCESS_CUSTOMER string = "customer"
+	// apikey with the operation scope on the datasource, superusers, and
+	// operators for read scope
+	ACCESS_DATASOURCE string = "datasource"
+	// operator or superuser authkey
+	ACCESS_OPERATOR string = "operator"
+	// superuser authkey
+	ACCESS_SUPERUSER string = "superuser"
+)
+
+// Operation is an api method served by both the http router and the tcp
+// server. Http routes are given as "<METHOD> <pattern>", url path
+// variables and query params are mapped to the tcp request fields.
+type Operation struct {
+	Method string
+	Http   []string
+	Access string
+	Scope  string
+	Params []TcpParam
+	// decodes http request body into the request
+	body func([]byte, *TcpMessage) error
+	// http response is the result itself instead of a HttpMessageResponse
+	raw bool
+	run func(*OperationContext) (interface{}, error)
+}
+
+// OperationContext is an operation request and the principal making it
+type OperationContext struct {
+	Request TcpMessage
+	// role of tcp connection or http authkey
+	Role string
+	// customer of request apikey, loaded when access is checked
+	Customer Customer
+	// If-Match header of http requests
+	IfMatch string
+	// X-Lock-Token header of http requests
+	LockToken string
+	// entity tag of the result, sent as http ETag header
+	ETag   string
+	loaded bool
+}
+
+// Datasource returns datasource of request, given as datasource or data.datasource
+func (self *OperationContext) Datasource() string {
+	if "" != self.Request.Datasource {
+		return self.Request.Datasource
+	}
+	return self.Request.Data.Datasource
+}
+
+// loadCustomer loads customer of request apikey
+func (self *OperationContext) loadCustomer() error {
+	if self.loaded {
+		return nil
+	}
+	if "" == self.Request.Apikey {
+		return ErrUnauthorized
+	}
+	customer, err := DB.GetCustomer(self.Request.Apikey)
+	if err != nil {
+		return NewApiError(ERROR_NOT_FOUND, err.Error())
+	}
+	self.Customer = customer
+	self.loaded = true
+	return nil
+}
+
+// checkRole checks role is at least the required role
+func (self *OperationContext) checkRole(required string) error {
+	if tcpRoleAllows(self.Role, required) {
+		return nil
+	}
+	if TCP_ROLE_NONE == self.Role {
+		return ErrUnauthorized
+	}
+	return ErrPermissionDenied
+}
+
+// CheckDatasource checks request is allowed scope on datasource.
+// Returns 401 if the apikey has no access to the datasource and 403 if
+// its scopes do not include the requested action.
+// @param datasource {string}
+// @param scope {string}
+// @returns Error
+func (self *OperationContext) CheckDatasource(datasource_id string, scope string) error {
+	if "" == datasource_id {
+		return ErrMissingParameters
+	}
+	if TCP_ROLE_SUPERUSER == self.Role || (TCP_ROLE_OPERATOR == self.Role && SCOPE_READ == scope) {
+		return nil
+	}
+	err := self.loadCustomer()
+	if err != nil {
+		return err
+	}
+	if !utils.StringInSlice(datasource_id, self.Customer.Datasources) {
+		return ErrUnauthorized
+	}
+	if !self.Customer.HasScope(datasource_id, scope) {
+		return NewApiError(ERROR_FORBIDDEN, "apikey requires "+scope+" scope")
+	}
+	return nil
+}
+
+// checkOwner checks request apikey owns datasource. Superusers may
+// manage every datasource.
+func (self *OperationContext) checkOwner(datasource_id string) error {
+	if TCP_ROLE_SUPERUSER == self.Role {
+		return nil
+	}
+	err := self.loadCustomer()
+	if err != nil {
+		return err
+	}
+	if !DB.IsDatasourceOwner(datasource_id, self.Customer) {
+		return ErrNotOwner
+	}
+	return nil
+}
+
+// authorize checks request is allowed to run operation
+func (self *OperationContext) authorize(op Operation) error {
+	switch op.Access {
+	case ACCESS_PUBLIC:
+		return nil
+	case ACCESS_CUSTOMER:
+		return self.loadCustomer()
+	case ACCESS_DATASOURCE:
+		return self.CheckDatasource(self.Datasource(), op.Scope)
+	case ACCESS_OPERATOR:
+		return self.checkRole(TCP_ROLE_OPERATOR)
+	}
+	return self.checkRole(TCP_ROLE_SUPERUSER)
+}
+
+// findOperation returns operation of tcp method
+func findOperation(method string) (Operation, bool) {
+	for _, op := range operations {
+		if method == op.Method {
+			return op, true
+		}
+	}
+	return Operation{}, false
+}
+
+// operationRoutes returns the http routes of the operations
+func operationRoutes() apiRoutes {
+	op_routes := apiRoutes{}
+	for _, op := range operations {
+		for _, route := range op.Http {
+			parts := strings.SplitN(route, " ", 2)
+			op_routes = append(op_routes, apiRoute{op.Method, parts[0], parts[1], op.httpHandler})
+		}
+	}
+	return op_routes
+}
+
+// operationTcpMethods describes the operations for the tcp help method
+func operationTcpMethods() []TcpMethod {
+	methods := []TcpMethod{}
+	for _, op := range operations {
+		role := TCP_ROLE_NONE
+		switch op.Access {
+		case ACCESS_OPERATOR:
+			role = TCP_ROLE_OPERATOR
+		case ACCESS_SUPERUSER:
+			role = TCP_ROLE_SUPERUSER
+		}
+		methods = append(methods, TcpMethod{Method: op.Method, Role: role, Scope: op.Scope, Params: op.Params, Http: op.Http})
+	}
+	return methods
+}
+
+// runTcpOperation runs operation request of tcp connection with role
+// @param role {string}
+// @param req {TcpMessage}
+// @returns HttpMessageResponse
+func runTcpOperation(role string, req TcpMessage) HttpMessageResponse {
+	op, ok := findOperation(req.Method)
+	if !ok {
+		return ErrMethodNotFound.Response()
+	}
+	ctx := &OperationContext{Request: req, Role: role}
+	err := ctx.authorize(op)
+	var result interface{}
+	if nil == err {
+		result, err = op.run(ctx)
+	}
+	if err != nil {
+		NetworkLogger.Warn("error: ", req.Method, " ", err, " [TCP]")
+		return apiError(err).Response()
+	}
+	return HttpMessageResponse{Status: JSEND_SUCCESS, Data: result}
+}
+
+// httpOperationRequest maps url path variables and query params of http
+// request to the tcp request fields
+func httpOperationRequest(op Operation, r *http.Request) (TcpMessage, error) {
+	vars := mux.Vars(r)
+	req := TcpMessage{Method: op.Method, Apikey: getRequestApikey(r), Datasource: vars["ds"]}
+	req.Data.GeoId = vars["k"]
+	if "" == req.Data.GeoId {
+		req.Data.GeoId = r.FormValue("geo_id")
+	}
+	// id is the webhook, tileset or tile layer param of the operation
+	for _, param := range op.Params {
+		switch param.Name {
+		case "data.webhook_id":
+			req.Data.WebhookId = vars["id"]
+		case "data.tileset_id":
+			req.Data.TilesetId = vars["id"]
+		case "data.tilelayer_id":
+			req.Data.TileLayerId = vars["id"]
+		}
+	}
+	req.Data.Collaborator = vars["collaborator"]
+	if "" != r.FormValue("tilelayer_url") || "" != r.FormValue("tilelayer_name") {
+		req.Data.TileLayer = &TileLayer{Url: r.FormValue("tilelayer_url"), Name: r.FormValue("tilelayer_name"), Proxy: "true" == r.FormValue("tilelayer_proxy")}
+	}
+
+	var err error
+	if "" != r.FormValue("since") {
+		req.Data.Since, err = strconv.ParseInt(r.FormValue("since"), 10, 64)
+	}
+	if err == nil && "" != r.FormValue("limit") {
+		req.Data.Limit, err = strconv.Atoi(r.FormValue("limit"))
+	}
+	if err == nil && nil != req.Data.TileLayer && "" != r.FormValue("tilelayer_proxy_ttl") {
+		req.Data.TileLayer.ProxyTtl, err = strconv.Atoi(r.FormValue("tilelayer_proxy_ttl"))
+	}
+	return req, err
+}
+
+// httpHandler serves operation on its http routes
+func (self Operation) httpHandler(w http.ResponseWriter, r *http.Request) {
+	NetworkLogger.Debug("[In] ", redactedRequest(r))
+
+	// Get request body, form bodies are read as params
+	var body []byte
+	if nil != self.body {
+		var err error
+		body, err = ioutil.ReadAll(r.Body)
+		if err != nil {
+			sendApiError(w, r, err)
+			return
+		}
+		r.Body.Close()
+	}
+
+	req, params_err := httpOperationRequest(self, r)
+	ctx := &OperationContext{Request: req, IfMatch: r.Header.Get("If-Match"), LockToken: r.Header.Get("X-Lock-Token")}
+	if authkey := getRequestAuthKey(r); "" != authkey {
+		// failed attempts count towards the same lockout as tcp authenticate
+		var locked bool
+		ctx.Role, locked = tcp_lockout.Authenticate(remoteHost(r.RemoteAddr), authkey)
+		if locked {
+			sendApiError(w, r, NewApiError(ERROR_UNAUTHORIZED, "too many failed attempts"))
+			return
+		}
+		if TCP_ROLE_NONE == ctx.Role {
+			sendApiError(w, r, ErrUnauthorized)
+			return
+		}
+	}
+
+	err := ctx.authorize(self)
+	if nil == err && nil != params_err {
+		err = validationFailed(params_err)
+	}
+	if nil == err && nil != self.body {
+		if body_err := self.body(body, &ctx.Request); body_err != nil {
+			err = validationFailed(body_err)
+		}
+	}
+	var result interface{}
+	if nil == err {
+		result, err = self.run(ctx)
+	}
+	if err != nil {
+		sendApiError(w, r, err)
+		return
+	}
+
+	if "" != ctx.ETag && "GET" == r.Method && CheckIfNoneMatch(w, r, ctx.ETag) {
+		return
+	}
+
+	var data interface{} = HttpMessageResponse{Status: JSEND_SUCCESS, Datasource: ctx.Datasource(), Data: result}
+	if self.raw {
+		data = result
+	}
+	js, err := MarshalJsonFromStruct(w, r, data)
+	if err != nil {
+		return
+	}
+
+	if "" != ctx.ETag {
+		w.Header().Set("ETag", ctx.ETag)
+	}
+	SendJsonResponse(w, r, js)
+}
+
+// etagMatches checks If-Match header against entity tag
+func etagMatches(header string, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if "*" == tag || etag == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// editor returns editor id of feature edits: the request customer, or the
+// websocket client holding the lock token sent as X-Lock-Token header or
+// data.lock_token. The superuser is not subject to locks.
+func (self *OperationContext) editor() string {
+	token := self.LockToken
+	if "" == token {
+		token = self.Request.Data.LockToken
+	}
+	if "" == self.Customer.Id || "" == token {
+		return self.Customer.Id
+	}
+	return lockHolder(self.Customer.Id, token)
+}
+
+// expectedVersion returns expected feature version of request, from the
+// If-Match header of http requests or data.expected_version. Returns
+// ANY_VERSION when no precondition was sent, or for "*".
+func (self *OperationContext) expectedVersion(geo_id string) (int, error) {
+	tag := strings.TrimSpace(self.IfMatch)
+	if "" == tag {
+		if nil == self.Request.Data.ExpectedVersion {
+			return ANY_VERSION, nil
+		}
+		if *self.Request.Data.ExpectedVersion < 0 {
+			return ANY_VERSION, validationFailed(fmt.Errorf("expected_version must not be negative"))
+		}
+		return *self.Request.Data.ExpectedVersion, nil
+	}
+	if "*" == tag {
+		return ANY_VERSION, nil
+	}
+	// strong entity tags only: "<geo_id>-<version>"
+	tag = strings.Trim(tag, `"`)
+	i := strings.LastIndex(tag, "-")
+	if -1 == i || geo_id != tag[:i] {
+		return 0, ErrPreconditionFailed
+	}
+	version, err := strconv.Atoi(tag[i+1:])
+	if err != nil || version < 0 {
+		return 0, ErrPreconditionFailed
+	}
+	return version, nil
+}
+
+// decodeData reads http request body as the request data
+func decodeData(body []byte, req *TcpMessage) error {
+	if 0 == len(strings.TrimSpace(string(body))) {
+		return nil
+	}
+	return json.Unmarshal(body, &req.Data)
+}
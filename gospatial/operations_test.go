@@ -0,0 +1,225 @@
+package gospatial
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/paulmach/go.geojson"
+)
+
+func TestOperationsRegistered(t *testing.T) {
+	router := Router()
+	for _, op := range operations {
+		if 0 == len(op.Http) || nil == op.run {
+			t.Errorf("Expected http route and handler: %v", op.Method)
+		}
+		for _, route := range op.Http {
+			if nil == router.Get(op.Method) {
+				t.Errorf("Expected route %v of %v", route, op.Method)
+			}
+		}
+		found := false
+		for _, info := range tcp_methods {
+			found = found || op.Method == info.Method
+		}
+		if !found {
+			t.Errorf("Expected tcp method %v", op.Method)
+		}
+	}
+}
+
+func TestHttpOperationRequestId(t *testing.T) {
+	for method, expected := range map[string]TcpData{
+		"delete_webhook":   {WebhookId: "abc"},
+		"delete_tileset":   {TilesetId: "abc"},
+		"delete_tilelayer": {TileLayerId: "abc"},
+	} {
+		op, _ := findOperation(method)
+		r := mux.SetURLVars(httptest.NewRequest("DELETE", "/", nil), map[string]string{"id": "abc"})
+		req, err := httpOperationRequest(op, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected.WebhookId != req.Data.WebhookId || expected.TilesetId != req.Data.TilesetId || expected.TileLayerId != req.Data.TileLayerId {
+			t.Errorf("Unexpected %v ids: %v %v %v", method, req.Data.WebhookId, req.Data.TilesetId, req.Data.TileLayerId)
+		}
+	}
+}
+
+func TestOperationParity(t *testing.T) {
+	server := httptest.NewServer(Router())
+	defer server.Close()
+	apikey := "testParityKey"
+	DB.InsertCustomer(Customer{Apikey: apikey})
+
+	tcpCode := func(role string, message string) int {
+		resp := runTcpOperation(role, parseRequest(message))
+		if JSEND_SUCCESS == resp.Status {
+			return http.StatusOK
+		}
+		data, _ := resp.Data.(map[string]string)
+		for status_code, code := range map[int]string{http.StatusNotFound: ERROR_NOT_FOUND, http.StatusUnauthorized: ERROR_UNAUTHORIZED, http.StatusForbidden: ERROR_FORBIDDEN} {
+			if code == data["code"] {
+				return status_code
+			}
+		}
+		return http.StatusInternalServerError
+	}
+	httpCode := func(method string, path string, header string, value string) int {
+		req, _ := http.NewRequest(method, server.URL+path, nil)
+		if "" != header {
+			req.Header.Set(header, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// layers created over tcp are viewed over http
+	resp := runTcpOperation(TCP_ROLE_NONE, parseRequest(`{"method": "new_layer", "apikey": "`+apikey+`"}`))
+	data, _ := resp.Data.(map[string]string)
+	ds := data["datasource"]
+	if "" == ds {
+		t.Fatalf("Expected new layer: %v", resp)
+	}
+	if code := httpCode("GET", "/api/v1/layer/"+ds, "X-Api-Key", apikey); http.StatusOK != code {
+		t.Errorf("Expected layer over http: %v", code)
+	}
+
+	// same error codes on both transports
+	if code := tcpCode(TCP_ROLE_NONE, `{"method": "view_feature", "datasource": "`+ds+`", "apikey": "`+apikey+`", "data": {"geo_id": "missing"}}`); http.StatusNotFound != code {
+		t.Errorf("Expected tcp feature not found: %v", code)
+	}
+	if code := httpCode("GET", "/api/v1/layer/"+ds+"/feature/missing", "X-Api-Key", apikey); http.StatusNotFound != code {
+		t.Errorf("Expected http feature not found: %v", code)
+	}
+	if code := tcpCode(TCP_ROLE_NONE, `{"method": "export_datasource", "datasource": "`+ds+`"}`); http.StatusUnauthorized != code {
+		t.Errorf("Expected tcp unauthorized: %v", code)
+	}
+	if code := httpCode("GET", "/api/v1/layer/"+ds, "", ""); http.StatusUnauthorized != code {
+		t.Errorf("Expected http unauthorized: %v", code)
+	}
+	if code := tcpCode(TCP_ROLE_OPERATOR, `{"method": "import_file", "file": "missing.geojson"}`); http.StatusForbidden != code {
+		t.Errorf("Expected tcp operator forbidden: %v", code)
+	}
+	OperatorKey = "testOperatorKey"
+	defer func() { OperatorKey = "" }()
+	// http imports upload the file instead of naming a server file
+	if code := httpCode("POST", "/api/v1/import?file=missing.geojson", "X-Auth-Key", SuperuserKey); http.StatusBadRequest != code {
+		t.Errorf("Expected http import without upload refused: %v", code)
+	}
+	upload, _ := http.NewRequest("POST", server.URL+"/api/v1/import", strings.NewReader(`{"features":[{"geometry":{"coordinates":[1,1],"type":"Point"},"properties":{},"type":"Feature"}],"type":"FeatureCollection"}`))
+	upload.Header.Set("X-Auth-Key", SuperuserKey)
+	imported := struct {
+		Data map[string]string `json:"data"`
+	}{}
+	if resp, err := http.DefaultClient.Do(upload); err != nil || http.StatusOK != resp.StatusCode {
+		t.Errorf("Expected http import: %v %v", resp, err)
+	} else {
+		json.NewDecoder(resp.Body).Decode(&imported)
+		resp.Body.Close()
+	}
+	if layer, err := DB.GetLayer(imported.Data["datasource"]); err != nil || 1 != len(layer.Features) {
+		t.Errorf("Expected imported layer: %v %v", imported, err)
+	}
+	if code := httpCode("GET", "/api/v1/datasources", "X-Auth-Key", OperatorKey); http.StatusOK != code {
+		t.Errorf("Expected http operator export: %v", code)
+	}
+
+	// explicit version 0 is checked, not skipped
+	feat := geojson.NewPointFeature([]float64{1, 1})
+	DB.InsertFeature(ds, feat)
+	geo_id := feat.Properties["geo_id"].(string)
+	resp = runTcpOperation(TCP_ROLE_NONE, parseRequest(`{"method": "delete_feature", "datasource": "`+ds+`", "apikey": "`+apikey+`", "data": {"geo_id": "`+geo_id+`", "expected_version": 0}}`))
+	if JSEND_FAIL != resp.Status {
+		t.Errorf("Expected tcp version conflict: %v", resp)
+	}
+	if code := httpCode("DELETE", "/api/v1/layer/"+ds+"/feature/"+geo_id+"?apikey="+apikey, "If-Match", `"`+geo_id+`-0"`); http.StatusPreconditionFailed != code {
+		t.Errorf("Expected http precondition failed: %v", code)
+	}
+
+	// delete_layer over tcp
+	if code := tcpCode(TCP_ROLE_NONE, `{"method": "delete_layer", "datasource": "`+ds+`", "apikey": "`+apikey+`"}`); http.StatusOK != code {
+		t.Fatalf("Expected layer deleted: %v", code)
+	}
+	if _, err := DB.GetLayer(ds); ErrDatasourceNotFound != err {
+		t.Errorf("Expected layer removed: %v", err)
+	}
+	customer, _ := DB.GetCustomer(apikey)
+	if 0 != len(customer.Datasources) {
+		t.Errorf("Expected layer removed from customer: %v", customer)
+	}
+	if code := httpCode("GET", "/api/v1/layer/"+ds, "X-Api-Key", apikey); http.StatusUnauthorized != code {
+		t.Errorf("Expected deleted layer unauthorized: %v", code)
+	}
+}
+
+func TestOperationErrorResponses(t *testing.T) {
+	js, _ := json.Marshal(runTcpOperation(TCP_ROLE_NONE, parseRequest(`{"method": "unknown_method"}`)))
+	failed := struct {
+		Status string `json:"status"`
+		Data   struct {
+			Code  string `json:"code"`
+			Error string `json:"error"`
+		} `json:"data"`
+	}{}
+	if err := json.Unmarshal(js, &failed); err != nil || JSEND_FAIL != failed.Status || ERROR_NOT_FOUND != failed.Data.Code {
+		t.Errorf("Expected method not found: %s %v", js, err)
+	}
+
+	w := httptest.NewRecorder()
+	sendApiError(w, httptest.NewRequest("GET", "/api/v1/layer/missing", nil), ErrFeatureLocked)
+	if http.StatusLocked != w.Code || !strings.Contains(w.Body.String(), `"code":"conflict"`) {
+		t.Errorf("Expected feature locked: %v %v", w.Code, w.Body.String())
+	}
+
+	// server errors are sent as JSend error with code and message
+	w = httptest.NewRecorder()
+	sendApiError(w, httptest.NewRequest("POST", "/api/v1/layer", nil), ErrServerShuttingDown)
+	errored := map[string]interface{}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &errored); err != nil || http.StatusServiceUnavailable != w.Code || JSEND_ERROR != errored["status"] || ERROR_SHUTTING_DOWN != errored["code"] {
+		t.Errorf("Expected shutting down: %v %v", w.Code, w.Body.String())
+	}
+
+	// messages are escaped
+	js, _ = json.Marshal(validationFailed(errors.New(`invalid "geo_id"`)).Response())
+	if err := json.Unmarshal(js, &failed); err != nil || `invalid "geo_id"` != failed.Data.Error {
+		t.Errorf("Expected escaped message: %s %v", js, err)
+	}
+}
+
+func TestHttpAuthkeyLockout(t *testing.T) {
+	max_attempts := TCP_AUTH_MAX_ATTEMPTS
+	TCP_AUTH_MAX_ATTEMPTS = 2
+	tcp_lockout = &TcpLockout{failures: make(map[string]*authFailures)}
+	defer func() {
+		TCP_AUTH_MAX_ATTEMPTS = max_attempts
+		tcp_lockout = &TcpLockout{failures: make(map[string]*authFailures)}
+	}()
+
+	export := func(authkey string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/api/v1/datasources", nil)
+		r.Header.Set("X-Auth-Key", authkey)
+		Router().ServeHTTP(w, r)
+		return w
+	}
+	if w := export(SuperuserKey); http.StatusOK != w.Code {
+		t.Errorf("Expected superuser can export: %v %v", w.Code, w.Body.String())
+	}
+	export("wrong")
+	export("wrong")
+	if w := export(SuperuserKey); http.StatusUnauthorized != w.Code || !strings.Contains(w.Body.String(), "too many failed attempts") {
+		t.Errorf("Expected host locked out: %v %v", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,87 @@
+package gospatial
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// Allows webhooks and proxied tile layers to reach loopback, private and
+// link-local addresses. Only for tests and trusted deployments, as their
+// urls are set by customers.
+var OUTBOUND_ALLOW_PRIVATE bool = false
+
+// publicIP checks ip is routable on the public internet
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast())
+}
+
+// CheckOutboundUrl checks url is an absolute http(s) url whose host only
+// resolves to public addresses
+// @param raw_url {string}
+// @returns Error
+func CheckOutboundUrl(raw_url string) error {
+	u, err := url.Parse(raw_url)
+	if err != nil || ("http" != u.Scheme && "https" != u.Scheme) || "" == u.Hostname() {
+		return fmt.Errorf("url must be an absolute http(s) url")
+	}
+	if OUTBOUND_ALLOW_PRIVATE {
+		return nil
+	}
+	ips, err := net.LookupIP(u.Hostname())
+	if err != nil {
+		return fmt.Errorf("host %v could not be resolved", u.Hostname())
+	}
+	for _, ip := range ips {
+		if !publicIP(ip) {
+			return fmt.Errorf("host %v resolves to a private address", u.Hostname())
+		}
+	}
+	return nil
+}
+
+// outboundDialControl refuses connections to non public addresses. It
+// checks the dialed address, so hosts resolving to other addresses after
+// their url was checked are refused as well.
+func outboundDialControl(network string, address string, _ syscall.RawConn) error {
+	if OUTBOUND_ALLOW_PRIVATE {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if nil == ip || !publicIP(ip) {
+		return fmt.Errorf("connection to private address %v refused", host)
+	}
+	return nil
+}
+
+// NewOutboundClient returns http client for requests to customer urls,
+// which only connects to public addresses
+// @param timeout {time.Duration}
+// @returns *http.Client
+func NewOutboundClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, Control: outboundDialControl}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+			MaxIdleConnsPerHost: 4,
+		},
+		// redirects are dialed with the same guard
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if 5 <= len(via) {
+				return fmt.Errorf("too many redirects")
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,185 @@
+package gospatial
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"sort"
+)
+
+import "github.com/paulmach/go.geojson"
+
+// Rendered tile settings
+const (
+	// width and height of rendered tiles in pixels
+	RASTER_TILE_SIZE int = 256
+	// pixels features are drawn beyond tile borders, covers the largest
+	// point radius and stroke width of styles
+	RASTER_BUFFER int = 48
+)
+
+// tilePixel returns pixel coordinates of lon/lat point in tile
+func (self tileCoord) tilePixel(point []float64) []float64 {
+	p := self.project(point)
+	scale := float64(RASTER_TILE_SIZE) / float64(MVT_EXTENT)
+	return []float64{p[0] * scale, p[1] * scale}
+}
+
+// tilePixels returns pixel coordinates of line in tile
+func (self tileCoord) tilePixels(line [][]float64) [][]float64 {
+	pixels := make([][]float64, 0, len(line))
+	for _, point := range line {
+		if 2 <= len(point) {
+			pixels = append(pixels, self.tilePixel(point))
+		}
+	}
+	return pixels
+}
+
+// fillRings fills polygon rings into mask with the even-odd rule, so inner
+// rings are holes. Pixels are filled when their center is inside.
+func fillRings(mask *image.Alpha, rings [][][]float64) {
+	bounds := mask.Bounds()
+	miny, maxy := math.Inf(1), math.Inf(-1)
+	for _, ring := range rings {
+		for _, p := range ring {
+			miny, maxy = math.Min(miny, p[1]), math.Max(maxy, p[1])
+		}
+	}
+	start := int(math.Max(float64(bounds.Min.Y), math.Floor(miny)))
+	end := int(math.Min(float64(bounds.Max.Y-1), math.Ceil(maxy)))
+	for y := start; y <= end; y++ {
+		cy := float64(y) + 0.5
+		crossings := []float64{}
+		for _, ring := range rings {
+			for i := range ring {
+				a, b := ring[i], ring[(i+1)%len(ring)]
+				if (a[1] <= cy) != (b[1] <= cy) {
+					crossings = append(crossings, a[0]+(cy-a[1])*(b[0]-a[0])/(b[1]-a[1]))
+				}
+			}
+		}
+		sort.Float64s(crossings)
+		for i := 0; i+1 < len(crossings); i += 2 {
+			x0 := int(math.Max(float64(bounds.Min.X), math.Ceil(crossings[i]-0.5)))
+			x1 := int(math.Min(float64(bounds.Max.X-1), math.Floor(crossings[i+1]-0.5)))
+			for x := x0; x <= x1; x++ {
+				mask.SetAlpha(x, y, color.Alpha{255})
+			}
+		}
+	}
+}
+
+// fillCircle fills circle into mask, or the ring between inner and radius
+// when inner is greater than 0
+func fillCircle(mask *image.Alpha, center []float64, radius float64, inner float64) {
+	bounds := mask.Bounds().Intersect(image.Rect(int(math.Floor(center[0]-radius)), int(math.Floor(center[1]-radius)), int(math.Ceil(center[0]+radius))+1, int(math.Ceil(center[1]+radius))+1))
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			d := math.Hypot(float64(x)+0.5-center[0], float64(y)+0.5-center[1])
+			if d <= radius && d >= inner {
+				mask.SetAlpha(x, y, color.Alpha{255})
+			}
+		}
+	}
+}
+
+// strokeLine draws line into mask with width, joined by round joins
+func strokeLine(mask *image.Alpha, line [][]float64, width float64) {
+	half := width / 2
+	for i, p := range line {
+		if 1 < width {
+			fillCircle(mask, p, half, 0)
+		}
+		if 0 == i {
+			continue
+		}
+		a := line[i-1]
+		dx, dy := p[0]-a[0], p[1]-a[1]
+		length := math.Hypot(dx, dy)
+		if 0 == length {
+			continue
+		}
+		// segment as quad around its center line, at least a pixel wide
+		nx, ny := -dy/length*math.Max(half, 0.5), dx/length*math.Max(half, 0.5)
+		fillRings(mask, [][][]float64{{{a[0] + nx, a[1] + ny}, {p[0] + nx, p[1] + ny}, {p[0] - nx, p[1] - ny}, {a[0] - nx, a[1] - ny}}})
+	}
+}
+
+// RenderTile draws features on a transparent PNG tile with style
+// @param tile {tileCoord}
+// @param features {[]*geojson.Feature}
+// @param style {LayerStyle}
+// @returns []byte
+// @returns Error
+func RenderTile(tile tileCoord, features []*geojson.Feature, style LayerStyle) ([]byte, error) {
+	img := image.NewNRGBA(image.Rect(0, 0, RASTER_TILE_SIZE, RASTER_TILE_SIZE))
+	fill_mask := image.NewAlpha(img.Bounds())
+	stroke_mask := image.NewAlpha(img.Bounds())
+	fill, _ := parseColor(style.Fill)
+	stroke, _ := parseColor(style.Stroke)
+
+	composite := func(mask *image.Alpha, c color.NRGBA) {
+		draw.DrawMask(img, img.Bounds(), image.NewUniform(c), image.ZP, mask, image.ZP, draw.Over)
+		for i := range mask.Pix {
+			mask.Pix[i] = 0
+		}
+	}
+
+	for _, feat := range features {
+		if nil == feat.Geometry {
+			continue
+		}
+		geom := feat.Geometry
+		feat_fill := style.featureColor(feat, fill)
+		feat_stroke := stroke
+		switch geom.Type {
+		case geojson.GeometryPoint, geojson.GeometryMultiPoint:
+			points := geom.MultiPoint
+			if geojson.GeometryPoint == geom.Type {
+				points = [][]float64{geom.Point}
+			}
+			for _, p := range tile.tilePixels(points) {
+				fillCircle(fill_mask, p, style.PointRadius, 0)
+				if 0 < style.StrokeWidth {
+					fillCircle(stroke_mask, p, style.PointRadius+style.StrokeWidth/2, math.Max(0, style.PointRadius-style.StrokeWidth/2))
+				}
+			}
+		case geojson.GeometryLineString, geojson.GeometryMultiLineString:
+			lines := geom.MultiLineString
+			if geojson.GeometryLineString == geom.Type {
+				lines = [][][]float64{geom.LineString}
+			}
+			// lines have no fill, the ramp colors their stroke
+			feat_stroke = style.featureColor(feat, stroke)
+			for _, line := range lines {
+				strokeLine(stroke_mask, tile.tilePixels(line), style.StrokeWidth)
+			}
+		case geojson.GeometryPolygon, geojson.GeometryMultiPolygon:
+			polygons := geom.MultiPolygon
+			if geojson.GeometryPolygon == geom.Type {
+				polygons = [][][][]float64{geom.Polygon}
+			}
+			for _, polygon := range polygons {
+				rings := [][][]float64{}
+				for _, ring := range polygon {
+					pixels := tile.tilePixels(ring)
+					rings = append(rings, pixels)
+					if 0 < style.StrokeWidth {
+						strokeLine(stroke_mask, pixels, style.StrokeWidth)
+					}
+				}
+				fillRings(fill_mask, rings)
+			}
+		}
+		composite(fill_mask, feat_fill)
+		composite(stroke_mask, feat_stroke)
+	}
+
+	buffer := bytes.Buffer{}
+	err := png.Encode(&buffer, img)
+	return buffer.Bytes(), err
+}
@@ -0,0 +1,161 @@
+package gospatial
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+import "github.com/paulmach/go.geojson"
+
+// decodeTile decodes PNG tile
+func decodeTile(t *testing.T, data []byte) image.Image {
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if RASTER_TILE_SIZE != img.Bounds().Dx() || RASTER_TILE_SIZE != img.Bounds().Dy() {
+		t.Fatalf("Unexpected tile size: %v", img.Bounds())
+	}
+	return img
+}
+
+// pixelColor returns color of tile pixel
+func pixelColor(img image.Image, x, y int) color.NRGBA {
+	return color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+}
+
+func TestRenderTile(t *testing.T) {
+	style := LayerStyle{Fill: "#ff0000", Stroke: "#000000", StrokeWidth: 0, PointRadius: 4}
+
+	// point at the center of tile 0/0/0
+	data, err := RenderTile(tileCoord{0, 0, 0}, []*geojson.Feature{geojson.NewPointFeature([]float64{0, 0})}, style)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := decodeTile(t, data)
+	if (color.NRGBA{255, 0, 0, 255}) != pixelColor(img, 128, 128) {
+		t.Errorf("Expected point filled: %v", pixelColor(img, 128, 128))
+	}
+	if 0 != pixelColor(img, 10, 10).A || 0 != pixelColor(img, 128, 140).A {
+		t.Errorf("Expected transparent background")
+	}
+
+	// polygon with hole around the center
+	polygon := geojson.NewPolygonFeature([][][]float64{
+		{{-90, -60}, {90, -60}, {90, 60}, {-90, 60}, {-90, -60}},
+		{{-30, -30}, {30, -30}, {30, 30}, {-30, 30}, {-30, -30}}})
+	data, _ = RenderTile(tileCoord{0, 0, 0}, []*geojson.Feature{polygon}, style)
+	img = decodeTile(t, data)
+	if 0 != pixelColor(img, 128, 128).A || 255 != pixelColor(img, 170, 128).A || 0 != pixelColor(img, 250, 128).A {
+		t.Errorf("Expected polygon filled outside its hole")
+	}
+
+	// ramp colors by property, between its stops
+	style.Ramp = &ColorRamp{Property: "value", Stops: []ColorStop{{10, "#ffffff"}, {0, "#000000"}}}
+	if err := style.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	point := geojson.NewPointFeature([]float64{0, 0})
+	point.Properties["value"] = float64(5)
+	data, _ = RenderTile(tileCoord{0, 0, 0}, []*geojson.Feature{point}, style)
+	if c := pixelColor(decodeTile(t, data), 128, 128); (color.NRGBA{128, 128, 128, 255}) != c {
+		t.Errorf("Expected interpolated ramp color: %v", c)
+	}
+
+	for _, invalid := range []LayerStyle{
+		{Fill: "red", Stroke: "#000"},
+		{Fill: "#fff", Stroke: "#00000g"},
+		{Fill: "#fff", Stroke: "#000", StrokeWidth: -1},
+		{Fill: "#fff", Stroke: "#000", Ramp: &ColorRamp{Property: "value", Stops: []ColorStop{{0, "#000"}}}},
+	} {
+		if nil == invalid.Validate() {
+			t.Errorf("Expected invalid style: %v", invalid)
+		}
+	}
+}
+
+func TestRasterTileRoutes(t *testing.T) {
+	server := httptest.NewServer(Router())
+	defer server.Close()
+	apikey := "testRasterTileKey"
+	ds, _ := DB.NewLayer()
+	DB.InsertCustomer(Customer{Apikey: apikey, Datasources: []string{ds}})
+	DB.InsertFeature(ds, geojson.NewPointFeature([]float64{0, 0}))
+
+	request := func(method string, path string, body string) (*http.Response, []byte) {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return resp, data
+	}
+	tile_path := "/api/v1/layer/" + ds + "/render/0/0/0.png?apikey=" + apikey
+
+	resp, body := request("GET", tile_path, "")
+	if http.StatusOK != resp.StatusCode || "image/png" != resp.Header.Get("Content-Type") {
+		t.Fatalf("Expected rendered tile: %v %s", resp.StatusCode, body)
+	}
+	if 0 == pixelColor(decodeTile(t, body), 128, 128).A {
+		t.Errorf("Expected feature drawn with default style")
+	}
+	if _, ok := RasterTiles.Get(ds, tileCoord{0, 0, 0}); !ok {
+		t.Errorf("Expected tile cached")
+	}
+
+	// style changes invalidate the cached tiles
+	resp, body = request("PUT", "/api/v1/layer/"+ds+"/style?apikey="+apikey, `{"fill": "#00ff00", "stroke": "#000", "point_radius": 6}`)
+	if http.StatusOK != resp.StatusCode {
+		t.Fatalf("Expected style set: %v %s", resp.StatusCode, body)
+	}
+	if _, ok := RasterTiles.Get(ds, tileCoord{0, 0, 0}); ok {
+		t.Errorf("Expected tile invalidated")
+	}
+	_, body = request("GET", tile_path, "")
+	if c := pixelColor(decodeTile(t, body), 128, 128); (color.NRGBA{0, 255, 0, 255}) != c {
+		t.Errorf("Expected feature drawn with layer style: %v", c)
+	}
+	if resp, _ = request("PUT", "/api/v1/layer/"+ds+"/style?apikey="+apikey, `{"fill": "green", "stroke": "#000"}`); http.StatusBadRequest != resp.StatusCode {
+		t.Errorf("Expected invalid color rejected: %v", resp.StatusCode)
+	}
+	style := struct {
+		Data LayerStyle `json:"data"`
+	}{}
+	_, body = request("GET", "/api/v1/layer/"+ds+"/style?apikey="+apikey, "")
+	json.Unmarshal(body, &style)
+	if "#00ff00" != style.Data.Fill || 6 != style.Data.PointRadius {
+		t.Errorf("Unexpected style: %s", body)
+	}
+
+	// writes invalidate the cached tiles
+	request("GET", tile_path, "")
+	DB.InsertFeature(ds, geojson.NewPointFeature([]float64{1, 1}))
+	if _, ok := RasterTiles.Get(ds, tileCoord{0, 0, 0}); ok {
+		t.Errorf("Expected tile invalidated by write")
+	}
+
+	if resp, _ = request("GET", "/api/v1/layer/"+ds+"/render/0/0/0.png", ""); http.StatusUnauthorized != resp.StatusCode {
+		t.Errorf("Expected apikey required: %v", resp.StatusCode)
+	}
+
+	// rendered layer as tile layer of customer
+	resp, body = request("POST", "/api/v1/layer/"+ds+"/render/tilelayer?apikey="+apikey+"&tilelayer_name=rendered", "")
+	if http.StatusOK != resp.StatusCode {
+		t.Fatalf("Expected tile layer added: %v %s", resp.StatusCode, body)
+	}
+	request("POST", "/api/v1/layer/"+ds+"/render/tilelayer?apikey="+apikey, "")
+	customer, _ := DB.GetCustomer(apikey)
+	if 1 != len(customer.TileLayers) || "/api/v1/layer/"+ds+"/render/{z}/{x}/{y}.png" != customer.TileLayers[0].Url || ds != customer.TileLayers[0].Datasource {
+		t.Errorf("Expected one rendered tile layer: %v", customer.TileLayers)
+	}
+}
@@ -0,0 +1,205 @@
+package gospatial
+
+// operations lists the api methods of both transports. Router() adds
+// their http routes and tcpClientHandler runs them by method name.
+var operations = []Operation{
+
+	// Health check
+	{Method: "ping", Http: []string{"GET /ping"}, Access: ACCESS_PUBLIC,
+		Params: []TcpParam{}, run: ping},
+
+	// Customers
+	{Method: "export_apikey", Http: []string{"GET /api/v1/customer", "GET /api/v1/layers"}, Access: ACCESS_CUSTOMER,
+		Params: []TcpParam{
+			{"apikey", "string", true}}, raw: true, run: viewCustomer},
+	{Method: "rotate_apikey", Http: []string{"POST /api/v1/customer/apikey"}, Access: ACCESS_CUSTOMER,
+		Params: []TcpParam{
+			{"apikey", "string", true}}, run: rotateApikey},
+	{Method: "revoke_apikey", Http: []string{"DELETE /api/v1/customer/apikey"}, Access: ACCESS_CUSTOMER,
+		Params: []TcpParam{
+			{"apikey", "string", true}}, run: revokeApikey},
+	{Method: "new_tilelayer", Http: []string{"POST /api/v1/tilelayer"}, Access: ACCESS_CUSTOMER,
+		Params: []TcpParam{
+			{"apikey", "string", true},
+			{"data.tilelayer", "object", true}}, run: newTileLayer},
+	{Method: "delete_tilelayer", Http: []string{"DELETE /api/v1/tilelayer/{id}"}, Access: ACCESS_CUSTOMER,
+		Params: []TcpParam{
+			{"apikey", "string", true},
+			{"data.tilelayer_id", "string", true}}, run: deleteTileLayer},
+	{Method: "delete_tileset", Http: []string{"DELETE /api/v1/tileset/{id}"}, Access: ACCESS_CUSTOMER,
+		Params: []TcpParam{
+			{"apikey", "string", true},
+			{"data.tileset_id", "string", true}}, run: deleteTileset},
+	{Method: "seed_tilelayer", Http: []string{"POST /api/v1/tilelayer/{id}/proxy/seed"}, Access: ACCESS_CUSTOMER,
+		Params: []TcpParam{
+			{"apikey", "string", true},
+			{"data.tilelayer_id", "string", true},
+			{"data.bbox", "array", true},
+			{"data.min_zoom", "integer", false},
+			{"data.max_zoom", "integer", true}}, body: decodeData, run: seedTileLayer},
+
+	// Layers
+	{Method: "new_layer", Http: []string{"POST /api/v1/layer"}, Access: ACCESS_CUSTOMER,
+		Params: []TcpParam{
+			{"apikey", "string", true}}, run: newLayer},
+	{Method: "export_datasource", Http: []string{"GET /api/v1/layer/{ds}"}, Access: ACCESS_DATASOURCE, Scope: SCOPE_READ,
+		Params: []TcpParam{
+			{"datasource", "string", true},
+			{"apikey", "string", false}}, raw: true, run: viewLayer},
+	{Method: "delete_layer", Http: []string{"DELETE /api/v1/layer/{ds}"}, Access: ACCESS_DATASOURCE, Scope: SCOPE_DELETE,
+		Params: []TcpParam{
+			{"datasource", "string", true},
+			{"apikey", "string", false}}, run: deleteLayer},
+
+	// Features
+	{Method: "insert_feature", Http: []string{"POST /api/v1/layer/{ds}/feature"}, Access: ACCESS_DATASOURCE, Scope: SCOPE_WRITE,
+		Params: []TcpParam{
+			{"data.datasource", "string", true},
+			{"data.feature", "object", true},
+			{"apikey", "string", false}}, body: decodeFeature, run: insertFeature},
+	{Method: "view_feature", Http: []string{"GET /api/v1/layer/{ds}/feature/{k}"}, Access: ACCESS_DATASOURCE, Scope: SCOPE_READ,
+		Params: []TcpParam{
+			{"data.datasource", "string", true},
+			{"data.geo_id", "string", true},
+			{"apikey", "string", false}}, raw: true, run: viewFeature},
+	{Method: "edit_feature", Http: []string{"PUT /api/v1/layer/{ds}/feature/{k}"}, Access: ACCESS_DATASOURCE, Scope: SCOPE_WRITE,
+		Params: []TcpParam{
+			{"data.datasource", "string", true},
+			{"data.geo_id", "string", true},
+			{"data.feature", "object", true},
+			{"data.expected_version", "integer", false},
+			{"apikey", "string", false}}, body: decodeFeature, run: editFeature},
+	{Method: "patch_feature", Http: []string{"PATCH /api/v1/layer/{ds}/feature/{k}"}, Access: ACCESS_DATASOURCE, Scope: SCOPE_WRITE,
+		Params: []TcpParam{
+			{"data.datasource", "string", true},
+			{"data.geo_id", "string", true},
+			{"data.feature", "object", true},
+			{"data.expected_version", "integer", false},
+			{"apikey", "string", false}}, body: decodeFeature, run: patchFeature},
+	{Method: "delete_feature", Http: []string{"DELETE /api/v1/layer/{ds}/feature/{k}"}, Access: ACCESS_DATASOURCE, Scope: SCOPE_DELETE,
+		Params: []TcpParam{
+			{"data.datasource", "string", true},
+			{"data.geo_id", "string", true},
+			{"data.expected_version", "integer", false},
+			{"apikey", "string", false}}, run: deleteFeature},
+	{Method: "sync_layer", Http: []string{"POST /api/v1/layer/{ds}/sync"}, Access: ACCESS_DATASOURCE, Scope: SCOPE_WRITE,
+		Params: []TcpParam{
+			{"datasource", "string", true},
+			{"data.sync", "object", true},
+			{"apikey", "string", false}}, body: decodeSync, run: syncLayer},
+	{Method: "report_positions", Http: []string{"POST /api/v1/layer/{ds}/positions"}, Access: ACCESS_DATASOURCE, Scope: SCOPE_WRITE,
+		Params: []TcpParam{
+			{"data.datasource", "string", true},
+			{"data.reports", "array", true},
+			{"apikey", "string", false}}, body: decodePositions, run: reportPositions},
+
+	// Sharing
+	{Method: "view_collaborators", Http: []string{"GET /api/v1/layer/{ds}/collaborators"}, Access: ACCESS_DATASOURCE, Scope: SCOPE_READ,
+		Params: []TcpParam{
+			{"datasource", "string", true},
+			{"apikey", "string", false}}, run: viewCollaborators},
+	{Method: "share_layer", Http: []string{"POST /api/v1/layer/{ds}/collaborators"}, Access: ACCESS_DATASOURCE, Scope: SCOPE_READ,
+		Params: []TcpParam{
+			{"datasource", "string", true},
+			{"data.apikey", "string", true},
+			{"data.role", "string", true},
+			{"apikey", "string", false}}, body: decodeData, run: shareLayer},
+	{Method: "revoke_layer", Http: []string{"DELETE /api/v1/layer/{ds}/collaborators/{collaborator}"}, Access: ACCESS_DATASOURCE, Scope: SCOPE_READ,
+		Params: []TcpParam{
+			{"datasource", "string", true},
+			{"data.collaborator", "string", true},
+			{"apikey", "string", false}}, run: revokeLayer},
+
+	// Webhooks
+	{Method: "new_webhook", Http: []string{"POST /api/v1/layer/{ds}/webhooks"}, Access: ACCESS_DATASOURCE, Scope: SCOPE_ADMIN,
+		Params: []TcpParam{
+			{"datasource", "string", true},
+			{"data.webhook", "object", true},
+			{"apikey", "string", false}}, body: decodeWebhook, run: newWebhook},
+	{Method: "view_webhooks", Http: []string{"GET /api/v1/layer/{ds}/webhooks"}, Access: ACCESS_DATASOURCE, Scope: SCOPE_ADMIN,
+		Params: []TcpParam{
+			{"datasource", "string", true},
+			{"apikey", "string", false}}, run: viewWebhooks},
+	{Method: "delete_webhook", Http: []string{"DELETE /api/v1/layer/{ds}/webhooks/{id}"}, Access: ACCESS_DATASOURCE, Scope: SCOPE_ADMIN,
+		Params: []TcpParam{
+			{"datasource", "string", true},
+			{"data.webhook_id", "string", true},
+			{"apikey", "string", false}}, run: deleteWebhook},
+	{Method: "view_webhook_deliveries", Http: []string{"GET /api/v1/layer/{ds}/webhooks/{id}/deliveries"}, Access: ACCESS_DATASOURCE, Scope: SCOPE_ADMIN,
+		Params: []TcpParam{
+			{"datasource", "string", true},
+			{"data.webhook_id", "string", true},
+			{"apikey", "string", false}}, run: viewWebhookDeliveries},
+
+	// Geofences
+	{Method: "set_geofences", Http: []string{"PUT /api/v1/layer/{ds}/geofences"}, Access: ACCESS_DATASOURCE, Scope: SCOPE_ADMIN,
+		Params: []TcpParam{
+			{"datasource", "string", true},
+			{"data.geofences", "object", true},
+			{"apikey", "string", false}}, body: decodeGeofences, run: setGeofences},
+	{Method: "view_geofences", Http: []string{"GET /api/v1/layer/{ds}/geofences"}, Access: ACCESS_DATASOURCE, Scope: SCOPE_READ,
+		Params: []TcpParam{
+			{"datasource", "string", true},
+			{"apikey", "string", false}}, run: viewGeofences},
+	{Method: "delete_geofences", Http: []string{"DELETE /api/v1/layer/{ds}/geofences"}, Access: ACCESS_DATASOURCE, Scope: SCOPE_ADMIN,
+		Params: []TcpParam{
+			{"datasource", "string", true},
+			{"apikey", "string", false}}, run: deleteGeofences},
+	{Method: "view_geofence_events", Http: []string{"GET /api/v1/layer/{ds}/geofences/events"}, Access: ACCESS_DATASOURCE, Scope: SCOPE_READ,
+		Params: []TcpParam{
+			{"datasource", "string", true},
+			{"data.geo_id", "string", false},
+			{"data.since", "integer", false},
+			{"data.limit", "integer", false},
+			{"apikey", "string", false}}, run: viewGeofenceEvents},
+
+	// Styles
+	{Method: "set_layer_style", Http: []string{"PUT /api/v1/layer/{ds}/style"}, Access: ACCESS_DATASOURCE, Scope: SCOPE_ADMIN,
+		Params: []TcpParam{
+			{"datasource", "string", true},
+			{"data.style", "object", true},
+			{"apikey", "string", false}}, body: decodeStyle, run: setLayerStyle},
+	{Method: "view_layer_style", Http: []string{"GET /api/v1/layer/{ds}/style"}, Access: ACCESS_DATASOURCE, Scope: SCOPE_READ,
+		Params: []TcpParam{
+			{"datasource", "string", true},
+			{"apikey", "string", false}}, run: viewLayerStyle},
+	{Method: "delete_layer_style", Http: []string{"DELETE /api/v1/layer/{ds}/style"}, Access: ACCESS_DATASOURCE, Scope: SCOPE_ADMIN,
+		Params: []TcpParam{
+			{"datasource", "string", true},
+			{"apikey", "string", false}}, run: deleteLayerStyle},
+	{Method: "new_render_tilelayer", Http: []string{"POST /api/v1/layer/{ds}/render/tilelayer"}, Access: ACCESS_DATASOURCE, Scope: SCOPE_READ,
+		Params: []TcpParam{
+			{"datasource", "string", true},
+			{"data.tilelayer", "object", false},
+			{"apikey", "string", true}}, run: newRenderTileLayer},
+
+	// Operator methods
+	{Method: "export_apikeys", Http: []string{"GET /api/v1/customers"}, Access: ACCESS_OPERATOR,
+		Params: []TcpParam{}, raw: true, run: exportCustomers},
+	{Method: "export_datasources", Http: []string{"GET /api/v1/datasources"}, Access: ACCESS_OPERATOR,
+		Params: []TcpParam{}, raw: true, run: exportDatasources},
+
+	// Superuser methods
+	{Method: "create_apikey", Http: []string{"POST /api/v1/customer"}, Access: ACCESS_SUPERUSER,
+		Params: []TcpParam{
+			{"data.datasources", "array", false},
+			{"data.scopes", "object", false}}, body: decodeData, run: createApikey},
+	{Method: "insert_apikey", Http: []string{"POST /api/v1/customers"}, Access: ACCESS_SUPERUSER,
+		Params: []TcpParam{
+			{"data.apikey", "string", true},
+			{"data.datasources", "array", false},
+			{"data.scopes", "object", false}}, body: decodeData, run: insertApikey},
+	{Method: "assign_datasource", Http: []string{"PUT /api/v1/customer/layer/{ds}"}, Access: ACCESS_SUPERUSER,
+		Params: []TcpParam{
+			{"apikey", "string", true},
+			{"datasource", "string", true},
+			{"data.scopes", "object", false}}, body: decodeData, run: assignDatasource},
+	{Method: "create_datasource", Http: []string{"POST /api/v1/layers"}, Access: ACCESS_SUPERUSER,
+		Params: []TcpParam{
+			{"data.datasource", "string", false},
+			{"data.layer", "object", false}}, body: decodeData, run: createDatasource},
+	// tcp requests name a file on the server, http requests upload it
+	{Method: "import_file", Http: []string{"POST /api/v1/import"}, Access: ACCESS_SUPERUSER,
+		Params: []TcpParam{
+			{"file", "string", true}}, body: decodeImportUpload, run: importFile},
+}
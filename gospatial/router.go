@@ -8,7 +8,7 @@ import (
 // Router for http api calls
 func Router() *mux.Router {
 	router := mux.NewRouter().StrictSlash(true)
-	for _, route := range routes {
+	for _, route := range append(routes, operationRoutes()...) {
 		var handler http.Handler
 		// log.Println("Attaching HTTP handler for route:", route.Method, route.Pattern)
 		ServerLogger.Info("Attaching HTTP handler for route: ", route.Method, " ", route.Pattern)
@@ -13,6 +13,8 @@ type apiRoute struct {
 
 type apiRoutes []apiRoute
 
+// routes served only over http, the api routes of operations are added
+// by Router()
 var routes = apiRoutes{
 
 	// Web Client apiRoutes
@@ -20,23 +22,32 @@ var routes = apiRoutes{
 	apiRoute{"Map", "GET", "/map", MapHandler},
 	apiRoute{"Dashboard", "GET", "/dashboard", DashboardHandler},
 
-	// Health check
-	apiRoute{"Ping", "GET", "/ping", PingHandler},
-
-	// Layers
-	apiRoute{"ViewLayers", "GET", "/api/v1/layers", ViewLayersHandler},
-	apiRoute{"ViewCustomer", "GET", "/api/v1/customer", ViewLayersHandler}, //
-	apiRoute{"ViewLayer", "GET", "/api/v1/layer/{ds}", ViewLayerHandler},
-	apiRoute{"NewLayer", "POST", "/api/v1/layer", NewLayerHandler},
-	apiRoute{"DeleteLayer", "DELETE", "/api/v1/layer/{ds}", DeleteLayerHandler},
-	apiRoute{"NewTileLayer", "POST", "/api/v1/tilelayer", NewTileLayerHandler},
-	apiRoute{"NewFeature", "POST", "/api/v1/layer/{ds}/feature", NewFeatureHandler},
-	apiRoute{"ViewFeature", "GET", "/api/v1/layer/{ds}/feature/{k}", ViewFeatureHandler},
-	apiRoute{"EditFeature", "PUT", "/api/v1/layer/{ds}/feature/{k}", EditFeatureHandler},
-
-	// Superuser apiRoutes
-	apiRoute{"NewCustomerHandler", "POST", "/api/v1/customer", NewCustomerHandler},
-	apiRoute{"AllCustomerDatasources", "GET", "/api/v1/customers", AllCustomerDatasources},
+	// Change feeds
+	apiRoute{"LayerChanges", "GET", "/api/v1/layer/{ds}/changes", LayerChangesHandler},
+
+	// Vector tiles
+	apiRoute{"VectorTile", "GET", "/api/v1/layer/{ds}/tiles/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.mvt", VectorTileHandler},
+	apiRoute{"LayerTileJSON", "GET", "/api/v1/layer/{ds}/tiles.json", LayerTileJSONHandler},
+
+	// Rendered tiles
+	apiRoute{"RasterTile", "GET", "/api/v1/layer/{ds}/render/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.png", RasterTileHandler},
+
+	// Tilesets
+	apiRoute{"UploadTileset", "POST", "/api/v1/tilelayer/mbtiles", UploadTilesetHandler},
+	apiRoute{"TilesetTile", "GET", "/api/v1/tilelayer/{id}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}", TilesetTileHandler},
+	apiRoute{"TilesetTileJSON", "GET", "/api/v1/tilelayer/{id}/tiles.json", TilesetTileJSONHandler},
+
+	// Tile proxy
+	apiRoute{"TileProxy", "GET", "/api/v1/tilelayer/{id}/proxy/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}", TileProxyHandler},
+
+	// OGC API - Features
+	apiRoute{"OgcLanding", "GET", "/ogc", OgcLandingHandler},
+	apiRoute{"OgcApi", "GET", "/ogc/api", OgcApiHandler},
+	apiRoute{"OgcConformance", "GET", "/ogc/conformance", OgcConformanceHandler},
+	apiRoute{"OgcCollections", "GET", "/ogc/collections", OgcCollectionsHandler},
+	apiRoute{"OgcCollection", "GET", "/ogc/collections/{ds}", OgcCollectionHandler},
+	apiRoute{"OgcItems", "GET", "/ogc/collections/{ds}/items", OgcItemsHandler},
+	apiRoute{"OgcItem", "GET", "/ogc/collections/{ds}/items/{k}", OgcItemHandler},
 
 	// Web Socket apiRoute
 	apiRoute{"Socket", "GET", "/ws/{ds}", serveWs},
@@ -0,0 +1,90 @@
+package gospatial
+
+import (
+	"fmt"
+)
+
+import (
+	"./utils"
+)
+
+// Apikey permission scopes on a datasource
+const (
+	// view layers, features and change feeds
+	SCOPE_READ string = "read"
+	// add, edit and lock features
+	SCOPE_WRITE string = "write"
+	// delete features and layer
+	SCOPE_DELETE string = "delete"
+	// manage webhooks and geofences, grants every scope
+	SCOPE_ADMIN string = "admin"
+)
+
+// ValidateScopes checks scope names
+// @param scopes {[]string}
+// @returns Error
+func ValidateScopes(scopes []string) error {
+	if 0 == len(scopes) {
+		return fmt.Errorf("scopes required")
+	}
+	for _, scope := range scopes {
+		switch scope {
+		case SCOPE_READ, SCOPE_WRITE, SCOPE_DELETE, SCOPE_ADMIN:
+		default:
+			return fmt.Errorf("unsupported scope: %q", scope)
+		}
+	}
+	return nil
+}
+
+// HasScope checks customer is allowed scope on datasource. Datasources
+// without scopes, such as those assigned before scopes existed, allow
+// every scope. Admin allows every scope and write or delete allow read.
+// @param datasource {string}
+// @param scope {string}
+// @returns bool
+func (self Customer) HasScope(datasource_id string, scope string) bool {
+	if !utils.StringInSlice(datasource_id, self.Datasources) {
+		return false
+	}
+	scopes, ok := self.Scopes[datasource_id]
+	if !ok {
+		return true
+	}
+	for _, granted := range scopes {
+		if granted == scope || SCOPE_ADMIN == granted || (SCOPE_READ == scope && (SCOPE_WRITE == granted || SCOPE_DELETE == granted)) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeScopes validates scopes and adds their datasources to the datasource list
+func (self *Customer) normalizeScopes() error {
+	for datasource_id, scopes := range self.Scopes {
+		err := ValidateScopes(scopes)
+		if err != nil {
+			return err
+		}
+		if !utils.StringInSlice(datasource_id, self.Datasources) {
+			self.Datasources = append(self.Datasources, datasource_id)
+		}
+	}
+	return nil
+}
+
+// setScopes returns copy of customer with scopes on datasource.
+// The cached customer is shared, so its scopes map is not modified.
+func (self Customer) setScopes(datasource_id string, scopes []string) Customer {
+	copied := make(map[string][]string)
+	for key, value := range self.Scopes {
+		copied[key] = value
+	}
+	if nil == scopes {
+		delete(copied, datasource_id)
+	} else {
+		copied[datasource_id] = scopes
+	}
+	self.Scopes = copied
+	return self
+}
@@ -0,0 +1,141 @@
+package gospatial
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/paulmach/go.geojson"
+)
+
+func TestCustomerScopes(t *testing.T) {
+	customer := Customer{Datasources: []string{"full"}, Scopes: map[string][]string{"viewer": {SCOPE_READ}, "editor": {SCOPE_WRITE}, "owner": {SCOPE_ADMIN}}}
+	err := customer.normalizeScopes()
+	if err != nil || 4 != len(customer.Datasources) {
+		t.Fatalf("Expected scope datasources added: %v %v", customer.Datasources, err)
+	}
+	expected := map[string][]bool{
+		// read, write, delete, admin
+		"full":   {true, true, true, true},
+		"viewer": {true, false, false, false},
+		"editor": {true, true, false, false},
+		"owner":  {true, true, true, true},
+		"other":  {false, false, false, false},
+	}
+	for ds, allowed := range expected {
+		for i, scope := range []string{SCOPE_READ, SCOPE_WRITE, SCOPE_DELETE, SCOPE_ADMIN} {
+			if allowed[i] != customer.HasScope(ds, scope) {
+				t.Errorf("Expected %v scope %v on %v", allowed[i], scope, ds)
+			}
+		}
+	}
+
+	err = DB.InsertCustomer(Customer{Apikey: "testBadScopes", Scopes: map[string][]string{"ds": {"superuser"}}})
+	if err == nil {
+		t.Error("Expected unsupported scope error")
+	}
+}
+
+func TestReadOnlyApikey(t *testing.T) {
+	server, ds := startSocketServer(t)
+	defer server.Close()
+	apikey := "testReadOnlyKey"
+	DB.InsertCustomer(Customer{Apikey: apikey, Scopes: map[string][]string{ds: {SCOPE_READ}}})
+
+	resp, err := http.Get(server.URL + "/api/v1/layer/" + ds + "?apikey=" + apikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if http.StatusOK != resp.StatusCode {
+		t.Errorf("Expected layer readable: %v", resp.StatusCode)
+	}
+
+	resp, err = http.Post(server.URL+"/api/v1/layer/"+ds+"/feature?apikey="+apikey, "application/json", strings.NewReader(`{"geometry":{"coordinates":[1,2],"type":"Point"},"properties":{},"type":"Feature"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if http.StatusForbidden != resp.StatusCode {
+		t.Errorf("Expected feature write forbidden: %v", resp.StatusCode)
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial(socketUrl(server, ds)+"?apikey="+apikey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ws.WriteJSON(socketMessage{Type: WS_MESSAGE_LOCK, Key: "1"})
+	reply, err := readReply(ws)
+	if err != nil || "error" != reply.Type || !strings.Contains(reply.Error, "write scope") {
+		t.Errorf("Expected lock refused: %v", reply)
+	}
+}
+
+func TestWriteApikeySyncDelete(t *testing.T) {
+	server, ds := startSocketServer(t)
+	defer server.Close()
+	apikey := "testWriteOnlyKey"
+	DB.InsertCustomer(Customer{Apikey: apikey, Scopes: map[string][]string{ds: {SCOPE_WRITE}}})
+
+	resp, err := http.Post(server.URL+"/api/v1/layer/"+ds+"/sync?apikey="+apikey, "application/json", strings.NewReader(`{"changes":[{"op":"insert","client_id":"a","feature":{"geometry":{"coordinates":[1,2],"type":"Point"},"properties":{},"type":"Feature"}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if http.StatusOK != resp.StatusCode {
+		t.Errorf("Expected sync insert allowed: %v", resp.StatusCode)
+	}
+
+	resp, err = http.Post(server.URL+"/api/v1/layer/"+ds+"/sync?apikey="+apikey, "application/json", strings.NewReader(`{"changes":[{"op":"delete","client_id":"b","geo_id":"1","base_version":1}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if http.StatusForbidden != resp.StatusCode {
+		t.Errorf("Expected sync delete forbidden: %v", resp.StatusCode)
+	}
+}
+
+func TestSocketWriteScopeDowngraded(t *testing.T) {
+	server, ds := startSocketServer(t)
+	defer server.Close()
+	apikey := "testDowngradedKey"
+	DB.InsertCustomer(Customer{Apikey: apikey, Scopes: map[string][]string{ds: {SCOPE_WRITE}}})
+	feat := geojson.NewPointFeature([]float64{1, 1})
+	err := DB.InsertFeature(ds, feat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	geo_id := feat.Properties["geo_id"].(string)
+
+	ws, _, err := websocket.DefaultDialer.Dial(socketUrl(server, ds)+"?apikey="+apikey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ws.WriteJSON(socketMessage{Type: WS_MESSAGE_LOCK, Key: geo_id})
+	reply, err := readMessage(ws, "lock", "error")
+	if err != nil || "lock" != reply.Type {
+		t.Errorf("Expected lock allowed: %v %v", reply, err)
+	}
+
+	// scopes changed while connected
+	DB.InsertCustomer(Customer{Apikey: apikey, Scopes: map[string][]string{ds: {SCOPE_READ}}})
+	ws.WriteJSON(socketMessage{Type: WS_MESSAGE_UNLOCK, Key: geo_id})
+	reply, err = readMessage(ws, "unlock", "error")
+	if err != nil || "error" != reply.Type || !strings.Contains(reply.Error, "write scope") {
+		t.Errorf("Expected unlock refused: %v %v", reply, err)
+	}
+
+	// write scope given back
+	DB.InsertCustomer(Customer{Apikey: apikey, Scopes: map[string][]string{ds: {SCOPE_WRITE}}})
+	ws.WriteJSON(socketMessage{Type: WS_MESSAGE_UNLOCK, Key: geo_id})
+	reply, err = readMessage(ws, "unlock", "error")
+	if err != nil || "unlock" != reply.Type {
+		t.Errorf("Expected unlock allowed: %v %v", reply, err)
+	}
+}
@@ -0,0 +1,235 @@
+package gospatial
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+import "github.com/boltdb/bolt"
+
+// Datasource collaborator roles
+const (
+	// full access, shares and deletes the datasource
+	ROLE_OWNER string = "owner"
+	// reads, edits and deletes features
+	ROLE_EDITOR string = "editor"
+	// reads layer and features
+	ROLE_VIEWER string = "viewer"
+)
+
+// ErrCollaboratorNotFound is returned when revoking a customer the datasource is not shared with
+var ErrCollaboratorNotFound = errors.New("collaborator not found!")
+
+// Collaborator is a customer a datasource is shared with. Datasources are
+// shared by apikey, which is not stored.
+type Collaborator struct {
+	Customer string `json:"customer"`
+	Apikey   string `json:"apikey,omitempty"`
+	Role     string `json:"role"`
+}
+
+// DatasourceShares records the owner customer id of a datasource and the
+// customers it is shared with. Access itself is granted by the
+// collaborators' scopes.
+type DatasourceShares struct {
+	Datasource    string         `json:"datasource"`
+	Owner         string         `json:"owner"`
+	Collaborators []Collaborator `json:"collaborators"`
+}
+
+// RoleScopes returns the apikey scopes granted by a shared role
+// @param role {string}
+// @returns []string
+// @returns Error
+func RoleScopes(role string) ([]string, error) {
+	switch role {
+	case ROLE_VIEWER:
+		return []string{SCOPE_READ}, nil
+	case ROLE_EDITOR:
+		return []string{SCOPE_WRITE, SCOPE_DELETE}, nil
+	}
+	return nil, fmt.Errorf("unsupported role: %q", role)
+}
+
+// removeDatasource returns copy of customer without access to datasource
+func (self Customer) removeDatasource(datasource_id string) Customer {
+	datasources := []string{}
+	for _, ds := range self.Datasources {
+		if ds != datasource_id {
+			datasources = append(datasources, ds)
+		}
+	}
+	self.Datasources = datasources
+	return self.setScopes(datasource_id, nil)
+}
+
+// GetDatasourceShares returns owner and collaborators of datasource.
+// Owner is empty for datasources created before ownership was recorded.
+// @param datasource {string}
+// @returns DatasourceShares
+// @returns Error
+func (self *Database) GetDatasourceShares(datasource_id string) (DatasourceShares, error) {
+	shares := DatasourceShares{Datasource: datasource_id, Collaborators: []Collaborator{}}
+	value, err := self.Select("shares", datasource_id)
+	if err != nil || 0 == len(value) {
+		return shares, err
+	}
+	err = json.Unmarshal(value, &shares)
+	return shares, err
+}
+
+func (self *Database) saveDatasourceShares(shares DatasourceShares) error {
+	value, err := json.Marshal(shares)
+	if err != nil {
+		return err
+	}
+	return self.Insert("shares", shares.Datasource, value)
+}
+
+// SetDatasourceOwner records customer as owner of datasource
+// @param datasource {string}
+// @param customer_id {string}
+// @returns Error
+func (self *Database) SetDatasourceOwner(datasource_id string, customer_id string) error {
+	self.share_guard.Lock()
+	defer self.share_guard.Unlock()
+	shares, err := self.GetDatasourceShares(datasource_id)
+	if err != nil {
+		return err
+	}
+	shares.Owner = customer_id
+	return self.saveDatasourceShares(shares)
+}
+
+// IsDatasourceOwner checks customer owns datasource. Datasources without
+// a recorded owner are owned by every apikey with admin scope on them.
+// @param datasource {string}
+// @param customer {Customer}
+// @returns bool
+func (self *Database) IsDatasourceOwner(datasource_id string, customer Customer) bool {
+	shares, err := self.GetDatasourceShares(datasource_id)
+	if err != nil {
+		ServerLogger.Error(err)
+		return false
+	}
+	if "" == shares.Owner {
+		return customer.HasScope(datasource_id, SCOPE_ADMIN)
+	}
+	return shares.Owner == customer.Id
+}
+
+// ShareDatasource gives the customer of apikey access to datasource with
+// role, replacing its previous role
+// @param datasource {string}
+// @param apikey {string}
+// @param role {string} ROLE_VIEWER or ROLE_EDITOR
+// @returns Collaborator
+// @returns Error
+func (self *Database) ShareDatasource(datasource_id string, apikey string, role string) (Collaborator, error) {
+	collaborator := Collaborator{Role: role}
+	scopes, err := RoleScopes(role)
+	if err != nil {
+		return collaborator, err
+	}
+
+	self.share_guard.Lock()
+	defer self.share_guard.Unlock()
+
+	shares, err := self.GetDatasourceShares(datasource_id)
+	if err != nil {
+		return collaborator, err
+	}
+
+	customer, err := self.GetCustomer(apikey)
+	if err != nil {
+		return collaborator, err
+	}
+	if customer.Id == shares.Owner {
+		return collaborator, fmt.Errorf("apikey owns datasource")
+	}
+	collaborator.Customer = customer.Id
+
+	customer = customer.removeDatasource(datasource_id)
+	customer.Datasources = append(customer.Datasources, datasource_id)
+	err = self.InsertCustomer(customer.setScopes(datasource_id, scopes))
+	if err != nil {
+		return collaborator, err
+	}
+
+	collaborators := []Collaborator{collaborator}
+	for _, other := range shares.Collaborators {
+		if customer.Id != other.Customer {
+			collaborators = append(collaborators, other)
+		}
+	}
+	shares.Collaborators = collaborators
+	return collaborator, self.saveDatasourceShares(shares)
+}
+
+// RevokeDatasource removes customer's shared access to datasource
+// @param datasource {string}
+// @param customer_id {string}
+// @returns Error
+func (self *Database) RevokeDatasource(datasource_id string, customer_id string) error {
+	self.share_guard.Lock()
+	defer self.share_guard.Unlock()
+
+	shares, err := self.GetDatasourceShares(datasource_id)
+	if err != nil {
+		return err
+	}
+
+	collaborators := []Collaborator{}
+	for _, collaborator := range shares.Collaborators {
+		if customer_id != collaborator.Customer {
+			collaborators = append(collaborators, collaborator)
+		}
+	}
+	if len(collaborators) == len(shares.Collaborators) {
+		return ErrCollaboratorNotFound
+	}
+
+	customer, err := self.GetCustomerById(customer_id)
+	if err == nil {
+		err = self.InsertCustomer(customer.removeDatasource(datasource_id))
+	}
+	if err != nil {
+		return err
+	}
+
+	shares.Collaborators = collaborators
+	return self.saveDatasourceShares(shares)
+}
+
+// deleteDatasourceShares revokes all collaborators of deleted datasource
+func (self *Database) deleteDatasourceShares(datasource_id string) error {
+	self.share_guard.Lock()
+	defer self.share_guard.Unlock()
+
+	shares, err := self.GetDatasourceShares(datasource_id)
+	if err != nil {
+		return err
+	}
+	for _, collaborator := range shares.Collaborators {
+		customer, err := self.GetCustomerById(collaborator.Customer)
+		if err != nil {
+			ServerLogger.Error(err)
+			continue
+		}
+		err = self.InsertCustomer(customer.removeDatasource(datasource_id))
+		if err != nil {
+			return err
+		}
+	}
+
+	conn := self.Connect()
+	defer conn.Close()
+	return conn.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("shares"))
+		if bucket == nil {
+			return fmt.Errorf("Bucket shares not found!")
+		}
+		return bucket.Delete([]byte(datasource_id))
+	})
+}
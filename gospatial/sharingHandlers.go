@@ -0,0 +1,55 @@
+package gospatial
+
+// viewCollaborators lists the owner of the layer and the customers it is shared with.
+// Only the layer owner can view collaborators.
+// @param apikey customer id
+// @oaram ds datasource uuid
+// @return json
+func viewCollaborators(ctx *OperationContext) (interface{}, error) {
+	err := ctx.checkOwner(ctx.Datasource())
+	if err != nil {
+		return nil, err
+	}
+	return DB.GetDatasourceShares(ctx.Datasource())
+}
+
+// shareLayer shares the layer with the customer of another apikey as viewer or editor.
+// Sharing again with a different role replaces the previous role.
+// Only the layer owner can share it.
+// @param apikey customer id
+// @oaram ds datasource uuid
+// @param data.apikey apikey to share with
+// @param data.role
+// @return json
+func shareLayer(ctx *OperationContext) (interface{}, error) {
+	err := ctx.checkOwner(ctx.Datasource())
+	if err != nil {
+		return nil, err
+	}
+	collaborator, err := DB.ShareDatasource(ctx.Datasource(), ctx.Request.Data.Apikey, ctx.Request.Data.Role)
+	if err != nil {
+		return nil, validationFailed(err)
+	}
+	return collaborator, nil
+}
+
+// revokeLayer removes shared access of a customer to the layer.
+// Only the layer owner can revoke access.
+// @param apikey customer id
+// @oaram ds datasource uuid
+// @param collaborator customer id to revoke
+// @return json
+func revokeLayer(ctx *OperationContext) (interface{}, error) {
+	err := ctx.checkOwner(ctx.Datasource())
+	if err != nil {
+		return nil, err
+	}
+	if "" == ctx.Request.Data.Collaborator {
+		return nil, ErrMissingParameters
+	}
+	err = DB.RevokeDatasource(ctx.Datasource(), ctx.Request.Data.Collaborator)
+	if err != nil {
+		return nil, err
+	}
+	return "access revoked", nil
+}
@@ -0,0 +1,105 @@
+package gospatial
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestShareLayer(t *testing.T) {
+	server := httptest.NewServer(Router())
+	defer server.Close()
+	owner, contractor := "testOwnerKey", "testContractorKey"
+	DB.InsertCustomer(Customer{Apikey: owner})
+	DB.InsertCustomer(Customer{Apikey: contractor})
+
+	request := func(method string, path string, apikey string, body string) int {
+		req, _ := http.NewRequest(method, server.URL+path+"?apikey="+apikey, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	resp, err := http.Post(server.URL+"/api/v1/layer?apikey="+owner, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := HttpMessageResponse{}
+	json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	layer := "/api/v1/layer/" + created.Datasource
+	feature := `{"geometry":{"coordinates":[1,2],"type":"Point"},"properties":{},"type":"Feature"}`
+
+	if code := request("POST", layer+"/collaborators", owner, `{"apikey": "`+contractor+`", "role": "viewer"}`); http.StatusOK != code {
+		t.Fatalf("Expected layer shared: %v", code)
+	}
+	if code := request("GET", layer, contractor, ""); http.StatusOK != code {
+		t.Errorf("Expected viewer can read layer: %v", code)
+	}
+	if code := request("POST", layer+"/feature", contractor, feature); http.StatusForbidden != code {
+		t.Errorf("Expected viewer cannot add feature: %v", code)
+	}
+
+	// editors edit features but do not own the layer
+	request("POST", layer+"/collaborators", owner, `{"apikey": "`+contractor+`", "role": "editor"}`)
+	if code := request("POST", layer+"/feature", contractor, feature); http.StatusOK != code {
+		t.Errorf("Expected editor can add feature: %v", code)
+	}
+	if code := request("DELETE", layer, contractor, ""); http.StatusForbidden != code {
+		t.Errorf("Expected editor cannot delete layer: %v", code)
+	}
+	if code := request("GET", layer+"/collaborators", contractor, ""); http.StatusForbidden != code {
+		t.Errorf("Expected editor cannot list collaborators: %v", code)
+	}
+	if code := request("POST", layer+"/collaborators", owner, `{"apikey": "`+contractor+`", "role": "superuser"}`); http.StatusBadRequest != code {
+		t.Errorf("Expected unsupported role: %v", code)
+	}
+
+	owner_customer, _ := DB.GetCustomer(owner)
+	contractor_customer, _ := DB.GetCustomer(contractor)
+	shares, _ := DB.GetDatasourceShares(created.Datasource)
+	if owner_customer.Id != shares.Owner || 1 != len(shares.Collaborators) || ROLE_EDITOR != shares.Collaborators[0].Role {
+		t.Errorf("Unexpected collaborators: %v", shares)
+	}
+
+	if code := request("DELETE", layer+"/collaborators/"+contractor_customer.Id, owner, ""); http.StatusOK != code {
+		t.Errorf("Expected access revoked: %v", code)
+	}
+	if code := request("GET", layer, contractor, ""); http.StatusUnauthorized != code {
+		t.Errorf("Expected revoked apikey cannot read layer: %v", code)
+	}
+	if code := request("DELETE", layer+"/collaborators/"+contractor_customer.Id, owner, ""); http.StatusNotFound != code {
+		t.Errorf("Expected collaborator not found: %v", code)
+	}
+
+	// deleting layer revokes collaborators, drops webhooks and geofences
+	request("POST", layer+"/collaborators", owner, `{"apikey": "`+contractor+`", "role": "viewer"}`)
+	OUTBOUND_ALLOW_PRIVATE = true
+	_, err = DB.InsertWebhook(Webhook{Datasource: created.Datasource, Url: "http://localhost/hook"})
+	OUTBOUND_ALLOW_PRIVATE = false
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = DB.InsertGeofenceSet(GeofenceSet{Datasource: "testTracked", Fences: created.Datasource})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := request("DELETE", layer, owner, ""); http.StatusOK != code {
+		t.Errorf("Expected owner can delete layer: %v", code)
+	}
+	customer, _ := DB.GetCustomer(contractor)
+	if customer.HasScope(created.Datasource, SCOPE_READ) {
+		t.Errorf("Expected collaborator access removed: %v", customer)
+	}
+	if hooks, _ := DB.GetWebhooks(created.Datasource); 0 != len(hooks) {
+		t.Errorf("Expected webhooks removed: %v", hooks)
+	}
+	if _, err := DB.GetGeofenceSet("testTracked"); ErrGeofencesNotFound != err {
+		t.Errorf("Expected geofences removed: %v", err)
+	}
+}
@@ -1,8 +1,15 @@
 package gospatial
 
 import (
+	"encoding/json"
 	"net/http"
+	"strings"
 	"sync"
+	"time"
+)
+
+import (
+	"./utils"
 )
 
 import (
@@ -10,85 +17,291 @@ import (
 	"github.com/gorilla/websocket"
 )
 
+// Websocket connection settings
+const (
+	// Time allowed to write a message to the client
+	WS_WRITE_WAIT = 10 * time.Second
+	// Time allowed to read the next pong message from the client
+	WS_PONG_WAIT = 60 * time.Second
+	// Send pings to client with this period. Must be less than WS_PONG_WAIT.
+	WS_PING_PERIOD = (WS_PONG_WAIT * 9) / 10
+	// Messages queued for a client before it is evicted as a slow consumer
+	WS_SEND_BUFFER = 256
+)
+
+// connection is a websocket client viewing a datasource. Messages are
+// queued on send and written by the connection's writer goroutine,
+// which is the only goroutine that writes to ws.
 type connection struct {
-	ws *websocket.Conn
-	ds string
-	ip string
-	c  int
+	id           uint64
+	ws           *websocket.Conn
+	ds           string
+	ip           string
+	customer     string
+	user         string
+	lock_token   string
+	apikey       string
+	send         chan []byte
+	guard        sync.RWMutex
+	subscription *subscription
+	cursor       []float64
+	viewport     []float64
+}
+
+// subscribe sets the area and filter for change events. nil receives all events.
+func (self *connection) subscribe(sub *subscription) {
+	self.guard.Lock()
+	self.subscription = sub
+	self.guard.Unlock()
+}
+
+// lockHolder returns the lock holder id of the client's feature locks
+func (self *connection) lockHolder() string {
+	return lockHolder(self.customer, self.lock_token)
+}
+
+// setPresence updates the client's cursor position and viewport
+func (self *connection) setPresence(cursor []float64, viewport []float64) {
+	self.guard.Lock()
+	self.cursor = cursor
+	self.viewport = viewport
+	self.guard.Unlock()
+}
+
+// presence returns who the client is and where it is looking
+func (self *connection) presence() presence {
+	self.guard.RLock()
+	defer self.guard.RUnlock()
+	return presence{Client: self.id, User: self.user, Cursor: self.cursor, Viewport: self.viewport}
+}
+
+// wantsChange checks change event against the connection's subscription
+func (self *connection) wantsChange(event ChangeEvent) bool {
+	self.guard.RLock()
+	defer self.guard.RUnlock()
+	return nil == self.subscription || self.subscription.matches(event)
 }
 
+// hub keeps track of websocket clients by datasource and connection id
 type hub struct {
 	guard   sync.RWMutex
-	Sockets map[string]map[int]*websocket.Conn
+	sockets map[string]map[uint64]*connection
+	next_id uint64
 }
 
 // Websocket status codes
 // http://tools.ietf.org/html/rfc6455#page-45
 
-func (self hub) broadcast(update bool, conn *connection) {
-	type Message struct {
-		Update  bool `json:"update"`
-		Viewers int  `json:"viewers"`
-	}
-	if len(self.Sockets[conn.ds]) != 0 {
-		ServerLogger.Debug("Broadcasting message to open connections")
-		self.guard.RLock()
-		viewers := len(self.Sockets[conn.ds])
-		self.guard.RUnlock()
-		msg := Message{Update: update, Viewers: viewers}
-		for i := range self.Sockets[conn.ds] {
-			if self.Sockets[conn.ds][i] != conn.ws {
-				ServerLogger.Debug("Sending message to client")
-				self.Sockets[conn.ds][i].WriteJSON(msg)
-			}
+// Hub contains active websockets for bidirectional communication
+var Hub = hub{
+	sockets: make(map[string]map[uint64]*connection),
+}
+
+// viewersMessage reports the number of clients viewing a datasource
+type viewersMessage struct {
+	Update  bool `json:"update"`
+	Viewers int  `json:"viewers"`
+}
+
+// register adds client to hub and assigns its connection id
+func (self *hub) register(conn *connection) {
+	self.guard.Lock()
+	self.next_id++
+	conn.id = self.next_id
+	if _, ok := self.sockets[conn.ds]; !ok {
+		self.sockets[conn.ds] = make(map[uint64]*connection)
+	}
+	self.sockets[conn.ds][conn.id] = conn
+	self.guard.Unlock()
+	self.broadcastViewers(conn.ds)
+	self.broadcastPresence(conn.ds)
+	self.sendTo(conn, locksMessage{Type: "locks", Locks: DB.FeatureLocks(conn.ds)})
+}
+
+// unregister removes client from hub and closes its send queue.
+// Safe to call more than once.
+func (self *hub) unregister(conn *connection) {
+	self.guard.Lock()
+	if _, ok := self.sockets[conn.ds][conn.id]; !ok {
+		self.guard.Unlock()
+		return
+	}
+	delete(self.sockets[conn.ds], conn.id)
+	if 0 == len(self.sockets[conn.ds]) {
+		delete(self.sockets, conn.ds)
+	}
+	close(conn.send)
+	self.guard.Unlock()
+	for _, lock := range DB.ReleaseClientLocks(conn.id) {
+		self.broadcast(lock.Datasource, lockMessage{Type: "unlock", FeatureLock: lock}, nil)
+	}
+	self.broadcastViewers(conn.ds)
+	self.broadcastPresence(conn.ds)
+}
+
+// Count returns number of open websocket connections
+// @returns int
+func (self *hub) Count() int {
+	self.guard.RLock()
+	defer self.guard.RUnlock()
+	n := 0
+	for ds := range self.sockets {
+		n += len(self.sockets[ds])
+	}
+	return n
+}
+
+// Viewers returns number of clients viewing datasource
+// @param ds {string}
+// @returns int
+func (self *hub) Viewers(ds string) int {
+	self.guard.RLock()
+	defer self.guard.RUnlock()
+	return len(self.sockets[ds])
+}
+
+// broadcast sends message to all clients viewing datasource that are
+// accepted by include, or to all of them when include is nil.
+// Clients whose send queue is full are evicted.
+func (self *hub) broadcast(ds string, msg interface{}, include func(*connection) bool) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		ServerLogger.Error(err)
+		return
+	}
+	slow := []*connection{}
+	self.guard.RLock()
+	for _, conn := range self.sockets[ds] {
+		if nil != include && !include(conn) {
+			continue
 		}
+		select {
+		case conn.send <- data:
+		default:
+			slow = append(slow, conn)
+		}
+	}
+	self.guard.RUnlock()
+	for _, conn := range slow {
+		NetworkLogger.Warn(conn.ip, " WS /ws/"+conn.ds+" slow consumer evicted")
+		self.unregister(conn)
 	}
 }
 
-func (self hub) broadcastAllDsViewers(update bool, ds string) {
-	type Message struct {
-		Update  bool `json:"update"`
-		Viewers int  `json:"viewers"`
+// sendTo queues message for a single client
+func (self *hub) sendTo(conn *connection, msg interface{}) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		ServerLogger.Error(err)
+		return
 	}
-	ServerLogger.Debug("Broadcasting message to open connections")
+	evict := false
 	self.guard.RLock()
-	viewers := len(self.Sockets[ds])
+	if _, ok := self.sockets[conn.ds][conn.id]; ok {
+		select {
+		case conn.send <- data:
+		default:
+			evict = true
+		}
+	}
 	self.guard.RUnlock()
-	msg := Message{Update: update, Viewers: viewers}
-	for i := range self.Sockets[ds] {
-		ServerLogger.Debug("Sending message to client")
-		self.Sockets[ds][i].WriteJSON(msg)
+	if evict {
+		NetworkLogger.Warn(conn.ip, " WS /ws/"+conn.ds+" slow consumer evicted")
+		self.unregister(conn)
 	}
 }
 
-// Hub contains active websockets for bidirectional communication
-var Hub = hub{
-	Sockets: make(map[string]map[int]*websocket.Conn),
+// broadcastViewers sends viewer count to all clients viewing datasource
+func (self *hub) broadcastViewers(ds string) {
+	ServerLogger.Debug("Broadcasting viewer count to open connections")
+	self.broadcast(ds, viewersMessage{Update: false, Viewers: self.Viewers(ds)}, nil)
+}
+
+// broadcastPresence sends the presence of every client viewing datasource to all of them
+func (self *hub) broadcastPresence(ds string) {
+	viewers := []presence{}
+	self.guard.RLock()
+	for _, conn := range self.sockets[ds] {
+		viewers = append(viewers, conn.presence())
+	}
+	self.guard.RUnlock()
+	self.broadcast(ds, presenceMessage{Type: "presence", Viewers: viewers}, nil)
+}
+
+// broadcastChange sends database change event to all viewers of the datasource
+// whose subscription matches it
+func (self *hub) broadcastChange(event ChangeEvent) {
+	ServerLogger.Debug("Broadcasting ", event.Type, " to open connections")
+	self.broadcast(event.Datasource, event, func(conn *connection) bool {
+		return conn.wantsChange(event)
+	})
+}
+
+// relay sends client message to all other viewers of the datasource
+func (self *hub) relay(conn *connection, msg socketMessage) {
+	self.broadcast(conn.ds, msg, func(other *connection) bool {
+		return other != conn
+	})
 }
 
+// messageListener reads client messages until the connection fails or
+// misses a pong. Unregisters the client on exit.
 func messageListener(conn *connection) {
 	defer func() {
-		Hub.guard.Lock()
+		Hub.unregister(conn)
 		conn.ws.Close()
-		delete(Hub.Sockets[conn.ds], conn.c)
-		if len(Hub.Sockets[conn.ds]) == 0 {
-			delete(Hub.Sockets, conn.ds)
-		}
-		Hub.guard.Unlock()
-		Hub.broadcast(false, conn)
 	}()
+	conn.ws.SetReadLimit(WS_MAX_MESSAGE_SIZE)
+	conn.ws.SetReadDeadline(time.Now().Add(WS_PONG_WAIT))
+	conn.ws.SetPongHandler(func(string) error {
+		conn.ws.SetReadDeadline(time.Now().Add(WS_PONG_WAIT))
+		return nil
+	})
 	for {
-		var m interface{}
-		err := conn.ws.ReadJSON(&m)
+		_, data, err := conn.ws.ReadMessage()
 		if err != nil {
-			ServerLogger.Warn(conn.ip, "WS /ws/"+conn.ds+" [1001]")
-			ServerLogger.Warn("%s %s", conn.ip, err)
+			NetworkLogger.Warn(conn.ip, " WS /ws/"+conn.ds+" [1001]")
+			ServerLogger.Warn(conn.ip, " ", err)
 			return
 		}
-		for i := range Hub.Sockets[conn.ds] {
-			if Hub.Sockets[conn.ds][i] != conn.ws {
-				ServerLogger.Debug("Sending message to client")
-				Hub.Sockets[conn.ds][i].WriteJSON(m)
+		// only supported message types are handled, nothing is relayed as is
+		msg, err := parseSocketMessage(data)
+		if err == nil {
+			err = socketMessageHandlers[msg.Type](conn, msg)
+		}
+		if err != nil {
+			NetworkLogger.Warn(conn.ip, " WS /ws/"+conn.ds+" invalid message: ", err)
+			Hub.sendTo(conn, socketReply{Type: "error", Error: err.Error()})
+		}
+	}
+}
+
+// messageWriter writes queued messages and pings to the client. Exits when
+// the send queue is closed or a write fails.
+func messageWriter(conn *connection) {
+	ticker := time.NewTicker(WS_PING_PERIOD)
+	defer func() {
+		ticker.Stop()
+		conn.ws.Close()
+	}()
+	for {
+		select {
+		case data, ok := <-conn.send:
+			conn.ws.SetWriteDeadline(time.Now().Add(WS_WRITE_WAIT))
+			if !ok {
+				// hub closed the queue
+				conn.ws.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			err := conn.ws.WriteMessage(websocket.TextMessage, data)
+			if err != nil {
+				return
+			}
+		case <-ticker.C:
+			conn.ws.SetWriteDeadline(time.Now().Add(WS_WRITE_WAIT))
+			err := conn.ws.WriteMessage(websocket.PingMessage, nil)
+			if err != nil {
+				return
 			}
 		}
 	}
@@ -102,25 +315,80 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
+// Websocket subprotocol. Clients that cannot set the apikey query param
+// may offer "apikey.<apikey>" alongside it as a subprotocol.
+const (
+	WS_SUBPROTOCOL        string = "gospatial"
+	WS_APIKEY_SUBPROTOCOL string = "apikey."
+)
+
+// Get apikey from websocket handshake headers, query param or subprotocol.
+// Returns apikey and subprotocol to accept.
+func getSocketApikey(r *http.Request) (string, string) {
+	apikey := getRequestApikey(r)
+	subprotocol := ""
+	for _, protocol := range websocket.Subprotocols(r) {
+		if strings.HasPrefix(protocol, WS_APIKEY_SUBPROTOCOL) {
+			if "" == apikey {
+				apikey = strings.TrimPrefix(protocol, WS_APIKEY_SUBPROTOCOL)
+			}
+			if "" == subprotocol {
+				subprotocol = protocol
+			}
+		} else if WS_SUBPROTOCOL == protocol {
+			subprotocol = protocol
+		}
+	}
+	return apikey, subprotocol
+}
+
+// serveWs upgrades request to websocket for datasource viewers.
+// Requires apikey with read scope on the datasource. Drawing and
+// feature locks also require write scope, checked on each message.
+// Viewers are shown to each other by customer id.
+// @param apikey customer id
+// @oaram ds datasource uuid
 func serveWs(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	ds := vars["ds"]
-	ip := r.RemoteAddr
-	ws, err := upgrader.Upgrade(w, r, nil)
+
+	/*=======================================*/
+	apikey, subprotocol := getSocketApikey(r)
+	if apikey == "" {
+		sendApiError(w, r, ErrUnauthorized)
+		return
+	}
+
+	customer, err := GetCustomerFromDatabase(w, r, apikey)
+	if err != nil {
+		return
+	}
+
+	if !CheckCustomerPermission(w, r, customer, ds, SCOPE_READ) {
+		return
+	}
+	/*=======================================*/
+
+	lock_token, err := utils.NewUUID()
+	if err != nil {
+		sendApiError(w, r, err)
+		return
+	}
+
+	var header http.Header
+	if "" != subprotocol {
+		header = http.Header{"Sec-Websocket-Protocol": {subprotocol}}
+	}
+	ws, err := upgrader.Upgrade(w, r, header)
 	if err != nil {
 		NetworkLogger.Critical(r.RemoteAddr, " WS /ws/"+ds+" [500]")
 		ServerLogger.Error(err)
 		return
 	}
-	conn := connection{ws: ws, ds: ds, ip: ip, c: len(Hub.Sockets[ds])}
-	if _, ok := Hub.Sockets[ds]; ok {
-		Hub.Sockets[ds][len(Hub.Sockets[ds])] = ws
-	} else {
-		Hub.Sockets[ds] = make(map[int]*websocket.Conn)
-		Hub.Sockets[ds][conn.c] = ws
-	}
 
+	conn := &connection{ws: ws, ds: ds, ip: r.RemoteAddr, customer: customer.Id, user: customer.Id, lock_token: lock_token, apikey: apikey, send: make(chan []byte, WS_SEND_BUFFER)}
 	NetworkLogger.Info(r.RemoteAddr, " WS /ws/"+ds+" [200]")
-	Hub.broadcastAllDsViewers(false, conn.ds)
-	go messageListener(&conn)
+	go messageWriter(conn)
+	Hub.register(conn)
+	go messageListener(conn)
 }
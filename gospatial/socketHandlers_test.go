@@ -0,0 +1,476 @@
+package gospatial
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/paulmach/go.geojson"
+)
+
+const testSocketApikey string = "testSocketKey"
+
+// startSocketServer creates datasource and customer and serves api routes
+func startSocketServer(t *testing.T) (*httptest.Server, string) {
+	ds, err := DB.NewLayer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = DB.InsertCustomer(Customer{Apikey: testSocketApikey, Datasources: []string{ds}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(Router()), ds
+}
+
+func socketUrl(server *httptest.Server, ds string) string {
+	return "ws" + strings.TrimPrefix(server.URL, "http") + "/ws/" + ds
+}
+
+func TestSocketRequiresApikey(t *testing.T) {
+	server, ds := startSocketServer(t)
+	defer server.Close()
+
+	_, resp, err := websocket.DefaultDialer.Dial(socketUrl(server, ds), nil)
+	if err == nil || http.StatusUnauthorized != resp.StatusCode {
+		t.Errorf("Expected unauthorized handshake: %v", err)
+	}
+
+	_, resp, err = websocket.DefaultDialer.Dial(socketUrl(server, "not_a_datasource")+"?apikey="+testSocketApikey, nil)
+	if err == nil || http.StatusUnauthorized != resp.StatusCode {
+		t.Errorf("Expected unauthorized handshake: %v", err)
+	}
+
+	// apikey as subprotocol
+	header := http.Header{"Sec-Websocket-Protocol": {WS_SUBPROTOCOL + ", " + WS_APIKEY_SUBPROTOCOL + testSocketApikey}}
+	ws, resp, err := websocket.DefaultDialer.Dial(socketUrl(server, ds), header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if WS_SUBPROTOCOL != resp.Header.Get("Sec-Websocket-Protocol") {
+		t.Errorf("Expected subprotocol: %v", resp.Header.Get("Sec-Websocket-Protocol"))
+	}
+}
+
+func TestSocketRejectsUnsupportedMessages(t *testing.T) {
+	server, ds := startSocketServer(t)
+	defer server.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial(socketUrl(server, ds)+"?apikey="+testSocketApikey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	for _, message := range []string{`{"type": "update", "update": true}`, `{"type": "draw"}`, `not json`} {
+		ws.WriteMessage(websocket.TextMessage, []byte(message))
+		reply, err := readReply(ws)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if "error" != reply.Type {
+			t.Errorf("Expected error reply for %v: %v", message, reply)
+		}
+	}
+}
+
+// readReply reads messages until a reply to the client arrives, skipping
+// viewer count, presence and lock messages broadcast by the hub
+func readReply(ws *websocket.Conn) (socketReply, error) {
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		reply := socketReply{}
+		err := ws.ReadJSON(&reply)
+		if err != nil {
+			return reply, err
+		}
+		switch reply.Type {
+		case "", "presence", "locks", "lock", "unlock":
+			continue
+		}
+		return reply, nil
+	}
+}
+
+// readMessage reads messages until a message of one of types arrives
+func readMessage(ws *websocket.Conn, types ...string) (socketReply, error) {
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		reply := socketReply{}
+		err := ws.ReadJSON(&reply)
+		if err != nil {
+			return reply, err
+		}
+		for _, message_type := range types {
+			if message_type == reply.Type {
+				return reply, nil
+			}
+		}
+	}
+}
+
+// dialSocket opens websocket for test customer
+func dialSocket(t *testing.T, server *httptest.Server, ds string) *websocket.Conn {
+	ws, _, err := websocket.DefaultDialer.Dial(socketUrl(server, ds)+"?apikey="+testSocketApikey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ws
+}
+
+// readChangeEvent reads messages until a change event of event_type arrives
+func readChangeEvent(ws *websocket.Conn, event_type string) (ChangeEvent, error) {
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		event := ChangeEvent{}
+		err := ws.ReadJSON(&event)
+		if err != nil || event_type == event.Type {
+			return event, err
+		}
+	}
+}
+
+// waitFor polls condition until it holds or timeout passes
+func waitFor(condition func() bool) bool {
+	timeout := time.Now().Add(5 * time.Second)
+	for time.Now().Before(timeout) {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestHubUniqueConnectionIds(t *testing.T) {
+	server, ds := startSocketServer(t)
+	defer server.Close()
+
+	first := dialSocket(t, server, ds)
+	defer first.Close()
+	second := dialSocket(t, server, ds)
+	third := dialSocket(t, server, ds)
+	defer third.Close()
+	if !waitFor(func() bool { return 3 == Hub.Viewers(ds) }) {
+		t.Fatalf("Expected 3 viewers: %v", Hub.Viewers(ds))
+	}
+
+	// ids must not be reused after a disconnect
+	second.Close()
+	if !waitFor(func() bool { return 2 == Hub.Viewers(ds) }) {
+		t.Fatalf("Expected 2 viewers: %v", Hub.Viewers(ds))
+	}
+	fourth := dialSocket(t, server, ds)
+	defer fourth.Close()
+	if !waitFor(func() bool { return 3 == Hub.Viewers(ds) }) {
+		t.Fatalf("Expected 3 viewers: %v", Hub.Viewers(ds))
+	}
+
+	Hub.broadcastChange(ChangeEvent{Type: FEATURE_DELETED, Datasource: ds, GeoId: "1"})
+	for _, ws := range []*websocket.Conn{first, third, fourth} {
+		event, err := readChangeEvent(ws, FEATURE_DELETED)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if "1" != event.GeoId {
+			t.Errorf("Unexpected event: %v", event)
+		}
+	}
+}
+
+func TestHubConcurrentBroadcast(t *testing.T) {
+	server, ds := startSocketServer(t)
+	defer server.Close()
+
+	clients := []*websocket.Conn{}
+	for i := 0; i < 5; i++ {
+		ws := dialSocket(t, server, ds)
+		defer ws.Close()
+		clients = append(clients, ws)
+	}
+	if !waitFor(func() bool { return 5 == Hub.Viewers(ds) }) {
+		t.Fatalf("Expected 5 viewers: %v", Hub.Viewers(ds))
+	}
+
+	// broadcast from several goroutines while other clients come and go
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				Hub.broadcastChange(ChangeEvent{Type: FEATURE_UPDATED, Datasource: ds, GeoId: fmt.Sprintf("%v-%v", i, j)})
+			}
+		}(i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ws, _, err := websocket.DefaultDialer.Dial(socketUrl(server, ds)+"?apikey="+testSocketApikey, nil)
+			if err == nil {
+				ws.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, ws := range clients {
+		for i := 0; i < 100; i++ {
+			_, err := readChangeEvent(ws, FEATURE_UPDATED)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestHubEvictsSlowConsumer(t *testing.T) {
+	server, ds := startSocketServer(t)
+	defer server.Close()
+
+	// client never reads
+	ws := dialSocket(t, server, ds)
+	defer ws.Close()
+	if !waitFor(func() bool { return 1 == Hub.Viewers(ds) }) {
+		t.Fatalf("Expected 1 viewer: %v", Hub.Viewers(ds))
+	}
+
+	payload := strings.Repeat("x", 128*1024)
+	for i := 0; i < 2*WS_SEND_BUFFER && 0 != Hub.Viewers(ds); i++ {
+		Hub.broadcast(ds, socketReply{Type: "test", Error: payload}, nil)
+	}
+	if !waitFor(func() bool { return 0 == Hub.Viewers(ds) }) {
+		t.Errorf("Slow consumer not evicted: %v", Hub.Viewers(ds))
+	}
+}
+
+// readNextChange reads messages until any change event arrives
+func readNextChange(ws *websocket.Conn) (ChangeEvent, error) {
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		event := ChangeEvent{}
+		err := ws.ReadJSON(&event)
+		if err != nil || 0 != event.Sequence {
+			return event, err
+		}
+	}
+}
+
+func TestSocketViewportSubscription(t *testing.T) {
+	server, ds := startSocketServer(t)
+	defer server.Close()
+
+	ws := dialSocket(t, server, ds)
+	defer ws.Close()
+
+	// invalid bbox
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"type": "subscribe", "bbox": [10, 10, 0, 0]}`))
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"type": "subscribe", "bbox": [0, 0, 10, 10], "filter": {"kind": "dot"}}`))
+	for _, expected := range []string{"error", "subscribed"} {
+		reply, err := readReply(ws)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected != reply.Type {
+			t.Errorf("Expected %v reply: %v", expected, reply)
+		}
+	}
+
+	point := func(name string, kind string, x float64, y float64) *geojson.Feature {
+		feat := geojson.NewPointFeature([]float64{x, y})
+		feat.Properties["name"] = name
+		feat.Properties["kind"] = kind
+		return feat
+	}
+
+	inside := point("inside", "dot", 5, 5)
+	for _, feat := range []*geojson.Feature{inside, point("outside", "dot", 20, 20), point("filtered", "square", 5, 5)} {
+		err := DB.InsertFeature(ds, feat)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	geo_id := inside.Properties["geo_id"].(string)
+
+	// moving out of the viewport is sent, further edits outside are not
+	err := DB.EditFeature(ds, geo_id, point("moved", "dot", 30, 30), ANY_VERSION, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = DB.EditFeature(ds, geo_id, point("gone", "dot", 40, 40), ANY_VERSION, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = DB.InsertFeature(ds, point("marker", "dot", 1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{"inside", "moved", "marker"} {
+		event, err := readNextChange(ws)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nil == event.Feature || expected != event.Feature.Properties["name"] {
+			t.Errorf("Expected %v change: %v", expected, event)
+		}
+	}
+}
+
+// readTyped reads messages until one of message_type arrives and decodes it into v
+func readTyped(ws *websocket.Conn, message_type string, v interface{}) error {
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return err
+		}
+		reply := socketReply{}
+		json.Unmarshal(data, &reply)
+		if message_type == reply.Type {
+			return json.Unmarshal(data, v)
+		}
+	}
+}
+
+func TestSocketPresenceAndLocks(t *testing.T) {
+	server, ds := startSocketServer(t)
+	defer server.Close()
+	err := DB.InsertCustomer(Customer{Apikey: "testSocketKey2", Datasources: []string{ds}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	feat := geojson.NewPointFeature([]float64{1, 1})
+	err = DB.InsertFeature(ds, feat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	geo_id := feat.Properties["geo_id"].(string)
+
+	customer, err := DB.GetCustomer(testSocketApikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, _, err := websocket.DefaultDialer.Dial(socketUrl(server, ds)+"?apikey="+testSocketApikey+"&user=bob", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	bob, _, err := websocket.DefaultDialer.Dial(socketUrl(server, ds)+"?apikey=testSocketKey2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	// carol shares alice's apikey
+	carol, _, err := websocket.DefaultDialer.Dial(socketUrl(server, ds)+"?apikey="+testSocketApikey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer carol.Close()
+
+	// bob sees alice's cursor, named by her customer rather than ?user=
+	alice.WriteMessage(websocket.TextMessage, []byte(`{"type": "presence", "cursor": [1, 2], "bbox": [0, 0, 10, 10]}`))
+	found := false
+	for !found {
+		msg := presenceMessage{}
+		err = readTyped(bob, "presence", &msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, viewer := range msg.Viewers {
+			if "bob" == viewer.User {
+				t.Errorf("Presence user taken from query: %v", viewer)
+			}
+			found = found || (customer.Id == viewer.User && 2 == len(viewer.Cursor) && 2 == viewer.Cursor[1])
+		}
+	}
+
+	// alice locks the feature, only she is sent the lock token
+	alice.WriteMessage(websocket.TextMessage, []byte(`{"type": "lock", "key": "`+geo_id+`"}`))
+	lock := lockMessage{}
+	err = readTyped(alice, "lock", &lock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := lock.Token
+	if geo_id != lock.GeoId || "" == token {
+		t.Errorf("Expected lock token: %v", lock)
+	}
+	lock = lockMessage{}
+	err = readTyped(bob, "lock", &lock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if geo_id != lock.GeoId || customer.Id != lock.User || "" != lock.Token {
+		t.Errorf("Unexpected lock: %v", lock)
+	}
+
+	// neither bob nor carol can claim or release it
+	for _, ws := range []*websocket.Conn{bob, carol} {
+		for _, message_type := range []string{"lock", "unlock"} {
+			ws.WriteMessage(websocket.TextMessage, []byte(`{"type": "`+message_type+`", "key": "`+geo_id+`"}`))
+			reply, err := readReply(ws)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if "error" != reply.Type {
+				t.Errorf("Expected %v error: %v", message_type, reply)
+			}
+		}
+	}
+
+	// edits require alice's lock token, even with her apikey
+	for _, edit := range []struct {
+		apikey string
+		token  string
+		status int
+	}{
+		{"testSocketKey2", "", http.StatusLocked},
+		{testSocketApikey, "", http.StatusLocked},
+		{testSocketApikey, "not_the_token", http.StatusLocked},
+		{testSocketApikey, token, http.StatusOK},
+	} {
+		body := strings.NewReader(`{"geometry":{"coordinates":[2,2],"type":"Point"},"properties":{},"type":"Feature"}`)
+		req, _ := http.NewRequest("PUT", server.URL+"/api/v1/layer/"+ds+"/feature/"+geo_id+"?apikey="+edit.apikey, body)
+		if "" != edit.token {
+			req.Header.Set("X-Lock-Token", edit.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if edit.status != resp.StatusCode {
+			t.Errorf("Expected %v status: %v", edit.status, resp.StatusCode)
+		}
+	}
+
+	// lock is released when alice disconnects
+	alice.Close()
+	err = readTyped(bob, "unlock", &lock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if geo_id != lock.GeoId {
+		t.Errorf("Unexpected unlock: %v", lock)
+	}
+	if 0 != len(DB.FeatureLocks(ds)) {
+		t.Errorf("Expected no locks: %v", DB.FeatureLocks(ds))
+	}
+
+	// releasing a feature without lock is refused, not announced
+	bob.WriteMessage(websocket.TextMessage, []byte(`{"type": "unlock", "key": "`+geo_id+`"}`))
+	reply, err := readMessage(bob, "unlock", "error")
+	if err != nil || "error" != reply.Type || !strings.Contains(reply.Error, "not locked") {
+		t.Errorf("Expected unlock refused: %v %v", reply, err)
+	}
+}
@@ -0,0 +1,202 @@
+package gospatial
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+import "github.com/paulmach/go.geojson"
+
+// Maximum size in bytes of a message read from a websocket client
+const WS_MAX_MESSAGE_SIZE int64 = 512 * 1024
+
+// Websocket client message types
+const (
+	WS_MESSAGE_PING        string = "ping"
+	WS_MESSAGE_DRAW        string = "draw"
+	WS_MESSAGE_SUBSCRIBE   string = "subscribe"
+	WS_MESSAGE_UNSUBSCRIBE string = "unsubscribe"
+	WS_MESSAGE_PRESENCE    string = "presence"
+	WS_MESSAGE_LOCK        string = "lock"
+	WS_MESSAGE_UNLOCK      string = "unlock"
+)
+
+// socketMessage is the envelope for messages sent by websocket clients.
+// Draw messages preview a feature being drawn and are relayed to the
+// other viewers of the datasource. Subscribe messages limit change events
+// to features intersecting bbox and matching filter properties. Presence
+// messages share the client's cursor and bbox viewport with other viewers.
+// Lock and unlock messages claim and release the edit lock on feature key.
+type socketMessage struct {
+	Type    string                 `json:"type"`
+	Client  uint64                 `json:"client"`
+	Key     string                 `json:"key,omitempty"`
+	Feature *geojson.Feature       `json:"feature,omitempty"`
+	Bbox    []float64              `json:"bbox,omitempty"`
+	Filter  map[string]interface{} `json:"filter,omitempty"`
+	Cursor  []float64              `json:"cursor,omitempty"`
+}
+
+// socketReply is sent back to the client for pings and invalid messages
+type socketReply struct {
+	Type  string `json:"type"`
+	Error string `json:"error,omitempty"`
+}
+
+// presence describes a client viewing a datasource
+type presence struct {
+	Client   uint64    `json:"client"`
+	User     string    `json:"user"`
+	Cursor   []float64 `json:"cursor,omitempty"`
+	Viewport []float64 `json:"bbox,omitempty"`
+}
+
+// presenceMessage lists the clients viewing a datasource
+type presenceMessage struct {
+	Type    string     `json:"type"`
+	Viewers []presence `json:"viewers"`
+}
+
+// lockMessage announces a feature lock being claimed or released.
+// Token is only sent to the lock holder, for edits of the locked feature.
+type lockMessage struct {
+	Type string `json:"type"`
+	FeatureLock
+	Token string `json:"token,omitempty"`
+}
+
+// locksMessage lists the active feature locks, sent to new clients
+type locksMessage struct {
+	Type  string        `json:"type"`
+	Locks []FeatureLock `json:"locks"`
+}
+
+// socketMessageHandlers validates and handles each supported client message type
+var socketMessageHandlers = map[string]func(*connection, socketMessage) error{
+	WS_MESSAGE_PING:        handleSocketPing,
+	WS_MESSAGE_DRAW:        handleSocketDraw,
+	WS_MESSAGE_SUBSCRIBE:   handleSocketSubscribe,
+	WS_MESSAGE_UNSUBSCRIBE: handleSocketUnsubscribe,
+	WS_MESSAGE_PRESENCE:    handleSocketPresence,
+	WS_MESSAGE_LOCK:        handleSocketLock,
+	WS_MESSAGE_UNLOCK:      handleSocketUnlock,
+}
+
+// parseSocketMessage decodes client message and checks it has a supported type
+func parseSocketMessage(data []byte) (socketMessage, error) {
+	msg := socketMessage{}
+	err := json.Unmarshal(data, &msg)
+	if err != nil {
+		return msg, err
+	}
+	if _, ok := socketMessageHandlers[msg.Type]; !ok {
+		return msg, fmt.Errorf("unsupported message type: %q", msg.Type)
+	}
+	return msg, nil
+}
+
+func handleSocketPing(conn *connection, msg socketMessage) error {
+	Hub.sendTo(conn, socketReply{Type: "pong"})
+	return nil
+}
+
+// requireSocketWriter checks client's apikey has write scope. The apikey is
+// loaded again for each message, so clients lose write access as soon as
+// their apikey is revoked, rotated out or downgraded.
+func requireSocketWriter(conn *connection, msg socketMessage) error {
+	customer, err := DB.GetCustomer(conn.apikey)
+	if err != nil || !customer.HasScope(conn.ds, SCOPE_WRITE) {
+		return fmt.Errorf("%v message requires write scope", msg.Type)
+	}
+	return nil
+}
+
+func handleSocketDraw(conn *connection, msg socketMessage) error {
+	if err := requireSocketWriter(conn, msg); err != nil {
+		return err
+	}
+	if "" == msg.Key {
+		return fmt.Errorf("draw message requires key")
+	}
+	if nil != msg.Feature && nil == msg.Feature.Geometry {
+		return fmt.Errorf("draw feature has no geometry")
+	}
+	// client id is assigned by the server
+	msg.Client = conn.id
+	Hub.relay(conn, msg)
+	return nil
+}
+
+// handleSocketSubscribe replaces the client's viewport subscription.
+// Sent again as the client pans.
+func handleSocketSubscribe(conn *connection, msg socketMessage) error {
+	sub, err := newSubscription(msg.Bbox, msg.Filter)
+	if err != nil {
+		return err
+	}
+	conn.subscribe(sub)
+	Hub.sendTo(conn, socketReply{Type: "subscribed"})
+	return nil
+}
+
+// handleSocketUnsubscribe clears the client's subscription so it receives all change events
+func handleSocketUnsubscribe(conn *connection, msg socketMessage) error {
+	conn.subscribe(nil)
+	Hub.sendTo(conn, socketReply{Type: "unsubscribed"})
+	return nil
+}
+
+// handleSocketPresence updates the client's cursor and viewport and
+// sends the presence list to all viewers
+func handleSocketPresence(conn *connection, msg socketMessage) error {
+	if 0 != len(msg.Cursor) && 2 != len(msg.Cursor) {
+		return fmt.Errorf("cursor must be [x, y]")
+	}
+	if 0 != len(msg.Bbox) && 4 != len(msg.Bbox) {
+		return fmt.Errorf("bbox must be [minx, miny, maxx, maxy]")
+	}
+	conn.setPresence(msg.Cursor, msg.Bbox)
+	Hub.broadcastPresence(conn.ds)
+	return nil
+}
+
+// handleSocketLock claims or renews the edit lock on feature key and
+// announces it to all viewers. The client is sent its lock token.
+func handleSocketLock(conn *connection, msg socketMessage) error {
+	if err := requireSocketWriter(conn, msg); err != nil {
+		return err
+	}
+	if "" == msg.Key {
+		return fmt.Errorf("lock message requires key")
+	}
+	lock, err := DB.LockFeature(conn.ds, msg.Key, conn.lockHolder(), conn.user, conn.id)
+	if ErrFeatureLocked == err {
+		return fmt.Errorf("feature locked by %v", lock.User)
+	}
+	if err != nil {
+		return err
+	}
+	Hub.broadcast(conn.ds, lockMessage{Type: "lock", FeatureLock: lock}, func(other *connection) bool {
+		return other != conn
+	})
+	Hub.sendTo(conn, lockMessage{Type: "lock", FeatureLock: lock, Token: conn.lock_token})
+	return nil
+}
+
+// handleSocketUnlock releases the client's edit lock on feature key and
+// announces it to all viewers. Features the client holds no lock on are
+// refused.
+func handleSocketUnlock(conn *connection, msg socketMessage) error {
+	if err := requireSocketWriter(conn, msg); err != nil {
+		return err
+	}
+	if "" == msg.Key {
+		return fmt.Errorf("unlock message requires key")
+	}
+	err := DB.UnlockFeature(conn.ds, msg.Key, conn.lockHolder())
+	if err != nil {
+		return err
+	}
+	Hub.broadcast(conn.ds, lockMessage{Type: "unlock", FeatureLock: FeatureLock{Datasource: conn.ds, GeoId: msg.Key, User: conn.user, Client: conn.id}}, nil)
+	return nil
+}
@@ -0,0 +1,151 @@
+package gospatial
+
+import (
+	"math"
+)
+
+import "github.com/paulmach/go.geojson"
+
+// SpatialIndex is a grid index of layer feature bounding boxes. It keeps
+// the features the layer had when it was built, so searches are not
+// affected by later edits of the layer.
+type SpatialIndex struct {
+	bounds   []float64
+	size     int
+	cell_w   float64
+	cell_h   float64
+	cells    map[int][]int
+	boxes    [][]float64
+	features []*geojson.Feature
+}
+
+// NewSpatialIndex builds index of the feature collection. The grid has
+// about one cell per feature.
+// @param geojs {*geojson.FeatureCollection}
+// @returns *SpatialIndex
+func NewSpatialIndex(geojs *geojson.FeatureCollection) *SpatialIndex {
+	index := &SpatialIndex{
+		bounds:   []float64{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)},
+		cells:    make(map[int][]int),
+		boxes:    make([][]float64, len(geojs.Features)),
+		features: make([]*geojson.Feature, len(geojs.Features)),
+	}
+	copy(index.features, geojs.Features)
+	for i, feat := range index.features {
+		if bounds, ok := geometryBounds(feat.Geometry); ok {
+			index.boxes[i] = bounds
+			index.bounds[0] = math.Min(index.bounds[0], bounds[0])
+			index.bounds[1] = math.Min(index.bounds[1], bounds[1])
+			index.bounds[2] = math.Max(index.bounds[2], bounds[2])
+			index.bounds[3] = math.Max(index.bounds[3], bounds[3])
+		}
+	}
+	index.size = int(math.Ceil(math.Sqrt(float64(len(index.features)))))
+	if 0 == index.size {
+		index.size = 1
+	}
+	// avoid zero sized cells for layers of a single point
+	index.cell_w = math.Max((index.bounds[2]-index.bounds[0])/float64(index.size), 1e-9)
+	index.cell_h = math.Max((index.bounds[3]-index.bounds[1])/float64(index.size), 1e-9)
+	for i, bounds := range index.boxes {
+		if nil == bounds {
+			continue
+		}
+		index.eachCell(bounds, func(cell int) {
+			index.cells[cell] = append(index.cells[cell], i)
+		})
+	}
+	return index
+}
+
+// eachCell calls fn with every grid cell overlapping bbox
+func (self *SpatialIndex) eachCell(bbox []float64, fn func(int)) {
+	clamp := func(v float64) int {
+		return int(math.Min(math.Max(v, 0), float64(self.size-1)))
+	}
+	min_x := clamp(math.Floor((bbox[0] - self.bounds[0]) / self.cell_w))
+	min_y := clamp(math.Floor((bbox[1] - self.bounds[1]) / self.cell_h))
+	max_x := clamp(math.Floor((bbox[2] - self.bounds[0]) / self.cell_w))
+	max_y := clamp(math.Floor((bbox[3] - self.bounds[1]) / self.cell_h))
+	for x := min_x; x <= max_x; x++ {
+		for y := min_y; y <= max_y; y++ {
+			fn(y*self.size + x)
+		}
+	}
+}
+
+// Search returns the features whose bounding box intersects bbox
+// @param bbox {[]float64} [minx, miny, maxx, maxy]
+// @returns []*geojson.Feature
+func (self *SpatialIndex) Search(bbox []float64) []*geojson.Feature {
+	results := []*geojson.Feature{}
+	if bbox[0] > self.bounds[2] || bbox[2] < self.bounds[0] || bbox[1] > self.bounds[3] || bbox[3] < self.bounds[1] {
+		return results
+	}
+	seen := make(map[int]bool)
+	self.eachCell(bbox, func(cell int) {
+		for _, i := range self.cells[cell] {
+			if seen[i] {
+				continue
+			}
+			seen[i] = true
+			box := self.boxes[i]
+			if box[0] <= bbox[2] && box[2] >= bbox[0] && box[1] <= bbox[3] && box[3] >= bbox[1] {
+				results = append(results, self.features[i])
+			}
+		}
+	})
+	return results
+}
+
+// pointInRing checks if point is inside linear ring using ray casting
+func pointInRing(point []float64, ring [][]float64) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		if (ring[i][1] > point[1]) != (ring[j][1] > point[1]) &&
+			point[0] < (ring[j][0]-ring[i][0])*(point[1]-ring[i][1])/(ring[j][1]-ring[i][1])+ring[i][0] {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// pointInPolygon checks if point is inside polygon outer ring and outside its holes
+func pointInPolygon(point []float64, polygon [][][]float64) bool {
+	if 0 == len(polygon) || !pointInRing(point, polygon[0]) {
+		return false
+	}
+	for _, hole := range polygon[1:] {
+		if pointInRing(point, hole) {
+			return false
+		}
+	}
+	return true
+}
+
+// PointInGeometry checks if point is inside a Polygon or MultiPolygon geometry
+// @param point {[]float64}
+// @param geom {*geojson.Geometry}
+// @returns bool
+func PointInGeometry(point []float64, geom *geojson.Geometry) bool {
+	if nil == geom || 2 > len(point) {
+		return false
+	}
+	switch geom.Type {
+	case geojson.GeometryPolygon:
+		return pointInPolygon(point, geom.Polygon)
+	case geojson.GeometryMultiPolygon:
+		for _, polygon := range geom.MultiPolygon {
+			if pointInPolygon(point, polygon) {
+				return true
+			}
+		}
+	case geojson.GeometryCollection:
+		for _, child := range geom.Geometries {
+			if PointInGeometry(point, child) {
+				return true
+			}
+		}
+	}
+	return false
+}
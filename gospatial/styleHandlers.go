@@ -0,0 +1,52 @@
+package gospatial
+
+import (
+	"encoding/json"
+)
+
+// decodeStyle reads http request body as layer style
+func decodeStyle(body []byte, req *TcpMessage) error {
+	req.Data.Style = &LayerStyle{}
+	return json.Unmarshal(body, req.Data.Style)
+}
+
+// setLayerStyle sets the style rendered tiles of the layer are drawn with
+// @param apikey customer id
+// @oaram ds datasource uuid
+// @return json
+func setLayerStyle(ctx *OperationContext) (interface{}, error) {
+	if nil == ctx.Request.Data.Style {
+		return nil, ErrMissingParameters
+	}
+	style := *ctx.Request.Data.Style
+	err := style.Validate()
+	if err != nil {
+		return nil, validationFailed(err)
+	}
+	err = DB.InsertLayerStyle(ctx.Datasource(), style)
+	if err != nil {
+		return nil, err
+	}
+	return style, nil
+}
+
+// viewLayerStyle returns the style of the layer, the default style if
+// none was set
+// @param apikey customer id
+// @oaram ds datasource uuid
+// @return json
+func viewLayerStyle(ctx *OperationContext) (interface{}, error) {
+	return DB.GetLayerStyle(ctx.Datasource())
+}
+
+// deleteLayerStyle resets the layer to the default style
+// @param apikey customer id
+// @oaram ds datasource uuid
+// @return json
+func deleteLayerStyle(ctx *OperationContext) (interface{}, error) {
+	err := DB.DeleteLayerStyle(ctx.Datasource())
+	if err != nil {
+		return nil, err
+	}
+	return "style deleted", nil
+}
@@ -0,0 +1,127 @@
+package gospatial
+
+import (
+	"fmt"
+	"math"
+)
+
+import "github.com/paulmach/go.geojson"
+
+// subscription limits the change events sent to a websocket client to
+// features intersecting its viewport and matching its property filter.
+type subscription struct {
+	Bbox   []float64
+	Filter map[string]interface{}
+}
+
+// newSubscription validates bbox [minx, miny, maxx, maxy] and filter
+func newSubscription(bbox []float64, filter map[string]interface{}) (*subscription, error) {
+	if 4 != len(bbox) {
+		return nil, fmt.Errorf("bbox must be [minx, miny, maxx, maxy]")
+	}
+	if bbox[0] > bbox[2] || bbox[1] > bbox[3] {
+		return nil, fmt.Errorf("bbox min is greater than max")
+	}
+	return &subscription{Bbox: bbox, Filter: filter}, nil
+}
+
+// matches checks if change event is visible to the subscriber. Layer events
+// always match. Feature events match if the feature before or after the
+// change is in the subscribed area, so clients see features leave it too.
+func (self *subscription) matches(event ChangeEvent) bool {
+	if nil == event.Feature && nil == event.Previous {
+		return "" == event.GeoId
+	}
+	return self.matchesFeature(event.Feature) || self.matchesFeature(event.Previous)
+}
+
+// matchesFeature checks feature geometry against bbox and properties against filter
+func (self *subscription) matchesFeature(feat *geojson.Feature) bool {
+	if nil == feat {
+		return false
+	}
+	for key, value := range self.Filter {
+		if fmt.Sprintf("%v", value) != fmt.Sprintf("%v", feat.Properties[key]) {
+			return false
+		}
+	}
+	bounds, ok := geometryBounds(feat.Geometry)
+	if !ok {
+		return false
+	}
+	return bounds[0] <= self.Bbox[2] && bounds[2] >= self.Bbox[0] &&
+		bounds[1] <= self.Bbox[3] && bounds[3] >= self.Bbox[1]
+}
+
+// geometryBounds returns [minx, miny, maxx, maxy] of geometry
+// @param geom {*geojson.Geometry}
+// @returns []float64, bool false if geometry has no coordinates
+func geometryBounds(geom *geojson.Geometry) ([]float64, bool) {
+	bounds := []float64{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+	extend := func(point []float64) {
+		if 2 > len(point) {
+			return
+		}
+		bounds[0] = math.Min(bounds[0], point[0])
+		bounds[1] = math.Min(bounds[1], point[1])
+		bounds[2] = math.Max(bounds[2], point[0])
+		bounds[3] = math.Max(bounds[3], point[1])
+	}
+	var walk func(geom *geojson.Geometry)
+	walk = func(geom *geojson.Geometry) {
+		if nil == geom {
+			return
+		}
+		switch geom.Type {
+		case geojson.GeometryPoint:
+			extend(geom.Point)
+		case geojson.GeometryMultiPoint:
+			for _, point := range geom.MultiPoint {
+				extend(point)
+			}
+		case geojson.GeometryLineString:
+			for _, point := range geom.LineString {
+				extend(point)
+			}
+		case geojson.GeometryMultiLineString:
+			for _, line := range geom.MultiLineString {
+				for _, point := range line {
+					extend(point)
+				}
+			}
+		case geojson.GeometryPolygon:
+			for _, ring := range geom.Polygon {
+				for _, point := range ring {
+					extend(point)
+				}
+			}
+		case geojson.GeometryMultiPolygon:
+			for _, polygon := range geom.MultiPolygon {
+				for _, ring := range polygon {
+					for _, point := range ring {
+						extend(point)
+					}
+				}
+			}
+		case geojson.GeometryCollection:
+			for _, child := range geom.Geometries {
+				walk(child)
+			}
+		}
+	}
+	walk(geom)
+	return bounds, bounds[0] <= bounds[2]
+}
+
+// layerBounds returns [minx, miny, maxx, maxy] of layer features
+// @param geojs {*geojson.FeatureCollection}
+// @returns []float64, bool false if no feature has coordinates
+func layerBounds(geojs *geojson.FeatureCollection) ([]float64, bool) {
+	bounds := []float64{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+	for _, feat := range geojs.Features {
+		if box, ok := geometryBounds(feat.Geometry); ok {
+			bounds = []float64{math.Min(bounds[0], box[0]), math.Min(bounds[1], box[1]), math.Max(bounds[2], box[2]), math.Max(bounds[3], box[3])}
+		}
+	}
+	return bounds, bounds[0] <= bounds[2]
+}
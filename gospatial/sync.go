@@ -0,0 +1,278 @@
+package gospatial
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/paulmach/go.geojson"
+)
+
+// Sync change operations
+const (
+	SYNC_INSERT string = "insert"
+	SYNC_UPDATE string = "update"
+	SYNC_PATCH  string = "patch"
+	SYNC_DELETE string = "delete"
+)
+
+// ErrInvalidSyncChange is returned for sync changes missing the fields
+// of their op
+var ErrInvalidSyncChange = errors.New("invalid sync change")
+
+// SyncChange is a change made by an offline client. Updates, patches and
+// deletes carry the feature version the client edited, 0 for features
+// stored before versions were counted. Changes with a client_id are
+// applied once, retries return the original result.
+type SyncChange struct {
+	Op          string           `json:"op"`
+	ClientId    string           `json:"client_id"`
+	GeoId       string           `json:"geo_id"`
+	BaseVersion *int             `json:"base_version"`
+	Feature     *geojson.Feature `json:"feature"`
+}
+
+// SyncRequest carries the client's sync token and local changes
+type SyncRequest struct {
+	Token   string       `json:"token"`
+	Changes []SyncChange `json:"changes"`
+}
+
+// SyncApplied reports a client change stored by the server
+type SyncApplied struct {
+	Op       string `json:"op"`
+	ClientId string `json:"client_id,omitempty"`
+	GeoId    string `json:"geo_id"`
+	Version  int    `json:"version"`
+}
+
+// SyncConflict reports a client change that was not stored, with the
+// client's feature and the feature currently on the server.
+type SyncConflict struct {
+	Op       string           `json:"op"`
+	ClientId string           `json:"client_id,omitempty"`
+	GeoId    string           `json:"geo_id"`
+	Reason   string           `json:"reason"`
+	Local    *geojson.Feature `json:"local"`
+	Server   *geojson.Feature `json:"server"`
+}
+
+// SyncResult is returned to the client. Changes holds every change made
+// by others since the client's token. When Reset is set the token could
+// not be resumed and Layer holds the whole layer instead.
+type SyncResult struct {
+	Token     string                     `json:"token"`
+	Reset     bool                       `json:"reset,omitempty"`
+	Layer     *geojson.FeatureCollection `json:"layer,omitempty"`
+	Applied   []SyncApplied              `json:"applied"`
+	Conflicts []SyncConflict             `json:"conflicts"`
+	Changes   []ChangeEvent              `json:"changes"`
+}
+
+// Validate checks sync change has the fields its op needs. Returns an
+// error wrapping ErrInvalidSyncChange.
+// @returns Error
+func (self SyncChange) Validate() error {
+	switch self.Op {
+	case SYNC_INSERT:
+		if nil == self.Feature {
+			return fmt.Errorf("%w: %v change requires feature", ErrInvalidSyncChange, self.Op)
+		}
+	case SYNC_UPDATE, SYNC_PATCH:
+		if nil == self.Feature {
+			return fmt.Errorf("%w: %v change requires feature", ErrInvalidSyncChange, self.Op)
+		}
+		fallthrough
+	case SYNC_DELETE:
+		if "" == self.GeoId || nil == self.BaseVersion || 0 > *self.BaseVersion {
+			return fmt.Errorf("%w: %v change requires geo_id and base_version", ErrInvalidSyncChange, self.Op)
+		}
+	default:
+		return fmt.Errorf("%w: unsupported change op: %q", ErrInvalidSyncChange, self.Op)
+	}
+	return nil
+}
+
+// Sync applies offline client changes to layer and returns the changes
+// made since the client's token. Changes that conflict with the server
+// version of a feature are not applied and are returned as conflicts.
+// Changes are validated first, none are applied if one is invalid.
+// @param datasource {string}
+// @param request {SyncRequest}
+// @param editor {string} customer id making the changes, or lock holder id when sent with a lock token
+// @returns SyncResult
+// @returns Error
+func (self *Database) Sync(datasource_id string, request SyncRequest, editor string) (SyncResult, error) {
+	result := SyncResult{Applied: []SyncApplied{}, Conflicts: []SyncConflict{}, Changes: []ChangeEvent{}}
+
+	for _, change := range request.Changes {
+		err := change.Validate()
+		if err != nil {
+			return result, err
+		}
+	}
+
+	_, err := self.GetLayer(datasource_id)
+	if err != nil {
+		return result, err
+	}
+
+	// versions written by this sync, so they are not sent back
+	own := make(map[string]int)
+	// retries of a change may be sent concurrently
+	self.sync_guard.Lock()
+	for _, change := range request.Changes {
+		applied, ok, err := self.syncClientResult(datasource_id, change.ClientId)
+		if err != nil {
+			self.sync_guard.Unlock()
+			return result, err
+		}
+		if !ok {
+			var conflict *SyncConflict
+			applied, conflict = self.applySyncChange(datasource_id, change, editor)
+			if nil != conflict {
+				result.Conflicts = append(result.Conflicts, *conflict)
+				continue
+			}
+			err = self.saveSyncClientResult(datasource_id, applied)
+			if err != nil {
+				ServerLogger.Error(err)
+			}
+		}
+		own[applied.GeoId] = applied.Version
+		result.Applied = append(result.Applied, applied)
+	}
+	self.sync_guard.Unlock()
+
+	seq := self.Sequence()
+	since, err := strconv.ParseUint(request.Token, 10, 64)
+	if err == nil {
+		var events []ChangeEvent
+		events, err = self.ChangesSince(datasource_id, since)
+		for _, event := range events {
+			if version, ok := own[event.GeoId]; ok && version == FeatureVersion(event.Feature) {
+				continue
+			}
+			result.Changes = append(result.Changes, event)
+			if event.Sequence > seq {
+				seq = event.Sequence
+			}
+		}
+	}
+
+	// no token or changes no longer stored, client reloads layer
+	if err != nil {
+		result.Reset = true
+		result.Changes = []ChangeEvent{}
+		result.Layer, err = self.GetLayer(datasource_id)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	result.Token = fmt.Sprintf("%v", seq)
+	return result, nil
+}
+
+// applySyncChange writes one client change. Returns a conflict if it was not applied.
+func (self *Database) applySyncChange(datasource_id string, change SyncChange, editor string) (SyncApplied, *SyncConflict) {
+	applied := SyncApplied{Op: change.Op, ClientId: change.ClientId, GeoId: change.GeoId}
+
+	var err error
+	switch change.Op {
+	case SYNC_INSERT:
+		err = self.InsertFeature(datasource_id, change.Feature)
+		if err == nil {
+			applied.GeoId = fmt.Sprintf("%v", change.Feature.Properties["geo_id"])
+		}
+	case SYNC_UPDATE:
+		err = self.EditFeature(datasource_id, change.GeoId, change.Feature, *change.BaseVersion, editor)
+	case SYNC_PATCH:
+		err = self.PatchFeature(datasource_id, change.GeoId, change.Feature, *change.BaseVersion, editor)
+	case SYNC_DELETE:
+		err = self.DeleteFeature(datasource_id, change.GeoId, *change.BaseVersion, editor)
+		if ErrFeatureNotFound == err {
+			// already deleted
+			err = nil
+		}
+	}
+
+	if err == nil {
+		if nil != change.Feature && SYNC_DELETE != change.Op {
+			applied.Version = FeatureVersion(change.Feature)
+		}
+		return applied, nil
+	}
+
+	conflict := &SyncConflict{Op: change.Op, ClientId: change.ClientId, GeoId: change.GeoId, Local: change.Feature}
+	switch err {
+	case ErrVersionConflict:
+		conflict.Reason = "version"
+	case ErrFeatureNotFound:
+		conflict.Reason = "deleted"
+	case ErrFeatureLocked:
+		conflict.Reason = "locked"
+	default:
+		conflict.Reason = err.Error()
+	}
+	conflict.Server, _ = self.GetFeature(datasource_id, change.GeoId)
+	return applied, conflict
+}
+
+// syncClientKey is the sync_clients table key of client change id
+func syncClientKey(datasource_id string, client_id string) string {
+	return datasource_id + "/" + client_id
+}
+
+// syncClientResult returns result of client change applied before, false
+// if it was not
+func (self *Database) syncClientResult(datasource_id string, client_id string) (SyncApplied, bool, error) {
+	applied := SyncApplied{}
+	if "" == client_id {
+		return applied, false, nil
+	}
+	value, err := self.Select("sync_clients", syncClientKey(datasource_id, client_id))
+	if err != nil || 0 == len(value) {
+		return applied, false, err
+	}
+	err = json.Unmarshal(value, &applied)
+	return applied, nil == err, err
+}
+
+// saveSyncClientResult records result of applied client change
+func (self *Database) saveSyncClientResult(datasource_id string, applied SyncApplied) error {
+	if "" == applied.ClientId {
+		return nil
+	}
+	value, err := json.Marshal(applied)
+	if err != nil {
+		return err
+	}
+	return self.Insert("sync_clients", syncClientKey(datasource_id, applied.ClientId), value)
+}
+
+// deleteSyncClients removes the recorded client changes of datasource
+func (self *Database) deleteSyncClients(datasource_id string) error {
+	conn := self.Connect()
+	defer conn.Close()
+	return conn.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("sync_clients"))
+		if bucket == nil {
+			return fmt.Errorf("Bucket sync_clients not found!")
+		}
+		prefix := []byte(syncClientKey(datasource_id, ""))
+		cursor := bucket.Cursor()
+		for key, _ := cursor.Seek(prefix); nil != key && bytes.HasPrefix(key, prefix); key, _ = cursor.Seek(prefix) {
+			err := cursor.Delete()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
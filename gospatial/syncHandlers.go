@@ -0,0 +1,34 @@
+package gospatial
+
+import (
+	"encoding/json"
+)
+
+// decodeSync reads http request body as the sync request
+func decodeSync(body []byte, req *TcpMessage) error {
+	req.Data.Sync = &SyncRequest{}
+	return json.Unmarshal(body, req.Data.Sync)
+}
+
+// syncLayer applies changes made by an offline client and returns
+// conflicts, the changes made since the client's sync token and a new token.
+// @param apikey customer id
+// @oaram ds datasource uuid
+// @return json
+func syncLayer(ctx *OperationContext) (interface{}, error) {
+	request := ctx.Request.Data.Sync
+	if nil == request {
+		return nil, ErrMissingParameters
+	}
+	// deletes need the same scope as delete_feature
+	for _, change := range request.Changes {
+		if SYNC_DELETE == change.Op {
+			err := ctx.CheckDatasource(ctx.Datasource(), SCOPE_DELETE)
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	return DB.Sync(ctx.Datasource(), *request, ctx.editor())
+}
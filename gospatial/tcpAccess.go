@@ -0,0 +1,77 @@
+package gospatial
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+)
+
+// Networks allowed to connect to the tcp server when none are configured
+var TCP_DEFAULT_ALLOWED_CIDRS = []string{"127.0.0.0/8", "::1/128"}
+
+// ParseCIDRs parses allowlist of CIDR ranges
+// @param cidrs {[]string}
+// @returns []*net.IPNet
+// @returns Error
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// NewTcpTLSConfig loads tls certificate of the tcp server. Client
+// certificates signed by client_ca are required when it is not empty.
+// @param cert_file {string}
+// @param key_file {string}
+// @param client_ca {string} optional
+// @returns *tls.Config
+// @returns Error
+func NewTcpTLSConfig(cert_file string, key_file string, client_ca string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cert_file, key_file)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if "" != client_ca {
+		pem, err := ioutil.ReadFile(client_ca)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %v", client_ca)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// allowed checks remote address is in the allowed networks
+func (self TcpServer) allowed(addr net.Addr) bool {
+	networks := self.AllowedNetworks
+	if 0 == len(networks) {
+		networks, _ = ParseCIDRs(TCP_DEFAULT_ALLOWED_CIDRS)
+	}
+	ip := net.ParseIP(tcpHost(addr))
+	if nil == ip {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package gospatial
+
+import (
+	"crypto/subtle"
+	"net"
+	"sync"
+	"time"
+)
+
+// Roles of tcp connections and http authkeys
+const (
+	// unauthenticated connections
+	TCP_ROLE_NONE string = ""
+	// read-only operators authenticated with OperatorKey
+	TCP_ROLE_OPERATOR string = "operator"
+	// superusers authenticated with SuperuserKey
+	TCP_ROLE_SUPERUSER string = "superuser"
+)
+
+// Failed authenticate attempts from a host before it is locked out
+var TCP_AUTH_MAX_ATTEMPTS int = 5
+
+// Time a host is locked out after too many failed authenticate attempts
+var TCP_AUTH_LOCKOUT time.Duration = 5 * time.Minute
+
+// tcpRoleAllows checks role is at least the required role
+func tcpRoleAllows(role string, required string) bool {
+	switch required {
+	case TCP_ROLE_NONE:
+		return true
+	case TCP_ROLE_OPERATOR:
+		return TCP_ROLE_OPERATOR == role || TCP_ROLE_SUPERUSER == role
+	}
+	return TCP_ROLE_SUPERUSER == role
+}
+
+// authkeyRole returns the role of superuser or operator authkey
+// @param authkey {string}
+// @returns string role
+func authkeyRole(authkey string) string {
+	switch {
+	case "" != SuperuserKey && 1 == subtle.ConstantTimeCompare([]byte(SuperuserKey), []byte(authkey)):
+		return TCP_ROLE_SUPERUSER
+	case "" != OperatorKey && 1 == subtle.ConstantTimeCompare([]byte(OperatorKey), []byte(authkey)):
+		return TCP_ROLE_OPERATOR
+	}
+	return TCP_ROLE_NONE
+}
+
+// authFailures counts failed authenticate attempts of a host
+type authFailures struct {
+	count        int
+	locked_until time.Time
+}
+
+// TcpLockout locks out hosts after TCP_AUTH_MAX_ATTEMPTS failed
+// authenticate attempts
+type TcpLockout struct {
+	guard    sync.Mutex
+	failures map[string]*authFailures
+}
+
+var tcp_lockout = &TcpLockout{failures: make(map[string]*authFailures)}
+
+// tcpHost returns host of remote address, failures are counted per host
+func tcpHost(addr net.Addr) string {
+	return remoteHost(addr.String())
+}
+
+// remoteHost returns host of a host:port address, such as http request
+// RemoteAddr
+func remoteHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// Authenticate returns the role of authkey. Hosts that are locked out are
+// refused without checking authkey.
+// @param host {string}
+// @param authkey {string}
+// @returns string role
+// @returns bool host is locked out
+func (self *TcpLockout) Authenticate(host string, authkey string) (string, bool) {
+	self.guard.Lock()
+	defer self.guard.Unlock()
+
+	failures, ok := self.failures[host]
+	if ok && time.Now().Before(failures.locked_until) {
+		return TCP_ROLE_NONE, true
+	}
+
+	role := authkeyRole(authkey)
+	if TCP_ROLE_NONE != role {
+		delete(self.failures, host)
+		return role, false
+	}
+
+	if !ok {
+		failures = &authFailures{}
+		self.failures[host] = failures
+	}
+	failures.count++
+	if TCP_AUTH_MAX_ATTEMPTS <= failures.count {
+		NetworkLogger.Warn("Locked out ", host, " after ", failures.count, " failed authenticate attempts [TCP]")
+		failures.count = 0
+		failures.locked_until = time.Now().Add(TCP_AUTH_LOCKOUT)
+	}
+	return TCP_ROLE_NONE, false
+}
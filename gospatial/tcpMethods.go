@@ -0,0 +1,38 @@
+package gospatial
+
+// TcpParam describes a tcp method parameter. Names of parameters inside
+// the data object are prefixed with "data.".
+type TcpParam struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Required bool   `json:"required"`
+}
+
+// TcpMethod describes a tcp method, the least role allowed to call it,
+// the apikey scope needed on the datasource and the http routes of the
+// same operation.
+type TcpMethod struct {
+	Method string     `json:"method"`
+	Role   string     `json:"role"`
+	Scope  string     `json:"scope,omitempty"`
+	Params []TcpParam `json:"params"`
+	Http   []string   `json:"http,omitempty"`
+}
+
+// tcp_methods lists the tcp methods in help order, the methods handled by
+// the connection followed by the operations
+var tcp_methods = append(tcp_connection_methods, operationTcpMethods()...)
+
+// tcp_connection_methods are handled by the tcp connection
+var tcp_connection_methods = []TcpMethod{
+	{Method: "help", Role: TCP_ROLE_NONE, Params: []TcpParam{}},
+	{Method: "authenticate", Role: TCP_ROLE_NONE, Params: []TcpParam{
+		{"authkey", "string", true}}},
+	{Method: "batch", Role: TCP_ROLE_NONE, Params: []TcpParam{
+		{"data.requests", "array", true}}},
+	{Method: "subscribe", Role: TCP_ROLE_NONE, Params: []TcpParam{
+		{"data.datasources", "array", false},
+		{"apikey", "string", false}}},
+	{Method: "unsubscribe", Role: TCP_ROLE_NONE, Params: []TcpParam{
+		{"data.datasources", "array", false}}},
+}
@@ -2,6 +2,7 @@ package gospatial
 
 import (
 	"bufio"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,7 +11,11 @@ import (
 	"net/textproto"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 import (
@@ -26,13 +31,18 @@ const (
 )
 
 var (
-	ActiveTcpClients int
+	// open tcp connections, updated atomically
+	ActiveTcpClients int64
 )
 
+// TcpServer serves the tcp protocol on Host and Port. Connections are
+// accepted from AllowedNetworks, or loopback when it is empty, and use
+// tls when TLSConfig is set.
 type TcpServer struct {
-	Host             string
-	Port             string
-	ActiveTcpClients int
+	Host            string
+	Port            string
+	TLSConfig       *tls.Config
+	AllowedNetworks []*net.IPNet
 }
 
 func (self TcpServer) Start() {
@@ -49,7 +59,14 @@ func (self TcpServer) Start() {
 		}
 
 		// Listen for incoming connections.
-		l, err := net.Listen(TCP_DEFAULT_CONN_TYPE, host+":"+port)
+		address := net.JoinHostPort(host, port)
+		var l net.Listener
+		var err error
+		if nil != self.TLSConfig {
+			l, err = tls.Listen(TCP_DEFAULT_CONN_TYPE, address, self.TLSConfig)
+		} else {
+			l, err = net.Listen(TCP_DEFAULT_CONN_TYPE, address)
+		}
 		if err != nil {
 			ServerLogger.Error("Error listening:", err.Error())
 			panic(err)
@@ -58,7 +75,7 @@ func (self TcpServer) Start() {
 		// Close the listener when the application closes.
 		defer l.Close()
 
-		ServerLogger.Info("Tcp Listening on " + host + ":" + port)
+		ServerLogger.Info("Tcp Listening on " + address)
 
 		for {
 			// Listen for an incoming connection.
@@ -70,11 +87,12 @@ func (self TcpServer) Start() {
 
 			NetworkLogger.Info("Connection open ", conn.RemoteAddr().String(), " [TCP]")
 
-			// check for local connection
-			if strings.Contains(conn.RemoteAddr().String(), "127.0.0.1") {
+			// check connection is from allowed network
+			if self.allowed(conn.RemoteAddr()) {
 				// Handle connections in a new goroutine.
 				go self.tcpClientHandler(conn)
 			} else {
+				NetworkLogger.Warn("Connection refused ", conn.RemoteAddr().String(), " [TCP]")
 				conn.Close()
 			}
 
@@ -84,14 +102,31 @@ func (self TcpServer) Start() {
 
 // close tcp client
 func (self TcpServer) closeClient(conn net.Conn) {
-	ActiveTcpClients--
+	atomic.AddInt64(&ActiveTcpClients, -1)
 	conn.Close()
 }
 
+// Requests of one connection processed concurrently
+var TCP_MAX_PIPELINE int = 32
+
+// tcpConnection is a tcp client connection. Requests are processed
+// concurrently and responses written in the order they complete, so
+// pipelining clients correlate them by request id.
+type tcpConnection struct {
+	server       TcpServer
+	conn         net.Conn
+	role         string
+	guard        sync.Mutex
+	pending      sync.WaitGroup
+	slots        chan bool
+	subscription tcpSubscription
+	done         chan bool
+}
+
 // Handles incoming requests.
 func (self TcpServer) tcpClientHandler(conn net.Conn) {
 
-	ActiveTcpClients++
+	atomic.AddInt64(&ActiveTcpClients, 1)
 
 	reader := bufio.NewReader(conn)
 	tp := textproto.NewReader(reader)
@@ -99,322 +134,134 @@ func (self TcpServer) tcpClientHandler(conn net.Conn) {
 	//	defer conn.Close()
 	defer self.closeClient(conn)
 
-	// DEBUGGING
-	authenticated := true
+	// connections start unauthenticated
+	client := &tcpConnection{server: self, conn: conn, role: TCP_ROLE_NONE, slots: make(chan bool, TCP_MAX_PIPELINE), done: make(chan bool)}
+	defer client.closeSubscription()
+	defer client.pending.Wait()
 
 	for {
 
 		// will listen for message to process ending in newline (\n)
 		//message, _ := bufio.NewReader(conn).ReadString('\n') // sometimes read partial messages
-		message, _ := tp.ReadLine()
+		message, err := tp.ReadLine()
+		if err != nil {
+			NetworkLogger.Info("Connection closed", " [TCP]")
+			return
+		}
 
 		// output message received
-		NetworkLogger.Info("[TCP] Message Received: ", string([]byte(message)))
+		NetworkLogger.Info("[TCP] Message Received: ", redactTcpMessage(message))
 
 		// json parse message
 		req := TcpMessage{}
-		err := json.Unmarshal([]byte(message), &req)
+		err = json.Unmarshal([]byte(message), &req)
 		if err != nil {
 
 			// invalid message
 			// close connection
 			// '\x04' end of transmittion character
 			NetworkLogger.Warn("error:", err)
-			resp := `{"status": "error", "error": "` + fmt.Sprintf("%v", err) + `",""}`
-			conn.Write([]byte(resp + "\n"))
+			client.write(validationFailed(err).Response())
 			NetworkLogger.Info("Connection closed", " [TCP]")
 			return
 
-		} else {
-
-			success := false
-			var resp string
-			switch {
-
-			case req.Method == "ping":
-				resp = `{"status": "ok", "data": { "message": "pong", "version": "` + VERSION + `"}}`
-				success = true
-
-			case req.Method == "help":
-				conn.Write([]byte("Methods:\n"))
-				conn.Write([]byte("\t ping\n"))
-				conn.Write([]byte("\t assign_datasource\n"))
-				conn.Write([]byte("\t create_apikey\n"))
-				conn.Write([]byte("\t insert_apikey\n"))
-				conn.Write([]byte("\t insert_feature\n"))
-				conn.Write([]byte("\t edit_feature\n"))
-				conn.Write([]byte("\t create_datasource\n"))
-				conn.Write([]byte("\t export_apikeys\n"))
-				conn.Write([]byte("\t export_apikey\n"))
-				conn.Write([]byte("\t export_datasources\n"))
-				conn.Write([]byte("\t export_datasource\n"))
-				conn.Write([]byte("\t import_file\n"))
-				success = true
-
-			case req.Method == "authenticate":
-				// {"method":"authenticate", "authkey": "7q1qcqmsxnvw"}
-				authenticated = SuperuserKey == req.Authkey
-				if authenticated {
-					resp := `{"status": "ok", "data": {}}`
-					conn.Write([]byte(resp + "\n"))
-				} else {
-					NetworkLogger.Warn("error: incorrect authkey", " [TCP]")
-					resp := `{"status": "error", "error": "incorrect authkey"}`
-					conn.Write([]byte(resp + "\n"))
-				}
-				success = true
-
-			// APIKEYS
-			case req.Method == "create_apikey" && authenticated:
-				resp = self.create_apikey(req)
-				success = true
-
-			case req.Method == "insert_apikey" && authenticated:
-				resp = self.insert_apikey(req)
-				success = true
-
-			case req.Method == "export_apikeys" && authenticated:
-				resp = self.export_apikeys(req)
-				success = true
-
-			case req.Method == "export_apikey" && authenticated:
-				resp = self.export_apikey(req)
-				success = true
-
-			case req.Method == "insert_feature" && authenticated:
-				resp = self.insert_feature(req)
-				success = true
-
-			case req.Method == "edit_feature" && authenticated:
-				resp = self.edit_feature(req)
-				success = true
-
-			// DATASOURCES
-			case req.Method == "assign_datasource" && authenticated:
-				resp = self.assign_datasource(req)
-				success = true
-
-			case req.Method == "create_datasource" && authenticated:
-				resp = self.create_datasource(req)
-				success = true
-
-			// TODO: ERROR HANDLING
-			case req.Method == "export_datasources" && authenticated:
-				resp = self.export_datasources(req)
-				success = true
-
-			case req.Method == "export_datasource" && authenticated:
-				resp = self.export_datasource(req)
-				success = true
-
-			case req.Method == "import_file" && authenticated:
-				resp = self.import_file(req)
-				success = true
-			}
-
-			if !authenticated {
-				resp = `{"status": "error", "error": "connection not authenticated"}`
-			} else if !success {
-				resp = `{"status": "error", "error": "method not found"}`
-			}
-
-			conn.Write([]byte(resp + "\n"))
-
 		}
 
-	}
-}
-
-// APIKEYS
-func (self TcpServer) create_apikey(req TcpMessage) string {
-	// {"method":"create_apikey"}
-	apikey := utils.NewAPIKey(12)
-	customer := Customer{Apikey: apikey}
-	resp := `{"status": "ok", "data": {"apikey": "` + apikey + `"}}`
-	err := DB.InsertCustomer(customer)
-	if err != nil {
-		fmt.Println(err)
-		resp = `{"status": "error", "error": "` + err.Error() + `"}`
-	}
-	return resp
-}
+		// authenticate changes the role of requests read after it
+		if "authenticate" == req.Method {
+			client.write(client.call(client.role, req))
+			continue
+		}
 
-func (self TcpServer) insert_apikey(req TcpMessage) string {
-	// {"method": "insert_apikey"}
-	resp := `{"status": "ok", "data": {}}`
-	if "" == req.Data.Apikey {
-		err := errors.New("Missing required parameters")
-		resp = `{"status": "error", "error": "` + err.Error() + `"}`
-	} else {
+		role := client.role
+		client.slots <- true
+		client.pending.Add(1)
+		go func() {
+			defer client.pending.Done()
+			client.write(client.call(role, req))
+			<-client.slots
+		}()
 
-		customer := Customer{Apikey: req.Data.Apikey, Datasources: req.Data.Datasources}
-		resp = `{"status": "ok", "data": {"apikey": "` + req.Data.Apikey + `"}}`
-		err := DB.InsertCustomer(customer)
-		if err != nil {
-			fmt.Println(err)
-			resp = `{"status": "error", "error": "` + err.Error() + `"}`
-		}
 	}
-	return resp
 }
 
-func (self TcpServer) export_apikeys(req TcpMessage) string {
-	// {"method":"export_apikeys"}
-	resp := `{"status":"ok","data":{}}`
-	apikeys, err := DB.SelectAll("apikeys")
+// write sends response or change event line to client
+func (self *tcpConnection) write(resp interface{}) {
+	js, err := json.Marshal(resp)
 	if err != nil {
-		resp = `{"status":"error", "error":"` + err.Error() + `"}`
-	} else {
-		js, err := json.Marshal(apikeys)
-		resp = `{"status":"ok","data":` + string(js) + `}`
-		if err != nil {
-			resp = `{"status":"error", "error":"` + err.Error() + `"}`
-		}
+		ServerLogger.Error(err)
+		js, _ = json.Marshal(apiError(err).Response())
 	}
-	return resp
+	self.guard.Lock()
+	defer self.guard.Unlock()
+	self.conn.Write(append(js, '\n'))
 }
 
-func (self TcpServer) export_apikey(req TcpMessage) string {
-	// {"method":"export_apikey","apikey":"12dB6BlenIeB"}
-	resp := `{"status":"ok","data":{}}`
-	apikey, err := DB.GetCustomer(req.Apikey)
-	if err != nil {
-		resp = `{"status":"error", "error":"` + err.Error() + `"}`
-	} else {
-		js, err := json.Marshal(apikey)
-		resp = `{"status":"ok","data":` + string(js) + `}`
-		if err != nil {
-			resp = `{"status":"error", "error":"` + err.Error() + `"}`
+// call runs request with role and returns its response with the request id
+func (self *tcpConnection) call(role string, req TcpMessage) TcpResponse {
+	var resp HttpMessageResponse
+	switch req.Method {
+
+	case "help":
+		resp = HttpMessageResponse{Status: JSEND_SUCCESS, Data: tcp_methods}
+
+	case "authenticate":
+		// {"method":"authenticate", "authkey": "7q1qcqmsxnvw"}
+		var locked bool
+		self.role, locked = tcp_lockout.Authenticate(tcpHost(self.conn.RemoteAddr()), req.Authkey)
+		switch {
+		case locked:
+			NetworkLogger.Warn("error: too many failed attempts", " [TCP]")
+			resp = NewApiError(ERROR_UNAUTHORIZED, "too many failed attempts").Response()
+		case TCP_ROLE_NONE == self.role:
+			NetworkLogger.Warn("error: incorrect authkey", " [TCP]")
+			resp = NewApiError(ERROR_UNAUTHORIZED, "incorrect authkey").Response()
+		default:
+			resp = HttpMessageResponse{Status: JSEND_SUCCESS, Data: map[string]string{"role": self.role}}
 		}
-	}
-	return resp
-}
 
-// DATASOURCES
-func (self TcpServer) assign_datasource(req TcpMessage) string {
-	// {"method":"assign_datasource"}
-	resp := `{"status": "ok", "data": {}}`
-	datasource_id := req.Datasource
-	apikey := req.Apikey
+	case "batch":
+		// {"method":"batch","id":1,"data":{"requests":[{"method":"ping","id":2}]}}
+		resp = self.batch(role, req)
 
-	if "" == datasource_id || "" == apikey {
-		err := errors.New("Missing required parameters")
-		resp = `{"status": "error", "error": "` + err.Error() + `"}`
-	} else {
+	case "subscribe":
+		resp = self.subscribe(role, req)
 
-		customer, err := DB.GetCustomer(apikey)
-		resp = `{"status": "ok", "data": {}}`
-		if err != nil {
-			resp = `{"status": "error", "error": "` + err.Error() + `"}`
-		}
+	case "unsubscribe":
+		resp = self.unsubscribe(req)
 
-		_, err = DB.GetLayer(datasource_id)
-		if err != nil {
-			resp = `{"status": "error", "error": "` + err.Error() + `"}`
-		} else {
-			if !utils.StringInSlice(datasource_id, customer.Datasources) {
-				customer.Datasources = append(customer.Datasources, datasource_id)
-				DB.InsertCustomer(customer)
-			}
-		}
-	}
-
-	return resp
-}
-
-func (self TcpServer) create_datasource(req TcpMessage) string {
-	// {"method":"create_datasource"}
-	resp := `{"status":"ok","data":{}}`
-	if "" != req.Data.Datasource {
-		resp = `{"status":"ok","data": {"datasource_id":"` + req.Data.Datasource + `"}}`
-		err := DB.InsertLayer(req.Data.Datasource, req.Data.Layer)
-		if err != nil {
-			resp = `{"status": "error", "error": "` + err.Error() + `"}`
-		}
-	} else {
-		datasource_id, err := DB.NewLayer()
-		resp = `{"status":"ok","data": {"datasource_id":"` + datasource_id + `"}}`
-		if err != nil {
-			resp = `{"status": "error", "error": "` + err.Error() + `"}`
-		}
+	default:
+		// operations shared with the http api
+		resp = runTcpOperation(role, req)
 	}
-	return resp
-}
 
-func (self TcpServer) export_datasources(req TcpMessage) string {
-	// {"method":"export_datasources"}
-	resp := `{"status":"ok","data":{}}`
-	layers, err := DB.SelectAll("layers")
-	if err != nil {
-		resp = `{"status":"error", "error":"` + err.Error() + `"}`
-	} else {
-		js, err := json.Marshal(layers)
-		resp = `{"status":"ok","data":"` + string(js) + `"}`
-		if err != nil {
-			resp = `{"status":"error", "error":"` + err.Error() + `"}`
-		}
-	}
-	return resp
+	return TcpResponse{Id: req.Id, HttpMessageResponse: resp}
 }
 
-func (self TcpServer) export_datasource(req TcpMessage) string {
-	// {"method":"export_datasource","datasource":"3b1f5d633d884b9499adfc9b49c45236"}
-	resp := `{"status":"ok","data":{}}`
-	layer, err := DB.GetLayer(req.Datasource)
-	if err != nil {
-		resp = `{"status":"error", "error":"` + err.Error() + `"}`
-	} else {
-		js, err := json.Marshal(layer)
-		resp = `{"status":"ok","data":"` + string(js) + `"}`
-		if err != nil {
-			resp = `{"status":"error", "error":"` + err.Error() + `"}`
-		}
+// batch runs requests in order and returns their responses
+func (self *tcpConnection) batch(role string, req TcpMessage) HttpMessageResponse {
+	if 0 == len(req.Data.Requests) {
+		return ErrMissingParameters.Response()
 	}
-	return resp
-}
-
-// FEATURES
-func (self TcpServer) insert_feature(req TcpMessage) string {
-	// {"method":"insert_feature"}
-	resp := `{"status":"ok","data": {"datasource_id":"` + req.Data.Datasource + `", "message":"feature added"}}`
-	if "" == req.Data.Datasource {
-		err := errors.New("Missing required parameters")
-		resp = `{"status": "error", "error": "` + err.Error() + `"}`
-	} else {
-		err := DB.InsertFeature(req.Data.Datasource, req.Data.Feature)
-		if err != nil {
-			resp = `{"status": "error", "error": "` + err.Error() + `"}`
+	responses := []TcpResponse{}
+	for _, item := range req.Data.Requests {
+		switch item.Method {
+		case "authenticate", "batch":
+			resp := NewApiError(ERROR_VALIDATION_FAILED, "method not allowed in batch").Response()
+			responses = append(responses, TcpResponse{Id: item.Id, HttpMessageResponse: resp})
+		default:
+			responses = append(responses, self.call(role, item))
 		}
 	}
-	return resp
+	return HttpMessageResponse{Status: JSEND_SUCCESS, Data: responses}
 }
 
-func (self TcpServer) edit_feature(req TcpMessage) string {
-	// {"method":"edit_feature"}
-	resp := `{"status":"ok","data": {"datasource_id":"` + req.Data.Datasource + `", "message":"feature edited"}}`
-	if "" == req.Data.Datasource || "" == req.Data.GeoId {
-		err := errors.New("Missing required parameters")
-		resp = `{"status": "error", "error": "` + err.Error() + `"}`
-	} else {
-		err := DB.EditFeature(req.Data.Datasource, req.Data.GeoId, req.Data.Feature)
-		if err != nil {
-			fmt.Println(err)
-			resp = `{"status": "error", "error": "` + err.Error() + `"}`
-		}
-	}
-	return resp
-}
+// tcp_secret_pattern matches authkey and apikey values of tcp messages
+var tcp_secret_pattern = regexp.MustCompile(`("(?:authkey|apikey)"\s*:\s*)"[^"]*"`)
 
-// FILE
-func (self TcpServer) import_file(req TcpMessage) string {
-	// {"method":"import_file","file":"springfield_projects_edit.geojson"}
-	resp := `{"status":"ok","data":{}}`
-	result, err := importDatasource(req.File)
-	resp = `{"status":"ok","data": {"datasource": "` + result + `"}}`
-	if err != nil {
-		resp = `{"status":"error", "error":"` + err.Error() + `"}`
-	}
-	return resp
+// redactTcpMessage hides authkeys and apikeys of message for logging
+func redactTcpMessage(message string) string {
+	return tcp_secret_pattern.ReplaceAllString(message, `$1"REDACTED"`)
 }
 
 func importDatasource(importFile string) (string, error) {
@@ -425,14 +272,11 @@ func importDatasource(importFile string) (string, error) {
 	if _, err := os.Stat(importFile); os.IsNotExist(err) {
 		return "", err
 	}
-	// ERROR
-	// CRASHES IF NO "." character FOUND
-	ext := strings.Split(importFile, ".")[1]
+	ext := strings.TrimPrefix(filepath.Ext(importFile), ".")
 	// convert shapefile
 	if ext == "shp" {
 		// Convert .shp to .geojson
-		geojsonFile := strings.Replace(importFile, ".shp", ".geojson", -1)
-		fmt.Println("ogr2ogr", "-f", "GeoJSON", "-t_srs", "crs:84", geojsonFile, importFile)
+		geojsonFile = strings.Replace(importFile, ".shp", ".geojson", -1)
 		out, err := exec.Command("ogr2ogr", "-f", "GeoJSON", "-t_srs", "crs:84", geojsonFile, importFile).Output()
 		if err != nil {
 			return fmt.Sprintf("%v", out), err
@@ -461,10 +305,3 @@ func importDatasource(importFile string) (string, error) {
 	}
 	return ds, nil
 }
-
-/*
-
-"insert_layer"
-"delete_layer"
-
-*/
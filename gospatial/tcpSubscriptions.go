@@ -0,0 +1,181 @@
+package gospatial
+
+import (
+	"sort"
+	"sync"
+)
+
+// Change events buffered per subscribed tcp connection before it is
+// closed as a slow consumer
+var TCP_SUBSCRIBE_BUFFER int = 1000
+
+// tcpSubscription is the change events a tcp connection subscribed to.
+// Events are sent from one goroutine per connection.
+type tcpSubscription struct {
+	guard sync.Mutex
+	all   bool
+	// apikey each datasource was subscribed with, empty for authenticated
+	// connections
+	datasources map[string]string
+	cancel      func()
+	forwarding  bool
+	events      chan ChangeEvent
+	dropped     sync.Once
+}
+
+// subscribe adds datasources to the connection's subscription. Only
+// superuser connections subscribe to all datasources, by giving none.
+// Unauthenticated connections need an apikey with read scope on each,
+// which is checked again before each change event is sent.
+func (self *tcpConnection) subscribe(role string, req TcpMessage) HttpMessageResponse {
+	// {"method":"subscribe","data":{"datasources":["3b1f5d633d884b9499adfc9b49c45236"]}}
+	datasources := req.Data.Datasources
+	if 0 == len(datasources) && TCP_ROLE_SUPERUSER != role {
+		return NewApiError(ERROR_FORBIDDEN, "only superuser connections subscribe to all datasources").Response()
+	}
+	if TCP_ROLE_NONE == role {
+		customer, err := DB.GetCustomer(req.Apikey)
+		if err != nil {
+			return ErrUnauthorized.Response()
+		}
+		for _, datasource_id := range datasources {
+			if !customer.HasScope(datasource_id, SCOPE_READ) {
+				return ErrPermissionDenied.Response()
+			}
+		}
+	}
+
+	sub := &self.subscription
+	sub.guard.Lock()
+	defer sub.guard.Unlock()
+	if nil == sub.datasources {
+		sub.datasources = make(map[string]string)
+		sub.events = make(chan ChangeEvent, TCP_SUBSCRIBE_BUFFER)
+	}
+	if 0 == len(datasources) {
+		sub.all = true
+	}
+	apikey := ""
+	if TCP_ROLE_NONE == role {
+		apikey = req.Apikey
+	}
+	for _, datasource_id := range datasources {
+		sub.datasources[datasource_id] = apikey
+	}
+	if nil == sub.cancel {
+		sub.cancel = Changes.Listen(self.notify)
+	}
+	if !sub.forwarding {
+		sub.forwarding = true
+		go self.forward()
+	}
+	return self.subscriptionResponse()
+}
+
+// unsubscribe removes datasources from the connection's subscription, or
+// all of them when none are given
+func (self *tcpConnection) unsubscribe(req TcpMessage) HttpMessageResponse {
+	// {"method":"unsubscribe","data":{"datasources":["3b1f5d633d884b9499adfc9b49c45236"]}}
+	sub := &self.subscription
+	sub.guard.Lock()
+	defer sub.guard.Unlock()
+	if 0 == len(req.Data.Datasources) {
+		sub.all = false
+		sub.datasources = make(map[string]string)
+	}
+	for _, datasource_id := range req.Data.Datasources {
+		delete(sub.datasources, datasource_id)
+	}
+	if !sub.all && 0 == len(sub.datasources) && nil != sub.cancel {
+		sub.cancel()
+		sub.cancel = nil
+	}
+	return self.subscriptionResponse()
+}
+
+// subscriptionResponse describes subscription, must hold its guard
+func (self *tcpConnection) subscriptionResponse() HttpMessageResponse {
+	sub := &self.subscription
+	datasources := []string{}
+	for datasource_id := range sub.datasources {
+		datasources = append(datasources, datasource_id)
+	}
+	sort.Strings(datasources)
+	data := map[string]interface{}{"all": sub.all, "datasources": datasources, "seq": DB.Sequence()}
+	return HttpMessageResponse{Status: JSEND_SUCCESS, Data: data}
+}
+
+// notify queues subscribed change events, closing connections that fall behind
+func (self *tcpConnection) notify(event ChangeEvent) {
+	sub := &self.subscription
+	sub.guard.Lock()
+	_, subscribed := sub.datasources[event.Datasource]
+	subscribed = subscribed || sub.all
+	sub.guard.Unlock()
+	if !subscribed {
+		return
+	}
+	select {
+	case sub.events <- event:
+	default:
+		sub.dropped.Do(func() {
+			NetworkLogger.Warn(self.conn.RemoteAddr().String(), " subscription slow consumer closed [TCP]")
+			self.conn.Close()
+		})
+	}
+}
+
+// forward writes queued change events to the connection until it closes
+func (self *tcpConnection) forward() {
+	for {
+		select {
+		case event := <-self.subscription.events:
+			if self.readable(event.Datasource) {
+				self.write(event)
+			}
+		case <-self.done:
+			return
+		}
+	}
+}
+
+// readable checks the apikey datasource was subscribed with still has read
+// scope on it. Datasources it lost access to, by revocation or changed
+// scopes, are removed from the subscription.
+func (self *tcpConnection) readable(datasource_id string) bool {
+	sub := &self.subscription
+	sub.guard.Lock()
+	apikey, ok := sub.datasources[datasource_id]
+	sub.guard.Unlock()
+	if !ok || "" == apikey {
+		return true
+	}
+	customer, err := DB.GetCustomer(apikey)
+	if nil == err && customer.HasScope(datasource_id, SCOPE_READ) {
+		return true
+	}
+
+	NetworkLogger.Warn(self.conn.RemoteAddr().String(), " subscription to ", datasource_id, " lost read scope [TCP]")
+	sub.guard.Lock()
+	defer sub.guard.Unlock()
+	if current, ok := sub.datasources[datasource_id]; ok && apikey == current {
+		delete(sub.datasources, datasource_id)
+	}
+	if !sub.all && 0 == len(sub.datasources) && nil != sub.cancel {
+		sub.cancel()
+		sub.cancel = nil
+	}
+	return false
+}
+
+// closeSubscription stops change events of closed connection
+func (self *tcpConnection) closeSubscription() {
+	sub := &self.subscription
+	sub.guard.Lock()
+	if nil != sub.cancel {
+		sub.cancel()
+		sub.cancel = nil
+	}
+	sub.guard.Unlock()
+	close(self.done)
+}
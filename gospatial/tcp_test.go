@@ -3,14 +3,29 @@ package gospatial
 import (
 	//"errors"
 	//"github.com/paulmach/go.geojson"
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 )
 
+import "github.com/paulmach/go.geojson"
+
 //var testDb Database
 var testTcpServer TcpServer
 
@@ -56,11 +71,19 @@ func parseResponse(message string) map[string]interface{} {
 	return data
 }
 
+func marshalResponse(resp interface{}) string {
+	js, err := json.Marshal(resp)
+	if err != nil {
+		log.Println(err)
+	}
+	return string(js)
+}
+
 func TestTCPCreateApikeySuccess(t *testing.T) {
 	req := parseRequest(`{"method": "create_apikey"}`)
-	resp := testTcpServer.create_apikey(req)
+	resp := marshalResponse(runTcpOperation(TCP_ROLE_SUPERUSER, req))
 	// check for error in response
-	if strings.Contains(resp, `"status": "error"`) {
+	if !strings.Contains(resp, `"status":"success"`) {
 		t.Error(resp)
 	}
 	// check if "apikey" in response
@@ -72,12 +95,12 @@ func TestTCPCreateApikeySuccess(t *testing.T) {
 /*
 func TestTCPMethodError(t *testing.T) {
 	req := parseRequest(`{"method": "this_is_not_a_supported_method"}`)
-	resp := testTcpServer.create_apikey(req)
+	resp := marshalResponse(runTcpOperation(TCP_ROLE_SUPERUSER, req))
 
 	log.Println(resp)
 
 	// check for error in response
-	if strings.Contains(resp, `"status": "error"`) {
+	if strings.Contains(resp, `"status":"fail"`) {
 		t.Error(resp)
 	}
 }
@@ -86,11 +109,11 @@ func TestTCPMethodError(t *testing.T) {
 func TestTCPInsertExportApikeySuccess(t *testing.T) {
 	// create and insert apikey
 	now := time.Now().Second()
-	test_apikey := fmt.Sprintf("test_apikey_%s", now)
+	test_apikey := fmt.Sprintf("test_apikey_%v", now)
 	req := parseRequest(`{"method": "insert_apikey", "data": { "apikey": "` + test_apikey + `" } }`)
-	resp := testTcpServer.insert_apikey(req)
+	resp := marshalResponse(runTcpOperation(TCP_ROLE_SUPERUSER, req))
 	// check for error in response
-	if !strings.Contains(resp, `"status": "ok"`) {
+	if !strings.Contains(resp, `"status":"success"`) {
 		t.Error(resp)
 	}
 	// check if "test_apikey" in response
@@ -99,25 +122,26 @@ func TestTCPInsertExportApikeySuccess(t *testing.T) {
 	}
 	//
 	req = parseRequest(`{"method": "export_apikey", "apikey": "` + test_apikey + `" }`)
-	resp = testTcpServer.export_apikey(req)
+	resp = marshalResponse(runTcpOperation(TCP_ROLE_SUPERUSER, req))
 	// check if "test_apikey" in response
 	if !strings.Contains(resp, test_apikey) {
 		t.Error(resp)
 	}
 	//
+	// apikeys are stored hashed, check customer id in response
+	customer, _ := DB.GetCustomer(test_apikey)
 	req = parseRequest(`{"method": "export_apikeys"}`)
-	resp = testTcpServer.export_apikeys(req)
-	// check if "test_apikey" in response
-	if !strings.Contains(resp, test_apikey) {
+	resp = marshalResponse(runTcpOperation(TCP_ROLE_SUPERUSER, req))
+	if "" == customer.Id || !strings.Contains(resp, customer.Id) || strings.Contains(resp, test_apikey) {
 		t.Error(resp)
 	}
 }
 
 func TestTCPCreateExportDatasources(t *testing.T) {
 	req := parseRequest(`{"method":"create_datasource"}`)
-	resp := testTcpServer.create_datasource(req)
+	resp := marshalResponse(runTcpOperation(TCP_ROLE_SUPERUSER, req))
 	// check for error in response
-	if strings.Contains(resp, `"status": "error"`) {
+	if !strings.Contains(resp, `"status":"success"`) {
 		t.Error(resp)
 	}
 	// // check if "apikey" in response
@@ -127,5 +151,318 @@ func TestTCPCreateExportDatasources(t *testing.T) {
 	log.Println(parseResponse(resp))
 }
 
+// dialTcp connects to tcp server, retrying while it starts listening
+func dialTcp(dial func() (net.Conn, error)) (net.Conn, error) {
+	conn, err := dial()
+	for i := 0; i < 50 && nil != err && strings.Contains(err.Error(), "refused"); i++ {
+		time.Sleep(10 * time.Millisecond)
+		conn, err = dial()
+	}
+	return conn, err
+}
+
+func TestTCPAuthenticate(t *testing.T) {
+	conn, err := dialTcp(func() (net.Conn, error) { return net.Dial("tcp", "localhost:3333") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	send := func(message string) string {
+		conn.Write([]byte(message + "\n"))
+		resp, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	OperatorKey = "testOperatorKey"
+	max_attempts := TCP_AUTH_MAX_ATTEMPTS
+	TCP_AUTH_MAX_ATTEMPTS = 2
+	defer func() {
+		OperatorKey = ""
+		TCP_AUTH_MAX_ATTEMPTS = max_attempts
+		tcp_lockout = &TcpLockout{failures: make(map[string]*authFailures)}
+	}()
+
+	if resp := send(`{"method": "ping"}`); !strings.Contains(resp, "pong") {
+		t.Errorf("Expected ping allowed: %v", resp)
+	}
+	if resp := send(`{"method": "create_apikey"}`); !strings.Contains(resp, "unauthorized") {
+		t.Errorf("Expected unauthenticated connection: %v", resp)
+	}
+	if resp := send(`{"method": "unknown_method"}`); !strings.Contains(resp, "method not found") {
+		t.Errorf("Expected method not found: %v", resp)
+	}
+
+	// operators export but do not write
+	if resp := send(`{"method": "authenticate", "authkey": "testOperatorKey"}`); !strings.Contains(resp, TCP_ROLE_OPERATOR) {
+		t.Fatalf("Expected operator role: %v", resp)
+	}
+	if resp := send(`{"method": "export_datasources"}`); !strings.Contains(resp, `"status":"success"`) {
+		t.Errorf("Expected operator can export: %v", resp)
+	}
+	if resp := send(`{"method": "create_apikey"}`); !strings.Contains(resp, "permission denied") {
+		t.Errorf("Expected operator cannot create apikey: %v", resp)
+	}
+
+	// failed attempts drop the role and lock out the host
+	if resp := send(`{"method": "authenticate", "authkey": "wrong"}`); !strings.Contains(resp, "incorrect authkey") {
+		t.Errorf("Expected incorrect authkey: %v", resp)
+	}
+	send(`{"method": "authenticate", "authkey": "wrong"}`)
+	if resp := send(`{"method": "authenticate", "authkey": "` + SuperuserKey + `"}`); !strings.Contains(resp, "too many failed attempts") {
+		t.Errorf("Expected host locked out: %v", resp)
+	}
+	if resp := send(`{"method": "export_datasources"}`); !strings.Contains(resp, "unauthorized") {
+		t.Errorf("Expected unauthenticated after failed attempt: %v", resp)
+	}
+
+	tcp_lockout = &TcpLockout{failures: make(map[string]*authFailures)}
+	if resp := send(`{"method": "authenticate", "authkey": "` + SuperuserKey + `"}`); !strings.Contains(resp, TCP_ROLE_SUPERUSER) {
+		t.Fatalf("Expected superuser role: %v", resp)
+	}
+	if resp := send(`{"method": "create_apikey"}`); !strings.Contains(resp, `"status":"success"`) {
+		t.Errorf("Expected superuser can create apikey: %v", resp)
+	}
+}
+
 // {"method":"export_datasource","datasource":"bf1f964abdab49aea6739bf7f6b32867"}
 // {"method":"export_datasources"}
+
+func TestTCPAllowedNetworks(t *testing.T) {
+	server := TcpServer{}
+	expected := map[string]bool{"127.0.0.1:5000": true, "[::1]:5000": true, "10.1.2.3:5000": false}
+	for addr, allowed := range expected {
+		tcp_addr, _ := net.ResolveTCPAddr("tcp", addr)
+		if allowed != server.allowed(tcp_addr) {
+			t.Errorf("Expected %v allowed %v", addr, allowed)
+		}
+	}
+
+	server.AllowedNetworks, _ = ParseCIDRs([]string{"10.0.0.0/8"})
+	tcp_addr, _ := net.ResolveTCPAddr("tcp", "10.1.2.3:5000")
+	if !server.allowed(tcp_addr) {
+		t.Error("Expected configured network allowed")
+	}
+	if _, err := ParseCIDRs([]string{"10.0.0.0"}); err == nil {
+		t.Error("Expected invalid CIDR error")
+	}
+}
+
+// writeTestCertificate writes self signed certificate and key to dir
+func writeTestCertificate(t *testing.T, dir string, name string) (string, string, tls.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key_der, _ := x509.MarshalECPrivateKey(key)
+	cert_pem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	key_pem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key_der})
+	cert_file, key_file := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	ioutil.WriteFile(cert_file, cert_pem, 0600)
+	ioutil.WriteFile(key_file, key_pem, 0600)
+	cert, _ := tls.X509KeyPair(cert_pem, key_pem)
+	return cert_file, key_file, cert
+}
+
+func TestTCPTLS(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gospatial")
+	defer os.RemoveAll(dir)
+	server_cert, server_key, _ := writeTestCertificate(t, dir, "server")
+	client_cert, _, client := writeTestCertificate(t, dir, "client")
+
+	config, err := NewTcpTLSConfig(server_cert, server_key, client_cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	listener.Close()
+	TcpServer{Host: "127.0.0.1", Port: port, TLSConfig: config}.Start()
+
+	roots := x509.NewCertPool()
+	server_pem, _ := ioutil.ReadFile(server_cert)
+	roots.AppendCertsFromPEM(server_pem)
+	ping := func(certs []tls.Certificate) string {
+		conn, err := dialTcp(func() (net.Conn, error) {
+			return tls.Dial("tcp", "127.0.0.1:"+port, &tls.Config{RootCAs: roots, Certificates: certs})
+		})
+		if err != nil {
+			return err.Error()
+		}
+		defer conn.Close()
+		conn.Write([]byte(`{"method": "ping"}` + "\n"))
+		resp, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			return err.Error()
+		}
+		return resp
+	}
+
+	if resp := ping([]tls.Certificate{client}); !strings.Contains(resp, "pong") {
+		t.Errorf("Expected ping over tls: %v", resp)
+	}
+	if resp := ping(nil); strings.Contains(resp, "pong") {
+		t.Errorf("Expected client certificate required: %v", resp)
+	}
+}
+
+func TestTCPPipelining(t *testing.T) {
+	conn, err := dialTcp(func() (net.Conn, error) { return net.Dial("tcp", "localhost:3333") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	read := func() map[string]interface{} {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &resp); err != nil {
+			t.Fatalf("Expected json response: %v %v", line, err)
+		}
+		return resp
+	}
+
+	// requests are sent without waiting for responses
+	conn.Write([]byte(`{"method": "authenticate", "authkey": "` + SuperuserKey + `", "id": 1}` + "\n" +
+		`{"method": "create_datasource", "id": 2}` + "\n" +
+		`{"method": "ping", "id": "three"}` + "\n" +
+		`{"method": "unknown_method", "id": 4}` + "\n"))
+	ids := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		resp := read()
+		ids[fmt.Sprintf("%v", resp["id"])] = true
+		data, _ := resp["data"].(map[string]interface{})
+		if "4" == fmt.Sprintf("%v", resp["id"]) && (nil == data || ERROR_NOT_FOUND != data["code"]) {
+			t.Errorf("Expected method not found: %v", resp)
+		}
+	}
+	for _, id := range []string{"1", "2", "three", "4"} {
+		if !ids[id] {
+			t.Errorf("Expected response with id %v: %v", id, ids)
+		}
+	}
+
+	conn.Write([]byte(`{"method": "batch", "id": 5, "data": {"requests": [{"method": "ping", "id": 6}, {"method": "authenticate", "id": 7}, {"method": "create_apikey", "id": 8}]}}` + "\n"))
+	resp := read()
+	responses, _ := resp["data"].([]interface{})
+	if 5 != resp["id"].(float64) || 3 != len(responses) {
+		t.Fatalf("Expected batch responses: %v", resp)
+	}
+	if JSEND_FAIL != responses[1].(map[string]interface{})["status"] || JSEND_SUCCESS != responses[2].(map[string]interface{})["status"] {
+		t.Errorf("Unexpected batch responses: %v", responses)
+	}
+
+	conn.Write([]byte(`{"method": "help"}` + "\n"))
+	resp = read()
+	methods, _ := resp["data"].([]interface{})
+	if len(tcp_methods) != len(methods) {
+		t.Fatalf("Expected method list: %v", resp)
+	}
+	for _, method := range methods {
+		info := method.(map[string]interface{})
+		if "create_apikey" == info["method"] && TCP_ROLE_SUPERUSER != info["role"] {
+			t.Errorf("Expected superuser method: %v", info)
+		}
+	}
+}
+
+func TestTCPSubscribe(t *testing.T) {
+	ds, _ := DB.NewLayer()
+	apikey := "testSubscribeKey"
+	DB.InsertCustomer(Customer{Apikey: apikey})
+
+	conn, err := dialTcp(func() (net.Conn, error) { return net.Dial("tcp", "localhost:3333") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	send := func(message string) string {
+		conn.Write([]byte(message + "\n"))
+		resp, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if resp := send(`{"method": "subscribe"}`); !strings.Contains(resp, "only superuser") {
+		t.Errorf("Expected subscribe to all refused: %v", resp)
+	}
+	if resp := send(`{"method": "subscribe", "apikey": "` + apikey + `", "data": {"datasources": ["` + ds + `"]}}`); !strings.Contains(resp, "permission denied") {
+		t.Errorf("Expected apikey without access refused: %v", resp)
+	}
+
+	send(`{"method": "authenticate", "authkey": "` + SuperuserKey + `"}`)
+	if resp := send(`{"method": "subscribe", "data": {"datasources": ["` + ds + `"]}}`); !strings.Contains(resp, ds) {
+		t.Fatalf("Expected subscribed: %v", resp)
+	}
+
+	feat := geojson.NewPointFeature([]float64{1, 1})
+	DB.InsertFeature(ds, feat)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := ChangeEvent{}
+	json.Unmarshal([]byte(line), &event)
+	if FEATURE_ADDED != event.Type || ds != event.Datasource || 0 == event.Sequence {
+		t.Errorf("Expected feature added event: %v", line)
+	}
+
+	if resp := send(`{"method": "unsubscribe"}`); !strings.Contains(resp, `"all":false,"datasources":[]`) {
+		t.Errorf("Expected unsubscribed: %v", resp)
+	}
+}
+
+func TestTCPSubscribeRevoked(t *testing.T) {
+	ds, _ := DB.NewLayer()
+	apikey := "testSubscribeRevokedKey"
+	DB.InsertCustomer(Customer{Apikey: apikey, Scopes: map[string][]string{ds: {SCOPE_READ}}})
+
+	conn, err := dialTcp(func() (net.Conn, error) { return net.Dial("tcp", "localhost:3333") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	conn.Write([]byte(`{"method": "subscribe", "apikey": "` + apikey + `", "data": {"datasources": ["` + ds + `"]}}` + "\n"))
+	if resp, err := reader.ReadString('\n'); err != nil || !strings.Contains(resp, ds) {
+		t.Fatalf("Expected subscribed: %v %v", resp, err)
+	}
+
+	DB.InsertFeature(ds, geojson.NewPointFeature([]float64{1, 1}))
+	if line, err := reader.ReadString('\n'); err != nil || !strings.Contains(line, FEATURE_ADDED) {
+		t.Errorf("Expected feature added event: %v %v", line, err)
+	}
+
+	// no events once the apikey loses read scope
+	customer, _ := DB.GetCustomer(apikey)
+	DB.InsertCustomer(customer.removeDatasource(ds))
+	DB.InsertFeature(ds, geojson.NewPointFeature([]float64{2, 2}))
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if line, err := reader.ReadString('\n'); nil == err {
+		t.Errorf("Expected no event after scope removed: %v", line)
+	}
+}
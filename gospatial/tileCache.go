@@ -0,0 +1,284 @@
+package gospatial
+
+import (
+	"container/list"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+import "github.com/paulmach/go.geojson"
+
+// Size of the vector tile cache in bytes
+var VECTOR_TILE_CACHE_SIZE = 64 * 1024 * 1024
+
+// Size of the rendered tile cache in bytes
+var RASTER_TILE_CACHE_SIZE = 256 * 1024 * 1024
+
+// tileCacheKey is a tile of a datasource
+type tileCacheKey struct {
+	Datasource string
+	Tile       tileCoord
+}
+
+// String returns bolt key of tile
+func (self tileCacheKey) String() string {
+	return fmt.Sprintf("%v/%v/%v/%v", self.Datasource, self.Tile.Z, self.Tile.X, self.Tile.Y)
+}
+
+// parseTileCacheKey parses bolt key of tile
+func parseTileCacheKey(key string) (tileCacheKey, error) {
+	parts := strings.Split(key, "/")
+	if 4 != len(parts) {
+		return tileCacheKey{}, fmt.Errorf("invalid tile key: %v", key)
+	}
+	coords := []int{}
+	for _, part := range parts[1:] {
+		coord, err := strconv.Atoi(part)
+		if err != nil {
+			return tileCacheKey{}, fmt.Errorf("invalid tile key: %v", key)
+		}
+		coords = append(coords, coord)
+	}
+	return tileCacheKey{parts[0], tileCoord{coords[0], coords[1], coords[2]}}, nil
+}
+
+// tileCacheEntry is a cached tile, its data is nil when stored in bolt
+type tileCacheEntry struct {
+	key  tileCacheKey
+	size int
+	data []byte
+}
+
+// TileCache is a size bounded cache of the tiles of datasources, least
+// recently used tiles are evicted first. Tiles are invalidated when a
+// change event of their datasource affects their bounds.
+type TileCache struct {
+	guard   sync.Mutex
+	size    int
+	limit   int
+	entries map[tileCacheKey]*list.Element
+	order   *list.List
+	// bumped on every invalidation of a datasource, so tiles rendered
+	// from a layer changed meanwhile are not stored
+	generations map[string]uint64
+	// fraction of the tile size features are drawn beyond tile borders
+	buffer float64
+	// bolt table tiles are stored in, tiles are kept in memory when empty.
+	// Stored tiles are indexed on first use.
+	table  string
+	loaded sync.Once
+}
+
+// NewTileCache returns empty tile cache
+// @param limit {int} size in bytes
+// @param buffer {float64} tile buffer as fraction of the tile size
+// @returns *TileCache
+func NewTileCache(limit int, buffer float64) *TileCache {
+	return &TileCache{
+		limit:       limit,
+		entries:     make(map[tileCacheKey]*list.Element),
+		order:       list.New(),
+		generations: make(map[string]uint64),
+		buffer:      buffer,
+	}
+}
+
+// NewBoltTileCache returns tile cache storing tiles in bolt table, which
+// keeps them across restarts
+// @param table {string}
+// @param limit {int} size in bytes
+// @param buffer {float64} tile buffer as fraction of the tile size
+// @returns *TileCache
+func NewBoltTileCache(table string, limit int, buffer float64) *TileCache {
+	cache := NewTileCache(limit, buffer)
+	cache.table = table
+	return cache
+}
+
+// VectorTiles caches encoded vector tiles
+var VectorTiles = NewTileCache(VECTOR_TILE_CACHE_SIZE, float64(MVT_BUFFER)/float64(MVT_EXTENT))
+
+// RasterTiles caches rendered tiles in bolt
+var RasterTiles = NewBoltTileCache("raster_tiles", RASTER_TILE_CACHE_SIZE, float64(RASTER_BUFFER)/float64(RASTER_TILE_SIZE))
+
+// tile caches invalidated by database writes
+var tile_caches = []*TileCache{VectorTiles, RasterTiles}
+
+// invalidateTiles drops the cached tiles affected by change event. Called
+// by the database write paths before the event is published, so tiles are
+// not served from the cache after the write returns.
+func invalidateTiles(event ChangeEvent) {
+	for _, cache := range tile_caches {
+		cache.invalidateChange(event)
+	}
+}
+
+// Get returns cached tile
+// @param datasource {string}
+// @param tile {tileCoord}
+// @returns []byte
+// @returns bool false if tile is not cached
+func (self *TileCache) Get(datasource_id string, tile tileCoord) ([]byte, bool) {
+	self.load()
+	self.guard.Lock()
+	defer self.guard.Unlock()
+	element, ok := self.entries[tileCacheKey{datasource_id, tile}]
+	if !ok {
+		return nil, false
+	}
+	self.order.MoveToFront(element)
+	entry := element.Value.(*tileCacheEntry)
+	if "" == self.table {
+		return entry.data, true
+	}
+	data, err := DB.Select(self.table, entry.key.String())
+	if err != nil || 0 == len(data) {
+		self.remove(element)
+		return nil, false
+	}
+	return data, true
+}
+
+// load indexes the tiles stored in bolt table
+func (self *TileCache) load() {
+	if "" == self.table {
+		return
+	}
+	self.loaded.Do(func() {
+		self.guard.Lock()
+		defer self.guard.Unlock()
+		stale := []string{}
+		err := DB.scanKeys(self.table, func(key string, size int) {
+			tile_key, err := parseTileCacheKey(key)
+			if err != nil {
+				stale = append(stale, key)
+				return
+			}
+			self.entries[tile_key] = self.order.PushBack(&tileCacheEntry{key: tile_key, size: size})
+			self.size += size
+		})
+		if err != nil {
+			ServerLogger.Error(err)
+		}
+		for self.size > self.limit {
+			stale = append(stale, self.order.Remove(self.order.Back()).(*tileCacheEntry).key.String())
+		}
+		self.deleteStored(stale)
+	})
+}
+
+// Generation returns invalidation count of datasource, read before
+// rendering a tile and passed to Put
+// @param datasource {string}
+// @returns uint64
+func (self *TileCache) Generation(datasource_id string) uint64 {
+	self.guard.Lock()
+	defer self.guard.Unlock()
+	return self.generations[datasource_id]
+}
+
+// Put caches tile rendered at generation of datasource. The tile is not
+// stored if the datasource was invalidated since.
+// @param datasource {string}
+// @param tile {tileCoord}
+// @param data {[]byte}
+// @param generation {uint64}
+func (self *TileCache) Put(datasource_id string, tile tileCoord, data []byte, generation uint64) {
+	self.load()
+	self.guard.Lock()
+	defer self.guard.Unlock()
+	if generation != self.generations[datasource_id] || len(data) > self.limit {
+		return
+	}
+	key := tileCacheKey{datasource_id, tile}
+	if element, ok := self.entries[key]; ok {
+		self.order.Remove(element)
+		self.size -= element.Value.(*tileCacheEntry).size
+	}
+	entry := &tileCacheEntry{key: key, size: len(data), data: data}
+	if "" != self.table {
+		entry.data = nil
+		if err := DB.Insert(self.table, key.String(), data); err != nil {
+			delete(self.entries, key)
+			return
+		}
+	}
+	self.entries[key] = self.order.PushFront(entry)
+	self.size += entry.size
+	evicted := []string{}
+	for self.size > self.limit {
+		evicted = append(evicted, self.evict(self.order.Back()))
+	}
+	self.deleteStored(evicted)
+}
+
+// evict drops cache entry and returns its bolt key, must be called while
+// holding guard
+func (self *TileCache) evict(element *list.Element) string {
+	entry := self.order.Remove(element).(*tileCacheEntry)
+	delete(self.entries, entry.key)
+	self.size -= entry.size
+	return entry.key.String()
+}
+
+// remove drops cache entry, must be called while holding guard
+func (self *TileCache) remove(element *list.Element) {
+	self.deleteStored([]string{self.evict(element)})
+}
+
+// deleteStored deletes tiles from bolt table
+func (self *TileCache) deleteStored(keys []string) {
+	if "" == self.table || 0 == len(keys) {
+		return
+	}
+	if err := DB.Delete(self.table, keys...); err != nil {
+		ServerLogger.Error(err)
+	}
+}
+
+// Invalidate drops the cached tiles of datasource intersecting bbox
+// [minlon, minlat, maxlon, maxlat], or all of its tiles if bbox is nil
+// @param datasource {string}
+// @param bbox {[]float64}
+func (self *TileCache) Invalidate(datasource_id string, bbox []float64) {
+	self.load()
+	self.guard.Lock()
+	defer self.guard.Unlock()
+	self.generations[datasource_id]++
+	invalidated := []string{}
+	for key, element := range self.entries {
+		if datasource_id != key.Datasource {
+			continue
+		}
+		if nil != bbox {
+			bounds := key.Tile.Bounds(self.buffer)
+			if bbox[0] > bounds[2] || bbox[2] < bounds[0] || bbox[1] > bounds[3] || bbox[3] < bounds[1] {
+				continue
+			}
+		}
+		invalidated = append(invalidated, self.evict(element))
+	}
+	self.deleteStored(invalidated)
+}
+
+// invalidateChange drops the tiles affected by change event, the tiles of
+// the feature before and after the change
+func (self *TileCache) invalidateChange(event ChangeEvent) {
+	if nil == event.Feature && nil == event.Previous {
+		self.Invalidate(event.Datasource, nil)
+		return
+	}
+	for _, feat := range []*geojson.Feature{event.Feature, event.Previous} {
+		if nil == feat {
+			continue
+		}
+		bounds, ok := geometryBounds(feat.Geometry)
+		if !ok {
+			self.Invalidate(event.Datasource, nil)
+			return
+		}
+		self.Invalidate(event.Datasource, bounds)
+	}
+}
@@ -0,0 +1,194 @@
+package gospatial
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+import "github.com/gorilla/mux"
+
+// getRequestTile reads tile coordinates from url path
+func getRequestTile(r *http.Request) (tileCoord, error) {
+	vars := mux.Vars(r)
+	tile := tileCoord{}
+	var err error
+	for _, coord := range []struct {
+		name  string
+		value *int
+	}{{"z", &tile.Z}, {"x", &tile.X}, {"y", &tile.Y}} {
+		*coord.value, err = strconv.Atoi(vars[coord.name])
+		if err != nil {
+			return tile, fmt.Errorf("invalid tile coordinates")
+		}
+	}
+	if !tile.valid() {
+		return tile, fmt.Errorf("invalid tile coordinates")
+	}
+	return tile, nil
+}
+
+// checkTileRequest checks request apikey may read datasource
+func checkTileRequest(w http.ResponseWriter, r *http.Request, ds string) bool {
+	apikey := GetApikeyFromRequest(w, r)
+	if apikey == "" {
+		return false
+	}
+	customer, err := GetCustomerFromDatabase(w, r, apikey)
+	if err != nil {
+		return false
+	}
+	return CheckCustomerPermission(w, r, customer, ds, SCOPE_READ)
+}
+
+// VectorTileHandler serves layer features as Mapbox Vector Tile. Tiles
+// without features are sent as 204 No Content.
+// @param apikey
+// @param ds
+// @param z
+// @param x
+// @param y
+func VectorTileHandler(w http.ResponseWriter, r *http.Request) {
+	NetworkLogger.Debug("[In] ", redactedRequest(r))
+	ds := mux.Vars(r)["ds"]
+	if !checkTileRequest(w, r, ds) {
+		return
+	}
+	tile, err := getRequestTile(r)
+	if err != nil {
+		sendApiError(w, r, validationFailed(err))
+		return
+	}
+
+	data, ok := VectorTiles.Get(ds, tile)
+	if !ok {
+		generation := VectorTiles.Generation(ds)
+		_, index, err := DB.GetLayerIndex(ds)
+		if err != nil {
+			sendApiError(w, r, err)
+			return
+		}
+		data = EncodeVectorTile(ds, tile, index.Search(tile.Bounds(float64(MVT_BUFFER)/float64(MVT_EXTENT))))
+		VectorTiles.Put(ds, tile, data, generation)
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if 0 == len(data) {
+		NetworkLogger.Info(r.RemoteAddr, fmt.Sprintf(" %v %v [204]", r.Method, r.URL.Path))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	NetworkLogger.Info(r.RemoteAddr, fmt.Sprintf(" %v %v [200]", r.Method, r.URL.Path))
+	w.Header().Set("Content-Type", "application/vnd.mapbox-vector-tile")
+	w.Write(data)
+}
+
+// RasterTileHandler serves layer features rendered as PNG tile with the
+// style of the layer. Tiles without features are sent transparent.
+// @param apikey
+// @param ds
+// @param z
+// @param x
+// @param y
+func RasterTileHandler(w http.ResponseWriter, r *http.Request) {
+	NetworkLogger.Debug("[In] ", redactedRequest(r))
+	ds := mux.Vars(r)["ds"]
+	if !checkTileRequest(w, r, ds) {
+		return
+	}
+	tile, err := getRequestTile(r)
+	if err != nil {
+		sendApiError(w, r, validationFailed(err))
+		return
+	}
+
+	data, ok := RasterTiles.Get(ds, tile)
+	if !ok {
+		generation := RasterTiles.Generation(ds)
+		style, err := DB.GetLayerStyle(ds)
+		if err != nil {
+			sendApiError(w, r, err)
+			return
+		}
+		_, index, err := DB.GetLayerIndex(ds)
+		if err != nil {
+			sendApiError(w, r, err)
+			return
+		}
+		data, err = RenderTile(tile, index.Search(tile.Bounds(float64(RASTER_BUFFER)/float64(RASTER_TILE_SIZE))), style)
+		if err != nil {
+			sendApiError(w, r, err)
+			return
+		}
+		RasterTiles.Put(ds, tile, data, generation)
+	}
+
+	NetworkLogger.Info(r.RemoteAddr, fmt.Sprintf(" %v %v [200]", r.Method, r.URL.Path))
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(data)
+}
+
+// tileUrl returns url template of layer tiles. The apikey is kept when it
+// was sent as query param, as map clients request tiles without headers.
+func tileUrl(r *http.Request, path string) string {
+	href := requestBaseUrl(r) + path
+	if apikey := r.URL.Query().Get("apikey"); "" != apikey {
+		href += "?apikey=" + url.QueryEscape(apikey)
+	}
+	return href
+}
+
+// LayerTileJSONHandler serves TileJSON document of layer vector tiles
+// @param apikey
+// @param ds
+func LayerTileJSONHandler(w http.ResponseWriter, r *http.Request) {
+	NetworkLogger.Debug("[In] ", redactedRequest(r))
+	ds := mux.Vars(r)["ds"]
+	if !checkTileRequest(w, r, ds) {
+		return
+	}
+	lyr, err := DB.GetLayer(ds)
+	if err != nil {
+		sendApiError(w, r, err)
+		return
+	}
+
+	// property types of layer features
+	fields := make(map[string]string)
+	for _, feat := range lyr.Features {
+		for name, value := range feat.Properties {
+			switch value.(type) {
+			case float64, int, int64:
+				fields[name] = "Number"
+			case bool:
+				fields[name] = "Boolean"
+			case nil:
+			default:
+				fields[name] = "String"
+			}
+		}
+	}
+	bounds, ok := layerBounds(lyr)
+	if !ok {
+		bounds = []float64{-180, -MVT_MAX_LATITUDE, 180, MVT_MAX_LATITUDE}
+	}
+
+	tilejson := map[string]interface{}{
+		"tilejson":      "3.0.0",
+		"name":          ds,
+		"scheme":        "xyz",
+		"tiles":         []string{tileUrl(r, "/api/v1/layer/"+ds+"/tiles/{z}/{x}/{y}.mvt")},
+		"minzoom":       0,
+		"maxzoom":       MVT_MAX_ZOOM,
+		"bounds":        bounds,
+		"center":        []float64{(bounds[0] + bounds[2]) / 2, (bounds[1] + bounds[3]) / 2, 0},
+		"vector_layers": []map[string]interface{}{{"id": ds, "fields": fields, "minzoom": 0, "maxzoom": MVT_MAX_ZOOM}},
+	}
+	js, err := MarshalJsonFromStruct(w, r, tilejson)
+	if err != nil {
+		return
+	}
+	SendJsonResponse(w, r, js)
+}
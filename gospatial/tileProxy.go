@@ -0,0 +1,425 @@
+package gospatial
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tile proxy settings
+var (
+	// Directory proxied tiles are cached in
+	TILE_PROXY_DIRECTORY string = "tile_cache"
+	// Size of the proxied tile cache in bytes
+	TILE_PROXY_CACHE_SIZE int64 = 1024 * 1024 * 1024
+	// Time cached tiles are served before they are fetched again, tile
+	// layers may set their own
+	TILE_PROXY_TTL time.Duration = 7 * 24 * time.Hour
+	// Time allowed for the upstream tile server to respond
+	TILE_PROXY_TIMEOUT time.Duration = 10 * time.Second
+	// Largest upstream tile in bytes, larger tiles are failed
+	TILE_PROXY_MAX_TILE_SIZE int64 = 4 * 1024 * 1024
+	// Most tiles fetched by a single seed request
+	TILE_PROXY_MAX_SEED int = 10000
+	// Time a seed request fetches tiles, the remaining tiles are skipped
+	// and cached by repeating the request
+	TILE_PROXY_SEED_DURATION time.Duration = time.Minute
+	// Concurrent upstream requests of a seed request
+	TILE_PROXY_SEED_WORKERS int = 4
+)
+
+// proxyTileKey is a tile of a proxied tile layer
+type proxyTileKey struct {
+	TileLayer string
+	Tile      tileCoord
+}
+
+// proxyTileEntry is a tile cached on disk and when it was fetched
+type proxyTileEntry struct {
+	key     proxyTileKey
+	size    int64
+	fetched time.Time
+}
+
+// TileSeedResult counts the tiles of a seed request
+type TileSeedResult struct {
+	Tiles   int `json:"tiles"`
+	Cached  int `json:"cached"`
+	Fetched int `json:"fetched"`
+	Empty   int `json:"empty"`
+	Failed  int `json:"failed"`
+	// tiles not fetched within the seed duration
+	Skipped int `json:"skipped"`
+}
+
+// TileProxyCache fetches the tiles of proxied tile layers from their
+// upstream servers and caches them as files. Least recently used tiles
+// are evicted when the cache exceeds its size, expired tiles are fetched
+// again and served while the upstream server fails.
+type TileProxyCache struct {
+	guard     sync.Mutex
+	directory string
+	limit     int64
+	size      int64
+	entries   map[proxyTileKey]*list.Element
+	order     *list.List
+	client    *http.Client
+	// cached files are indexed on first use
+	loaded sync.Once
+}
+
+// NewTileProxyCache returns tile proxy caching tiles in directory
+// @param directory {string}
+// @param limit {int64} size in bytes
+// @returns *TileProxyCache
+func NewTileProxyCache(directory string, limit int64) *TileProxyCache {
+	return &TileProxyCache{
+		directory: directory,
+		limit:     limit,
+		entries:   make(map[proxyTileKey]*list.Element),
+		order:     list.New(),
+		client:    NewOutboundClient(TILE_PROXY_TIMEOUT),
+	}
+}
+
+// TileProxy proxies the tiles of tile layers
+var TileProxy = NewTileProxyCache(TILE_PROXY_DIRECTORY, TILE_PROXY_CACHE_SIZE)
+
+// ValidateProxyUrl checks tile layer url is an absolute http(s) url
+// template of a public host with z, x and y placeholders
+// @param template {string}
+// @returns Error
+func ValidateProxyUrl(template string) error {
+	if !strings.Contains(template, "{z}") || !strings.Contains(template, "{x}") || (!strings.Contains(template, "{y}") && !strings.Contains(template, "{-y}")) {
+		return fmt.Errorf("proxied tile layer url requires {z}, {x} and {y} placeholders")
+	}
+	err := CheckOutboundUrl(upstreamTileUrl(template, tileCoord{0, 0, 0}))
+	if err != nil {
+		return fmt.Errorf("proxied tile layer %v", err)
+	}
+	return nil
+}
+
+// upstreamTileUrl fills url template of tile layer with tile coordinates.
+// {-y} is the TMS row and {s} the first subdomain.
+func upstreamTileUrl(template string, tile tileCoord) string {
+	return strings.NewReplacer(
+		"{z}", strconv.Itoa(tile.Z),
+		"{x}", strconv.Itoa(tile.X),
+		"{y}", strconv.Itoa(tile.Y),
+		"{-y}", strconv.Itoa((1<<uint(tile.Z))-1-tile.Y),
+		"{s}", "a",
+	).Replace(template)
+}
+
+// tileTtl returns time tiles of tile layer are cached
+func tileTtl(tilelayer TileLayer) time.Duration {
+	if 0 < tilelayer.ProxyTtl {
+		return time.Duration(tilelayer.ProxyTtl) * time.Second
+	}
+	return TILE_PROXY_TTL
+}
+
+// file returns path of cached tile
+func (self *TileProxyCache) file(key proxyTileKey) string {
+	return filepath.Join(self.directory, key.TileLayer, strconv.Itoa(key.Tile.Z), strconv.Itoa(key.Tile.X), strconv.Itoa(key.Tile.Y))
+}
+
+// load indexes the cached tiles, most recently fetched first
+func (self *TileProxyCache) load() {
+	self.loaded.Do(func() {
+		self.guard.Lock()
+		defer self.guard.Unlock()
+		cached := []*proxyTileEntry{}
+		filepath.Walk(self.directory, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return nil
+			}
+			rel, _ := filepath.Rel(self.directory, path)
+			parts := strings.Split(filepath.ToSlash(rel), "/")
+			coords := []int{}
+			for _, part := range parts[1:] {
+				coord, err := strconv.Atoi(part)
+				if err != nil {
+					break
+				}
+				coords = append(coords, coord)
+			}
+			if 4 != len(parts) || 3 != len(coords) {
+				os.Remove(path)
+				return nil
+			}
+			key := proxyTileKey{parts[0], tileCoord{coords[0], coords[1], coords[2]}}
+			cached = append(cached, &proxyTileEntry{key: key, size: info.Size(), fetched: info.ModTime()})
+			return nil
+		})
+		sort.Slice(cached, func(i, j int) bool {
+			return cached[i].fetched.After(cached[j].fetched)
+		})
+		for _, entry := range cached {
+			self.entries[entry.key] = self.order.PushBack(entry)
+			self.size += entry.size
+		}
+		self.evictOverLimit()
+	})
+}
+
+// Get returns cached tile and when it was fetched
+// @param tilelayer_id {string}
+// @param tile {tileCoord}
+// @returns []byte
+// @returns time.Time
+// @returns bool false if tile is not cached
+func (self *TileProxyCache) Get(tilelayer_id string, tile tileCoord) ([]byte, time.Time, bool) {
+	self.load()
+	self.guard.Lock()
+	defer self.guard.Unlock()
+	element, ok := self.entries[proxyTileKey{tilelayer_id, tile}]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	entry := element.Value.(*proxyTileEntry)
+	data, err := ioutil.ReadFile(self.file(entry.key))
+	if err != nil {
+		self.remove(element)
+		return nil, time.Time{}, false
+	}
+	self.order.MoveToFront(element)
+	return data, entry.fetched, true
+}
+
+// Put caches tile fetched now
+// @param tilelayer_id {string}
+// @param tile {tileCoord}
+// @param data {[]byte}
+// @returns Error
+func (self *TileProxyCache) Put(tilelayer_id string, tile tileCoord, data []byte) error {
+	self.load()
+	self.guard.Lock()
+	defer self.guard.Unlock()
+	key := proxyTileKey{tilelayer_id, tile}
+	if element, ok := self.entries[key]; ok {
+		self.order.Remove(element)
+		delete(self.entries, key)
+		self.size -= element.Value.(*proxyTileEntry).size
+	}
+	if int64(len(data)) > self.limit {
+		return nil
+	}
+
+	// write to temporary file first, so readers never see partial tiles
+	file := self.file(key)
+	err := os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	entry := &proxyTileEntry{key: key, size: int64(len(data)), fetched: time.Now()}
+	self.entries[key] = self.order.PushFront(entry)
+	self.size += entry.size
+	self.evictOverLimit()
+	return nil
+}
+
+// evictOverLimit drops least recently used tiles until the cache fits its
+// size, must be called while holding guard
+func (self *TileProxyCache) evictOverLimit() {
+	for self.size > self.limit && 0 != self.order.Len() {
+		self.remove(self.order.Back())
+	}
+}
+
+// remove drops cached tile, must be called while holding guard
+func (self *TileProxyCache) remove(element *list.Element) {
+	entry := self.order.Remove(element).(*proxyTileEntry)
+	delete(self.entries, entry.key)
+	self.size -= entry.size
+	err := os.Remove(self.file(entry.key))
+	if err != nil && !os.IsNotExist(err) {
+		ServerLogger.Error(err)
+	}
+}
+
+// fetch requests tile from the upstream server of tile layer. Returns nil
+// for tiles the server does not have.
+func (self *TileProxyCache) fetch(tilelayer TileLayer, tile tileCoord) ([]byte, error) {
+	req, err := http.NewRequest("GET", upstreamTileUrl(tilelayer.Url, tile), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "gospatial/"+VERSION)
+	resp, err := self.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		data, err := ioutil.ReadAll(io.LimitReader(resp.Body, TILE_PROXY_MAX_TILE_SIZE+1))
+		if nil == err && int64(len(data)) > TILE_PROXY_MAX_TILE_SIZE {
+			err = fmt.Errorf("upstream tile exceeds %v bytes", TILE_PROXY_MAX_TILE_SIZE)
+		}
+		return data, err
+	case http.StatusNoContent, http.StatusNotFound:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("upstream tile server responded %v", resp.StatusCode)
+}
+
+// Tile returns tile of proxied tile layer from the cache, or from its
+// upstream server once expired. Expired tiles are returned while the
+// upstream server fails. Returns nil for tiles the server does not have.
+// @param tilelayer {TileLayer}
+// @param tile {tileCoord}
+// @returns []byte
+// @returns Error
+func (self *TileProxyCache) Tile(tilelayer TileLayer, tile tileCoord) ([]byte, error) {
+	data, fetched, ok := self.Get(tilelayer.Id, tile)
+	if ok && time.Since(fetched) < tileTtl(tilelayer) {
+		return data, nil
+	}
+	fresh, err := self.fetch(tilelayer, tile)
+	if err != nil {
+		if ok {
+			ServerLogger.Warn("Serving expired tile ", tilelayer.Id, " ", tile, ": ", err)
+			return data, nil
+		}
+		return nil, err
+	}
+	if nil == fresh {
+		return nil, nil
+	}
+	err = self.Put(tilelayer.Id, tile, fresh)
+	if err != nil {
+		ServerLogger.Error(err)
+	}
+	return fresh, nil
+}
+
+// Purge drops the cached tiles of tile layer
+// @param tilelayer_id {string}
+func (self *TileProxyCache) Purge(tilelayer_id string) {
+	self.load()
+	self.guard.Lock()
+	defer self.guard.Unlock()
+	for key, element := range self.entries {
+		if tilelayer_id == key.TileLayer {
+			self.remove(element)
+		}
+	}
+	err := os.RemoveAll(filepath.Join(self.directory, tilelayer_id))
+	if err != nil {
+		ServerLogger.Error(err)
+	}
+}
+
+// tileRange returns the tile columns and rows covering bbox
+// [minlon, minlat, maxlon, maxlat] at zoom level
+func tileRange(bbox []float64, zoom int) (int, int, int, int) {
+	n := 1 << uint(zoom)
+	column := func(lon float64) int {
+		return int(math.Max(0, math.Min(float64(n-1), math.Floor((lon+180)/360*float64(n)))))
+	}
+	row := func(lat float64) int {
+		lat = math.Max(-MVT_MAX_LATITUDE, math.Min(MVT_MAX_LATITUDE, lat)) * math.Pi / 180
+		y := (1 - math.Log(math.Tan(lat)+1/math.Cos(lat))/math.Pi) / 2 * float64(n)
+		return int(math.Max(0, math.Min(float64(n-1), math.Floor(y))))
+	}
+	return column(bbox[0]), row(bbox[3]), column(bbox[2]), row(bbox[1])
+}
+
+// Seed caches the tiles of tile layer covering bbox from minzoom through
+// maxzoom. Tiles still cached are not fetched again. Seeding stops after
+// TILE_PROXY_SEED_DURATION, the tiles left are counted as skipped.
+// @param tilelayer {TileLayer}
+// @param bbox {[]float64} [minlon, minlat, maxlon, maxlat]
+// @param minzoom {int}
+// @param maxzoom {int}
+// @returns TileSeedResult
+// @returns Error
+func (self *TileProxyCache) Seed(tilelayer TileLayer, bbox []float64, minzoom int, maxzoom int) (TileSeedResult, error) {
+	result := TileSeedResult{}
+	if 4 != len(bbox) || bbox[0] > bbox[2] || bbox[1] > bbox[3] {
+		return result, fmt.Errorf("bbox must be [minlon, minlat, maxlon, maxlat]")
+	}
+	if minzoom < 0 || maxzoom > MVT_MAX_ZOOM || minzoom > maxzoom {
+		return result, fmt.Errorf("zoom range must be within 0 and %v", MVT_MAX_ZOOM)
+	}
+	for z := minzoom; z <= maxzoom; z++ {
+		minx, miny, maxx, maxy := tileRange(bbox, z)
+		result.Tiles += (maxx - minx + 1) * (maxy - miny + 1)
+		if result.Tiles > TILE_PROXY_MAX_SEED {
+			return result, fmt.Errorf("seed exceeds %v tiles", TILE_PROXY_MAX_SEED)
+		}
+	}
+
+	deadline := time.Now().Add(TILE_PROXY_SEED_DURATION)
+	tiles := make(chan tileCoord)
+	var guard sync.Mutex
+	var workers sync.WaitGroup
+	for i := 0; i < TILE_PROXY_SEED_WORKERS; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for tile := range tiles {
+				_, fetched, ok := self.Get(tilelayer.Id, tile)
+				if ok && time.Since(fetched) < tileTtl(tilelayer) {
+					guard.Lock()
+					result.Cached++
+					guard.Unlock()
+					continue
+				}
+				data, err := self.fetch(tilelayer, tile)
+				if nil == err && nil != data {
+					err = self.Put(tilelayer.Id, tile, data)
+				}
+				guard.Lock()
+				switch {
+				case nil != err:
+					result.Failed++
+				case nil == data:
+					result.Empty++
+				default:
+					result.Fetched++
+				}
+				guard.Unlock()
+			}
+		}()
+	}
+	for z := minzoom; z <= maxzoom; z++ {
+		minx, miny, maxx, maxy := tileRange(bbox, z)
+		for x := minx; x <= maxx; x++ {
+			for y := miny; y <= maxy; y++ {
+				if time.Now().After(deadline) {
+					guard.Lock()
+					result.Skipped++
+					guard.Unlock()
+					continue
+				}
+				tiles <- tileCoord{z, x, y}
+			}
+		}
+	}
+	close(tiles)
+	workers.Wait()
+	return result, nil
+}
@@ -0,0 +1,227 @@
+package gospatial
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tileServer serves png tiles named by their coordinates, and fails while
+// down
+type tileServer struct {
+	guard    sync.Mutex
+	requests map[string]int
+	down     bool
+}
+
+func (self *tileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	self.guard.Lock()
+	defer self.guard.Unlock()
+	self.requests[r.URL.Path]++
+	if self.down {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/9/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Write([]byte("\x89PNG\r\n\x1a\n" + r.URL.Path))
+}
+
+func (self *tileServer) count(path string) int {
+	self.guard.Lock()
+	defer self.guard.Unlock()
+	return self.requests[path]
+}
+
+func (self *tileServer) setDown(down bool) {
+	self.guard.Lock()
+	defer self.guard.Unlock()
+	self.down = down
+}
+
+func TestTileProxy(t *testing.T) {
+	directory, err := ioutil.TempDir("", "tile_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	proxy := TileProxy
+	TileProxy = NewTileProxyCache(directory, 1024*1024)
+	defer func() {
+		TileProxy = proxy
+	}()
+
+	upstream := &tileServer{requests: make(map[string]int)}
+	tiles := httptest.NewServer(upstream)
+	defer tiles.Close()
+	server := httptest.NewServer(Router())
+	defer server.Close()
+	apikey := "testTileProxyKey"
+	DB.InsertCustomer(Customer{Apikey: apikey})
+
+	// upstream servers on private addresses are refused
+	resp, err := http.PostForm(server.URL+"/api/v1/tilelayer?apikey="+apikey, url.Values{
+		"tilelayer_url":   {tiles.URL + "/{z}/{x}/{y}.png"},
+		"tilelayer_proxy": {"true"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if http.StatusBadRequest != resp.StatusCode {
+		t.Errorf("Expected loopback upstream refused: %v", resp.StatusCode)
+	}
+	if _, err := TileProxy.client.Get(tiles.URL + "/0/0/0.png"); nil == err {
+		t.Errorf("Expected dial to loopback upstream refused")
+	}
+	OUTBOUND_ALLOW_PRIVATE = true
+	defer func() {
+		OUTBOUND_ALLOW_PRIVATE = false
+	}()
+
+	// register proxied tile layer
+	resp, err = http.PostForm(server.URL+"/api/v1/tilelayer?apikey="+apikey, url.Values{
+		"tilelayer_name":  {"upstream"},
+		"tilelayer_url":   {tiles.URL + "/{z}/{x}/{y}.png"},
+		"tilelayer_proxy": {"true"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := struct {
+		Data struct {
+			Tilelayer TileLayer `json:"tilelayer"`
+		} `json:"data"`
+	}{}
+	json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	tilelayer := created.Data.Tilelayer
+	if "" == tilelayer.Id || !tilelayer.Proxy {
+		t.Fatalf("Expected proxied tile layer: %v", tilelayer)
+	}
+	resp, _ = http.PostForm(server.URL+"/api/v1/tilelayer?apikey="+apikey, url.Values{"tilelayer_url": {"/relative/{z}/{x}/{y}.png"}, "tilelayer_proxy": {"true"}})
+	resp.Body.Close()
+	if http.StatusBadRequest != resp.StatusCode {
+		t.Errorf("Expected relative url rejected for proxy: %v", resp.StatusCode)
+	}
+
+	get := func(path string) (*http.Response, string) {
+		resp, err := http.Get(server.URL + "/api/v1/tilelayer/" + tilelayer.Id + "/proxy" + path + "?apikey=" + apikey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	// tiles are fetched once and served from the cache
+	for i := 0; i < 2; i++ {
+		resp, body := get("/2/1/3")
+		if http.StatusOK != resp.StatusCode || !strings.HasSuffix(body, "/2/1/3.png") {
+			t.Fatalf("Expected proxied tile: %v %v", resp.StatusCode, body)
+		}
+	}
+	if 1 != upstream.count("/2/1/3.png") {
+		t.Errorf("Expected tile cached: %v", upstream.count("/2/1/3.png"))
+	}
+	if _, err := os.Stat(TileProxy.file(proxyTileKey{tilelayer.Id, tileCoord{2, 1, 3}})); err != nil {
+		t.Errorf("Expected tile cached on disk: %v", err)
+	}
+	if resp, _ := get("/9/0/0"); http.StatusNoContent != resp.StatusCode {
+		t.Errorf("Expected missing upstream tile: %v", resp.StatusCode)
+	}
+
+	// expired tiles are fetched again, and served while upstream is down
+	ttl := TILE_PROXY_TTL
+	TILE_PROXY_TTL = time.Nanosecond
+	defer func() {
+		TILE_PROXY_TTL = ttl
+	}()
+	get("/2/1/3")
+	if 2 != upstream.count("/2/1/3.png") {
+		t.Errorf("Expected expired tile fetched: %v", upstream.count("/2/1/3.png"))
+	}
+	upstream.setDown(true)
+	if resp, body := get("/2/1/3"); http.StatusOK != resp.StatusCode || !strings.HasSuffix(body, "/2/1/3.png") {
+		t.Errorf("Expected expired tile while upstream is down: %v %v", resp.StatusCode, body)
+	}
+	if resp, _ := get("/2/0/0"); http.StatusBadGateway != resp.StatusCode {
+		t.Errorf("Expected upstream error: %v", resp.StatusCode)
+	}
+	upstream.setDown(false)
+	TILE_PROXY_TTL = ttl
+
+	// oversized upstream tiles fail
+	max_tile_size := TILE_PROXY_MAX_TILE_SIZE
+	TILE_PROXY_MAX_TILE_SIZE = 4
+	if resp, _ := get("/2/0/1"); http.StatusBadGateway != resp.StatusCode {
+		t.Errorf("Expected oversized tile failed: %v", resp.StatusCode)
+	}
+	TILE_PROXY_MAX_TILE_SIZE = max_tile_size
+
+	// seed over tcp, tiles cached before are not fetched again
+	fetched := upstream.count("/2/1/3.png")
+	message := fmt.Sprintf(`{"method": "seed_tilelayer", "apikey": %q, "data": {"tilelayer_id": %q, "bbox": [-180, -85, 180, 85], "min_zoom": 0, "max_zoom": 2}}`, apikey, tilelayer.Id)
+	seeded := runTcpOperation(TCP_ROLE_NONE, parseRequest(message))
+	result, ok := seeded.Data.(TileSeedResult)
+	if JSEND_SUCCESS != seeded.Status || !ok || 21 != result.Tiles || 1 != result.Cached || 20 != result.Fetched {
+		t.Errorf("Unexpected seed result: %v", seeded)
+	}
+	if 1 != upstream.count("/1/1/1.png") || fetched != upstream.count("/2/1/3.png") {
+		t.Errorf("Expected seeded tiles fetched once")
+	}
+	// seeding stops after its duration
+	seed_duration := TILE_PROXY_SEED_DURATION
+	TILE_PROXY_SEED_DURATION = 0
+	message = fmt.Sprintf(`{"method": "seed_tilelayer", "apikey": %q, "data": {"tilelayer_id": %q, "bbox": [-180, -85, 180, 85], "min_zoom": 3, "max_zoom": 3}}`, apikey, tilelayer.Id)
+	seeded = runTcpOperation(TCP_ROLE_NONE, parseRequest(message))
+	if result, ok := seeded.Data.(TileSeedResult); !ok || 64 != result.Skipped || 0 != result.Fetched {
+		t.Errorf("Expected seed skipped: %v", seeded)
+	}
+	TILE_PROXY_SEED_DURATION = seed_duration
+	message = fmt.Sprintf(`{"method": "seed_tilelayer", "apikey": %q, "data": {"tilelayer_id": %q, "bbox": [-180, -85, 180, 85], "max_zoom": 20}}`, apikey, tilelayer.Id)
+	if seeded = runTcpOperation(TCP_ROLE_NONE, parseRequest(message)); JSEND_FAIL != seeded.Status {
+		t.Errorf("Expected seed limited: %v", seeded)
+	}
+
+	// least recently used tiles are evicted over the cache size
+	TileProxy = NewTileProxyCache(directory, 100)
+	get("/1/0/0")
+	get("/1/0/1")
+	if _, _, ok := TileProxy.Get(tilelayer.Id, tileCoord{2, 1, 3}); ok {
+		t.Errorf("Expected least recently used tile evicted")
+	}
+	if _, _, ok := TileProxy.Get(tilelayer.Id, tileCoord{1, 0, 1}); !ok {
+		t.Errorf("Expected recent tile cached")
+	}
+
+	// deleting the tile layer drops its cached tiles
+	req, _ := http.NewRequest("DELETE", server.URL+"/api/v1/tilelayer/"+tilelayer.Id+"?apikey="+apikey, nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	customer, _ := DB.GetCustomer(apikey)
+	if http.StatusOK != resp.StatusCode || 0 != len(customer.TileLayers) {
+		t.Errorf("Expected tile layer deleted: %v %v", resp.StatusCode, customer.TileLayers)
+	}
+	if _, _, ok := TileProxy.Get(tilelayer.Id, tileCoord{1, 0, 1}); ok {
+		t.Errorf("Expected cached tiles dropped")
+	}
+	if _, err := os.Stat(filepath.Join(directory, tilelayer.Id)); !os.IsNotExist(err) {
+		t.Errorf("Expected tile cache directory removed: %v", err)
+	}
+}
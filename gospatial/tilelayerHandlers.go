@@ -1,70 +1,205 @@
 package gospatial
 
 import (
-	"encoding/json"
+	"fmt"
 	"net/http"
 )
 
-// NewLayerHandler creates a new geojson layer. Saves layer to database and adds layer to customer
-// @param apikey
-// @return json
-func NewTileLayerHandler(w http.ResponseWriter, r *http.Request) {
-	// networkLoggerInfoIn.Printf("%v\n", r)
-	NetworkLogger.Debug(r)
+import (
+	"./utils"
+)
 
-	// Get params
-	apikey := r.FormValue("apikey")
+import "github.com/gorilla/mux"
 
-	tilelayer_url := r.FormValue("tilelayer_url")
-	tilelayer_name := r.FormValue("tilelayer_name")
-	tilelayer := TileLayer{Url: tilelayer_url, Name: tilelayer_name}
+// newTileLayer adds tile layer to customer
+// @param apikey
+// @param tilelayer_url
+// @param tilelayer_name
+// @param tilelayer_proxy serve tiles through the caching tile proxy
+// @param tilelayer_proxy_ttl seconds tiles are cached
+// @return json
+func newTileLayer(ctx *OperationContext) (interface{}, error) {
+	tilelayer := ctx.Request.Data.TileLayer
+	if nil == tilelayer {
+		return nil, ErrMissingParameters
+	}
+	tilelayer.Id, _ = utils.NewUUID()
 
 	// if isUrl(tilelayer.Url) != true {
-	// 	networkLoggerError.Println(r.RemoteAddr, "POST /api/v1/tilelayer [400]")
-	// 	http.Error(w, "not a valid url", http.StatusBadRequest)
-	// 	return
+	// 	return nil, validationFailed(fmt.Errorf("not a valid url"))
 	// }
+	if tilelayer.Proxy {
+		err := ValidateProxyUrl(tilelayer.Url)
+		if err != nil {
+			return nil, validationFailed(err)
+		}
+	}
+	if tilelayer.ProxyTtl < 0 {
+		return nil, validationFailed(fmt.Errorf("proxy_ttl must not be negative"))
+	}
 
-	// Check for apikey in request
-	if apikey == "" {
-		// networkLoggerError.Println(r.RemoteAddr, "POST /api/v1/tilelayer [401]")
-		NetworkLogger.Error(r.RemoteAddr, " POST /api/v1/tilelayer [401]")
-		http.Error(w, `{"status": "fail", "result": "unauthorized"}`, http.StatusUnauthorized)
-		return
+	// Add tile layer to customer
+	customer := ctx.Customer
+	customer.TileLayers = append(customer.TileLayers, *tilelayer)
+	err := DB.InsertCustomer(customer)
+	if err != nil {
+		return nil, err
 	}
+	return map[string]TileLayer{"tilelayer": *tilelayer}, nil
+}
 
-	// Get customer from database
-	customer, err := DB.GetCustomer(apikey)
+// newRenderTileLayer adds the rendered tiles of a layer as tile layer to
+// customer. The url is relative and has no apikey, clients add their own.
+// @param apikey
+// @param ds
+// @param tilelayer_name defaults to the datasource
+// @return json
+func newRenderTileLayer(ctx *OperationContext) (interface{}, error) {
+	ds := ctx.Datasource()
+	tilelayer := TileLayer{
+		Name:       ds,
+		Url:        "/api/v1/layer/" + ds + "/render/{z}/{x}/{y}.png",
+		Datasource: ds,
+	}
+	if nil != ctx.Request.Data.TileLayer && "" != ctx.Request.Data.TileLayer.Name {
+		tilelayer.Name = ctx.Request.Data.TileLayer.Name
+	}
+
+	// Replace rendered tile layer of datasource, superusers are authorized
+	// without loading the customer
+	err := ctx.loadCustomer()
 	if err != nil {
-		// networkLoggerWarning.Println(r.RemoteAddr, "POST /api/v1/tilelayer [404]")
-		NetworkLogger.Error(r.RemoteAddr, " POST /api/v1/tilelayer [404]")
-		http.Error(w, err.Error(), http.StatusNotFound)
-		return
+		return nil, err
+	}
+	customer := ctx.Customer
+	tilelayers := []TileLayer{}
+	for _, existing := range customer.TileLayers {
+		if ds != existing.Datasource {
+			tilelayers = append(tilelayers, existing)
+		}
+	}
+	tilelayer.Id, _ = utils.NewUUID()
+	customer.TileLayers = append(tilelayers, tilelayer)
+	err = DB.InsertCustomer(customer)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]TileLayer{"tilelayer": tilelayer}, nil
+}
+
+// deleteTileLayer removes tile layer from customer and drops its cached
+// proxy tiles. Tile layers of uploaded tilesets are deleted with their
+// tileset.
+// @param apikey
+// @param tilelayer_id
+// @return json
+func deleteTileLayer(ctx *OperationContext) (interface{}, error) {
+	tilelayer_id := ctx.Request.Data.TileLayerId
+	if "" == tilelayer_id {
+		return nil, ErrMissingParameters
+	}
+	customer := ctx.Customer
+	tilelayers := []TileLayer{}
+	var deleted *TileLayer
+	for i, tilelayer := range customer.TileLayers {
+		if tilelayer_id == tilelayer.Id {
+			deleted = &customer.TileLayers[i]
+			continue
+		}
+		tilelayers = append(tilelayers, tilelayer)
+	}
+	if nil == deleted {
+		return nil, NewApiError(ERROR_NOT_FOUND, "tile layer not found")
 	}
+	if "" != deleted.Tileset {
+		return nil, validationFailed(fmt.Errorf("tile layer of tileset is deleted with delete_tileset"))
+	}
+	customer.TileLayers = tilelayers
+	err := DB.InsertCustomer(customer)
+	if err != nil {
+		return nil, err
+	}
+	if deleted.Proxy {
+		TileProxy.Purge(deleted.Id)
+	}
+	return "tile layer deleted", nil
+}
 
-	// Add datasource uuid to customer
-	customer.TileLayers = append(customer.TileLayers, tilelayer)
-	// customer.TileLayers[tilelayer_name] = tilelayer_url
-	DB.InsertCustomer(customer)
+// getProxiedTileLayer returns proxied tile layer of customer by id
+func getProxiedTileLayer(customer Customer, tilelayer_id string) (TileLayer, error) {
+	for _, tilelayer := range customer.TileLayers {
+		if "" != tilelayer_id && tilelayer_id == tilelayer.Id {
+			if !tilelayer.Proxy {
+				return tilelayer, NewApiError(ERROR_NOT_FOUND, "tile layer is not proxied")
+			}
+			return tilelayer, nil
+		}
+	}
+	return TileLayer{}, NewApiError(ERROR_NOT_FOUND, "tile layer not found")
+}
 
-	// Generate message
-	data := `{"status": "success", "data": {"tilelayer": {"url": "` + tilelayer_url + `", "name": "` + tilelayer_name + `"}}}`
-	js, err := json.Marshal(data)
+// TileProxyHandler serves tile of proxied tile layer from the tile proxy
+// cache. Tiles the upstream server does not have are sent as 204 No
+// Content.
+// @param apikey
+// @param id
+// @param z
+// @param x
+// @param y
+func TileProxyHandler(w http.ResponseWriter, r *http.Request) {
+	NetworkLogger.Debug("[In] ", redactedRequest(r))
+	apikey := GetApikeyFromRequest(w, r)
+	if apikey == "" {
+		return
+	}
+	customer, err := GetCustomerFromDatabase(w, r, apikey)
 	if err != nil {
-		// networkLoggerError.Println(r.RemoteAddr, "POST /api/v1/tilelayer [500]")
-		NetworkLogger.Critical(r.RemoteAddr, " POST /api/v1/tilelayer [500]")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tilelayer, err := getProxiedTileLayer(customer, mux.Vars(r)["id"])
+	if err != nil {
+		sendApiError(w, r, err)
+		return
+	}
+	tile, err := getRequestTile(r)
+	if err != nil {
+		sendApiError(w, r, validationFailed(err))
 		return
 	}
 
-	// Return results
-	w.Header().Set("Content-Type", "application/json")
-	// allow cross domain AJAX requests
+	data, err := TileProxy.Tile(tilelayer, tile)
+	if err != nil {
+		sendApiError(w, r, NewApiError(ERROR_UPSTREAM, err.Error()))
+		return
+	}
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	// networkLoggerInfo.Println(r.RemoteAddr, "POST /api/v1/layer [200]")
-	NetworkLogger.Info(r.RemoteAddr, " POST /api/v1/tilelayer [200]")
-	// networkLoggerInfoOut.Println(string(js))
-	NetworkLogger.Debug(js)
-	w.Write(js)
+	if 0 == len(data) {
+		NetworkLogger.Info(r.RemoteAddr, fmt.Sprintf(" %v %v [204]", r.Method, r.URL.Path))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	NetworkLogger.Info(r.RemoteAddr, fmt.Sprintf(" %v %v [200]", r.Method, r.URL.Path))
+	w.Header().Set("Content-Type", http.DetectContentType(data))
+	w.Write(data)
+}
 
+// seedTileLayer caches the tiles of proxied tile layer covering bbox in
+// the zoom range
+// @param apikey
+// @param tilelayer_id
+// @param bbox [minlon, minlat, maxlon, maxlat]
+// @param min_zoom
+// @param max_zoom
+// @return json
+func seedTileLayer(ctx *OperationContext) (interface{}, error) {
+	data := ctx.Request.Data
+	tilelayer, err := getProxiedTileLayer(ctx.Customer, data.TileLayerId)
+	if err != nil {
+		return nil, err
+	}
+	result, err := TileProxy.Seed(tilelayer, data.Bbox, data.MinZoom, data.MaxZoom)
+	if err != nil {
+		return nil, validationFailed(err)
+	}
+	return result, nil
 }
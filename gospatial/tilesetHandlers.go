@@ -0,0 +1,280 @@
+package gospatial
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+)
+
+import (
+	"./utils"
+)
+
+import "github.com/gorilla/mux"
+
+// readTilesetUpload writes MBTiles file of request body to file. The file
+// is sent as raw body or as file part of a multipart form.
+// @returns string tile layer name
+// @returns Error
+func readTilesetUpload(r *http.Request, file io.Writer) (string, error) {
+	name := strings.TrimSpace(r.FormValue("tilelayer_name"))
+	media_type, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if "multipart/form-data" != media_type {
+		_, err := io.Copy(file, r.Body)
+		return name, err
+	}
+	upload, _, err := r.FormFile("file")
+	if err != nil {
+		return name, err
+	}
+	defer upload.Close()
+	_, err = io.Copy(file, upload)
+	return name, err
+}
+
+// UploadTilesetHandler stores uploaded MBTiles file as tileset and adds
+// it to the tile layers of the customer
+// @param apikey
+// @param tilelayer_name defaults to the name in the MBTiles metadata
+// @return json
+func UploadTilesetHandler(w http.ResponseWriter, r *http.Request) {
+	NetworkLogger.Debug("[In] ", redactedRequest(r))
+	// limit body before form values are parsed from it
+	r.Body = http.MaxBytesReader(w, r.Body, TILESET_MAX_SIZE)
+	apikey := GetApikeyFromRequest(w, r)
+	if apikey == "" {
+		return
+	}
+	customer, err := GetCustomerFromDatabase(w, r, apikey)
+	if err != nil {
+		return
+	}
+
+	err = os.MkdirAll(TILESET_DIRECTORY, 0755)
+	if err != nil {
+		sendApiError(w, r, err)
+		return
+	}
+	file, err := ioutil.TempFile(TILESET_DIRECTORY, "upload-")
+	if err != nil {
+		sendApiError(w, r, err)
+		return
+	}
+	// the temporary file is gone once renamed to the tileset file
+	defer os.Remove(file.Name())
+
+	name, err := readTilesetUpload(r, file)
+	file.Close()
+	if err != nil {
+		sendApiError(w, r, validationFailed(err))
+		return
+	}
+
+	// read metadata of the upload
+	mbtiles, err := OpenMBTiles(file.Name())
+	if err != nil {
+		sendApiError(w, r, validationFailed(err))
+		return
+	}
+	tileset, err := mbtiles.Tileset()
+	mbtiles.Close()
+	if err != nil {
+		sendApiError(w, r, validationFailed(err))
+		return
+	}
+	tileset.Id, _ = utils.NewUUID()
+	tileset.Owner = customer.Id
+	if "" != name {
+		tileset.Name = name
+	}
+	if "" == tileset.Name {
+		tileset.Name = tileset.Id
+	}
+	if info, err := os.Stat(file.Name()); nil == err {
+		tileset.Size = info.Size()
+	}
+
+	err = os.Rename(file.Name(), tileset.File())
+	if err != nil {
+		sendApiError(w, r, err)
+		return
+	}
+	err = DB.InsertTileset(tileset)
+	if err != nil {
+		os.Remove(tileset.File())
+		sendApiError(w, r, err)
+		return
+	}
+
+	// Add tile layer to customer
+	tilelayer := TileLayer{Id: tileset.Id, Name: tileset.Name, Url: "/api/v1/tilelayer/" + tileset.Id + "/{z}/{x}/{y}", Tileset: tileset.Id}
+	customer.TileLayers = append(customer.TileLayers, tilelayer)
+	err = DB.InsertCustomer(customer)
+	if err != nil {
+		sendApiError(w, r, err)
+		return
+	}
+
+	js, err := MarshalJsonFromStruct(w, r, HttpMessageResponse{Status: JSEND_SUCCESS, Data: map[string]interface{}{"tilelayer": tilelayer, "tileset": tileset}})
+	if err != nil {
+		return
+	}
+	SendJsonResponse(w, r, js)
+}
+
+// getRequestTileset returns tileset of url path if it belongs to the
+// customer of the request apikey. Returns false if an error response was
+// sent.
+func getRequestTileset(w http.ResponseWriter, r *http.Request) (Tileset, bool) {
+	apikey := GetApikeyFromRequest(w, r)
+	if apikey == "" {
+		return Tileset{}, false
+	}
+	customer, err := GetCustomerFromDatabase(w, r, apikey)
+	if err != nil {
+		return Tileset{}, false
+	}
+	tileset, err := DB.GetTileset(mux.Vars(r)["id"])
+	if err != nil {
+		sendApiError(w, r, err)
+		return tileset, false
+	}
+	if customer.Id != tileset.Owner {
+		sendApiError(w, r, ErrUnauthorized)
+		return tileset, false
+	}
+	return tileset, true
+}
+
+// TilesetTileHandler serves tile of uploaded tileset. Tiles missing from
+// the tileset are sent as 204 No Content.
+// @param apikey
+// @param id
+// @param z
+// @param x
+// @param y
+func TilesetTileHandler(w http.ResponseWriter, r *http.Request) {
+	NetworkLogger.Debug("[In] ", redactedRequest(r))
+	tileset, ok := getRequestTileset(w, r)
+	if !ok {
+		return
+	}
+	tile, err := getRequestTile(r)
+	if err != nil {
+		sendApiError(w, r, validationFailed(err))
+		return
+	}
+	mbtiles, err := OpenTileset(tileset)
+	if err != nil {
+		sendApiError(w, r, err)
+		return
+	}
+	data, err := mbtiles.Tile(tile)
+	if err != nil {
+		sendApiError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if 0 == len(data) {
+		NetworkLogger.Info(r.RemoteAddr, fmt.Sprintf(" %v %v [204]", r.Method, r.URL.Path))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	NetworkLogger.Info(r.RemoteAddr, fmt.Sprintf(" %v %v [200]", r.Method, r.URL.Path))
+	w.Header().Set("Content-Type", tileset.ContentType())
+	// vector tiles are usually stored gzip compressed
+	if "pbf" == tileset.Format && bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+	w.Write(data)
+}
+
+// TilesetTileJSONHandler serves TileJSON document of uploaded tileset
+// @param apikey
+// @param id
+func TilesetTileJSONHandler(w http.ResponseWriter, r *http.Request) {
+	NetworkLogger.Debug("[In] ", redactedRequest(r))
+	tileset, ok := getRequestTileset(w, r)
+	if !ok {
+		return
+	}
+	bounds := tileset.Bounds
+	if nil == bounds {
+		bounds = []float64{-180, -MVT_MAX_LATITUDE, 180, MVT_MAX_LATITUDE}
+	}
+	center := tileset.Center
+	if nil == center {
+		center = []float64{(bounds[0] + bounds[2]) / 2, (bounds[1] + bounds[3]) / 2, float64(tileset.MinZoom)}
+	}
+
+	tilejson := map[string]interface{}{
+		"tilejson": "3.0.0",
+		"name":     tileset.Name,
+		"scheme":   "xyz",
+		"format":   tileset.Format,
+		"tiles":    []string{tileUrl(r, "/api/v1/tilelayer/"+tileset.Id+"/{z}/{x}/{y}")},
+		"minzoom":  tileset.MinZoom,
+		"maxzoom":  tileset.MaxZoom,
+		"bounds":   bounds,
+		"center":   center,
+	}
+	if "" != tileset.Attribution {
+		tilejson["attribution"] = tileset.Attribution
+	}
+	if "" != tileset.Description {
+		tilejson["description"] = tileset.Description
+	}
+	if "pbf" == tileset.Format {
+		tilejson["vector_layers"] = tileset.VectorLayers
+		if nil == tileset.VectorLayers {
+			tilejson["vector_layers"] = []interface{}{}
+		}
+	}
+	js, err := MarshalJsonFromStruct(w, r, tilejson)
+	if err != nil {
+		return
+	}
+	SendJsonResponse(w, r, js)
+}
+
+// deleteTileset deletes uploaded tileset of customer and its tile layer
+// @param apikey
+// @param tileset_id
+// @return json
+func deleteTileset(ctx *OperationContext) (interface{}, error) {
+	if "" == ctx.Request.Data.TilesetId {
+		return nil, ErrMissingParameters
+	}
+	tileset, err := DB.GetTileset(ctx.Request.Data.TilesetId)
+	if err != nil {
+		return nil, err
+	}
+	if ctx.Customer.Id != tileset.Owner {
+		return nil, ErrUnauthorized
+	}
+	err = DB.DeleteTileset(tileset.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Remove tile layer from customer
+	customer := ctx.Customer
+	tilelayers := []TileLayer{}
+	for _, tilelayer := range customer.TileLayers {
+		if tileset.Id != tilelayer.Tileset {
+			tilelayers = append(tilelayers, tilelayer)
+		}
+	}
+	customer.TileLayers = tilelayers
+	err = DB.InsertCustomer(customer)
+	if err != nil {
+		return nil, err
+	}
+	return "tileset deleted", nil
+}
@@ -0,0 +1,299 @@
+package gospatial
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+import _ "github.com/mattn/go-sqlite3"
+
+// Tileset hosting settings
+var (
+	// Directory uploaded MBTiles files are stored in
+	TILESET_DIRECTORY string = "tilesets"
+	// Largest MBTiles upload in bytes
+	TILESET_MAX_SIZE int64 = 2 * 1024 * 1024 * 1024
+)
+
+// ErrTilesetNotFound is returned for unknown tileset ids
+var ErrTilesetNotFound = errors.New("tileset not found!")
+
+// Tileset is an uploaded MBTiles file of raster or vector tiles. Format is
+// the tile format, png, jpg, webp or pbf.
+type Tileset struct {
+	Id           string          `json:"id"`
+	Owner        string          `json:"owner"`
+	Name         string          `json:"name"`
+	Format       string          `json:"format"`
+	Bounds       []float64       `json:"bounds,omitempty"`
+	Center       []float64       `json:"center,omitempty"`
+	MinZoom      int             `json:"minzoom"`
+	MaxZoom      int             `json:"maxzoom"`
+	Attribution  string          `json:"attribution,omitempty"`
+	Description  string          `json:"description,omitempty"`
+	VectorLayers json.RawMessage `json:"vector_layers,omitempty"`
+	Size         int64           `json:"size"`
+}
+
+// ContentType returns media type of the tiles
+// @returns string
+func (self Tileset) ContentType() string {
+	switch self.Format {
+	case "png":
+		return "image/png"
+	case "jpg":
+		return "image/jpeg"
+	case "webp":
+		return "image/webp"
+	}
+	return "application/vnd.mapbox-vector-tile"
+}
+
+// File returns path of the MBTiles file of tileset
+// @returns string
+func (self Tileset) File() string {
+	return filepath.Join(TILESET_DIRECTORY, self.Id+".mbtiles")
+}
+
+// MBTiles is an open MBTiles file, a sqlite database of tiles in TMS
+// row order and its metadata
+type MBTiles struct {
+	db *sql.DB
+}
+
+// OpenMBTiles opens MBTiles file read only and checks its tables
+// @param file {string}
+// @returns *MBTiles
+// @returns Error
+func OpenMBTiles(file string) (*MBTiles, error) {
+	db, err := sql.Open("sqlite3", "file:"+file+"?mode=ro&immutable=1")
+	if err != nil {
+		return nil, err
+	}
+	var zoom int
+	_, err = db.Exec("SELECT name, value FROM metadata LIMIT 1")
+	if nil == err {
+		err = db.QueryRow("SELECT zoom_level FROM tiles LIMIT 1").Scan(&zoom)
+	}
+	switch {
+	case sql.ErrNoRows == err:
+		err = fmt.Errorf("mbtiles has no tiles")
+	case nil != err:
+		err = fmt.Errorf("not a valid mbtiles file: %v", err)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &MBTiles{db: db}, nil
+}
+
+// Close closes the sqlite database
+func (self *MBTiles) Close() error {
+	return self.db.Close()
+}
+
+// Tile returns tile data, nil for tiles missing from the tileset
+// @param tile {tileCoord} xyz tile
+// @returns []byte
+// @returns Error
+func (self *MBTiles) Tile(tile tileCoord) ([]byte, error) {
+	var data []byte
+	row := (1 << uint(tile.Z)) - 1 - tile.Y
+	err := self.db.QueryRow("SELECT tile_data FROM tiles WHERE zoom_level = ? AND tile_column = ? AND tile_row = ?", tile.Z, tile.X, row).Scan(&data)
+	if sql.ErrNoRows == err {
+		return nil, nil
+	}
+	return data, err
+}
+
+// Tileset returns tileset described by the metadata table. Missing zoom
+// levels are read from the tiles and a missing format from the first tile.
+// @returns Tileset
+// @returns Error
+func (self *MBTiles) Tileset() (Tileset, error) {
+	tileset := Tileset{}
+	rows, err := self.db.Query("SELECT name, value FROM metadata")
+	if err != nil {
+		return tileset, err
+	}
+	defer rows.Close()
+	metadata := make(map[string]string)
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return tileset, err
+		}
+		metadata[name] = value
+	}
+	if err := rows.Err(); err != nil {
+		return tileset, err
+	}
+
+	tileset.Name = metadata["name"]
+	tileset.Format = metadata["format"]
+	tileset.Attribution = metadata["attribution"]
+	tileset.Description = metadata["description"]
+	tileset.Bounds = parseMetadataNumbers(metadata["bounds"], 4)
+	tileset.Center = parseMetadataNumbers(metadata["center"], 3)
+
+	// vector tilesets describe their layers in the json metadata
+	if "" != metadata["json"] {
+		layers := struct {
+			VectorLayers json.RawMessage `json:"vector_layers"`
+		}{}
+		if nil == json.Unmarshal([]byte(metadata["json"]), &layers) {
+			tileset.VectorLayers = layers.VectorLayers
+		}
+	}
+
+	minzoom, min_err := strconv.Atoi(metadata["minzoom"])
+	maxzoom, max_err := strconv.Atoi(metadata["maxzoom"])
+	if nil != min_err || nil != max_err {
+		err = self.db.QueryRow("SELECT min(zoom_level), max(zoom_level) FROM tiles").Scan(&minzoom, &maxzoom)
+		if err != nil {
+			return tileset, err
+		}
+	}
+	tileset.MinZoom, tileset.MaxZoom = minzoom, maxzoom
+
+	switch tileset.Format {
+	case "png", "jpg", "webp", "pbf":
+	case "jpeg":
+		tileset.Format = "jpg"
+	case "mvt":
+		tileset.Format = "pbf"
+	case "":
+		var data []byte
+		err = self.db.QueryRow("SELECT tile_data FROM tiles LIMIT 1").Scan(&data)
+		if err != nil {
+			return tileset, err
+		}
+		tileset.Format = tileFormat(data)
+	default:
+		return tileset, fmt.Errorf("unsupported tile format: %v", tileset.Format)
+	}
+	return tileset, nil
+}
+
+// parseMetadataNumbers parses comma separated numbers of metadata value,
+// nil unless there are n of them
+func parseMetadataNumbers(value string, n int) []float64 {
+	parts := strings.Split(value, ",")
+	if n != len(parts) {
+		return nil
+	}
+	numbers := []float64{}
+	for _, part := range parts {
+		number, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil
+		}
+		numbers = append(numbers, number)
+	}
+	return numbers
+}
+
+// tileFormat detects tile format from tile data
+func tileFormat(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("\x89PNG")):
+		return "png"
+	case bytes.HasPrefix(data, []byte("\xff\xd8")):
+		return "jpg"
+	case 12 <= len(data) && "RIFF" == string(data[:4]) && "WEBP" == string(data[8:12]):
+		return "webp"
+	}
+	return "pbf"
+}
+
+// open MBTiles files of tilesets
+var (
+	mbtiles_files = make(map[string]*MBTiles)
+	mbtiles_guard sync.Mutex
+)
+
+// OpenTileset returns open MBTiles file of tileset, files stay open for
+// the following tile requests
+// @param tileset {Tileset}
+// @returns *MBTiles
+// @returns Error
+func OpenTileset(tileset Tileset) (*MBTiles, error) {
+	mbtiles_guard.Lock()
+	defer mbtiles_guard.Unlock()
+	if mbtiles, ok := mbtiles_files[tileset.Id]; ok {
+		return mbtiles, nil
+	}
+	mbtiles, err := OpenMBTiles(tileset.File())
+	if err != nil {
+		return nil, err
+	}
+	mbtiles_files[tileset.Id] = mbtiles
+	return mbtiles, nil
+}
+
+// closeTileset closes MBTiles file of tileset if open
+func closeTileset(tileset_id string) {
+	mbtiles_guard.Lock()
+	defer mbtiles_guard.Unlock()
+	if mbtiles, ok := mbtiles_files[tileset_id]; ok {
+		mbtiles.Close()
+		delete(mbtiles_files, tileset_id)
+	}
+}
+
+// InsertTileset stores tileset
+// @param tileset {Tileset}
+// @returns Error
+func (self *Database) InsertTileset(tileset Tileset) error {
+	value, err := json.Marshal(tileset)
+	if err != nil {
+		return err
+	}
+	return self.Insert("tilesets", tileset.Id, value)
+}
+
+// GetTileset returns tileset by id
+// @param tileset_id {string}
+// @returns Tileset
+// @returns Error
+func (self *Database) GetTileset(tileset_id string) (Tileset, error) {
+	tileset := Tileset{}
+	value, err := self.Select("tilesets", tileset_id)
+	if err != nil {
+		return tileset, err
+	}
+	if 0 == len(value) {
+		return tileset, ErrTilesetNotFound
+	}
+	err = json.Unmarshal(value, &tileset)
+	return tileset, err
+}
+
+// DeleteTileset deletes tileset and its MBTiles file
+// @param tileset_id {string}
+// @returns Error
+func (self *Database) DeleteTileset(tileset_id string) error {
+	tileset, err := self.GetTileset(tileset_id)
+	if err != nil {
+		return err
+	}
+	err = self.Delete("tilesets", tileset_id)
+	if err != nil {
+		return err
+	}
+	closeTileset(tileset_id)
+	err = os.Remove(tileset.File())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,150 @@
+package gospatial
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeMBTiles writes MBTiles file with metadata and tiles keyed by their
+// TMS zoom, column and row
+func writeMBTiles(t *testing.T, file string, metadata map[string]string, tiles map[[3]int][]byte) {
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, statement := range []string{
+		"CREATE TABLE metadata (name text, value text)",
+		"CREATE TABLE tiles (zoom_level integer, tile_column integer, tile_row integer, tile_data blob)",
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, value := range metadata {
+		db.Exec("INSERT INTO metadata (name, value) VALUES (?, ?)", name, value)
+	}
+	for coord, data := range tiles {
+		db.Exec("INSERT INTO tiles (zoom_level, tile_column, tile_row, tile_data) VALUES (?, ?, ?, ?)", coord[0], coord[1], coord[2], data)
+	}
+}
+
+func TestTilesetRoutes(t *testing.T) {
+	directory, err := ioutil.TempDir("", "tilesets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	tileset_directory := TILESET_DIRECTORY
+	TILESET_DIRECTORY = filepath.Join(directory, "tilesets")
+	defer func() {
+		TILESET_DIRECTORY = tileset_directory
+	}()
+
+	server := httptest.NewServer(Router())
+	defer server.Close()
+	apikey := "testTilesetKey"
+	DB.InsertCustomer(Customer{Apikey: apikey})
+	DB.InsertCustomer(Customer{Apikey: "testTilesetOtherKey"})
+
+	// raster tileset with tile 1/0/0 stored at TMS row 1
+	png_tile := []byte("\x89PNG tile")
+	upload := filepath.Join(directory, "upload.mbtiles")
+	writeMBTiles(t, upload, map[string]string{"name": "basemap", "bounds": "-180,-85,180,85", "minzoom": "0", "maxzoom": "1"}, map[[3]int][]byte{{1, 0, 1}: png_tile})
+	mbtiles, _ := ioutil.ReadFile(upload)
+
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	form.WriteField("tilelayer_name", "offline basemap")
+	part, _ := form.CreateFormFile("file", "upload.mbtiles")
+	part.Write(mbtiles)
+	form.Close()
+	resp, err := http.Post(server.URL+"/api/v1/tilelayer/mbtiles?apikey="+apikey, form.FormDataContentType(), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploaded := struct {
+		Data struct {
+			Tilelayer TileLayer `json:"tilelayer"`
+			Tileset   Tileset   `json:"tileset"`
+		} `json:"data"`
+	}{}
+	json.NewDecoder(resp.Body).Decode(&uploaded)
+	resp.Body.Close()
+	tileset := uploaded.Data.Tileset
+	if http.StatusOK != resp.StatusCode || "" == tileset.Id || "png" != tileset.Format || "offline basemap" != tileset.Name || 1 != tileset.MaxZoom {
+		t.Fatalf("Expected tileset uploaded: %v %v", resp.StatusCode, tileset)
+	}
+	customer, _ := DB.GetCustomer(apikey)
+	if 1 != len(customer.TileLayers) || tileset.Id != customer.TileLayers[0].Tileset || "/api/v1/tilelayer/"+tileset.Id+"/{z}/{x}/{y}" != customer.TileLayers[0].Url {
+		t.Errorf("Expected tile layer of tileset: %v", customer.TileLayers)
+	}
+
+	get := func(path string) (*http.Response, []byte) {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, body
+	}
+	tiles := "/api/v1/tilelayer/" + tileset.Id
+	resp, data := get(tiles + "/1/0/0?apikey=" + apikey)
+	if http.StatusOK != resp.StatusCode || "image/png" != resp.Header.Get("Content-Type") || !bytes.Equal(png_tile, data) {
+		t.Errorf("Expected tile of xyz row: %v %s", resp.StatusCode, data)
+	}
+	if resp, _ = get(tiles + "/1/0/1?apikey=" + apikey); http.StatusNoContent != resp.StatusCode {
+		t.Errorf("Expected missing tile: %v", resp.StatusCode)
+	}
+	if resp, _ = get(tiles + "/1/0/0?apikey=testTilesetOtherKey"); http.StatusUnauthorized != resp.StatusCode {
+		t.Errorf("Expected tileset of other customer rejected: %v", resp.StatusCode)
+	}
+
+	tilejson := struct {
+		Tiles   []string
+		Format  string
+		Bounds  []float64
+		Maxzoom int
+	}{}
+	_, data = get(tiles + "/tiles.json?apikey=" + apikey)
+	json.Unmarshal(data, &tilejson)
+	if 1 != len(tilejson.Tiles) || server.URL+tiles+"/{z}/{x}/{y}?apikey="+apikey != tilejson.Tiles[0] || "png" != tilejson.Format || 4 != len(tilejson.Bounds) || 1 != tilejson.Maxzoom {
+		t.Errorf("Unexpected tilejson: %s", data)
+	}
+
+	// raw uploads need a valid mbtiles file
+	resp, _ = http.Post(server.URL+"/api/v1/tilelayer/mbtiles?apikey="+apikey, "application/octet-stream", bytes.NewReader([]byte("not sqlite")))
+	resp.Body.Close()
+	if http.StatusBadRequest != resp.StatusCode {
+		t.Errorf("Expected invalid upload rejected: %v", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest("DELETE", server.URL+tiles+"?apikey="+apikey, nil)
+	resp, _ = http.DefaultClient.Do(req)
+	resp.Body.Close()
+	if http.StatusBadRequest != resp.StatusCode {
+		t.Errorf("Expected tile layer of tileset kept: %v", resp.StatusCode)
+	}
+	req, _ = http.NewRequest("DELETE", server.URL+"/api/v1/tileset/"+tileset.Id+"?apikey="+apikey, nil)
+	resp, _ = http.DefaultClient.Do(req)
+	resp.Body.Close()
+	customer, _ = DB.GetCustomer(apikey)
+	if http.StatusOK != resp.StatusCode || 0 != len(customer.TileLayers) {
+		t.Errorf("Expected tileset deleted: %v %v", resp.StatusCode, customer.TileLayers)
+	}
+	if _, err := os.Stat(tileset.File()); !os.IsNotExist(err) {
+		t.Errorf("Expected tileset file removed")
+	}
+	if files, _ := ioutil.ReadDir(TILESET_DIRECTORY); 0 != len(files) {
+		t.Errorf("Expected uploads cleaned up: %v", files)
+	}
+}
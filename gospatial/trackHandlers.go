@@ -0,0 +1,44 @@
+package gospatial
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// parsePositionReports reads a single position report or a list of reports
+func parsePositionReports(body []byte) ([]PositionReport, error) {
+	reports := []PositionReport{}
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+		err := json.Unmarshal(body, &reports)
+		return reports, err
+	}
+	report := PositionReport{}
+	err := json.Unmarshal(body, &report)
+	return append(reports, report), err
+}
+
+// decodePositions reads http request body as the request position reports
+func decodePositions(body []byte, req *TcpMessage) error {
+	reports, err := parsePositionReports(body)
+	req.Data.Reports = reports
+	return err
+}
+
+// reportPositions ingests device position reports into the layer,
+// updating each device's last known position and daily track.
+// @param apikey customer id
+// @oaram ds datasource uuid
+// @return json
+func reportPositions(ctx *OperationContext) (interface{}, error) {
+	reports := ctx.Request.Data.Reports
+	if 0 == len(reports) {
+		return nil, ErrMissingParameters
+	}
+	for _, report := range reports {
+		err := report.Validate()
+		if err != nil {
+			return nil, validationFailed(err)
+		}
+	}
+	return DB.ReportPositions(ctx.Datasource(), reports)
+}
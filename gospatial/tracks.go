@@ -0,0 +1,408 @@
+package gospatial
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+import "github.com/paulmach/go.geojson"
+
+// Track feature kinds, stored in the track_type property
+const (
+	TRACK_POSITION string = "position"
+	TRACK_LINE     string = "track"
+)
+
+// Handling of reports older than the device's last known position
+const (
+	// add vertex to the track in timestamp order
+	TRACK_OUT_OF_ORDER_INSERT string = "insert"
+	// discard report
+	TRACK_OUT_OF_ORDER_DROP string = "drop"
+)
+
+var (
+	// Days tracks are kept, 0 keeps all tracks
+	TRACK_RETENTION_DAYS int = 30
+	// Vertices kept per track, the oldest are removed first. 0 is unlimited
+	TRACK_MAX_VERTICES int = 10000
+	// Handling of late reports, TRACK_OUT_OF_ORDER_INSERT or TRACK_OUT_OF_ORDER_DROP
+	TRACK_OUT_OF_ORDER string = TRACK_OUT_OF_ORDER_INSERT
+)
+
+// PositionReport is a position fix sent by a tracked device.
+// Timestamp is unix time, the time of ingestion when 0.
+type PositionReport struct {
+	DeviceId  string  `json:"device_id"`
+	Lon       float64 `json:"lon"`
+	Lat       float64 `json:"lat"`
+	Timestamp int64   `json:"timestamp"`
+	Speed     float64 `json:"speed"`
+}
+
+// TrackReportResult counts the reports stored and the reports discarded
+// as late or older than the track retention
+type TrackReportResult struct {
+	Applied int `json:"applied"`
+	Dropped int `json:"dropped"`
+}
+
+// Validate checks position report has a device and valid coordinates
+// @returns Error
+func (self PositionReport) Validate() error {
+	if "" == self.DeviceId {
+		return fmt.Errorf("position report requires device_id")
+	}
+	if -180 > self.Lon || 180 < self.Lon || -90 > self.Lat || 90 < self.Lat {
+		return fmt.Errorf("position report coordinates out of range: %v %v", self.Lon, self.Lat)
+	}
+	if 0 > self.Timestamp {
+		return fmt.Errorf("position report timestamp must be unix time")
+	}
+	return nil
+}
+
+// PositionGeoId returns geo_id of the device's last known position feature
+// @param device_id {string}
+// @returns string
+func PositionGeoId(device_id string) string {
+	return "position-" + device_id
+}
+
+// TrackGeoId returns geo_id of the device's track for the day of timestamp (UTC)
+// @param device_id {string}
+// @param timestamp {int64}
+// @returns string
+func TrackGeoId(device_id string, timestamp int64) string {
+	return "track-" + device_id + "-" + trackDay(timestamp)
+}
+
+func trackDay(timestamp int64) string {
+	return time.Unix(timestamp, 0).UTC().Format("2006-01-02")
+}
+
+// trackNumbers reads a numeric array property, which is []interface{}
+// once the layer has been loaded from the database
+func trackNumbers(value interface{}) []float64 {
+	switch v := value.(type) {
+	case []float64:
+		return append([]float64{}, v...)
+	case []interface{}:
+		numbers := make([]float64, 0, len(v))
+		for _, n := range v {
+			f, _ := n.(float64)
+			numbers = append(numbers, f)
+		}
+		return numbers
+	}
+	return []float64{}
+}
+
+// trackWrite is a feature changed by a batch of position reports
+type trackWrite struct {
+	geo_id   string
+	previous *geojson.Feature
+	added    bool
+	deleted  bool
+}
+
+// trackBatch collects changed features of a layer, copying each feature
+// before it is first changed so readers of the cached layer are not affected
+type trackBatch struct {
+	db             *Database
+	featCollection *geojson.FeatureCollection
+	writes         []*trackWrite
+	index          map[string]*trackWrite
+	now            int64
+}
+
+// feature returns a copy of the feature for writing, or nil if it does not exist
+func (self *trackBatch) feature(geo_id string) *geojson.Feature {
+	i := self.db.findFeature(self.featCollection, geo_id)
+	if -1 == i {
+		return nil
+	}
+	if _, ok := self.index[geo_id]; ok {
+		return self.featCollection.Features[i]
+	}
+	value, err := self.featCollection.Features[i].MarshalJSON()
+	if err != nil {
+		ServerLogger.Error(err)
+		return nil
+	}
+	previous, err := geojson.UnmarshalFeature(value)
+	if err != nil {
+		ServerLogger.Error(err)
+		return nil
+	}
+	current, _ := geojson.UnmarshalFeature(value)
+	self.featCollection.Features[i] = current
+	self.record(&trackWrite{geo_id: geo_id, previous: previous})
+	return current
+}
+
+// create adds new track feature to layer
+func (self *trackBatch) create(geo_id string, device_id string, track_type string, geom *geojson.Geometry) *geojson.Feature {
+	feat := geojson.NewFeature(geom)
+	feat.Properties["is_active"] = true
+	feat.Properties["is_deleted"] = false
+	feat.Properties["date_created"] = self.now
+	feat.Properties["geo_id"] = geo_id
+	feat.Properties["version"] = 0
+	feat.Properties["device_id"] = device_id
+	feat.Properties["track_type"] = track_type
+	self.featCollection.AddFeature(feat)
+	self.record(&trackWrite{geo_id: geo_id, added: true})
+	return feat
+}
+
+// remove deletes feature from layer
+func (self *trackBatch) remove(geo_id string) {
+	previous := self.feature(geo_id)
+	if nil == previous {
+		return
+	}
+	i := self.db.findFeature(self.featCollection, geo_id)
+	self.featCollection.Features = append(self.featCollection.Features[:i], self.featCollection.Features[i+1:]...)
+	self.index[geo_id].deleted = true
+}
+
+func (self *trackBatch) record(write *trackWrite) {
+	self.writes = append(self.writes, write)
+	self.index[write.geo_id] = write
+}
+
+// report applies position report. Returns false if it was discarded.
+func (self *trackBatch) report(report PositionReport, cutoff string) bool {
+	if "" != cutoff && trackDay(report.Timestamp) < cutoff {
+		return false
+	}
+
+	position_id := PositionGeoId(report.DeviceId)
+	late := false
+	if i := self.db.findFeature(self.featCollection, position_id); -1 != i {
+		last, _ := self.featCollection.Features[i].Properties["timestamp"].(float64)
+		if v, ok := self.featCollection.Features[i].Properties["timestamp"].(int64); ok {
+			last = float64(v)
+		}
+		late = float64(report.Timestamp) < last
+	}
+	if late && TRACK_OUT_OF_ORDER_DROP == TRACK_OUT_OF_ORDER {
+		return false
+	}
+
+	// last known position
+	if !late {
+		position := self.feature(position_id)
+		if nil == position {
+			position = self.create(position_id, report.DeviceId, TRACK_POSITION, nil)
+		}
+		position.Geometry = geojson.NewPointGeometry([]float64{report.Lon, report.Lat})
+		position.Properties["timestamp"] = report.Timestamp
+		position.Properties["speed"] = report.Speed
+	}
+
+	// vertex of the day's track, in timestamp order
+	track_id := TrackGeoId(report.DeviceId, report.Timestamp)
+	track := self.feature(track_id)
+	if nil == track {
+		track = self.create(track_id, report.DeviceId, TRACK_LINE, nil)
+		track.Properties["day"] = trackDay(report.Timestamp)
+	}
+	times := trackNumbers(track.Properties["times"])
+	speeds := trackNumbers(track.Properties["speeds"])
+	coordinates := [][]float64{}
+	if nil != track.Geometry && track.Geometry.IsPoint() {
+		coordinates = append(coordinates, track.Geometry.Point)
+	} else if nil != track.Geometry {
+		coordinates = track.Geometry.LineString
+	}
+	times, speeds = alignTrackTimes(times, speeds, len(coordinates), float64(report.Timestamp))
+	i := sort.Search(len(times), func(i int) bool {
+		return times[i] > float64(report.Timestamp)
+	})
+	times = append(times[:i], append([]float64{float64(report.Timestamp)}, times[i:]...)...)
+	speeds = append(speeds[:i], append([]float64{report.Speed}, speeds[i:]...)...)
+	coordinates = append(coordinates[:i:i], append([][]float64{{report.Lon, report.Lat}}, coordinates[i:]...)...)
+	if 0 < TRACK_MAX_VERTICES && TRACK_MAX_VERTICES < len(times) {
+		n := len(times) - TRACK_MAX_VERTICES
+		times, speeds, coordinates = times[n:], speeds[n:], coordinates[n:]
+	}
+	track.Geometry = trackGeometry(coordinates)
+	track.Properties["times"] = times
+	track.Properties["speeds"] = speeds
+	return true
+}
+
+// alignTrackTimes returns times and speeds with one value per track vertex.
+// Track features may be edited by clients, so the properties can be out of
+// step with the geometry. Extra values are dropped from the start, missing
+// ones are filled in before the first known time.
+func alignTrackTimes(times []float64, speeds []float64, vertices int, timestamp float64) ([]float64, []float64) {
+	if len(times) > vertices {
+		times = times[len(times)-vertices:]
+	}
+	if len(times) < vertices {
+		first := timestamp
+		if 0 < len(times) && times[0] < first {
+			first = times[0]
+		}
+		missing := make([]float64, vertices-len(times))
+		for i := range missing {
+			missing[i] = first
+		}
+		times = append(missing, times...)
+	}
+	if len(speeds) > len(times) {
+		speeds = speeds[len(speeds)-len(times):]
+	}
+	for len(speeds) < len(times) {
+		speeds = append([]float64{0}, speeds...)
+	}
+	return times, speeds
+}
+
+// trackGeometry returns geometry of track vertices. A track with a single
+// vertex is stored as Point, as a LineString needs two positions.
+func trackGeometry(coordinates [][]float64) *geojson.Geometry {
+	if 1 == len(coordinates) {
+		return geojson.NewPointGeometry(coordinates[0])
+	}
+	return geojson.NewLineStringGeometry(coordinates)
+}
+
+// prune removes tracks of days before cutoff
+func (self *trackBatch) prune(cutoff string) {
+	expired := []string{}
+	for _, feat := range self.featCollection.Features {
+		day, _ := feat.Properties["day"].(string)
+		if TRACK_LINE == feat.Properties["track_type"] && "" != day && day < cutoff {
+			expired = append(expired, fmt.Sprintf("%v", feat.Properties["geo_id"]))
+		}
+	}
+	for _, geo_id := range expired {
+		self.remove(geo_id)
+	}
+}
+
+// ReportPositions ingests device position reports into layer. Each report
+// moves the device's last known position point and adds a vertex to the
+// device's LineString track for the day, a Point until its second vertex.
+// Late reports are handled as set by TRACK_OUT_OF_ORDER, and tracks older
+// than TRACK_RETENTION_DAYS are removed. Every changed feature is written to the commit log and sent
+// as a change event.
+// @param datasource {string}
+// @param reports {[]PositionReport}
+// @returns TrackReportResult
+// @returns Error
+func (self *Database) ReportPositions(datasource_id string, reports []PositionReport) (TrackReportResult, error) {
+	result := TrackReportResult{}
+
+	// write lock for shutdown process
+	if self.WriteLock {
+		return result, ErrServerShuttingDown
+	}
+
+	now := time.Now().Unix()
+	for i := range reports {
+		err := reports[i].Validate()
+		if err != nil {
+			return result, err
+		}
+		if 0 == reports[i].Timestamp {
+			reports[i].Timestamp = now
+		}
+	}
+
+	self.commit_guard.Lock()
+	defer self.commit_guard.Unlock()
+
+	featCollection, err := self.GetLayer(datasource_id)
+	if err != nil {
+		return result, err
+	}
+
+	// work on a copy of the feature list, the cached layer stays unchanged until saved
+	featCollection = &geojson.FeatureCollection{
+		Type:     featCollection.Type,
+		Features: append([]*geojson.Feature{}, featCollection.Features...),
+	}
+	batch := &trackBatch{db: self, featCollection: featCollection, index: make(map[string]*trackWrite), now: now}
+
+	cutoff := ""
+	if 0 < TRACK_RETENTION_DAYS {
+		cutoff = trackDay(now - int64(TRACK_RETENTION_DAYS-1)*24*60*60)
+	}
+	for _, report := range reports {
+		if batch.report(report, cutoff) {
+			result.Applied++
+		} else {
+			result.Dropped++
+		}
+	}
+	if "" != cutoff {
+		batch.prune(cutoff)
+	}
+
+	if 0 == len(batch.writes) {
+		return result, nil
+	}
+
+	// Write to commit log
+	type committed struct {
+		seq        uint64
+		event_type string
+		value      []byte
+		write      *trackWrite
+	}
+	changes := []committed{}
+	for _, write := range batch.writes {
+		if write.deleted {
+			if write.added {
+				continue
+			}
+			seq := self.nextSequence()
+			self.commitLog("delete_feature", seq, map[string]string{"datasource": datasource_id, "geo_id": write.geo_id})
+			changes = append(changes, committed{seq, FEATURE_DELETED, nil, write})
+			continue
+		}
+
+		feat := featCollection.Features[self.findFeature(featCollection, write.geo_id)]
+		feat.Properties["date_modified"] = now
+		feat.Properties["version"] = FeatureVersion(write.previous) + 1
+		// not normalized into the layer schema, which would add the track
+		// properties to every feature of the cached layer
+		feat, err = self.normalizeGeometry(feat)
+		if nil != err {
+			return result, err
+		}
+
+		value, err := feat.MarshalJSON()
+		if err != nil {
+			return result, err
+		}
+		seq := self.nextSequence()
+		if write.added {
+			self.commitLog("insert_feature", seq, map[string]interface{}{"datasource": datasource_id, "feature": json.RawMessage(value)})
+			changes = append(changes, committed{seq, FEATURE_ADDED, value, write})
+		} else {
+			self.commitLog("edit_feature", seq, map[string]interface{}{"datasource": datasource_id, "geo_id": write.geo_id, "feature": json.RawMessage(value)})
+			changes = append(changes, committed{seq, FEATURE_UPDATED, value, write})
+		}
+	}
+
+	// insert layer
+	err = self.saveLayer(datasource_id, featCollection)
+	if err != nil {
+		panic(err)
+	}
+	for _, change := range changes {
+		if FEATURE_DELETED == change.event_type {
+			self.removeFeatureLock(datasource_id, change.write.geo_id)
+		}
+		self.emitFeatureChange(change.seq, change.event_type, datasource_id, change.write.geo_id, change.value, change.write.previous)
+	}
+	return result, nil
+}
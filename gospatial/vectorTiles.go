@@ -0,0 +1,552 @@
+package gospatial
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+import "github.com/paulmach/go.geojson"
+
+// Mapbox Vector Tile settings
+const (
+	// tile coordinate extent of a tile
+	MVT_EXTENT int = 4096
+	// clip buffer around tiles in tile coordinates, so lines and polygon
+	// edges do not show at tile borders
+	MVT_BUFFER int = 64
+	// simplification tolerance in tile coordinates, one pixel of a 256px tile
+	MVT_TOLERANCE float64 = 16
+	// largest zoom level served
+	MVT_MAX_ZOOM int = 22
+	// web mercator latitude limit
+	MVT_MAX_LATITUDE float64 = 85.0511287798
+)
+
+// MVT 2.1 geometry types
+const (
+	mvt_point      uint64 = 1
+	mvt_linestring uint64 = 2
+	mvt_polygon    uint64 = 3
+)
+
+// MVT 2.1 geometry commands
+const (
+	mvt_move_to    uint32 = 1
+	mvt_line_to    uint32 = 2
+	mvt_close_path uint32 = 7
+)
+
+// tileCoord is the zoom, column and row of a tile
+type tileCoord struct {
+	Z int
+	X int
+	Y int
+}
+
+// valid checks tile coordinates are within the zoom level
+func (self tileCoord) valid() bool {
+	n := 1 << uint(self.Z)
+	return 0 <= self.Z && self.Z <= MVT_MAX_ZOOM && 0 <= self.X && self.X < n && 0 <= self.Y && self.Y < n
+}
+
+// Bounds returns [minlon, minlat, maxlon, maxlat] of tile grown by buffer
+// given as fraction of the tile size
+// @param buffer {float64}
+// @returns []float64
+func (self tileCoord) Bounds(buffer float64) []float64 {
+	n := math.Pow(2, float64(self.Z))
+	lon := func(x float64) float64 {
+		return x/n*360 - 180
+	}
+	lat := func(y float64) float64 {
+		return math.Atan(math.Sinh(math.Pi*(1-2*y/n))) * 180 / math.Pi
+	}
+	x, y := float64(self.X), float64(self.Y)
+	return []float64{lon(x - buffer), lat(y + 1 + buffer), lon(x + 1 + buffer), lat(y - buffer)}
+}
+
+// project returns tile coordinates of lon/lat point
+func (self tileCoord) project(point []float64) []float64 {
+	lat := math.Max(-MVT_MAX_LATITUDE, math.Min(MVT_MAX_LATITUDE, point[1])) * math.Pi / 180
+	n := math.Pow(2, float64(self.Z))
+	x := (point[0] + 180) / 360 * n
+	y := (1 - math.Log(math.Tan(lat)+1/math.Cos(lat))/math.Pi) / 2 * n
+	extent := float64(MVT_EXTENT)
+	return []float64{(x - float64(self.X)) * extent, (y - float64(self.Y)) * extent}
+}
+
+// projectLine returns tile coordinates of line
+func (self tileCoord) projectLine(line [][]float64) [][]float64 {
+	projected := make([][]float64, 0, len(line))
+	for _, point := range line {
+		if 2 <= len(point) {
+			projected = append(projected, self.project(point))
+		}
+	}
+	return projected
+}
+
+// clip_min and clip_max bound tile coordinates of clipped geometries
+var clip_min, clip_max = float64(-MVT_BUFFER), float64(MVT_EXTENT + MVT_BUFFER)
+
+// pointInClip checks point is inside the buffered tile
+func pointInClip(point []float64) bool {
+	return clip_min <= point[0] && point[0] <= clip_max && clip_min <= point[1] && point[1] <= clip_max
+}
+
+// clipLine clips line to the buffered tile using Liang-Barsky, returning
+// the parts of the line inside it
+func clipLine(line [][]float64) [][][]float64 {
+	parts := [][][]float64{}
+	part := [][]float64{}
+	for i := 1; i < len(line); i++ {
+		a, b := line[i-1], line[i]
+		dx, dy := b[0]-a[0], b[1]-a[1]
+		t0, t1 := 0.0, 1.0
+		inside := true
+		for _, edge := range [][2]float64{{-dx, a[0] - clip_min}, {dx, clip_max - a[0]}, {-dy, a[1] - clip_min}, {dy, clip_max - a[1]}} {
+			p, q := edge[0], edge[1]
+			if 0 == p {
+				inside = inside && q >= 0
+				continue
+			}
+			t := q / p
+			if p < 0 {
+				t0 = math.Max(t0, t)
+			} else {
+				t1 = math.Min(t1, t)
+			}
+		}
+		if !inside || t0 > t1 {
+			if 1 < len(part) {
+				parts = append(parts, part)
+			}
+			part = [][]float64{}
+			continue
+		}
+		start := []float64{a[0] + t0*dx, a[1] + t0*dy}
+		end := []float64{a[0] + t1*dx, a[1] + t1*dy}
+		if 0 == len(part) {
+			part = append(part, start)
+		}
+		part = append(part, end)
+		// segment leaves the tile
+		if t1 < 1 {
+			parts = append(parts, part)
+			part = [][]float64{}
+		}
+	}
+	if 1 < len(part) {
+		parts = append(parts, part)
+	}
+	return parts
+}
+
+// clipRing clips polygon ring to the buffered tile using Sutherland-Hodgman
+func clipRing(ring [][]float64) [][]float64 {
+	type edge struct {
+		inside    func([]float64) bool
+		intersect func(a, b []float64) []float64
+	}
+	at_x := func(a, b []float64, x float64) []float64 {
+		return []float64{x, a[1] + (b[1]-a[1])*(x-a[0])/(b[0]-a[0])}
+	}
+	at_y := func(a, b []float64, y float64) []float64 {
+		return []float64{a[0] + (b[0]-a[0])*(y-a[1])/(b[1]-a[1]), y}
+	}
+	edges := []edge{
+		{func(p []float64) bool { return p[0] >= clip_min }, func(a, b []float64) []float64 { return at_x(a, b, clip_min) }},
+		{func(p []float64) bool { return p[0] <= clip_max }, func(a, b []float64) []float64 { return at_x(a, b, clip_max) }},
+		{func(p []float64) bool { return p[1] >= clip_min }, func(a, b []float64) []float64 { return at_y(a, b, clip_min) }},
+		{func(p []float64) bool { return p[1] <= clip_max }, func(a, b []float64) []float64 { return at_y(a, b, clip_max) }},
+	}
+	output := ring
+	for _, e := range edges {
+		input := output
+		output = [][]float64{}
+		for i, current := range input {
+			previous := input[(i+len(input)-1)%len(input)]
+			if e.inside(current) {
+				if !e.inside(previous) {
+					output = append(output, e.intersect(previous, current))
+				}
+				output = append(output, current)
+			} else if e.inside(previous) {
+				output = append(output, e.intersect(previous, current))
+			}
+		}
+		if 0 == len(output) {
+			break
+		}
+	}
+	return output
+}
+
+// simplifyLine simplifies line with Douglas-Peucker
+func simplifyLine(line [][]float64, tolerance float64) [][]float64 {
+	if len(line) < 3 {
+		return line
+	}
+	keep := make([]bool, len(line))
+	keep[0], keep[len(line)-1] = true, true
+	var simplify func(first int, last int)
+	simplify = func(first int, last int) {
+		a, b := line[first], line[last]
+		dx, dy := b[0]-a[0], b[1]-a[1]
+		length := math.Hypot(dx, dy)
+		max_dist, index := 0.0, -1
+		for i := first + 1; i < last; i++ {
+			p := line[i]
+			var dist float64
+			if 0 == length {
+				dist = math.Hypot(p[0]-a[0], p[1]-a[1])
+			} else {
+				dist = math.Abs(dy*p[0]-dx*p[1]+b[0]*a[1]-b[1]*a[0]) / length
+			}
+			if dist > max_dist {
+				max_dist, index = dist, i
+			}
+		}
+		if -1 != index && max_dist > tolerance {
+			keep[index] = true
+			simplify(first, index)
+			simplify(index, last)
+		}
+	}
+	simplify(0, len(line)-1)
+	simplified := [][]float64{}
+	for i, point := range line {
+		if keep[i] {
+			simplified = append(simplified, point)
+		}
+	}
+	return simplified
+}
+
+// roundLine rounds line to integer tile coordinates, dropping repeated points
+func roundLine(line [][]float64) [][2]int64 {
+	rounded := [][2]int64{}
+	for _, point := range line {
+		p := [2]int64{int64(math.Floor(point[0] + 0.5)), int64(math.Floor(point[1] + 0.5))}
+		if 0 == len(rounded) || p != rounded[len(rounded)-1] {
+			rounded = append(rounded, p)
+		}
+	}
+	return rounded
+}
+
+// ringArea returns twice the signed area of ring in tile coordinates,
+// positive for rings which are clockwise on screen
+func ringArea(ring [][2]int64) int64 {
+	var area int64
+	for i := range ring {
+		j := (i + 1) % len(ring)
+		area += ring[i][0]*ring[j][1] - ring[j][0]*ring[i][1]
+	}
+	return area
+}
+
+// mvtGeometry encodes geometry commands of a feature in tile coordinates
+type mvtGeometry struct {
+	commands []uint32
+	cursor   [2]int64
+}
+
+// zigzag encodes signed integer as protocol buffer sint
+func zigzag(n int64) uint64 {
+	return uint64((n << 1) ^ (n >> 63))
+}
+
+// command appends command with the points as parameters
+func (self *mvtGeometry) command(id uint32, points [][2]int64) {
+	self.commands = append(self.commands, (id&0x7)|(uint32(len(points))<<3))
+	for _, p := range points {
+		self.commands = append(self.commands, uint32(zigzag(p[0]-self.cursor[0])), uint32(zigzag(p[1]-self.cursor[1])))
+		self.cursor = p
+	}
+}
+
+// line appends line string
+func (self *mvtGeometry) line(line [][2]int64) {
+	if len(line) < 2 {
+		return
+	}
+	self.command(mvt_move_to, line[:1])
+	self.command(mvt_line_to, line[1:])
+}
+
+// ring appends polygon ring wound as exterior or interior ring
+func (self *mvtGeometry) ring(ring [][2]int64, exterior bool) bool {
+	if 1 < len(ring) && ring[0] == ring[len(ring)-1] {
+		ring = ring[:len(ring)-1]
+	}
+	if len(ring) < 3 {
+		return false
+	}
+	area := ringArea(ring)
+	if 0 == area {
+		return false
+	}
+	if (area > 0) != exterior {
+		reversed := make([][2]int64, len(ring))
+		for i, p := range ring {
+			reversed[len(ring)-1-i] = p
+		}
+		ring = reversed
+	}
+	self.command(mvt_move_to, ring[:1])
+	self.command(mvt_line_to, ring[1:])
+	self.commands = append(self.commands, (mvt_close_path&0x7)|(1<<3))
+	return true
+}
+
+// tileLines returns the clipped and simplified parts of line in tile
+// coordinates
+func (self tileCoord) tileLines(line [][]float64) [][][2]int64 {
+	lines := [][][2]int64{}
+	for _, part := range clipLine(self.projectLine(line)) {
+		if rounded := roundLine(simplifyLine(part, MVT_TOLERANCE)); 1 < len(rounded) {
+			lines = append(lines, rounded)
+		}
+	}
+	return lines
+}
+
+// tilePolygon appends the clipped and simplified rings of polygon to geom.
+// Polygons whose exterior ring is clipped away are skipped.
+func (self tileCoord) tilePolygon(geom *mvtGeometry, polygon [][][]float64) {
+	for i, ring := range polygon {
+		clipped := clipRing(self.projectLine(ring))
+		if 0 != len(clipped) {
+			clipped = append(clipped, clipped[0])
+		}
+		ok := geom.ring(roundLine(simplifyLine(clipped, MVT_TOLERANCE)), 0 == i)
+		if !ok && 0 == i {
+			return
+		}
+	}
+}
+
+// encodeGeometry returns mvt geometry type and commands of geometry in
+// tile. Returns no commands when the geometry is outside the tile.
+// Geometry collections are not supported.
+func (self tileCoord) encodeGeometry(geometry *geojson.Geometry) (uint64, []uint32) {
+	geom := &mvtGeometry{}
+	if nil == geometry {
+		return 0, nil
+	}
+	switch geometry.Type {
+	case geojson.GeometryPoint, geojson.GeometryMultiPoint:
+		points := geometry.MultiPoint
+		if geojson.GeometryPoint == geometry.Type {
+			points = [][]float64{geometry.Point}
+		}
+		rounded := [][2]int64{}
+		for _, point := range self.projectLine(points) {
+			if pointInClip(point) {
+				rounded = append(rounded, roundLine([][]float64{point})[0])
+			}
+		}
+		if 0 != len(rounded) {
+			geom.command(mvt_move_to, rounded)
+		}
+		return mvt_point, geom.commands
+	case geojson.GeometryLineString, geojson.GeometryMultiLineString:
+		lines := geometry.MultiLineString
+		if geojson.GeometryLineString == geometry.Type {
+			lines = [][][]float64{geometry.LineString}
+		}
+		for _, line := range lines {
+			for _, part := range self.tileLines(line) {
+				geom.line(part)
+			}
+		}
+		return mvt_linestring, geom.commands
+	case geojson.GeometryPolygon, geojson.GeometryMultiPolygon:
+		polygons := geometry.MultiPolygon
+		if geojson.GeometryPolygon == geometry.Type {
+			polygons = [][][][]float64{geometry.Polygon}
+		}
+		for _, polygon := range polygons {
+			self.tilePolygon(geom, polygon)
+		}
+		return mvt_polygon, geom.commands
+	}
+	return 0, nil
+}
+
+// pbuf writes protocol buffer messages
+type pbuf []byte
+
+func (self *pbuf) varint(v uint64) {
+	for v >= 0x80 {
+		*self = append(*self, byte(v)|0x80)
+		v >>= 7
+	}
+	*self = append(*self, byte(v))
+}
+
+func (self *pbuf) key(field uint64, wire_type uint64) {
+	self.varint(field<<3 | wire_type)
+}
+
+func (self *pbuf) uint(field uint64, v uint64) {
+	self.key(field, 0)
+	self.varint(v)
+}
+
+func (self *pbuf) bytes(field uint64, v []byte) {
+	self.key(field, 2)
+	self.varint(uint64(len(v)))
+	*self = append(*self, v...)
+}
+
+func (self *pbuf) double(field uint64, v float64) {
+	self.key(field, 1)
+	bits := math.Float64bits(v)
+	for i := uint(0); i < 8; i++ {
+		*self = append(*self, byte(bits>>(8*i)))
+	}
+}
+
+func (self *pbuf) packed(field uint64, values []uint32) {
+	packed := pbuf{}
+	for _, v := range values {
+		packed.varint(uint64(v))
+	}
+	self.bytes(field, packed)
+}
+
+// mvtValue is a feature property value of a tile layer
+type mvtValue struct {
+	kind   uint64
+	text   string
+	number float64
+	int    int64
+	bool   bool
+}
+
+// newMvtValue returns tile value of property. Objects and arrays are
+// encoded as json strings, null values are skipped.
+func newMvtValue(value interface{}) (mvtValue, bool) {
+	switch v := value.(type) {
+	case nil:
+		return mvtValue{}, false
+	case string:
+		return mvtValue{kind: 1, text: v}, true
+	case bool:
+		return mvtValue{kind: 7, bool: v}, true
+	case int:
+		return mvtValue{kind: 6, int: int64(v)}, true
+	case int64:
+		return mvtValue{kind: 6, int: v}, true
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return mvtValue{kind: 6, int: int64(v)}, true
+		}
+		return mvtValue{kind: 3, number: v}, true
+	}
+	js, err := json.Marshal(value)
+	if err != nil {
+		return mvtValue{}, false
+	}
+	return mvtValue{kind: 1, text: string(js)}, true
+}
+
+// encode returns Value message of tile value
+func (self mvtValue) encode() []byte {
+	msg := pbuf{}
+	switch self.kind {
+	case 1:
+		msg.bytes(1, []byte(self.text))
+	case 3:
+		msg.double(3, self.number)
+	case 6:
+		msg.uint(6, zigzag(self.int))
+	case 7:
+		value := uint64(0)
+		if self.bool {
+			value = 1
+		}
+		msg.uint(7, value)
+	}
+	return msg
+}
+
+// EncodeVectorTile encodes features as MVT 2.1 tile with a single layer.
+// Features are clipped to the tile and its buffer, and simplified to the
+// tile resolution. Returns an empty tile if no feature is in the tile.
+// @param layer_name {string}
+// @param tile {tileCoord}
+// @param features {[]*geojson.Feature}
+// @returns []byte
+func EncodeVectorTile(layer_name string, tile tileCoord, features []*geojson.Feature) []byte {
+	keys := []string{}
+	key_index := make(map[string]int)
+	values := []mvtValue{}
+	value_index := make(map[mvtValue]int)
+	encoded := [][]byte{}
+
+	for _, feat := range features {
+		geom_type, commands := tile.encodeGeometry(feat.Geometry)
+		if 0 == len(commands) {
+			continue
+		}
+		// properties sorted so tiles are reproducible
+		names := []string{}
+		for name := range feat.Properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		tags := []uint32{}
+		for _, name := range names {
+			value, ok := newMvtValue(feat.Properties[name])
+			if !ok {
+				continue
+			}
+			if _, ok := key_index[name]; !ok {
+				key_index[name] = len(keys)
+				keys = append(keys, name)
+			}
+			if _, ok := value_index[value]; !ok {
+				value_index[value] = len(values)
+				values = append(values, value)
+			}
+			tags = append(tags, uint32(key_index[name]), uint32(value_index[value]))
+		}
+
+		msg := pbuf{}
+		if id, err := strconv.ParseUint(fmt.Sprintf("%v", feat.Properties["geo_id"]), 10, 64); err == nil {
+			msg.uint(1, id)
+		}
+		if 0 != len(tags) {
+			msg.packed(2, tags)
+		}
+		msg.uint(3, geom_type)
+		msg.packed(4, commands)
+		encoded = append(encoded, msg)
+	}
+
+	if 0 == len(encoded) {
+		return []byte{}
+	}
+	layer := pbuf{}
+	layer.uint(15, 2)
+	layer.bytes(1, []byte(layer_name))
+	for _, msg := range encoded {
+		layer.bytes(2, msg)
+	}
+	for _, key := range keys {
+		layer.bytes(3, []byte(key))
+	}
+	for _, value := range values {
+		layer.bytes(4, value.encode())
+	}
+	layer.uint(5, uint64(MVT_EXTENT))
+	tile_msg := pbuf{}
+	tile_msg.bytes(3, layer)
+	return tile_msg
+}
@@ -0,0 +1,216 @@
+package gospatial
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+import "github.com/paulmach/go.geojson"
+
+// pbField is a decoded protocol buffer field, varint or length delimited
+type pbField struct {
+	value uint64
+	bytes []byte
+}
+
+// decodePbuf decodes fields of protocol buffer message by field number
+func decodePbuf(t *testing.T, data []byte) map[uint64][]pbField {
+	fields := make(map[uint64][]pbField)
+	varint := func() uint64 {
+		var v uint64
+		for shift := uint(0); ; shift += 7 {
+			if 0 == len(data) {
+				t.Fatalf("Unexpected end of message")
+			}
+			b := data[0]
+			data = data[1:]
+			v |= uint64(b&0x7f) << shift
+			if b < 0x80 {
+				return v
+			}
+		}
+	}
+	for 0 != len(data) {
+		key := varint()
+		switch key & 0x7 {
+		case 0:
+			fields[key>>3] = append(fields[key>>3], pbField{value: varint()})
+		case 1:
+			fields[key>>3] = append(fields[key>>3], pbField{bytes: data[:8]})
+			data = data[8:]
+		case 2:
+			n := varint()
+			fields[key>>3] = append(fields[key>>3], pbField{bytes: data[:n]})
+			data = data[n:]
+		default:
+			t.Fatalf("Unexpected wire type: %v", key)
+		}
+	}
+	return fields
+}
+
+// decodePacked decodes packed varints
+func decodePacked(data []byte) []uint32 {
+	values := []uint32{}
+	var v uint32
+	var shift uint
+	for _, b := range data {
+		v |= uint32(b&0x7f) << shift
+		shift += 7
+		if b < 0x80 {
+			values = append(values, v)
+			v, shift = 0, 0
+		}
+	}
+	return values
+}
+
+// decodeTileFeatures returns layer and feature messages of single layer tile
+func decodeTileFeatures(t *testing.T, data []byte) (map[uint64][]pbField, []map[uint64][]pbField) {
+	layers := decodePbuf(t, data)[3]
+	if 1 != len(layers) {
+		t.Fatalf("Expected one layer: %v", layers)
+	}
+	layer := decodePbuf(t, layers[0].bytes)
+	features := []map[uint64][]pbField{}
+	for _, feature := range layer[2] {
+		features = append(features, decodePbuf(t, feature.bytes))
+	}
+	return layer, features
+}
+
+func TestEncodeVectorTile(t *testing.T) {
+	point := geojson.NewPointFeature([]float64{0, 0})
+	point.Properties["geo_id"] = "1500000000"
+	point.Properties["name"] = "center"
+	point.Properties["count"] = float64(3)
+	outside := geojson.NewPointFeature([]float64{10, 10})
+	data := EncodeVectorTile("test", tileCoord{1, 1, 1}, []*geojson.Feature{point, outside})
+
+	layer, features := decodeTileFeatures(t, data)
+	if "test" != string(layer[1][0].bytes) || 2 != layer[15][0].value || uint64(MVT_EXTENT) != layer[5][0].value {
+		t.Errorf("Unexpected layer: %v", layer)
+	}
+	if 1 != len(features) {
+		t.Fatalf("Expected point in tile: %v", features)
+	}
+	if 1500000000 != features[0][1][0].value || mvt_point != features[0][3][0].value {
+		t.Errorf("Unexpected feature: %v", features[0])
+	}
+	// MoveTo(1) to the top left corner of tile 1/1/1
+	geometry := decodePacked(features[0][4][0].bytes)
+	if 3 != len(geometry) || 9 != geometry[0] || 0 != geometry[1] || 0 != geometry[2] {
+		t.Errorf("Unexpected point geometry: %v", geometry)
+	}
+	if 6 != len(decodePacked(features[0][2][0].bytes)) || 3 != len(layer[3]) {
+		t.Errorf("Expected tags of properties: %v", layer[3])
+	}
+
+	if 0 != len(EncodeVectorTile("test", tileCoord{1, 0, 0}, []*geojson.Feature{outside})) {
+		t.Errorf("Expected empty tile")
+	}
+}
+
+func TestEncodeVectorTilePolygon(t *testing.T) {
+	// counter clockwise polygon covering tile 2/2/1 and beyond
+	polygon := geojson.NewPolygonFeature([][][]float64{{{-10, -10}, {100, -10}, {100, 80}, {-10, 80}, {-10, -10}}})
+	tile := tileCoord{2, 2, 1}
+	_, features := decodeTileFeatures(t, EncodeVectorTile("test", tile, []*geojson.Feature{polygon}))
+	geometry := decodePacked(features[0][4][0].bytes)
+
+	// MoveTo(1), LineTo(n), ClosePath
+	if 9 != geometry[0] || 2 != geometry[3]&0x7 || 15 != geometry[len(geometry)-1] {
+		t.Fatalf("Unexpected polygon commands: %v", geometry)
+	}
+	unzigzag := func(v uint32) int64 {
+		return int64(v>>1) ^ -int64(v&1)
+	}
+	ring := [][2]int64{{unzigzag(geometry[1]), unzigzag(geometry[2])}}
+	for i := 4; i+1 < len(geometry)-1; i += 2 {
+		last := ring[len(ring)-1]
+		ring = append(ring, [2]int64{last[0] + unzigzag(geometry[i]), last[1] + unzigzag(geometry[i+1])})
+	}
+	if ringArea(ring) <= 0 {
+		t.Errorf("Expected clockwise exterior ring: %v", ring)
+	}
+	for _, p := range ring {
+		if p[0] < -int64(MVT_BUFFER) || p[0] > int64(MVT_EXTENT+MVT_BUFFER) || p[1] < -int64(MVT_BUFFER) || p[1] > int64(MVT_EXTENT+MVT_BUFFER) {
+			t.Errorf("Expected ring clipped to tile buffer: %v", ring)
+		}
+	}
+}
+
+func TestClipLine(t *testing.T) {
+	max := float64(MVT_EXTENT + MVT_BUFFER)
+	parts := clipLine([][]float64{{-1000, 100}, {1000, 100}, {1000, -1000}, {2000, -1000}, {2000, 100}, {9000, 100}})
+	if 2 != len(parts) {
+		t.Fatalf("Expected line to enter tile twice: %v", parts)
+	}
+	if -float64(MVT_BUFFER) != parts[0][0][0] || max != parts[1][len(parts[1])-1][0] {
+		t.Errorf("Expected parts clipped to tile buffer: %v", parts)
+	}
+}
+
+func TestVectorTileRoutes(t *testing.T) {
+	server := httptest.NewServer(Router())
+	defer server.Close()
+	apikey := "testVectorTileKey"
+	ds, _ := DB.NewLayer()
+	DB.InsertCustomer(Customer{Apikey: apikey, Datasources: []string{ds}})
+	DB.InsertFeature(ds, geojson.NewPointFeature([]float64{-76.6, 39.3}))
+
+	get := func(path string) (*http.Response, []byte) {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, body
+	}
+	tile_path := "/api/v1/layer/" + ds + "/tiles/4/4/6.mvt?apikey=" + apikey
+
+	resp, body := get(tile_path)
+	if http.StatusOK != resp.StatusCode || "application/vnd.mapbox-vector-tile" != resp.Header.Get("Content-Type") {
+		t.Fatalf("Expected vector tile: %v %s", resp.StatusCode, body)
+	}
+	if _, features := decodeTileFeatures(t, body); 1 != len(features) {
+		t.Errorf("Expected feature in tile: %v", features)
+	}
+	if _, ok := VectorTiles.Get(ds, tileCoord{4, 4, 6}); !ok {
+		t.Errorf("Expected tile cached")
+	}
+
+	// writes invalidate the cached tile
+	DB.InsertFeature(ds, geojson.NewPointFeature([]float64{-76.5, 39.2}))
+	if _, ok := VectorTiles.Get(ds, tileCoord{4, 4, 6}); ok {
+		t.Errorf("Expected tile invalidated")
+	}
+	_, body = get(tile_path)
+	if _, features := decodeTileFeatures(t, body); 2 != len(features) {
+		t.Errorf("Expected new feature in tile: %v", features)
+	}
+
+	if resp, _ = get("/api/v1/layer/" + ds + "/tiles/4/0/0.mvt?apikey=" + apikey); http.StatusNoContent != resp.StatusCode {
+		t.Errorf("Expected empty tile: %v", resp.StatusCode)
+	}
+	if resp, _ = get("/api/v1/layer/" + ds + "/tiles/1/2/0.mvt?apikey=" + apikey); http.StatusBadRequest != resp.StatusCode {
+		t.Errorf("Expected invalid tile: %v", resp.StatusCode)
+	}
+	if resp, _ = get("/api/v1/layer/" + ds + "/tiles/4/4/6.mvt"); http.StatusUnauthorized != resp.StatusCode {
+		t.Errorf("Expected apikey required: %v", resp.StatusCode)
+	}
+
+	tilejson := struct {
+		Tiles        []string
+		VectorLayers []struct{ Id string } `json:"vector_layers"`
+	}{}
+	resp, body = get("/api/v1/layer/" + ds + "/tiles.json?apikey=" + apikey)
+	json.Unmarshal(body, &tilejson)
+	if 1 != len(tilejson.Tiles) || server.URL+"/api/v1/layer/"+ds+"/tiles/{z}/{x}/{y}.mvt?apikey="+apikey != tilejson.Tiles[0] || ds != tilejson.VectorLayers[0].Id {
+		t.Errorf("Unexpected tilejson: %s", body)
+	}
+}
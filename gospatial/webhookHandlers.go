@@ -0,0 +1,86 @@
+package gospatial
+
+import (
+	"encoding/json"
+)
+
+// decodeWebhook reads http request body as the request webhook
+func decodeWebhook(body []byte, req *TcpMessage) error {
+	req.Data.Webhook = &Webhook{}
+	return json.Unmarshal(body, req.Data.Webhook)
+}
+
+// getRequestWebhook returns webhook of request if it belongs to the datasource
+func getRequestWebhook(ctx *OperationContext) (Webhook, error) {
+	hook, err := DB.GetWebhook(ctx.Request.Data.WebhookId)
+	if err == nil && ctx.Datasource() != hook.Datasource {
+		err = ErrWebhookNotFound
+	}
+	if err != nil {
+		return hook, ErrWebhookNotFound
+	}
+	return hook, nil
+}
+
+// newWebhook registers webhook for datasource change events.
+// The response includes the secret used to sign deliveries.
+// @param apikey customer id
+// @oaram ds datasource uuid
+// @return json
+func newWebhook(ctx *OperationContext) (interface{}, error) {
+	if nil == ctx.Request.Data.Webhook {
+		return nil, ErrMissingParameters
+	}
+	hook := *ctx.Request.Data.Webhook
+	hook.Id = ""
+	hook.Datasource = ctx.Datasource()
+	hook, err := DB.InsertWebhook(hook)
+	if err != nil {
+		return nil, validationFailed(err)
+	}
+	return hook, nil
+}
+
+// viewWebhooks lists webhooks registered for datasource
+// @param apikey customer id
+// @oaram ds datasource uuid
+// @return json
+func viewWebhooks(ctx *OperationContext) (interface{}, error) {
+	hooks, err := DB.GetWebhooks(ctx.Datasource())
+	if err != nil {
+		return nil, err
+	}
+	// secrets are only returned when webhook is registered
+	for i := range hooks {
+		hooks[i].Secret = ""
+	}
+	return hooks, nil
+}
+
+// deleteWebhook removes webhook from datasource
+// @param apikey customer id
+// @oaram ds datasource uuid
+// @return json
+func deleteWebhook(ctx *OperationContext) (interface{}, error) {
+	hook, err := getRequestWebhook(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = DB.DeleteWebhook(hook.Id)
+	if err != nil {
+		return nil, err
+	}
+	return "webhook deleted", nil
+}
+
+// viewWebhookDeliveries lists deliveries of webhook with their status
+// @param apikey customer id
+// @oaram ds datasource uuid
+// @return json
+func viewWebhookDeliveries(ctx *OperationContext) (interface{}, error) {
+	hook, err := getRequestWebhook(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return DB.GetWebhookDeliveries(hook.Id)
+}
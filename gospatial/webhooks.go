@@ -0,0 +1,631 @@
+package gospatial
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+import (
+	"./utils"
+)
+
+import "github.com/boltdb/bolt"
+
+// Webhook delivery settings
+var (
+	// Delay before the first retry, doubled after each failed attempt
+	WEBHOOK_BACKOFF time.Duration = 5 * time.Second
+	// Attempts before a delivery is marked failed
+	WEBHOOK_MAX_ATTEMPTS int = 8
+	// Time allowed for the receiver to respond
+	WEBHOOK_TIMEOUT time.Duration = 10 * time.Second
+	// Period the outbox is checked for due deliveries
+	WEBHOOK_POLL_PERIOD time.Duration = time.Second
+	// Webhooks delivered at the same time
+	WEBHOOK_WORKERS int = 8
+	// Time delivered deliveries are listed before they are pruned
+	WEBHOOK_RETENTION time.Duration = 7 * 24 * time.Hour
+	// Period delivered deliveries are pruned
+	WEBHOOK_PRUNE_PERIOD time.Duration = time.Hour
+)
+
+// Webhook delivery status
+const (
+	WEBHOOK_PENDING   string = "pending"
+	WEBHOOK_DELIVERED string = "delivered"
+	WEBHOOK_FAILED    string = "failed"
+)
+
+// Headers sent with webhook deliveries
+const (
+	WEBHOOK_SIGNATURE_HEADER string = "X-Gospatial-Signature"
+	WEBHOOK_EVENT_HEADER     string = "X-Gospatial-Event"
+	WEBHOOK_DELIVERY_HEADER  string = "X-Gospatial-Delivery"
+)
+
+// ErrWebhookNotFound is returned for unknown webhook ids
+var ErrWebhookNotFound = errors.New("webhook not found!")
+
+// Webhook posts datasource change events to Url. Events filters the
+// change event types sent, empty sends all of them.
+type Webhook struct {
+	Id         string   `json:"id"`
+	Datasource string   `json:"datasource"`
+	Url        string   `json:"url"`
+	Events     []string `json:"events"`
+	Secret     string   `json:"secret,omitempty"`
+}
+
+// WebhookDelivery is a change event queued for or sent to a webhook
+type WebhookDelivery struct {
+	Id          string      `json:"id"`
+	Webhook     string      `json:"webhook"`
+	Event       ChangeEvent `json:"event"`
+	Status      string      `json:"status"`
+	Attempts    int         `json:"attempts"`
+	LastStatus  int         `json:"last_status,omitempty"`
+	LastError   string      `json:"last_error,omitempty"`
+	Created     time.Time   `json:"created"`
+	LastAttempt time.Time   `json:"last_attempt,omitempty"`
+	NextAttempt time.Time   `json:"next_attempt,omitempty"`
+}
+
+// Validate checks webhook url and event types
+// @returns Error
+func (self Webhook) Validate() error {
+	err := CheckOutboundUrl(self.Url)
+	if err != nil {
+		return fmt.Errorf("webhook %v", err)
+	}
+	for _, event_type := range self.Events {
+		switch event_type {
+		case FEATURE_ADDED, FEATURE_UPDATED, FEATURE_DELETED, LAYER_REPLACED, LAYER_DELETED:
+		default:
+			return fmt.Errorf("unsupported event type: %q", event_type)
+		}
+	}
+	return nil
+}
+
+// wants checks if webhook subscribes to change event
+func (self Webhook) wants(event ChangeEvent) bool {
+	if self.Datasource != event.Datasource {
+		return false
+	}
+	if 0 == len(self.Events) {
+		return true
+	}
+	for _, event_type := range self.Events {
+		if event_type == event.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of body with the webhook secret
+// @param body {[]byte}
+// @returns string
+func (self Webhook) Sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(self.Secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// InsertWebhook stores webhook. Id and secret are generated when missing.
+// @param hook {Webhook}
+// @returns Webhook
+// @returns Error
+func (self *Database) InsertWebhook(hook Webhook) (Webhook, error) {
+	err := hook.Validate()
+	if err != nil {
+		return hook, err
+	}
+	if "" == hook.Id {
+		hook.Id, _ = utils.NewUUID()
+	}
+	if "" == hook.Secret {
+		hook.Secret = utils.NewAPIKey(32)
+	}
+	value, err := json.Marshal(hook)
+	if err != nil {
+		return hook, err
+	}
+	err = self.Insert("webhooks", hook.Id, value)
+	return hook, err
+}
+
+// GetWebhook returns webhook by id
+// @param id {string}
+// @returns Webhook
+// @returns Error
+func (self *Database) GetWebhook(id string) (Webhook, error) {
+	hook := Webhook{}
+	value, err := self.Select("webhooks", id)
+	if err != nil {
+		return hook, err
+	}
+	if 0 == len(value) {
+		return hook, ErrWebhookNotFound
+	}
+	err = json.Unmarshal(value, &hook)
+	return hook, err
+}
+
+// GetWebhooks returns webhooks registered for datasource
+// @param datasource {string}
+// @returns []Webhook
+// @returns Error
+func (self *Database) GetWebhooks(datasource_id string) ([]Webhook, error) {
+	hooks := []Webhook{}
+	err := self.scanTable("webhooks", func(value []byte) error {
+		hook := Webhook{}
+		err := json.Unmarshal(value, &hook)
+		if err == nil && datasource_id == hook.Datasource {
+			hooks = append(hooks, hook)
+		}
+		return err
+	})
+	return hooks, err
+}
+
+// DeleteWebhook removes webhook. Its pending deliveries fail.
+// @param id {string}
+// @returns Error
+func (self *Database) DeleteWebhook(id string) error {
+	conn := self.Connect()
+	defer conn.Close()
+	return conn.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("webhooks"))
+		if bucket == nil {
+			return fmt.Errorf("Bucket webhooks not found!")
+		}
+		return bucket.Delete([]byte(id))
+	})
+}
+
+// deleteDatasourceWebhooks removes webhooks of datasource with their
+// deliveries, pending ones included
+func (self *Database) deleteDatasourceWebhooks(datasource_id string) error {
+	hooks, err := self.GetWebhooks(datasource_id)
+	if err != nil || 0 == len(hooks) {
+		return err
+	}
+	conn := self.Connect()
+	defer conn.Close()
+	return conn.Update(func(tx *bolt.Tx) error {
+		for _, table := range []string{"webhooks", "webhook_deliveries", "webhook_outbox"} {
+			if tx.Bucket([]byte(table)) == nil {
+				return fmt.Errorf("Bucket %q not found!", table)
+			}
+		}
+		for _, hook := range hooks {
+			err := tx.Bucket([]byte("webhooks")).Delete([]byte(hook.Id))
+			if err != nil {
+				return err
+			}
+			// delivery ids end with their webhook id
+			suffix := []byte("-" + hook.Id)
+			for _, table := range []string{"webhook_deliveries", "webhook_outbox"} {
+				bucket := tx.Bucket([]byte(table))
+				keys := [][]byte{}
+				bucket.ForEach(func(key, _ []byte) error {
+					if bytes.HasSuffix(key, suffix) {
+						keys = append(keys, append([]byte{}, key...))
+					}
+					return nil
+				})
+				for _, key := range keys {
+					err = bucket.Delete(key)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// GetWebhookDeliveries returns deliveries of webhook, oldest first
+// @param id {string}
+// @returns []WebhookDelivery
+// @returns Error
+func (self *Database) GetWebhookDeliveries(id string) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+	err := self.scanTable("webhook_deliveries", func(value []byte) error {
+		delivery := WebhookDelivery{}
+		err := json.Unmarshal(value, &delivery)
+		if err == nil && id == delivery.Webhook {
+			deliveries = append(deliveries, delivery)
+		}
+		return err
+	})
+	return deliveries, err
+}
+
+// pendingWebhookDeliveries returns deliveries in the outbox
+func (self *Database) pendingWebhookDeliveries() ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+	err := self.scanTable("webhook_outbox", func(value []byte) error {
+		delivery := WebhookDelivery{}
+		err := json.Unmarshal(value, &delivery)
+		deliveries = append(deliveries, delivery)
+		return err
+	})
+	return deliveries, err
+}
+
+// saveWebhookDelivery stores delivery. Pending deliveries are kept in the
+// outbox until they are delivered or fail.
+func (self *Database) saveWebhookDelivery(delivery WebhookDelivery) error {
+	value, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	conn := self.Connect()
+	defer conn.Close()
+	return conn.Update(func(tx *bolt.Tx) error {
+		for _, table := range []string{"webhook_deliveries", "webhook_outbox"} {
+			if tx.Bucket([]byte(table)) == nil {
+				return fmt.Errorf("Bucket %q not found!", table)
+			}
+		}
+		key := []byte(delivery.Id)
+		err := tx.Bucket([]byte("webhook_deliveries")).Put(key, self.compressByte(value))
+		if err != nil {
+			return err
+		}
+		outbox := tx.Bucket([]byte("webhook_outbox"))
+		if WEBHOOK_PENDING == delivery.Status {
+			return outbox.Put(key, self.compressByte(value))
+		}
+		return outbox.Delete(key)
+	})
+}
+
+// pruneWebhookDeliveries removes delivered deliveries last attempted
+// before time
+func (self *Database) pruneWebhookDeliveries(before time.Time) error {
+	conn := self.Connect()
+	defer conn.Close()
+	return conn.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("webhook_deliveries"))
+		if bucket == nil {
+			return fmt.Errorf("Bucket webhook_deliveries not found!")
+		}
+		pruned := [][]byte{}
+		err := bucket.ForEach(func(key, value []byte) error {
+			delivery := WebhookDelivery{}
+			err := json.Unmarshal(self.decompressByte(value), &delivery)
+			if nil == err && WEBHOOK_DELIVERED == delivery.Status && delivery.LastAttempt.Before(before) {
+				pruned = append(pruned, append([]byte{}, key...))
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range pruned {
+			err = bucket.Delete(key)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// webhookSequence returns sequence number of the last change event queued
+// for webhooks, false if none was queued yet
+func (self *Database) webhookSequence() (uint64, bool, error) {
+	value, err := self.Select("webhook_state", "sequence")
+	if err != nil || 0 == len(value) {
+		return 0, false, err
+	}
+	seq, err := strconv.ParseUint(string(value), 10, 64)
+	return seq, nil == err, err
+}
+
+// setWebhookSequence stores sequence number of the last change event
+// queued for webhooks
+func (self *Database) setWebhookSequence(seq uint64) error {
+	return self.Insert("webhook_state", "sequence", []byte(strconv.FormatUint(seq, 10)))
+}
+
+// scanTable calls fn with every value stored in table
+func (self *Database) scanTable(table string, fn func([]byte) error) error {
+	conn := self.Connect()
+	defer conn.Close()
+	return conn.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(table))
+		if bucket == nil {
+			return fmt.Errorf("Bucket %q not found!", table)
+		}
+		return bucket.ForEach(func(_, value []byte) error {
+			return fn(self.decompressByte(value))
+		})
+	})
+}
+
+// WebhookDispatcher queues change events for the webhooks registered on
+// their datasource and delivers them from the outbox, retrying failed
+// deliveries with exponential backoff. Change events are read from the
+// changes table after the last queued sequence number, so none are lost
+// while the dispatcher is busy or stopped. Each webhook is delivered in
+// order by one worker, so a slow receiver only holds up its own deliveries.
+type WebhookDispatcher struct {
+	db      *Database
+	client  *http.Client
+	notify  chan bool
+	stop    chan bool
+	done    chan bool
+	cancel  func()
+	workers sync.WaitGroup
+	guard   sync.Mutex
+	// webhooks with a running worker
+	busy map[string]bool
+}
+
+// StartWebhooks starts delivering webhooks for database changes.
+// Deliveries left in the outbox and changes made while stopped are resumed.
+// @param db {*Database}
+// @returns *WebhookDispatcher
+func StartWebhooks(db *Database) *WebhookDispatcher {
+	dispatcher := &WebhookDispatcher{
+		db:     db,
+		client: NewOutboundClient(WEBHOOK_TIMEOUT),
+		notify: make(chan bool, 1),
+		stop:   make(chan bool),
+		done:   make(chan bool),
+		busy:   make(map[string]bool),
+	}
+	// changes made before webhooks were first started are not delivered
+	_, ok, err := db.webhookSequence()
+	if nil == err && !ok {
+		err = db.setWebhookSequence(db.Sequence())
+	}
+	if err != nil {
+		ServerLogger.Error(err)
+	}
+	dispatcher.cancel = Changes.Listen(func(event ChangeEvent) {
+		select {
+		case dispatcher.notify <- true:
+		default:
+		}
+	})
+	go dispatcher.run()
+	return dispatcher
+}
+
+// Stop stops webhook deliveries. Pending deliveries stay in the outbox.
+func (self *WebhookDispatcher) Stop() {
+	self.cancel()
+	close(self.stop)
+	<-self.done
+	self.workers.Wait()
+}
+
+func (self *WebhookDispatcher) run() {
+	defer close(self.done)
+	ticker := time.NewTicker(WEBHOOK_POLL_PERIOD)
+	defer ticker.Stop()
+	pruned := time.Time{}
+	for {
+		self.enqueueChanges()
+		self.deliverDue()
+		if time.Since(pruned) > WEBHOOK_PRUNE_PERIOD {
+			pruned = time.Now()
+			err := self.db.pruneWebhookDeliveries(pruned.Add(-WEBHOOK_RETENTION))
+			if err != nil {
+				ServerLogger.Error(err)
+			}
+		}
+		select {
+		case <-self.notify:
+		case <-ticker.C:
+		case <-self.stop:
+			return
+		}
+	}
+}
+
+// enqueueChanges queues the change events stored after the last queued
+// sequence number
+func (self *WebhookDispatcher) enqueueChanges() {
+	seq, ok, err := self.db.webhookSequence()
+	if err != nil || !ok {
+		ServerLogger.Error("Webhook sequence not loaded ", err)
+		return
+	}
+	for {
+		events, err := self.db.changesAfter(seq, 1000)
+		if err != nil {
+			ServerLogger.Error(err)
+			return
+		}
+		if 0 == len(events) {
+			return
+		}
+		if seq+1 != events[0].Sequence {
+			ServerLogger.Error("Webhook changes ", seq+1, " to ", events[0].Sequence-1, " expired before delivery")
+		}
+		for _, event := range events {
+			select {
+			case <-self.stop:
+				return
+			default:
+			}
+			self.enqueue(event)
+			seq = event.Sequence
+			err = self.db.setWebhookSequence(seq)
+			if err != nil {
+				ServerLogger.Error(err)
+				return
+			}
+		}
+	}
+}
+
+// enqueue adds delivery to the outbox for each webhook wanting change event
+func (self *WebhookDispatcher) enqueue(event ChangeEvent) {
+	hooks, err := self.db.GetWebhooks(event.Datasource)
+	if err != nil {
+		ServerLogger.Error(err)
+		return
+	}
+	event.Previous = nil
+	for _, hook := range hooks {
+		if !hook.wants(event) {
+			continue
+		}
+		now := time.Now()
+		delivery := WebhookDelivery{
+			Id:          fmt.Sprintf("%020d-%v", event.Sequence, hook.Id),
+			Webhook:     hook.Id,
+			Event:       event,
+			Status:      WEBHOOK_PENDING,
+			Created:     now,
+			NextAttempt: now,
+		}
+		err = self.db.saveWebhookDelivery(delivery)
+		if err != nil {
+			ServerLogger.Error(err)
+		}
+	}
+}
+
+// deliverDue starts a worker for each webhook with outbox deliveries whose
+// retry time has come, up to WEBHOOK_WORKERS of them
+func (self *WebhookDispatcher) deliverDue() {
+	deliveries, err := self.db.pendingWebhookDeliveries()
+	if err != nil {
+		ServerLogger.Error(err)
+		return
+	}
+	// outbox keys sort deliveries of a webhook in sequence order, later
+	// deliveries wait for a delivery being retried
+	due := make(map[string][]WebhookDelivery)
+	waiting := make(map[string]bool)
+	order := []string{}
+	now := time.Now()
+	for _, delivery := range deliveries {
+		if waiting[delivery.Webhook] {
+			continue
+		}
+		if delivery.NextAttempt.After(now) {
+			waiting[delivery.Webhook] = true
+			continue
+		}
+		if _, ok := due[delivery.Webhook]; !ok {
+			order = append(order, delivery.Webhook)
+		}
+		due[delivery.Webhook] = append(due[delivery.Webhook], delivery)
+	}
+
+	self.guard.Lock()
+	defer self.guard.Unlock()
+	for _, hook_id := range order {
+		if self.busy[hook_id] {
+			continue
+		}
+		if len(self.busy) >= WEBHOOK_WORKERS {
+			return
+		}
+		self.busy[hook_id] = true
+		self.workers.Add(1)
+		go self.deliver(hook_id, due[hook_id])
+	}
+}
+
+// deliver attempts deliveries of one webhook in order, stopping at the
+// first one that is not delivered
+func (self *WebhookDispatcher) deliver(hook_id string, deliveries []WebhookDelivery) {
+	defer func() {
+		self.guard.Lock()
+		delete(self.busy, hook_id)
+		self.guard.Unlock()
+		self.workers.Done()
+	}()
+	for _, delivery := range deliveries {
+		select {
+		case <-self.stop:
+			return
+		default:
+		}
+		delivery = self.attempt(delivery)
+		err := self.db.saveWebhookDelivery(delivery)
+		if err != nil {
+			ServerLogger.Error(err)
+		}
+		// later deliveries wait for the retry
+		if WEBHOOK_DELIVERED != delivery.Status {
+			return
+		}
+	}
+}
+
+// attempt posts delivery to its webhook and returns the updated delivery
+func (self *WebhookDispatcher) attempt(delivery WebhookDelivery) WebhookDelivery {
+	delivery.Attempts++
+	delivery.LastAttempt = time.Now()
+
+	hook, err := self.db.GetWebhook(delivery.Webhook)
+	if err != nil {
+		delivery.Status = WEBHOOK_FAILED
+		delivery.LastError = err.Error()
+		return delivery
+	}
+
+	delivery.LastStatus, err = self.post(hook, delivery)
+	if err == nil {
+		delivery.Status = WEBHOOK_DELIVERED
+		delivery.LastError = ""
+		delivery.NextAttempt = time.Time{}
+		return delivery
+	}
+
+	NetworkLogger.Warn(hook.Url, " WEBHOOK ", delivery.Id, " ", err)
+	delivery.LastError = err.Error()
+	if delivery.Attempts >= WEBHOOK_MAX_ATTEMPTS {
+		delivery.Status = WEBHOOK_FAILED
+		delivery.NextAttempt = time.Time{}
+		return delivery
+	}
+	delivery.NextAttempt = delivery.LastAttempt.Add(WEBHOOK_BACKOFF << uint(delivery.Attempts-1))
+	return delivery
+}
+
+// post sends signed change event to webhook url. Returns the response status.
+func (self *WebhookDispatcher) post(hook Webhook, delivery WebhookDelivery) (int, error) {
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest("POST", hook.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WEBHOOK_EVENT_HEADER, delivery.Event.Type)
+	req.Header.Set(WEBHOOK_DELIVERY_HEADER, delivery.Id)
+	req.Header.Set(WEBHOOK_SIGNATURE_HEADER, "sha256="+hook.Sign(body))
+	resp, err := self.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if 200 > resp.StatusCode || 300 <= resp.StatusCode {
+		return resp.StatusCode, fmt.Errorf("receiver responded %v", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,245 @@
+package gospatial
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+import "github.com/paulmach/go.geojson"
+
+// webhookReceiver records deliveries and fails the first failures of them
+type webhookReceiver struct {
+	guard      sync.Mutex
+	failures   int
+	bodies     [][]byte
+	signatures []string
+}
+
+func (self *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	self.guard.Lock()
+	defer self.guard.Unlock()
+	if 0 < self.failures {
+		self.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	self.bodies = append(self.bodies, body)
+	self.signatures = append(self.signatures, r.Header.Get(WEBHOOK_SIGNATURE_HEADER))
+}
+
+func (self *webhookReceiver) received() int {
+	self.guard.Lock()
+	defer self.guard.Unlock()
+	return len(self.bodies)
+}
+
+// reloadSequence continues DB sequence numbers after the change events
+// testDb stored in the same file, so webhooks do not skip changes
+func reloadSequence(t *testing.T) {
+	conn := DB.Connect()
+	defer conn.Close()
+	DB.commit_guard.Lock()
+	defer DB.commit_guard.Unlock()
+	err := DB.loadSequence(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebhookDeliveries(t *testing.T) {
+	reloadSequence(t)
+	backoff, poll := WEBHOOK_BACKOFF, WEBHOOK_POLL_PERIOD
+	WEBHOOK_BACKOFF, WEBHOOK_POLL_PERIOD = 10*time.Millisecond, 10*time.Millisecond
+	defer func() {
+		WEBHOOK_BACKOFF, WEBHOOK_POLL_PERIOD = backoff, poll
+	}()
+
+	receiver := &webhookReceiver{failures: 2}
+	target := httptest.NewServer(receiver)
+	defer target.Close()
+	server, ds := startSocketServer(t)
+	defer server.Close()
+	url := server.URL + "/api/v1/layer/" + ds + "/webhooks"
+
+	// receivers on private addresses are refused
+	for _, invalid := range []string{"ftp://example.com", "http://169.254.169.254/latest/meta-data", target.URL} {
+		resp, err := http.Post(url+"?apikey="+testSocketApikey, "application/json", strings.NewReader(`{"url": "`+invalid+`"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if http.StatusBadRequest != resp.StatusCode {
+			t.Errorf("Expected bad request for invalid url %v: %v", invalid, resp.StatusCode)
+		}
+	}
+	OUTBOUND_ALLOW_PRIVATE = true
+	defer func() {
+		OUTBOUND_ALLOW_PRIVATE = false
+	}()
+
+	// register webhook for added features only
+	resp, err := http.Post(url+"?apikey="+testSocketApikey, "application/json", strings.NewReader(`{"url": "`+target.URL+`", "events": ["feature_added"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := struct {
+		Data Webhook `json:"data"`
+	}{}
+	json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	hook := created.Data
+	if "" == hook.Id || "" == hook.Secret {
+		t.Fatalf("Expected webhook with secret: %v", hook)
+	}
+
+	dispatcher := StartWebhooks(&DB)
+	feat := geojson.NewPointFeature([]float64{1, 1})
+	err = DB.InsertFeature(ds, feat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	DB.EditFeature(ds, feat.Properties["geo_id"].(string), geojson.NewPointFeature([]float64{2, 2}), ANY_VERSION, "")
+
+	// delivered after two failed attempts
+	if !waitFor(func() bool { return 1 == receiver.received() }) {
+		t.Fatal("Webhook not delivered")
+	}
+	receiver.guard.Lock()
+	body, signature := receiver.bodies[0], receiver.signatures[0]
+	receiver.guard.Unlock()
+	if "sha256="+hook.Sign(body) != signature {
+		t.Errorf("Invalid signature: %v", signature)
+	}
+	event := ChangeEvent{}
+	json.Unmarshal(body, &event)
+	if FEATURE_ADDED != event.Type || ds != event.Datasource {
+		t.Errorf("Unexpected event: %v", event)
+	}
+
+	// outbox survives restart
+	dispatcher.Stop()
+	receiver.guard.Lock()
+	receiver.failures = 1
+	receiver.guard.Unlock()
+	// long enough that the retry waits for the restart
+	WEBHOOK_BACKOFF = 300 * time.Millisecond
+	dispatcher = StartWebhooks(&DB)
+	DB.InsertFeature(ds, geojson.NewPointFeature([]float64{3, 3}))
+	if !waitFor(func() bool {
+		receiver.guard.Lock()
+		defer receiver.guard.Unlock()
+		return 0 == receiver.failures
+	}) {
+		t.Fatal("Webhook not attempted")
+	}
+	dispatcher.Stop()
+	if 1 != receiver.received() {
+		t.Fatalf("Expected pending delivery: %v", receiver.received())
+	}
+	dispatcher = StartWebhooks(&DB)
+	if !waitFor(func() bool { return 2 == receiver.received() }) {
+		t.Fatal("Pending webhook not delivered after restart")
+	}
+
+	// changes made while stopped are delivered after restart
+	dispatcher.Stop()
+	DB.InsertFeature(ds, geojson.NewPointFeature([]float64{4, 4}))
+	dispatcher = StartWebhooks(&DB)
+	defer dispatcher.Stop()
+	if !waitFor(func() bool { return 3 == receiver.received() }) {
+		t.Fatal("Change made while stopped not delivered")
+	}
+
+	// delivery status, saved after the receiver responds
+	listed := struct {
+		Data []WebhookDelivery `json:"data"`
+	}{}
+	waitFor(func() bool {
+		resp, err := http.Get(url + "/" + hook.Id + "/deliveries?apikey=" + testSocketApikey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		json.NewDecoder(resp.Body).Decode(&listed)
+		return 3 == len(listed.Data) && WEBHOOK_DELIVERED == listed.Data[2].Status
+	})
+	if 3 != len(listed.Data) {
+		t.Fatalf("Expected 3 deliveries: %v", listed.Data)
+	}
+	for i, attempts := range []int{3, 2, 1} {
+		if WEBHOOK_DELIVERED != listed.Data[i].Status || attempts != listed.Data[i].Attempts {
+			t.Errorf("Unexpected delivery: %v", listed.Data[i])
+		}
+	}
+
+	// delivered deliveries are pruned
+	err = DB.pruneWebhookDeliveries(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deliveries, _ := DB.GetWebhookDeliveries(hook.Id); 0 != len(deliveries) {
+		t.Errorf("Expected delivered deliveries pruned: %v", deliveries)
+	}
+
+	// later changes wait for the retry of a failed delivery
+	receiver.guard.Lock()
+	receiver.failures = 1
+	receiver.guard.Unlock()
+	DB.InsertFeature(ds, geojson.NewPointFeature([]float64{5, 5}))
+	DB.InsertFeature(ds, geojson.NewPointFeature([]float64{6, 6}))
+	if !waitFor(func() bool { return 5 == receiver.received() }) {
+		t.Fatal("Webhook not delivered after retry")
+	}
+	receiver.guard.Lock()
+	first, second := ChangeEvent{}, ChangeEvent{}
+	json.Unmarshal(receiver.bodies[3], &first)
+	json.Unmarshal(receiver.bodies[4], &second)
+	receiver.guard.Unlock()
+	if first.Sequence >= second.Sequence {
+		t.Errorf("Expected deliveries in change order: %v %v", first.Sequence, second.Sequence)
+	}
+}
+
+func TestWebhookSlowReceiver(t *testing.T) {
+	reloadSequence(t)
+	poll := WEBHOOK_POLL_PERIOD
+	WEBHOOK_POLL_PERIOD = 10 * time.Millisecond
+	OUTBOUND_ALLOW_PRIVATE = true
+	defer func() {
+		WEBHOOK_POLL_PERIOD = poll
+		OUTBOUND_ALLOW_PRIVATE = false
+	}()
+
+	release := make(chan bool)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	receiver := &webhookReceiver{}
+	fast := httptest.NewServer(receiver)
+	defer fast.Close()
+
+	ds, _ := DB.NewLayer()
+	for _, target := range []string{slow.URL, fast.URL} {
+		_, err := DB.InsertWebhook(Webhook{Datasource: ds, Url: target})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	dispatcher := StartWebhooks(&DB)
+	defer dispatcher.Stop()
+	defer close(release)
+	for i := 0; i < 3; i++ {
+		DB.InsertFeature(ds, geojson.NewPointFeature([]float64{1, 1}))
+	}
+	if !waitFor(func() bool { return 3 == receiver.received() }) {
+		t.Fatalf("Expected deliveries not held up by slow receiver: %v", receiver.received())
+	}
+}
@@ -17,6 +17,7 @@ import (
 	"os"
 	"os/signal"
 	"runtime/pprof"
+	"sync/atomic"
 	"time"
 )
 
@@ -28,6 +29,7 @@ import (
 var (
 	port          int
 	tcp_port      int
+	tcp_host      string
 	database      string
 	bind          string
 	versionReport bool
@@ -43,10 +45,122 @@ const (
 )
 
 type serverConfig struct {
-	HttpPort int    `json:"http_port"`
-	TcpPort  int    `json:"tcp_port"`
-	Db       string `json:"db"`
-	Authkey  string `json:"authkey"`
+	HttpPort int         `json:"http_port"`
+	TcpPort  int         `json:"tcp_port"`
+	Db       string      `json:"db"`
+	Authkey  string      `json:"authkey"`
+	Tracks   trackConfig `json:"tracks"`
+	Tcp      tcpConfig   `json:"tcp"`
+	Tiles    tileConfig  `json:"tiles"`
+}
+
+// redacted returns config with authkeys blanked, for logging
+func (self serverConfig) redacted() serverConfig {
+	if "" != self.Authkey {
+		self.Authkey = "REDACTED"
+	}
+	if "" != self.Tcp.OperatorKey {
+		self.Tcp.OperatorKey = "REDACTED"
+	}
+	return self
+}
+
+// tcpConfig overrides tcp server authentication and network settings when set
+type tcpConfig struct {
+	Host            string   `json:"host,omitempty"`
+	AllowedCidrs    []string `json:"allowed_cidrs,omitempty"`
+	TlsCert         string   `json:"tls_cert,omitempty"`
+	TlsKey          string   `json:"tls_key,omitempty"`
+	TlsClientCa     string   `json:"tls_client_ca,omitempty"`
+	OperatorKey     string   `json:"operator_authkey,omitempty"`
+	AuthMaxAttempts *int     `json:"auth_max_attempts,omitempty"`
+	AuthLockout     *int     `json:"auth_lockout_seconds,omitempty"`
+}
+
+// apply sets gospatial tcp settings from config
+func (self tcpConfig) apply() {
+	if "" != self.OperatorKey {
+		gospatial.OperatorKey = self.OperatorKey
+	}
+	if nil != self.AuthMaxAttempts {
+		gospatial.TCP_AUTH_MAX_ATTEMPTS = *self.AuthMaxAttempts
+	}
+	if nil != self.AuthLockout {
+		gospatial.TCP_AUTH_LOCKOUT = time.Duration(*self.AuthLockout) * time.Second
+	}
+}
+
+// server returns tcp server listening on host and port
+func (self tcpConfig) server(port int) gospatial.TcpServer {
+	server := gospatial.TcpServer{Host: self.Host, Port: fmt.Sprintf("%v", port)}
+	if "" == server.Host {
+		server.Host = gospatial.TCP_DEFAULT_CONN_HOST
+	}
+	networks, err := gospatial.ParseCIDRs(self.AllowedCidrs)
+	if err != nil {
+		panic(err)
+	}
+	server.AllowedNetworks = networks
+	if "" != self.TlsCert {
+		server.TLSConfig, err = gospatial.NewTcpTLSConfig(self.TlsCert, self.TlsKey, self.TlsClientCa)
+		if err != nil {
+			panic(err)
+		}
+	}
+	return server
+}
+
+// trackConfig overrides position report ingestion settings when set
+type trackConfig struct {
+	RetentionDays *int   `json:"retention_days,omitempty"`
+	MaxVertices   *int   `json:"max_vertices,omitempty"`
+	OutOfOrder    string `json:"out_of_order,omitempty"`
+}
+
+// apply sets gospatial track settings from config
+func (self trackConfig) apply() {
+	if nil != self.RetentionDays {
+		gospatial.TRACK_RETENTION_DAYS = *self.RetentionDays
+	}
+	if nil != self.MaxVertices {
+		gospatial.TRACK_MAX_VERTICES = *self.MaxVertices
+	}
+	switch self.OutOfOrder {
+	case "":
+	case gospatial.TRACK_OUT_OF_ORDER_INSERT, gospatial.TRACK_OUT_OF_ORDER_DROP:
+		gospatial.TRACK_OUT_OF_ORDER = self.OutOfOrder
+	default:
+		panic(fmt.Errorf("unsupported tracks out_of_order: %v", self.OutOfOrder))
+	}
+}
+
+// tileConfig overrides tileset hosting and tile proxy settings when set
+type tileConfig struct {
+	Directory      string `json:"directory,omitempty"`
+	MaxUploadSize  *int64 `json:"max_upload_size,omitempty"`
+	ProxyDirectory string `json:"proxy_directory,omitempty"`
+	ProxyCacheSize *int64 `json:"proxy_cache_size,omitempty"`
+	ProxyTtl       *int   `json:"proxy_ttl_seconds,omitempty"`
+}
+
+// apply sets gospatial tileset and tile proxy settings from config
+func (self tileConfig) apply() {
+	if "" != self.Directory {
+		gospatial.TILESET_DIRECTORY = self.Directory
+	}
+	if nil != self.MaxUploadSize {
+		gospatial.TILESET_MAX_SIZE = *self.MaxUploadSize
+	}
+	if "" != self.ProxyDirectory {
+		gospatial.TILE_PROXY_DIRECTORY = self.ProxyDirectory
+	}
+	if nil != self.ProxyCacheSize {
+		gospatial.TILE_PROXY_CACHE_SIZE = *self.ProxyCacheSize
+	}
+	if nil != self.ProxyTtl {
+		gospatial.TILE_PROXY_TTL = time.Duration(*self.ProxyTtl) * time.Second
+	}
+	gospatial.TileProxy = gospatial.NewTileProxyCache(gospatial.TILE_PROXY_DIRECTORY, gospatial.TILE_PROXY_CACHE_SIZE)
 }
 
 var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
@@ -56,6 +170,7 @@ func init() {
 	flag.StringVar(&configFile, "c", DEFAULT_CONFIG_FILE, "server config file")
 	flag.IntVar(&port, "p", DEFAULT_HTTP_PORT, "http server port")
 	flag.IntVar(&tcp_port, "tcp_port", DEFAULT_TCP_PORT, "tcp server port")
+	flag.StringVar(&tcp_host, "tcp_host", "", "tcp server host")
 	flag.StringVar(&database, "db", db, "app database")
 	flag.StringVar(&gospatial.SuperuserKey, "s", "su", "superuser key")
 	flag.BoolVar(&versionReport, "V", false, "App Version")
@@ -80,6 +195,7 @@ func init() {
 		configuration.HttpPort = port
 		configuration.TcpPort = tcp_port
 		configuration.Db = database
+		configuration.Tcp.Host = tcp_host
 
 		// superuser key
 		if "su" == gospatial.SuperuserKey {
@@ -121,10 +237,18 @@ func init() {
 			configuration.TcpPort = tcp_port
 		}
 
+		if "" != tcp_host {
+			configuration.Tcp.Host = tcp_host
+		}
+
 		//configuration.Db = strings.Replace(database, ".db", "", -1) //database
 		//gospatial.ServerLogger.Info(strings.Replace(database, ".db", "", -1))
 	}
 
+	// settings from config file or commandline args
+	configuration.Tracks.apply()
+	configuration.Tcp.apply()
+	configuration.Tiles.apply()
 }
 
 func main() {
@@ -161,7 +285,7 @@ func main() {
 			gospatial.DB.WriteLock = true
 			now := time.Now()
 			for {
-				if 0 == len(gospatial.Hub.Sockets) && 0 == gospatial.ActiveTcpClients {
+				if 0 == gospatial.Hub.Count() && 0 == atomic.LoadInt64(&gospatial.ActiveTcpClients) {
 					gospatial.ServerLogger.Info("Shutting down...")
 					os.Exit(0)
 				}
@@ -192,11 +316,15 @@ func main() {
 		panic(err)
 	}
 
-	gospatial.ServerLogger.Info(configuration)
+	// deliver webhooks for database changes
+	gospatial.StartWebhooks(&gospatial.DB)
+	// evaluate tracked points against geofences
+	gospatial.StartGeofences(&gospatial.DB)
+
+	gospatial.ServerLogger.Info(configuration.redacted())
 
 	// start tcp server
-	//tcpServer := gospatial.TcpServer{Host: "localhost", Port: "3333"}
-	tcpServer := gospatial.TcpServer{Host: "localhost", Port: fmt.Sprintf("%v", configuration.TcpPort)}
+	tcpServer := configuration.Tcp.server(configuration.TcpPort)
 	tcpServer.Start()
 
 	// start http server
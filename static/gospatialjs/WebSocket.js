@@ -4,12 +4,12 @@
 		var self = this;
 		console.log("Opening websocket");
 		try { 
-			var url = "ws://" + window.location.host + "/ws/" + self.datasources[0];
+			var url = "ws://" + window.location.host + "/ws/" + self.datasources[0] + "?apikey=" + self.api.apikey;
 			ws = new WebSocket(url);
 		}
 		catch(err) {
 			console.log(err);
-			var url = "wss://" + window.location.host + "/ws/" + self.datasources[0];
+			var url = "wss://" + window.location.host + "/ws/" + self.datasources[0] + "?apikey=" + self.api.apikey;
 			ws = new WebSocket(url);
 		}
 		ws.onopen = function(e) { 
@@ -19,17 +19,24 @@
 			console.log(e.data);
 			var data = JSON.parse(e.data);
 			console.log(data);
-			if (data.update) {
-				self.apiClient.getLayer($('#layers').val(), function(error, result){
-					if (error) {
-						throw error;
-						self.errorMessage(error);
-					} else {apiClient
-						self.updateFeatureLayers(result);
-					}
-				});
+			switch (data.type) {
+				case "feature_added":
+				case "feature_updated":
+				case "feature_deleted":
+				case "layer_replaced":
+					self.apiClient.getLayer($('#layers').val(), function(error, result){
+						if (error) {
+							self.errorMessage(error);
+						} else {
+							self.updateFeatureLayers(result);
+						}
+					});
+					break;
+			}
+			// viewer count messages, presence messages list the viewers instead
+			if ("number" == typeof(data.viewers)) {
+				$("#viewers").text(data.viewers);
 			}
-			$("#viewers").text(data.viewers);
 			if (data.key) {
 				if (!self._editFeatures.hasOwnProperty(data.client)) {
 					self._editFeatures[data.client] = {
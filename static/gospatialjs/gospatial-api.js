@@ -58,6 +58,11 @@ var API = new GoSpatialApiHandler({server:"test",apikey:"1234", id:"1"});
 		this.editFeature = function(datasource, feature, callback) {
 			var self = this;
 			var geo_id = ""+feature.properties.geo_id;
+			// send feature version so concurrent edits are rejected
+			var headers = {};
+			if (typeof feature.properties.version != "undefined") {
+				headers["If-Match"] = '"' + geo_id + '-' + feature.properties.version + '"';
+			}
 			if ("object" == typeof(feature)) {
 				feature = JSON.stringify(feature);
 			}
@@ -66,7 +71,8 @@ var API = new GoSpatialApiHandler({server:"test",apikey:"1234", id:"1"});
 				feature,
 				function(error, result) {
 					callback(error, result);
-				}
+				},
+				headers
 			)
 		}
 
@@ -142,8 +148,8 @@ var API = new GoSpatialApiHandler({server:"test",apikey:"1234", id:"1"});
 			$.ajax(ajaxObj);
 		}
 
-		this.PUT = function(route, data, callback) {
-			var ajaxObj = this._getAjaxObject(route, "PUT", data, {}, callback);
+		this.PUT = function(route, data, callback, headers) {
+			var ajaxObj = this._getAjaxObject(route, "PUT", data, {headers: headers}, callback);
 			console.log(ajaxObj.data);
 			$.ajax(ajaxObj);
 		}